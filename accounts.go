@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// The default account of a Matrix user has an empty name in the database.
+// It can be selected explicitly with this name in commands and the provisioning API.
+const defaultAccountName = "default"
+
+const accountSelectorPrefix = "--account="
+
+var accountNameRegex = regexp.MustCompile("^[a-z0-9_-]{1,32}$")
+
+var (
+	errInvalidAccountName = errors.New("account names may only contain lowercase letters, numbers, hyphens and underscores")
+	errUnknownAccount     = errors.New("unknown account")
+)
+
+// normalizeAccountName converts a user-provided account name into the value stored in the database.
+func normalizeAccountName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == defaultAccountName {
+		return "", nil
+	} else if !accountNameRegex.MatchString(name) {
+		return "", errInvalidAccountName
+	}
+	return name, nil
+}
+
+func (user *User) AccountName() string {
+	if user.Account == "" {
+		return defaultAccountName
+	}
+	return user.Account
+}
+
+// GetUserAccount returns the Discord account with the given name for a Matrix user.
+// The empty name refers to the default account, which is the same as GetUserByMXID.
+func (br *DiscordBridge) GetUserAccount(userID id.UserID, account string, create bool) *User {
+	if account == "" {
+		return br.GetUserByMXID(userID)
+	} else if userID == br.Bot.UserID || br.IsGhost(userID) {
+		return nil
+	}
+	br.usersLock.Lock()
+	defer br.usersLock.Unlock()
+	if user := br.getLoadedUserAccount(userID, account); user != nil {
+		return user
+	}
+	dbUser := br.DB.User.GetByAccount(userID, account)
+	if dbUser == nil {
+		if !create {
+			return nil
+		}
+		dbUser = br.DB.User.New()
+		dbUser.MXID = userID
+		dbUser.Account = account
+		dbUser.Insert()
+	}
+	return br.loadUser(dbUser, nil)
+}
+
+// getLoadedUserAccount must be called with usersLock held.
+func (br *DiscordBridge) getLoadedUserAccount(userID id.UserID, account string) *User {
+	if account == "" {
+		return br.usersByMXID[userID]
+	}
+	return br.extraAccountsByMXID[userID][account]
+}
+
+// GetCachedUserAccounts returns all loaded accounts of a Matrix user, starting with the default account.
+func (br *DiscordBridge) GetCachedUserAccounts(userID id.UserID) []*User {
+	br.usersLock.Lock()
+	defer br.usersLock.Unlock()
+	var users []*User
+	if user, ok := br.usersByMXID[userID]; ok {
+		users = append(users, user)
+	}
+	extraAccounts := br.extraAccountsByMXID[userID]
+	names := make([]string, 0, len(extraAccounts))
+	for name := range extraAccounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		users = append(users, extraAccounts[name])
+	}
+	return users
+}
+
+// getCachedAccountsOf returns the loaded accounts of all the given Matrix users.
+func (br *DiscordBridge) getCachedAccountsOf(userIDs []id.UserID) []*User {
+	var users []*User
+	for _, userID := range userIDs {
+		users = append(users, br.GetCachedUserAccounts(userID)...)
+	}
+	return users
+}
+
+// getAllLoadedUsers returns every loaded account of every user.
+func (br *DiscordBridge) getAllLoadedUsers() []*User {
+	br.usersLock.Lock()
+	defer br.usersLock.Unlock()
+	users := make([]*User, 0, len(br.usersByMXID))
+	for _, user := range br.usersByMXID {
+		users = append(users, user)
+	}
+	for _, accounts := range br.extraAccountsByMXID {
+		for _, user := range accounts {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// GetAccounts returns all Discord accounts of the Matrix user, including ones that aren't logged in.
+func (user *User) GetAccounts() []*User {
+	user.bridge.usersLock.Lock()
+	defer user.bridge.usersLock.Unlock()
+	dbUsers := user.bridge.DB.User.GetAllAccounts(user.MXID)
+	users := make([]*User, 0, len(dbUsers))
+	for _, dbUser := range dbUsers {
+		account := user.bridge.getLoadedUserAccount(dbUser.MXID, dbUser.Account)
+		if account == nil {
+			account = user.bridge.loadUser(dbUser, nil)
+		}
+		users = append(users, account)
+	}
+	return users
+}
+
+// accountForPortal finds the account of the Matrix user that should be used for Matrix events in the given portal.
+// DM portals belong to the account that received them, while guild channels and group DMs use the first
+// connected account that is a member of the guild or group, preferring the default account.
+func (user *User) accountForPortal(portal *Portal) *User {
+	accounts := user.bridge.GetCachedUserAccounts(user.MXID)
+	if len(accounts) <= 1 {
+		return user
+	}
+	if portal.Key.Receiver != "" {
+		for _, account := range accounts {
+			if account.DiscordID == portal.Key.Receiver {
+				return account
+			}
+		}
+		return user
+	}
+	discordID := portal.GuildID
+	if discordID == "" {
+		discordID = portal.Key.ChannelID
+	}
+	for _, account := range accounts {
+		if account.Session != nil && account.IsInPortal(discordID) {
+			return account
+		}
+	}
+	return user
+}
+
+// accountForDiscordUser finds the account of the Matrix user that has a relationship with the given Discord user,
+// falling back to the user itself if none of the accounts know them.
+func (user *User) accountForDiscordUser(discordUserID string) *User {
+	for _, account := range user.bridge.GetCachedUserAccounts(user.MXID) {
+		if account.Session != nil && account.getRelationship(discordUserID) != nil {
+			return account
+		}
+	}
+	return user
+}
+
+// deleteAccount removes an extra account along with its spaces and portal membership data.
+func (user *User) deleteAccount() error {
+	if user.Account == "" {
+		return errors.New("the default account can't be removed")
+	}
+	if user.IsLoggedIn() {
+		user.Logout(false)
+	}
+	for _, spaceID := range []id.RoomID{user.DMSpaceRoom, user.SpaceRoom} {
+		if spaceID != "" {
+			_, err := user.bridge.Bot.LeaveRoom(spaceID)
+			if err != nil {
+				user.log.Warn().Err(err).Str("space_id", spaceID.String()).Msg("Failed to leave space of removed account")
+			}
+		}
+	}
+	user.bridge.usersLock.Lock()
+	delete(user.bridge.extraAccountsByMXID[user.MXID], user.Account)
+	user.bridge.usersLock.Unlock()
+	if user.ManagementRoom != "" {
+		user.bridge.managementRoomsLock.Lock()
+		if user.bridge.managementRooms[user.ManagementRoom] == user {
+			delete(user.bridge.managementRooms, user.ManagementRoom)
+		}
+		user.bridge.managementRoomsLock.Unlock()
+	}
+	user.Delete()
+	return nil
+}
+
+// accountCommandProcessor selects the Discord account that commands apply to before passing them to the
+// actual command processor. The account can be chosen explicitly with --account=<name> anywhere in the
+// command, otherwise it's inferred from the room the command was sent in.
+type accountCommandProcessor struct {
+	*commands.Processor
+	bridge *DiscordBridge
+}
+
+var _ bridge.CommandProcessor = (*accountCommandProcessor)(nil)
+
+var loginCommands = map[string]struct{}{
+	"login-token": {},
+	"login-qr":    {},
+	"login":       {},
+}
+
+func (proc *accountCommandProcessor) Handle(roomID id.RoomID, eventID id.EventID, brUser bridge.User, message string, replyTo id.EventID) {
+	user := brUser.(*User)
+	account, message, err := proc.bridge.resolveCommandAccount(roomID, user, message)
+	if err != nil {
+		content := event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("Failed to select account: %v", err),
+		}
+		content.SetReply(&event.Event{ID: eventID, RoomID: roomID, Sender: user.MXID})
+		_, err = proc.bridge.Bot.SendMessageEvent(roomID, event.EventMessage, &content)
+		if err != nil {
+			user.log.Warn().Err(err).Msg("Failed to send account selection error")
+		}
+		return
+	}
+	proc.Processor.Handle(roomID, eventID, account, message, replyTo)
+}
+
+// extractAccountSelector removes the --account=<name> flag from a command and returns the selected name.
+func extractAccountSelector(message string) (string, string, bool) {
+	for _, field := range strings.Fields(message) {
+		if strings.HasPrefix(field, accountSelectorPrefix) {
+			idx := strings.Index(message, field)
+			message = strings.TrimSpace(message[:idx] + strings.TrimLeft(message[idx+len(field):], " "))
+			return strings.TrimPrefix(field, accountSelectorPrefix), message, true
+		}
+	}
+	return "", message, false
+}
+
+func (br *DiscordBridge) resolveCommandAccount(roomID id.RoomID, user *User, message string) (*User, string, error) {
+	name, message, hasSelector := extractAccountSelector(message)
+	if !hasSelector {
+		br.managementRoomsLock.Lock()
+		owner, isManagementRoom := br.managementRooms[roomID]
+		br.managementRoomsLock.Unlock()
+		if isManagementRoom && owner.MXID == user.MXID {
+			return owner, message, nil
+		} else if portal := br.GetPortalByMXID(roomID); portal != nil {
+			return user.accountForPortal(portal), message, nil
+		}
+		return user, message, nil
+	}
+	account, err := normalizeAccountName(name)
+	if err != nil {
+		return nil, message, err
+	}
+	command, _, _ := strings.Cut(strings.ToLower(message), " ")
+	_, isLogin := loginCommands[command]
+	isNew := account != "" && isLogin && br.GetUserAccount(user.MXID, account, false) == nil
+	selected := br.GetUserAccount(user.MXID, account, isLogin)
+	if selected == nil {
+		return nil, message, fmt.Errorf("%w %s, log in with `login-qr %s%s` to add it", errUnknownAccount, name, accountSelectorPrefix, name)
+	}
+	if isNew && br.GetPortalByMXID(roomID) == nil {
+		br.managementRoomsLock.Lock()
+		_, isManagementRoom := br.managementRooms[roomID]
+		br.managementRoomsLock.Unlock()
+		if !isManagementRoom {
+			selected.SetManagementRoom(roomID)
+		}
+	}
+	return selected, message, nil
+}
@@ -0,0 +1,52 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractAccountSelector(t *testing.T) {
+	name, message, ok := extractAccountSelector("login-qr --account=work")
+	assert.True(t, ok)
+	assert.Equal(t, "work", name)
+	assert.Equal(t, "login-qr", message)
+
+	name, message, ok = extractAccountSelector("guilds --account=work bridge 123")
+	assert.True(t, ok)
+	assert.Equal(t, "work", name)
+	assert.Equal(t, "guilds bridge 123", message)
+
+	_, message, ok = extractAccountSelector("guilds status")
+	assert.False(t, ok)
+	assert.Equal(t, "guilds status", message)
+}
+
+func TestNormalizeAccountName(t *testing.T) {
+	name, err := normalizeAccountName("Work")
+	assert.NoError(t, err)
+	assert.Equal(t, "work", name)
+
+	name, err = normalizeAccountName("default")
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+
+	_, err = normalizeAccountName("not valid!")
+	assert.ErrorIs(t, err, errInvalidAccountName)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// Interaction tokens can be used for follow-up messages for 15 minutes after the interaction.
+const interactionTokenLifetime = 15 * time.Minute
+
+// interactionTimeoutMargin is how long before the token expires unanswered interactions are timed out,
+// so that the deferred response can still be replaced with a timeout message.
+const interactionTimeoutMargin = 30 * time.Second
+
+const interactionTimeoutMessage = "Didn't get a response from Matrix in time"
+
+type applicationCommandsFile struct {
+	Global []*discordgo.ApplicationCommand            `json:"global"`
+	Guilds map[string][]*discordgo.ApplicationCommand `json:"guilds"`
+}
+
+func loadApplicationCommands(path string) (*applicationCommandsFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var commands applicationCommandsFile
+	err = json.Unmarshal(data, &commands)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse commands: %w", err)
+	}
+	return &commands, nil
+}
+
+// registerApplicationCommands overwrites the global and guild commands of the bot with the ones in the
+// configured file. Only bots logged in by bridge admins are allowed to register commands.
+func (user *User) registerApplicationCommands(appID string) {
+	path := user.bridge.Config.Bridge.ApplicationCommands.File
+	session := user.Session
+	if path == "" || session == nil || session.IsUser || user.PermissionLevel < bridgeconfig.PermissionLevelAdmin {
+		return
+	}
+	log := user.log.With().Str("action", "register application commands").Str("application_id", appID).Logger()
+	commands, err := loadApplicationCommands(path)
+	if err != nil {
+		log.Err(err).Str("path", path).Msg("Failed to load application commands")
+		return
+	}
+	created, err := session.ApplicationCommandBulkOverwrite(appID, "", commands.Global)
+	if err != nil {
+		log.Err(err).Msg("Failed to register global application commands")
+	} else {
+		log.Info().Int("command_count", len(created)).Msg("Registered global application commands")
+	}
+	for guildID, guildCommands := range commands.Guilds {
+		created, err = session.ApplicationCommandBulkOverwrite(appID, guildID, guildCommands)
+		if err != nil {
+			log.Err(err).Str("guild_id", guildID).Msg("Failed to register guild application commands")
+		} else {
+			log.Info().Str("guild_id", guildID).Int("command_count", len(created)).Msg("Registered guild application commands")
+		}
+	}
+}
+
+// botInteraction is a command interaction that was bridged to Matrix and can still be responded to.
+type botInteraction struct {
+	*discordgo.Interaction
+	bot      *User
+	threadID string
+	expires  time.Time
+
+	lock sync.Mutex
+	// responded is set after the deferred response is replaced, later responses are sent as follow-ups.
+	responded bool
+}
+
+func (user *User) interactionCreateHandler(i *discordgo.InteractionCreate) {
+	if user.Session.IsUser || i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+	log := user.log.With().
+		Str("action", "handle interaction").
+		Str("interaction_id", i.ID).
+		Str("guild_id", i.GuildID).
+		Str("channel_id", i.ChannelID).
+		Logger()
+	if !user.bridge.Config.Bridge.ApplicationCommands.BridgeInteractions {
+		log.Debug().Msg("Ignoring interaction as bridging interactions is disabled")
+		return
+	}
+	portal, thread := user.findPortal(i.ChannelID)
+	if portal == nil || portal.MXID == "" {
+		log.Debug().Msg("Got interaction in unbridged channel")
+		err := user.Session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "This channel isn't bridged to Matrix",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to respond to interaction in unbridged channel")
+		}
+		return
+	}
+	// Interactions must be acknowledged within 3 seconds, the actual response comes from Matrix later
+	err := user.Session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to acknowledge interaction")
+		return
+	}
+	portal.queueDiscordMessage(portalDiscordMessage{msg: i, user: user, thread: thread}, "interaction create")
+}
+
+func (portal *Portal) handleDiscordInteraction(bot *User, i *discordgo.Interaction, thread *Thread) {
+	invoker := i.User
+	if i.Member != nil {
+		invoker = i.Member.User
+	}
+	if invoker == nil {
+		portal.log.Warn().Str("interaction_id", i.ID).Msg("Got interaction without user")
+		return
+	}
+	puppet := portal.bridge.GetPuppetByID(invoker.ID)
+	puppet.UpdateInfo(bot, invoker, nil)
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    formatInteractionCommand(i.ApplicationCommandData()),
+	}
+	var threadID string
+	if thread != nil {
+		threadID = thread.ID
+		content.RelatesTo = (&event.RelatesTo{}).SetThread(thread.RootMXID, thread.RootMXID)
+	}
+	resp, err := portal.sendMatrixMessage(puppet.IntentFor(portal), event.EventMessage, content, nil, 0)
+	if err != nil {
+		portal.log.Err(err).Str("interaction_id", i.ID).Msg("Failed to send interaction notice")
+		return
+	}
+	portal.log.Debug().
+		Str("interaction_id", i.ID).
+		Str("event_id", resp.EventID.String()).
+		Msg("Bridged interaction to Matrix")
+	portal.pruneBotInteractions()
+	lifetime := interactionTokenLifetime - interactionTimeoutMargin
+	interaction := &botInteraction{
+		Interaction: i,
+		bot:         bot,
+		threadID:    threadID,
+		expires:     time.Now().Add(lifetime),
+	}
+	portal.botInteractions.Set(resp.EventID, interaction)
+	time.AfterFunc(lifetime, func() {
+		portal.expireBotInteraction(resp.EventID, interaction)
+	})
+}
+
+func formatInteractionCommand(data discordgo.ApplicationCommandInteractionData) string {
+	parts := []string{"/" + data.Name}
+	parts = append(parts, formatInteractionOptions(data.Options)...)
+	return strings.Join(parts, " ")
+}
+
+func formatInteractionOptions(opts []*discordgo.ApplicationCommandInteractionDataOption) []string {
+	var parts []string
+	for _, opt := range opts {
+		switch opt.Type {
+		case discordgo.ApplicationCommandOptionSubCommand, discordgo.ApplicationCommandOptionSubCommandGroup:
+			parts = append(parts, opt.Name)
+			parts = append(parts, formatInteractionOptions(opt.Options)...)
+		default:
+			parts = append(parts, fmt.Sprintf("%s:%v", opt.Name, opt.Value))
+		}
+	}
+	return parts
+}
+
+// isBridgedInteractionResponse checks if the message is a response to an interaction that was bridged to Matrix,
+// i.e. it was sent by a bot logged into the bridge. Such responses are always sent from Matrix.
+func (portal *Portal) isBridgedInteractionResponse(msg *discordgo.Message) bool {
+	if msg.Interaction == nil || msg.Author == nil || !portal.bridge.Config.Bridge.ApplicationCommands.BridgeInteractions {
+		return false
+	}
+	bot := portal.bridge.GetCachedUserByID(msg.Author.ID)
+	return bot != nil && bot.Session != nil && !bot.Session.IsUser
+}
+
+// isBridgedInteractionPlaceholder checks if the message is the "thinking" placeholder of an interaction
+// that was deferred by interactionCreateHandler. The interaction itself is bridged as a notice instead,
+// and the placeholder is replaced with the first response from Matrix.
+func (portal *Portal) isBridgedInteractionPlaceholder(msg *discordgo.Message) bool {
+	return msg.Flags&discordgo.MessageFlagsLoading != 0 && portal.isBridgedInteractionResponse(msg)
+}
+
+// getBotInteraction returns the interaction that was bridged as the given Matrix event, if it can still be responded to.
+func (portal *Portal) getBotInteraction(eventID id.EventID) *botInteraction {
+	if eventID == "" {
+		return nil
+	}
+	interaction, ok := portal.botInteractions.Get(eventID)
+	if !ok {
+		return nil
+	} else if time.Now().After(interaction.expires) {
+		go portal.expireBotInteraction(eventID, interaction)
+		return nil
+	}
+	return interaction
+}
+
+func (portal *Portal) pruneBotInteractions() {
+	now := time.Now()
+	for eventID, interaction := range portal.botInteractions.CopyData() {
+		if now.After(interaction.expires) {
+			go portal.expireBotInteraction(eventID, interaction)
+		}
+	}
+}
+
+// expireBotInteraction forgets the given interaction and replaces the deferred response with a timeout message
+// if nothing was sent from Matrix, so that the bot doesn't appear to be thinking forever on Discord.
+func (portal *Portal) expireBotInteraction(eventID id.EventID, interaction *botInteraction) {
+	portal.botInteractions.Delete(eventID)
+	interaction.lock.Lock()
+	defer interaction.lock.Unlock()
+	if interaction.responded {
+		return
+	}
+	// Even if the edit fails, there's no point in trying again
+	interaction.responded = true
+	session := interaction.bot.Session
+	if session == nil {
+		return
+	}
+	content := interactionTimeoutMessage
+	_, err := session.InteractionResponseEdit(interaction.Interaction, &discordgo.WebhookEdit{Content: &content})
+	if err != nil {
+		portal.log.Warn().Err(err).
+			Str("interaction_id", interaction.ID).
+			Msg("Failed to replace expired interaction response with timeout message")
+	}
+}
+
+// handleMatrixInteractionResponse sends a Matrix reply to a bridged interaction as the bot's response to it.
+func (portal *Portal) handleMatrixInteractionResponse(sender *User, evt *event.Event, content *event.MessageEventContent, interaction *botInteraction) {
+	switch content.MsgType {
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+	default:
+		go portal.sendMessageMetrics(evt, errInteractionResponseNotText, "Ignoring")
+		return
+	}
+	session := interaction.bot.Session
+	if session == nil {
+		go portal.sendMessageMetrics(evt, ErrNotConnected, "Error sending")
+		return
+	}
+	discordContent, allowedMentions := portal.parseMatrixHTML(content, parseAllowedLinkPreviews(evt.Content.Raw))
+	if content.MsgType == event.MsgEmote && discordContent != "" {
+		discordContent = fmt.Sprintf("_%s_", discordContent)
+	}
+	interaction.lock.Lock()
+	defer interaction.lock.Unlock()
+	var msg *discordgo.Message
+	var err error
+	if !interaction.responded {
+		msg, err = session.InteractionResponseEdit(interaction.Interaction, &discordgo.WebhookEdit{
+			Content:         &discordContent,
+			AllowedMentions: allowedMentions,
+		})
+	} else {
+		msg, err = session.FollowupMessageCreate(interaction.Interaction, true, &discordgo.WebhookParams{
+			Content:         discordContent,
+			AllowedMentions: allowedMentions,
+		})
+	}
+	go portal.sendMessageMetrics(evt, err, "Error sending")
+	if msg != nil {
+		interaction.responded = true
+		ts, _ := discordgo.SnowflakeTimestamp(msg.ID)
+		// The placeholder message wasn't bridged, so the response is stored as the Matrix reply
+		portal.markMessageHandled(msg.ID, interaction.bot.DiscordID, ts, msg.EditedTimestamp, interaction.threadID, sender.MXID, []database.MessagePart{{MXID: evt.ID}})
+	}
+}
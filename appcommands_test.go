@@ -0,0 +1,70 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"go.mau.fi/util/exsync"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestFormatInteractionCommand(t *testing.T) {
+	assert.Equal(t, "/ping", formatInteractionCommand(discordgo.ApplicationCommandInteractionData{Name: "ping"}))
+	assert.Equal(t, "/deploy app production version:1.2 dry_run:true", formatInteractionCommand(discordgo.ApplicationCommandInteractionData{
+		Name: "deploy",
+		Options: []*discordgo.ApplicationCommandInteractionDataOption{{
+			Name: "app",
+			Type: discordgo.ApplicationCommandOptionSubCommandGroup,
+			Options: []*discordgo.ApplicationCommandInteractionDataOption{{
+				Name: "production",
+				Type: discordgo.ApplicationCommandOptionSubCommand,
+				Options: []*discordgo.ApplicationCommandInteractionDataOption{
+					{Name: "version", Type: discordgo.ApplicationCommandOptionString, Value: "1.2"},
+					{Name: "dry_run", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+				},
+			}},
+		}},
+	}))
+}
+
+func TestExpireBotInteraction(t *testing.T) {
+	portal := &Portal{botInteractions: exsync.NewMap[id.EventID, *botInteraction]()}
+	active := &botInteraction{Interaction: &discordgo.Interaction{ID: "1"}, bot: &User{}, expires: time.Now().Add(time.Minute)}
+	expired := &botInteraction{Interaction: &discordgo.Interaction{ID: "2"}, bot: &User{}, expires: time.Now().Add(-time.Minute)}
+	portal.botInteractions.Set("$active", active)
+	portal.botInteractions.Set("$expired", expired)
+
+	assert.Same(t, active, portal.getBotInteraction("$active"))
+	assert.Nil(t, portal.getBotInteraction("$expired"))
+	assert.Eventually(t, func() bool {
+		expired.lock.Lock()
+		defer expired.lock.Unlock()
+		return expired.responded
+	}, time.Second, 10*time.Millisecond, "expired interaction should be marked as responded")
+	_, ok := portal.botInteractions.Get("$expired")
+	assert.False(t, ok)
+
+	// Interactions that were already responded to aren't edited again
+	active.responded = true
+	portal.expireBotInteraction("$active", active)
+	_, ok = portal.botInteractions.Get("$active")
+	assert.False(t, ok)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"hash"
 	"image"
 	"io"
 	"net/http"
@@ -27,12 +31,15 @@ import (
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-discord/database"
+	"go.mau.fi/mautrix-discord/lottie"
 )
 
-func downloadDiscordAttachment(cli *http.Client, url string, maxSize int64) ([]byte, error) {
+// openDiscordAttachment starts downloading the given Discord CDN URL and returns the response body.
+// The returned size is -1 if the server didn't send a content length.
+func openDiscordAttachment(cli *http.Client, url string, maxSize int64) (io.ReadCloser, int64, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	for key, value := range discordgo.DroidDownloadHeaders {
 		req.Header.Set(key, value)
@@ -40,36 +47,40 @@ func downloadDiscordAttachment(cli *http.Client, url string, maxSize int64) ([]b
 
 	resp, err := cli.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode > 300 {
-		data, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status %d downloading %s: %s", resp.StatusCode, url, data)
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, 0, fmt.Errorf("unexpected status %d downloading %s: %s", resp.StatusCode, url, data)
 	}
-	if resp.Header.Get("Content-Length") != "" {
-		length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse content length: %w", err)
-		} else if length > maxSize {
-			return nil, fmt.Errorf("attachment too large (%d > %d)", length, maxSize)
-		}
-		return io.ReadAll(resp.Body)
-	} else {
-		var mbe *http.MaxBytesError
-		data, err := io.ReadAll(http.MaxBytesReader(nil, resp.Body, maxSize))
-		if err != nil && errors.As(err, &mbe) {
-			return nil, fmt.Errorf("attachment too large (over %d)", maxSize)
-		}
-		return data, err
+	if resp.ContentLength > maxSize {
+		_ = resp.Body.Close()
+		return nil, 0, fmt.Errorf("attachment too large (%d > %d)", resp.ContentLength, maxSize)
+	}
+	return http.MaxBytesReader(nil, resp.Body, maxSize), resp.ContentLength, nil
+}
+
+func downloadDiscordAttachment(cli *http.Client, url string, maxSize int64) ([]byte, error) {
+	body, _, err := openDiscordAttachment(cli, url, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var mbe *http.MaxBytesError
+	data, err := io.ReadAll(body)
+	if err != nil && errors.As(err, &mbe) {
+		return nil, fmt.Errorf("attachment too large (over %d)", maxSize)
 	}
+	return data, err
 }
 
-func uploadDiscordAttachment(cli *http.Client, url string, data []byte) error {
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+func uploadDiscordAttachment(cli *http.Client, url string, data io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, url, data)
 	if err != nil {
 		return err
 	}
+	req.ContentLength = size
 	for key, value := range discordgo.DroidBaseHeaders {
 		req.Header.Set(key, value)
 	}
@@ -91,7 +102,15 @@ func uploadDiscordAttachment(cli *http.Client, url string, data []byte) error {
 	return nil
 }
 
-func downloadMatrixAttachment(intent *appservice.IntentAPI, content *event.MessageEventContent) ([]byte, error) {
+var errDownloadTooLarge = errors.New("file is larger than the size limit")
+
+// downloadMatrixAttachment downloads and decrypts the file in the given content into a spooled file,
+// so that large files don't need to be held in memory. If the file is larger than maxSize bytes,
+// the download is stopped early and errDownloadTooLarge is returned. The size in the event content
+// isn't trusted, as the sender can set it to anything.
+//
+// The caller must close the returned file.
+func downloadMatrixAttachment(intent *appservice.IntentAPI, content *event.MessageEventContent, maxSize int64) (*spooledFile, error) {
 	var file *event.EncryptedFileInfo
 	rawMXC := content.URL
 
@@ -104,72 +123,167 @@ func downloadMatrixAttachment(intent *appservice.IntentAPI, content *event.Messa
 	if err != nil {
 		return nil, err
 	}
+	if file != nil {
+		if err = file.PrepareForDecryption(); err != nil {
+			return nil, err
+		}
+	}
 
-	data, err := intent.DownloadBytes(mxc)
+	body, err := intent.Download(mxc)
 	if err != nil {
 		return nil, err
 	}
+	defer body.Close()
 
+	spool := newSpooledFile(maxInMemoryMediaSize)
+	// Encryption doesn't change the size of the file, so the limit applies to the encrypted data too
+	var reader io.Reader = io.LimitReader(body, maxSize+1)
+	var hasher hash.Hash
 	if file != nil {
-		err = file.DecryptInPlace(data)
-		if err != nil {
-			return nil, err
+		hasher = sha256.New()
+		reader = io.TeeReader(reader, hasher)
+	}
+	n, err := io.Copy(spool, reader)
+	if err != nil {
+		_ = spool.Close()
+		return nil, err
+	} else if n > maxSize {
+		_ = spool.Close()
+		return nil, errDownloadTooLarge
+	}
+	if file != nil {
+		if base64.RawStdEncoding.EncodeToString(hasher.Sum(nil)) != strings.TrimRight(file.Hashes.SHA256, "=") {
+			_ = spool.Close()
+			return nil, attachment.HashMismatch
 		}
+		return decryptSpooledFile(spool, file)
 	}
+	return spool, nil
+}
 
-	return data, nil
+// decryptSpooledFile decrypts the given spooled file into a new one, closing the original.
+func decryptSpooledFile(encrypted *spooledFile, file *event.EncryptedFileInfo) (*spooledFile, error) {
+	defer encrypted.Close()
+	reader, err := encrypted.Reader()
+	if err != nil {
+		return nil, err
+	}
+	decrypted := newSpooledFile(maxInMemoryMediaSize)
+	// The hash was already verified, so the decrypting stream doesn't need to be closed.
+	_, err = io.Copy(decrypted, file.DecryptStream(reader))
+	if err != nil {
+		_ = decrypted.Close()
+		return nil, err
+	}
+	return decrypted, nil
 }
 
-func (br *DiscordBridge) uploadMatrixAttachment(intent *appservice.IntentAPI, data []byte, url string, encrypt bool, meta AttachmentMeta, semaWg *sync.WaitGroup) (*database.File, error) {
+// uploadMatrixAttachment uploads the given data to Matrix, encrypting it on the fly if necessary.
+// If size is negative (i.e. unknown), or if the data must be fully processed before the upload is started
+// (encrypted files with async uploads), the data is spooled into memory or a temp file first.
+func (br *DiscordBridge) uploadMatrixAttachment(intent *appservice.IntentAPI, data io.Reader, size int64, url string, encrypt bool, meta AttachmentMeta, semaWg *sync.WaitGroup) (*database.File, error) {
 	dbFile := br.DB.File.New()
 	dbFile.Timestamp = time.Now()
 	dbFile.URL = url
 	dbFile.ID = meta.AttachmentID
 	dbFile.EmojiName = meta.EmojiName
-	dbFile.Size = len(data)
-	dbFile.MimeType = mimetype.Detect(data).String()
+	dbFile.ChannelID = meta.ChannelID
+	dbFile.GuildID = meta.GuildID
+
+	bufReader := bufio.NewReaderSize(data, mediaSniffSize)
+	head, err := bufReader.Peek(mediaSniffSize)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+	dbFile.MimeType = mimetype.Detect(head).String()
 	if meta.MimeType == "" {
 		meta.MimeType = dbFile.MimeType
 	}
 	if strings.HasPrefix(meta.MimeType, "image/") {
-		cfg, _, _ := image.DecodeConfig(bytes.NewReader(data))
+		cfg, _, _ := image.DecodeConfig(bytes.NewReader(head))
 		dbFile.Width = cfg.Width
 		dbFile.Height = cfg.Height
 	}
 
+	var body io.Reader = bufReader
+	var encryptStream io.ReadCloser
 	uploadMime := meta.MimeType
 	if encrypt {
 		dbFile.Encrypted = true
 		dbFile.DecryptionInfo = attachment.NewEncryptedFile()
-		dbFile.DecryptionInfo.EncryptInPlace(data)
+		encryptStream = dbFile.DecryptionInfo.EncryptStream(body)
+		body = encryptStream
 		uploadMime = "application/octet-stream"
 	}
+	var spool *spooledFile
+	if size < 0 || (encrypt && br.Config.Homeserver.AsyncMedia) {
+		spool = newSpooledFile(maxInMemoryMediaSize)
+		if _, err = io.Copy(spool, body); err != nil {
+			_ = spool.Close()
+			return nil, err
+		}
+		size = spool.Size()
+		if body, err = spool.Reader(); err != nil {
+			_ = spool.Close()
+			return nil, err
+		}
+		if encryptStream != nil {
+			// Closing the stream fills the hash in the decryption info
+			_ = encryptStream.Close()
+			encryptStream = nil
+		}
+	}
+	dbFile.Size = int(size)
+
 	req := mautrix.ReqUploadMedia{
-		ContentBytes: data,
-		ContentType:  uploadMime,
+		Content:       body,
+		ContentLength: size,
+		ContentType:   uploadMime,
 	}
 	if br.Config.Homeserver.AsyncMedia {
 		resp, err := intent.CreateMXC()
 		if err != nil {
+			if spool != nil {
+				_ = spool.Close()
+			}
 			return nil, err
 		}
 		dbFile.MXC = resp.ContentURI
 		req.MXC = resp.ContentURI
 		req.UnstableUploadURL = resp.UnstableUploadURL
+		if spool == nil {
+			// The source stream can't outlive this function, so spool it before uploading in the background.
+			spool = newSpooledFile(maxInMemoryMediaSize)
+			if _, err = io.Copy(spool, body); err != nil {
+				_ = spool.Close()
+				return nil, err
+			}
+			if req.Content, err = spool.Reader(); err != nil {
+				_ = spool.Close()
+				return nil, err
+			}
+		}
 		semaWg.Add(1)
 		go func() {
 			defer semaWg.Done()
-			_, err = intent.UploadMedia(req)
+			defer spool.Close()
+			_, err := intent.UploadMedia(req)
 			if err != nil {
 				br.Log.Errorfln("Failed to upload %s: %v", req.MXC, err)
 				dbFile.Delete()
 			}
 		}()
 	} else {
+		if spool != nil {
+			defer spool.Close()
+		}
 		uploaded, err := intent.UploadMedia(req)
 		if err != nil {
 			return nil, err
 		}
+		if encryptStream != nil {
+			_ = encryptStream.Close()
+		}
 		dbFile.MXC = uploaded.ContentURI
 	}
 	return dbFile, nil
@@ -181,9 +295,19 @@ type AttachmentMeta struct {
 	EmojiName     string
 	CopyIfMissing bool
 	Converter     func([]byte) ([]byte, string, error)
+
+	// The channel and guild the file is being bridged in, which allows purging the media cache per portal.
+	ChannelID string
+	GuildID   string
 }
 
-var NoMeta = AttachmentMeta{}
+// attachmentMeta returns the base metadata for files bridged in this portal.
+func (portal *Portal) attachmentMeta() AttachmentMeta {
+	return AttachmentMeta{
+		ChannelID: portal.Key.ChannelID,
+		GuildID:   portal.GuildID,
+	}
+}
 
 type attachmentKey struct {
 	URL     string
@@ -215,6 +339,9 @@ func (br *DiscordBridge) convertLottie(data []byte) ([]byte, string, error) {
 	default:
 		return nil, "", fmt.Errorf("invalid animated sticker target %q in bridge config", br.Config.Bridge.AnimatedSticker.Target)
 	}
+	if !hasLottieConverter(lottieTarget == "pngs") {
+		return br.convertLottieNative(data, target, width, height, fps)
+	}
 
 	ctx := context.Background()
 	tempdir, err := os.MkdirTemp("", "mautrix_discord_lottie_")
@@ -268,10 +395,46 @@ func (br *DiscordBridge) convertLottie(data []byte) ([]byte, string, error) {
 	return data, outputMime, nil
 }
 
+// hasLottieConverter checks whether the external programs needed for converting lottie stickers are installed.
+func hasLottieConverter(needFFmpeg bool) bool {
+	if _, err := exec.LookPath("lottieconverter"); err != nil {
+		return false
+	}
+	if needFFmpeg {
+		_, err := exec.LookPath("ffmpeg")
+		return err == nil
+	}
+	return true
+}
+
+// convertLottieNative renders lottie stickers with the built-in renderer, which supports the basic shapes,
+// transforms and fills used by most stickers. There's no pure Go WebP encoder, so animated targets produce GIFs.
+func (br *DiscordBridge) convertLottieNative(data []byte, target string, width, height, fps int) ([]byte, string, error) {
+	anim, err := lottie.Parse(data)
+	if err != nil {
+		return nil, "", err
+	}
+	br.ZLog.Debug().Str("target", target).Msg("External lottie converter not found, using built-in renderer")
+	var buf bytes.Buffer
+	outputMime := "image/gif"
+	if target == "png" {
+		outputMime = "image/png"
+		err = anim.EncodePNG(&buf, width, height)
+	} else {
+		err = anim.EncodeGIF(&buf, width, height, fps)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to render lottie sticker: %w", err)
+	}
+	return buf.Bytes(), outputMime, nil
+}
+
 func (br *DiscordBridge) copyAttachmentToMatrix(intent *appservice.IntentAPI, url string, encrypt bool, meta AttachmentMeta) (returnDBFile *database.File, returnErr error) {
 	isCacheable := br.Config.Bridge.CacheMedia != "never" && (br.Config.Bridge.CacheMedia == "always" || !encrypt)
 	returnDBFile = br.DB.File.Get(url, encrypt)
-	if returnDBFile == nil {
+	if returnDBFile != nil {
+		returnDBFile.MarkUsed()
+	} else {
 		transferKey := attachmentKey{url, encrypt}
 		once, _ := br.attachmentTransfers.GetOrSet(transferKey, &exsync.ReturnableOnce[*database.File]{})
 		returnDBFile, returnErr = once.Do(func() (onceDBFile *database.File, onceErr error) {
@@ -299,21 +462,29 @@ func (br *DiscordBridge) copyAttachmentToMatrix(intent *appservice.IntentAPI, ur
 				br.parallelAttachmentSemaphore.Release(attachmentSizeVal)
 			}()
 
-			var data []byte
-			data, onceErr = downloadDiscordAttachment(http.DefaultClient, url, br.MediaConfig.UploadSize)
-			if onceErr != nil {
-				return
-			}
-
 			if meta.Converter != nil {
+				// Converters need the whole file, so there's no point in streaming
+				var data []byte
+				data, onceErr = downloadDiscordAttachment(http.DefaultClient, url, br.MediaConfig.UploadSize)
+				if onceErr != nil {
+					return
+				}
 				data, meta.MimeType, onceErr = meta.Converter(data)
 				if onceErr != nil {
 					onceErr = fmt.Errorf("failed to convert attachment: %w", onceErr)
 					return
 				}
+				onceDBFile, onceErr = br.uploadMatrixAttachment(intent, bytes.NewReader(data), int64(len(data)), url, encrypt, meta, &semaWg)
+			} else {
+				var body io.ReadCloser
+				var size int64
+				body, size, onceErr = openDiscordAttachment(http.DefaultClient, url, br.MediaConfig.UploadSize)
+				if onceErr != nil {
+					return
+				}
+				onceDBFile, onceErr = br.uploadMatrixAttachment(intent, body, size, url, encrypt, meta, &semaWg)
+				_ = body.Close()
 			}
-
-			onceDBFile, onceErr = br.uploadMatrixAttachment(intent, data, url, encrypt, meta, &semaWg)
 			if onceErr != nil {
 				return
 			}
@@ -27,11 +27,12 @@ func (portal *Portal) forwardBackfillInitial(source *User, thread *Thread) {
 		panic("forwardBackfillInitial() called without locking forwardBackfillLock")
 	}
 
-	limit := portal.bridge.Config.Bridge.Backfill.Limits.Initial.Channel
+	limits := portal.BridgeConfig().Backfill.Limits
+	limit := limits.Initial.Channel
 	if portal.GuildID == "" {
-		limit = portal.bridge.Config.Bridge.Backfill.Limits.Initial.DM
+		limit = limits.Initial.DM
 		if thread != nil {
-			limit = portal.bridge.Config.Bridge.Backfill.Limits.Initial.Thread
+			limit = limits.Initial.Thread
 			thread.initialBackfillAttempted = true
 		}
 	}
@@ -52,15 +53,21 @@ func (portal *Portal) forwardBackfillInitial(source *User, thread *Thread) {
 }
 
 func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID string, thread *Thread) {
+	portal.forwardBackfillMissed(source, serverLastMessageID, thread)
+	go portal.reconcileRecent(source, thread)
+}
+
+func (portal *Portal) forwardBackfillMissed(source *User, serverLastMessageID string, thread *Thread) {
 	if portal.MXID == "" {
 		return
 	}
 
-	limit := portal.bridge.Config.Bridge.Backfill.Limits.Missed.Channel
+	limits := portal.BridgeConfig().Backfill.Limits
+	limit := limits.Missed.Channel
 	if portal.GuildID == "" {
-		limit = portal.bridge.Config.Bridge.Backfill.Limits.Missed.DM
+		limit = limits.Missed.DM
 		if thread != nil {
-			limit = portal.bridge.Config.Bridge.Backfill.Limits.Missed.Thread
+			limit = limits.Missed.Thread
 		}
 	}
 	if limit == 0 {
@@ -92,6 +99,9 @@ func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID st
 			Str("last_bridged_message", lastMessage.DiscordID).
 			Str("last_server_message", serverLastMessageID).
 			Msg("Not backfilling, last message in database is newer than last message in metadata")
+		if portal.bridge.Config.Bridge.Backfill.CheckMissedEdits {
+			portal.backfillMissedEdits(log, source, lastMessage.DiscordID, thread)
+		}
 		return
 	}
 	log.Debug().
@@ -99,6 +109,8 @@ func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID st
 		Str("last_server_message", serverLastMessageID).
 		Msg("Backfilling missed messages")
 	if limit < 0 {
+		// Like backfillLimited, edits to the already bridged messages are always checked when there are new messages
+		portal.backfillMissedEdits(log, source, lastMessage.DiscordID, thread)
 		portal.backfillUnlimitedMissed(log, source, lastMessage.DiscordID, thread)
 	} else {
 		portal.backfillLimited(log, source, limit, lastMessage.DiscordID, thread)
@@ -107,19 +119,21 @@ func (portal *Portal) ForwardBackfillMissed(source *User, serverLastMessageID st
 
 const messageFetchChunkSize = 50
 
-func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User, limit int, until string, thread *Thread) ([]*discordgo.Message, bool, error) {
-	var messages []*discordgo.Message
+// collectBackfillMessages fetches messages newer than until (or the latest messages if until is empty).
+// If until was reached, the already bridged messages in the same chunk are returned separately,
+// so that they can be checked for edits that were missed.
+func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User, limit int, until string, thread *Thread) (messages, bridgedMessages []*discordgo.Message, foundAll bool, err error) {
 	var before string
-	var foundAll bool
 	protoChannelID := portal.Key.ChannelID
 	if thread != nil {
 		protoChannelID = thread.ID
 	}
 	for {
 		log.Debug().Str("before_id", before).Msg("Fetching messages for backfill")
-		newMessages, err := source.Session.ChannelMessages(protoChannelID, messageFetchChunkSize, before, "", "", portal.RefererOptIfUser(source.Session, protoChannelID)...)
+		var newMessages []*discordgo.Message
+		newMessages, err = source.Session.ChannelMessages(protoChannelID, messageFetchChunkSize, before, "", "", portal.RefererOptIfUser(source.Session, protoChannelID)...)
 		if err != nil {
-			return nil, false, err
+			return nil, nil, false, err
 		}
 		if until != "" {
 			for i, msg := range newMessages {
@@ -128,6 +142,7 @@ func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User,
 						Str("message_id", msg.ID).
 						Str("until_id", until).
 						Msg("Found message that was already bridged")
+					bridgedMessages = newMessages[i:]
 					newMessages = newMessages[:i]
 					foundAll = true
 					break
@@ -145,11 +160,11 @@ func (portal *Portal) collectBackfillMessages(log zerolog.Logger, source *User,
 		foundAll = false
 		messages = messages[:limit]
 	}
-	return messages, foundAll, nil
+	return
 }
 
 func (portal *Portal) backfillLimited(log zerolog.Logger, source *User, limit int, after string, thread *Thread) {
-	messages, foundAll, err := portal.collectBackfillMessages(log, source, limit, after, thread)
+	messages, bridgedMessages, foundAll, err := portal.collectBackfillMessages(log, source, limit, after, thread)
 	if err != nil {
 		if source.handlePossible40002(err) {
 			panic(err)
@@ -174,6 +189,57 @@ func (portal *Portal) backfillLimited(log zerolog.Logger, source *User, limit in
 		}
 	}
 	portal.sendBackfillBatch(log, source, messages, thread)
+	if len(bridgedMessages) > 0 {
+		sort.Sort(MessageSlice(bridgedMessages))
+		portal.bridgeMissedEdits(log, source, bridgedMessages)
+	}
+}
+
+// backfillMissedEdits fetches the most recent already bridged messages and bridges any edits that were missed.
+func (portal *Portal) backfillMissedEdits(log zerolog.Logger, source *User, lastBridgedID string, thread *Thread) {
+	protoChannelID := portal.Key.ChannelID
+	if thread != nil {
+		protoChannelID = thread.ID
+	}
+	log.Debug().Str("around_id", lastBridgedID).Msg("Fetching recent messages to check for missed edits")
+	messages, err := source.Session.ChannelMessages(protoChannelID, messageFetchChunkSize, "", "", lastBridgedID, portal.RefererOptIfUser(source.Session, protoChannelID)...)
+	if err != nil {
+		log.Err(err).Msg("Error fetching messages to check for missed edits")
+		return
+	}
+	bridgedMessages := make([]*discordgo.Message, 0, len(messages))
+	for _, msg := range messages {
+		if compareMessageIDs(msg.ID, lastBridgedID) <= 0 {
+			bridgedMessages = append(bridgedMessages, msg)
+		}
+	}
+	sort.Sort(MessageSlice(bridgedMessages))
+	portal.bridgeMissedEdits(log, source, bridgedMessages)
+}
+
+// bridgeMissedEdits compares the edit timestamps of the given already bridged messages
+// with the ones in the database, and sends replacement events for any edits that are newer.
+func (portal *Portal) bridgeMissedEdits(log zerolog.Logger, source *User, messages []*discordgo.Message) {
+	var count int
+	for _, msg := range messages {
+		if msg.EditedTimestamp == nil {
+			continue
+		}
+		existing := portal.bridge.DB.Message.GetFirstByDiscordID(portal.Key, msg.ID)
+		if existing == nil || !msg.EditedTimestamp.After(existing.EditTimestamp) {
+			continue
+		}
+		log.Debug().
+			Str("message_id", msg.ID).
+			Time("edit_ts", *msg.EditedTimestamp).
+			Time("db_edit_ts", existing.EditTimestamp).
+			Msg("Found edit that was missed while offline")
+		portal.handleDiscordMessageUpdate(source, msg)
+		count++
+	}
+	if count > 0 {
+		log.Info().Int("count", count).Msg("Bridged missed edits")
+	}
 }
 
 func (portal *Portal) backfillUnlimitedMissed(log zerolog.Logger, source *User, after string, thread *Thread) {
@@ -208,10 +274,125 @@ func (portal *Portal) sendBackfillBatch(log zerolog.Logger, source *User, messag
 		portal.forwardBatchSend(log, source, messages, thread)
 	} else {
 		log.Debug().Msg("Not using hungryserv, sending messages one by one")
+		backfillReactions := portal.BridgeConfig().Backfill.Reactions
 		for _, msg := range messages {
 			portal.handleDiscordMessageCreate(source, msg, thread)
+			if backfillReactions {
+				for _, reaction := range portal.collectBackfillReactions(log, source, msg, thread) {
+					portal.handleDiscordReaction(source, reaction, true, thread, nil)
+				}
+			}
 		}
 	}
+	if thread == nil {
+		portal.recurseBackfillThreads(log, source, messages)
+	}
+}
+
+// recurseBackfillThreads queues initial backfill for threads whose root messages were just backfilled.
+// The backfills will start after the current one releases forwardBackfillLock.
+func (portal *Portal) recurseBackfillThreads(log zerolog.Logger, source *User, messages []*discordgo.Message) {
+	maxThreads := portal.BridgeConfig().Backfill.RecurseThreads
+	if maxThreads <= 0 {
+		return
+	}
+	var count int
+	for _, msg := range messages {
+		if msg.Thread == nil {
+			continue
+		}
+		thread := portal.bridge.GetThreadByID(msg.Thread.ID, nil)
+		if thread == nil || thread.initialBackfillAttempted || msg.Thread.MessageCount == 0 {
+			continue
+		}
+		log.Debug().Str("thread_id", thread.ID).Msg("Queueing backfill of thread found in backfilled messages")
+		go thread.maybeInitialBackfill(source)
+		count++
+		if count >= maxThreads {
+			break
+		}
+	}
+}
+
+// collectBackfillReactions returns one reaction per user for each reaction on the given message.
+// The message object only includes counts, so the users are fetched separately unless the only reaction is from the source user.
+func (portal *Portal) collectBackfillReactions(log zerolog.Logger, source *User, msg *discordgo.Message, thread *Thread) []*discordgo.MessageReaction {
+	protoChannelID := portal.Key.ChannelID
+	if thread != nil {
+		protoChannelID = thread.ID
+	}
+	var reactions []*discordgo.MessageReaction
+	for _, reaction := range msg.Reactions {
+		if reaction.Emoji == nil || reaction.Count == 0 {
+			continue
+		}
+		var userIDs []string
+		if reaction.Count == 1 && reaction.Me {
+			userIDs = []string{source.DiscordID}
+		} else {
+			users, err := portal.fetchAllReactionUsers(source, protoChannelID, msg.ID, reaction.Emoji.APIName(), nil)
+			if err != nil {
+				log.Warn().Err(err).
+					Str("message_id", msg.ID).
+					Str("emoji", reaction.Emoji.APIName()).
+					Msg("Failed to fetch reaction users for backfill")
+				continue
+			}
+			for _, user := range users {
+				portal.bridge.GetPuppetByID(user.ID).UpdateInfo(source, user, nil)
+				userIDs = append(userIDs, user.ID)
+			}
+		}
+		for _, userID := range userIDs {
+			reactions = append(reactions, &discordgo.MessageReaction{
+				UserID:    userID,
+				MessageID: msg.ID,
+				ChannelID: protoChannelID,
+				GuildID:   portal.GuildID,
+				Emoji:     *reaction.Emoji,
+			})
+		}
+	}
+	return reactions
+}
+
+// convertReactionBatch converts the reactions on the messages in a backfill batch into annotation events.
+// The events, metas and dbMessages slices are the ones returned by convertMessageBatch.
+func (portal *Portal) convertReactionBatch(log zerolog.Logger, source *User, evts []*event.Event, metas []*discordgo.Message, dbMessages []database.Message, thread *Thread) ([]*event.Event, []*database.Reaction) {
+	var reactionEvts []*event.Event
+	var dbReactions []*database.Reaction
+	for i, msg := range metas {
+		if msg == nil || len(msg.Reactions) == 0 {
+			continue
+		}
+		for _, reaction := range portal.collectBackfillReactions(log, source, msg, thread) {
+			discordID, matrixReaction := portal.convertDiscordReactionKey(&reaction.Emoji)
+			if matrixReaction == "" {
+				continue
+			}
+			intent := portal.bridge.GetPuppetByID(reaction.UserID).IntentFor(portal)
+			content := portal.makeDiscordReactionContent(&reaction.Emoji, matrixReaction, evts[i].ID)
+			intent.AddDoublePuppetValue(content)
+			reactionEvts = append(reactionEvts, &event.Event{
+				ID:        portal.deterministicEventID(msg.ID, fmt.Sprintf("reaction/%s/%s", reaction.UserID, discordID)),
+				Type:      event.EventReaction,
+				Sender:    intent.UserID,
+				Timestamp: evts[i].Timestamp,
+				Content:   *content,
+			})
+			dbReaction := portal.bridge.DB.Reaction.New()
+			dbReaction.Channel = portal.Key
+			dbReaction.MessageID = msg.ID
+			dbReaction.FirstAttachmentID = dbMessages[i].AttachmentID
+			dbReaction.Sender = reaction.UserID
+			dbReaction.EmojiName = discordID
+			if thread != nil {
+				dbReaction.ThreadID = thread.ID
+			}
+			dbReactions = append(dbReactions, dbReaction)
+		}
+	}
+	return reactionEvts, dbReactions
 }
 
 func (portal *Portal) forwardBatchSend(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) {
@@ -220,16 +401,33 @@ func (portal *Portal) forwardBatchSend(log zerolog.Logger, source *User, message
 		log.Warn().Msg("Didn't get any events to backfill")
 		return
 	}
-	log.Info().Int("events", len(evts)).Msg("Converted messages to backfill")
+	var reactionEvts []*event.Event
+	var dbReactions []*database.Reaction
+	if portal.BridgeConfig().Backfill.Reactions {
+		reactionEvts, dbReactions = portal.convertReactionBatch(log, source, evts, metas, dbMessages, thread)
+	}
+	log.Info().
+		Int("events", len(evts)).
+		Int("reactions", len(reactionEvts)).
+		Msg("Converted messages to backfill")
+	allEvts := make([]*event.Event, 0, len(evts)+len(reactionEvts))
+	allEvts = append(allEvts, evts...)
+	allEvts = append(allEvts, reactionEvts...)
 	resp, err := portal.MainIntent().BeeperBatchSend(portal.MXID, &mautrix.ReqBeeperBatchSend{
 		Forward: true,
-		Events:  evts,
+		Events:  allEvts,
 	})
 	if err != nil {
 		log.Err(err).Msg("Error sending backfill batch")
 		return
+	} else if len(resp.EventIDs) != len(allEvts) {
+		log.Error().
+			Int("sent_count", len(allEvts)).
+			Int("response_count", len(resp.EventIDs)).
+			Msg("Backfill batch response has wrong number of event IDs")
+		return
 	}
-	for i, evtID := range resp.EventIDs {
+	for i, evtID := range resp.EventIDs[:len(evts)] {
 		dbMessages[i].MXID = evtID
 		if metas[i] != nil && metas[i].Flags == discordgo.MessageFlagsHasThread {
 			// TODO proper context
@@ -238,6 +436,10 @@ func (portal *Portal) forwardBatchSend(log zerolog.Logger, source *User, message
 		}
 	}
 	portal.bridge.DB.Message.MassInsert(portal.Key, dbMessages)
+	for i, dbReaction := range dbReactions {
+		dbReaction.MXID = resp.EventIDs[len(evts)+i]
+		dbReaction.Insert()
+	}
 }
 
 func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, messages []*discordgo.Message, thread *Thread) ([]*event.Event, []*discordgo.Message, []database.Message) {
@@ -317,14 +519,18 @@ func (portal *Portal) convertMessageBatch(log zerolog.Logger, source *User, mess
 			}
 			intent.AddDoublePuppetValue(&evt.Content)
 			evts = append(evts, evt)
-			dbMessages = append(dbMessages, database.Message{
+			dbMsg := database.Message{
 				Channel:      portal.Key,
 				DiscordID:    msg.ID,
 				SenderID:     msg.Author.ID,
 				Timestamp:    ts,
 				AttachmentID: part.AttachmentID,
 				SenderMXID:   intent.UserID,
-			})
+			}
+			if msg.EditedTimestamp != nil {
+				dbMsg.EditTimestamp = *msg.EditedTimestamp
+			}
+			dbMessages = append(dbMessages, dbMsg)
 			if i == 0 {
 				metas = append(metas, msg)
 			} else {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// channelEventQueue keeps the gateway events of each channel in order without blocking the gateway goroutine.
+// Every channel with pending events has its own goroutine, which exits once the channel's queue is empty,
+// so a slow portal only delays events in that portal.
+type channelEventQueue struct {
+	lock    sync.Mutex
+	pending map[string][]any
+	// overflowed contains the channels where events were dropped since the queue was last empty
+	overflowed map[string]struct{}
+	maxSize    int
+	handler    func(evt any)
+	// recoverDropped is called after the queue of a channel where events were dropped has been drained.
+	recoverDropped func(channelID string)
+}
+
+func newChannelEventQueue(maxSize int, handler func(evt any), recoverDropped func(channelID string)) *channelEventQueue {
+	return &channelEventQueue{
+		pending:        make(map[string][]any),
+		overflowed:     make(map[string]struct{}),
+		maxSize:        maxSize,
+		handler:        handler,
+		recoverDropped: recoverDropped,
+	}
+}
+
+// Push adds the event to the queue of the given channel. If the channel already has too many pending events,
+// the event is dropped and false is returned. Dropped events are recovered once the queue has been drained.
+func (q *channelEventQueue) Push(channelID string, evt any) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	queue := q.pending[channelID]
+	if q.maxSize > 0 && len(queue) >= q.maxSize {
+		q.overflowed[channelID] = struct{}{}
+		return false
+	}
+	q.pending[channelID] = append(queue, evt)
+	if len(queue) == 0 {
+		go q.drain(channelID)
+	}
+	return true
+}
+
+func (q *channelEventQueue) drain(channelID string) {
+	for {
+		// The event stays in the queue while it's being handled, so that Push doesn't start another goroutine.
+		q.lock.Lock()
+		evt := q.pending[channelID][0]
+		q.lock.Unlock()
+
+		q.handler(evt)
+
+		q.lock.Lock()
+		remaining := q.pending[channelID][1:]
+		if len(remaining) == 0 {
+			delete(q.pending, channelID)
+			_, overflowed := q.overflowed[channelID]
+			delete(q.overflowed, channelID)
+			q.lock.Unlock()
+			if overflowed && q.recoverDropped != nil {
+				q.recoverDropped(channelID)
+			}
+			return
+		}
+		q.pending[channelID] = remaining
+		q.lock.Unlock()
+	}
+}
+
+// portalEventChannelID returns the channel ID of gateway events that are forwarded to portals and must be
+// handled in order. Other events return an empty string.
+func portalEventChannelID(rawEvt any) string {
+	switch evt := rawEvt.(type) {
+	case *discordgo.MessageCreate:
+		return evt.ChannelID
+	case *discordgo.MessageUpdate:
+		return evt.ChannelID
+	case *discordgo.MessageDelete:
+		return evt.ChannelID
+	case *discordgo.MessageDeleteBulk:
+		return evt.ChannelID
+	case *discordgo.MessageReactionAdd:
+		return evt.ChannelID
+	case *discordgo.MessageReactionRemove:
+		return evt.ChannelID
+	case *discordgo.ChannelUpdate:
+		if evt.Channel != nil {
+			return evt.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelEventQueueOrder(t *testing.T) {
+	var lock sync.Mutex
+	handled := make(map[string][]int)
+	var wg sync.WaitGroup
+	wg.Add(20)
+	queue := newChannelEventQueue(0, func(evt any) {
+		defer wg.Done()
+		n := evt.(int)
+		lock.Lock()
+		defer lock.Unlock()
+		channelID := "even"
+		if n%2 == 1 {
+			channelID = "odd"
+		}
+		handled[channelID] = append(handled[channelID], n)
+	}, nil)
+	for i := 0; i < 20; i++ {
+		channelID := "even"
+		if i%2 == 1 {
+			channelID = "odd"
+		}
+		require.True(t, queue.Push(channelID, i))
+	}
+	wg.Wait()
+	assert.Equal(t, []int{0, 2, 4, 6, 8, 10, 12, 14, 16, 18}, handled["even"])
+	assert.Equal(t, []int{1, 3, 5, 7, 9, 11, 13, 15, 17, 19}, handled["odd"])
+	assert.Eventually(t, func() bool {
+		queue.lock.Lock()
+		defer queue.lock.Unlock()
+		return len(queue.pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestChannelEventQueueDropsWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	handled := make(chan any, 10)
+	recovered := make(chan string, 10)
+	queue := newChannelEventQueue(2, func(evt any) {
+		if evt == "slow" {
+			<-block
+		}
+		handled <- evt
+	}, func(channelID string) {
+		recovered <- channelID
+	})
+	require.True(t, queue.Push("1", "slow"))
+	require.True(t, queue.Push("1", "second"))
+	// A slow channel must not block or affect other channels
+	assert.False(t, queue.Push("1", "dropped"))
+	require.True(t, queue.Push("2", "other"))
+	assert.Equal(t, "other", <-handled)
+	close(block)
+	assert.Equal(t, "slow", <-handled)
+	assert.Equal(t, "second", <-handled)
+	// Dropped events are recovered only after the rest of the queue was handled, and only in the overflowed channel
+	assert.Equal(t, "1", <-recovered)
+	assert.Empty(t, recovered)
+}
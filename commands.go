@@ -26,6 +26,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/skip2/go-qrcode"
@@ -51,10 +52,11 @@ type WrappedCommandEvent struct {
 var HelpSectionPortalManagement = commands.HelpSection{Name: "Portal management", Order: 20}
 
 func (br *DiscordBridge) RegisterCommands() {
-	proc := br.CommandProcessor.(*commands.Processor)
+	proc := br.CommandProcessor.(*accountCommandProcessor)
 	proc.AddHandlers(
 		cmdLoginToken,
 		cmdLoginQR,
+		cmdAccounts,
 		cmdLogout,
 		cmdPing,
 		cmdReconnect,
@@ -66,8 +68,14 @@ func (br *DiscordBridge) RegisterCommands() {
 		cmdSetRelay,
 		cmdUnsetRelay,
 		cmdGuilds,
+		cmdJoin,
+		cmdLeaveGuild,
+		cmdFriends,
+		cmdConfig,
+		cmdExport,
 		cmdRejoinSpace,
 		cmdDeleteAllPortals,
+		cmdMediaCache,
 		cmdExec,
 		cmdCommands,
 	)
@@ -386,6 +394,41 @@ func fnRejoinSpace(ce *WrappedCommandEvent) {
 	}
 }
 
+var cmdExport = &commands.FullHandler{
+	Func: wrapCommand(fnExport),
+	Name: "export",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Export the bridged history of this portal as a DiscordChatExporter-compatible JSON and HTML archive",
+		Args:        "[--no-media]",
+	},
+	RequiresPortal:     true,
+	RequiresEventLevel: roomModerator,
+}
+
+func fnExport(ce *WrappedCommandEvent) {
+	includeMedia := true
+	if len(ce.Args) > 0 {
+		if ce.Args[0] != "--no-media" {
+			ce.Reply("**Usage**: `$cmdprefix export [--no-media]`")
+			return
+		}
+		includeMedia = false
+	}
+	if ce.User.GetManagementRoomID() == "" {
+		ce.Reply("You don't have a management room. Start a chat with the bridge bot first, the archive will be sent there.")
+		return
+	}
+	ce.Reply("Exporting history, the archive will be sent to your management room when it's ready")
+	_, err := ce.Portal.ExportHistory(ce.User, includeMedia)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to export portal history")
+		ce.Reply("Failed to export history: %v", err)
+	} else {
+		ce.Reply("Finished exporting history")
+	}
+}
+
 var roomModerator = event.Type{Type: "fi.mau.discord.admin", Class: event.StateEventType}
 
 var cmdSetRelay = &commands.FullHandler{
@@ -657,6 +700,81 @@ func fnGuildBridgingMode(ce *WrappedCommandEvent) {
 	ce.Reply("Set guild bridging mode to %s", mode.Description())
 }
 
+var cmdJoin = &commands.FullHandler{
+	Func: wrapCommand(fnJoin),
+	Name: "join",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Join a guild using an invite link, optionally bridging it right away",
+		Args:        "<_invite code or link_> [_bridging mode_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnJoin(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 || len(ce.Args) > 2 {
+		ce.Reply("**Usage**: `$cmdprefix join <invite code or link> [bridging mode]`\n\n" + availableModes)
+		return
+	}
+	mode := database.GuildBridgeNothing
+	if len(ce.Args) == 2 {
+		mode = database.ParseGuildBridgingMode(ce.Args[1])
+		if mode == database.GuildBridgeInvalid {
+			ce.Reply("Invalid guild bridging mode `%s`\n\n%s", ce.Args[1], availableModes)
+			return
+		}
+	}
+	invite, err := ce.User.resolveInvite(ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to resolve invite: %v", err)
+		return
+	}
+	ce.Reply("Joining %s", formatInviteInfo(invite))
+	alreadyJoined, err := ce.User.joinGuildByInvite(invite, mode)
+	if err != nil {
+		ce.Reply("Failed to join guild: %v", err)
+	} else if alreadyJoined && mode > database.GuildBridgeNothing {
+		ce.Reply("You're already in that guild, set bridging mode to %s", mode.Description())
+	} else if alreadyJoined {
+		ce.Reply("You're already in that guild")
+	} else if mode > database.GuildBridgeNothing {
+		ce.Reply("Successfully joined guild, it will be bridged with mode `%s` shortly", mode.String())
+	} else {
+		ce.Reply("Successfully joined guild. Use `$cmdprefix guilds bridge %s` to bridge it.", invite.Guild.ID)
+	}
+}
+
+var cmdLeaveGuild = &commands.FullHandler{
+	Func:    wrapCommand(fnLeaveGuild),
+	Name:    "leave-guild",
+	Aliases: []string{"leave-server"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Leave a Discord guild",
+		Args:        "[_guild ID_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnLeaveGuild(ce *WrappedCommandEvent) {
+	var guildID string
+	if len(ce.Args) == 1 {
+		guildID = ce.Args[0]
+	} else if len(ce.Args) == 0 && ce.Portal != nil && ce.Portal.GuildID != "" {
+		guildID = ce.Portal.GuildID
+	} else {
+		ce.Reply("**Usage**: `$cmdprefix leave-guild <guild ID>`")
+		return
+	}
+	if err := ce.User.leaveGuild(guildID); err != nil {
+		ce.Reply("Failed to leave guild: %v", err)
+	} else if ce.Bridge.Config.Bridge.DeleteGuildOnLeave && !ce.User.PortalHasOtherUsers(guildID) {
+		ce.Reply("Successfully left guild, the bridged rooms will be cleaned up")
+	} else {
+		ce.Reply("Successfully left guild")
+	}
+}
+
 var cmdBridge = &commands.FullHandler{
 	Func: wrapCommand(fnBridge),
 	Name: "bridge",
@@ -899,3 +1017,57 @@ func fnDeleteAllPortals(ce *WrappedCommandEvent) {
 		ce.Reply("Finished background cleanup of deleted portal rooms.")
 	}()
 }
+
+var cmdMediaCache = &commands.FullHandler{
+	Func: wrapCommand(fnMediaCache),
+	Name: "media-cache",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "View media cache stats or purge cached media of a guild or portal.",
+		Args:        "<stats/purge-guild/purge-portal> [_guild ID_ or _room ID_]",
+	},
+	RequiresAdmin: true,
+}
+
+const mediaCacheHelp = "**Usage**: `$cmdprefix media-cache <stats/purge-guild <guild ID>/purge-portal [room ID]>`"
+
+func fnMediaCache(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply(mediaCacheHelp)
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "stats":
+		stats := ce.Bridge.DB.File.GetStats()
+		if stats.Count == 0 {
+			ce.Reply("The media cache is empty")
+			return
+		}
+		ce.Reply(
+			"The media cache contains %d files totaling %.1f MiB. The least recently used file was last used %s.",
+			stats.Count, float64(stats.TotalSize)/1024/1024, stats.OldestUsed.Format(time.RFC3339),
+		)
+	case "purge-guild":
+		if len(ce.Args) < 2 {
+			ce.Reply("**Usage**: `$cmdprefix media-cache purge-guild <guild ID>`")
+			return
+		}
+		files := ce.Bridge.DB.File.GetAllByGuild(ce.Args[1])
+		size := ce.Bridge.purgeCachedFiles(files)
+		ce.Reply("Purged %d files (%.1f MiB) from the media cache", len(files), float64(size)/1024/1024)
+	case "purge-portal":
+		portal := ce.Portal
+		if len(ce.Args) > 1 {
+			portal = ce.Bridge.GetPortalByMXID(id.RoomID(ce.Args[1]))
+		}
+		if portal == nil {
+			ce.Reply("Portal not found. Either run this command in a portal room or pass a portal room ID.")
+			return
+		}
+		files := ce.Bridge.DB.File.GetAllByChannel(portal.Key.ChannelID)
+		size := ce.Bridge.purgeCachedFiles(files)
+		ce.Reply("Purged %d files (%.1f MiB) from the media cache", len(files), float64(size)/1024/1024)
+	default:
+		ce.Reply("Unknown subcommand `%s`\n\n"+mediaCacheHelp, ce.Args[0])
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var cmdAccounts = &commands.FullHandler{
+	Func:    wrapCommand(fnAccounts),
+	Name:    "accounts",
+	Aliases: []string{"account"},
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "List or remove your linked Discord accounts",
+		Args:        "<list/remove> [_name_]",
+	},
+}
+
+const smallAccountsHelp = "**Usage**: `$cmdprefix accounts <help/list/remove> [name]`"
+
+const fullAccountsHelp = smallAccountsHelp + `
+
+You can link multiple Discord accounts by adding ` + "`" + accountSelectorPrefix + "<name>`" + ` to the login commands,
+e.g. ` + "`$cmdprefix login-qr " + accountSelectorPrefix + "work`" + `. The same flag selects the account for any
+other command. Without it, commands apply to the account whose management room they're sent in, the account that
+owns the portal they're sent in, or the default account.
+
+* **help** - View this help message.
+* **list** - View your linked accounts.
+* **remove <_name_>** - Log out of an extra account and forget it.`
+
+func fnAccounts(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		fnListAccounts(ce)
+		return
+	}
+	subcommand := strings.ToLower(ce.Args[0])
+	ce.Args = ce.Args[1:]
+	switch subcommand {
+	case "list":
+		fnListAccounts(ce)
+	case "remove", "delete":
+		fnRemoveAccount(ce)
+	case "help":
+		ce.Reply(fullAccountsHelp)
+	default:
+		ce.Reply("Unknown subcommand `%s`\n\n"+smallAccountsHelp, subcommand)
+	}
+}
+
+func describeAccount(account *User) string {
+	if account.Session != nil && account.Session.State.User != nil {
+		return fmt.Sprintf("logged in as @%s (`%s`)", account.Session.State.User.Username, account.DiscordID)
+	} else if account.DiscordToken != "" {
+		return fmt.Sprintf("logged in as `%s`, but not connected", account.DiscordID)
+	} else {
+		return "not logged in"
+	}
+}
+
+func fnListAccounts(ce *WrappedCommandEvent) {
+	accounts := ce.User.GetAccounts()
+	lines := make([]string, len(accounts))
+	for i, account := range accounts {
+		lines[i] = fmt.Sprintf("* **%s** - %s", account.AccountName(), describeAccount(account))
+		if account == ce.User {
+			lines[i] += " (selected)"
+		}
+	}
+	ce.Reply("Your Discord accounts:\n\n%s\n\nUse `%s<name>` to select an account for a command.", strings.Join(lines, "\n"), accountSelectorPrefix)
+}
+
+func fnRemoveAccount(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix accounts remove <name>`")
+		return
+	}
+	name, err := normalizeAccountName(ce.Args[0])
+	if err != nil {
+		ce.Reply("Invalid account name: %v", err)
+		return
+	} else if name == "" {
+		ce.Reply("The default account can't be removed, use `$cmdprefix logout` to log out of it")
+		return
+	}
+	account := ce.Bridge.GetUserAccount(ce.User.MXID, name, false)
+	if account == nil {
+		ce.Reply("You don't have an account named `%s`", name)
+	} else if err = account.deleteAccount(); err != nil {
+		ce.Reply("Failed to remove account: %v", err)
+	} else {
+		ce.Reply("Removed account `%s`", name)
+	}
+}
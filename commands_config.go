@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/commands"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+type configOverrideTarget interface {
+	GetConfigOverrides() map[string]string
+	SetConfigOverride(key, value string) (string, error)
+	UnsetConfigOverride(key string) bool
+	BridgeConfig() *config.BridgeConfig
+}
+
+var (
+	_ configOverrideTarget = (*Guild)(nil)
+	_ configOverrideTarget = (*Portal)(nil)
+)
+
+var cmdConfig = &commands.FullHandler{
+	Func: wrapCommand(fnConfig),
+	Name: "config",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "View or override bridge config options for this portal or guild",
+		Args:        "[--guild[=<_guild ID_>]] <list/get/set/unset> [_key_] [_value_]",
+	},
+}
+
+const smallConfigHelp = "**Usage**: `$cmdprefix config [--guild[=<guild ID>]] <help/list/get/set/unset> [key] [value]`"
+
+const fullConfigHelp = smallConfigHelp + `
+
+Overrides apply to the portal the command is run in. The --guild flag targets the guild of the portal
+instead, or the given guild if the command is run outside a portal. Portal overrides take precedence
+over guild overrides, which take precedence over the bridge config file.
+
+* **help** - View this help message.
+* **list** - View the effective values of all overridable options.
+* **get <_key_>** - View the effective value of an option.
+* **set <_key_> <_value_>** - Override an option.
+* **unset <_key_>** - Remove an override.`
+
+func fnConfig(ce *WrappedCommandEvent) {
+	var target configOverrideTarget
+	var guild *Guild
+	var guildFlag string
+	var hasGuildFlag bool
+	if len(ce.Args) > 0 && strings.HasPrefix(ce.Args[0], "--guild") {
+		hasGuildFlag = true
+		guildFlag = strings.TrimPrefix(strings.TrimPrefix(ce.Args[0], "--guild"), "=")
+		ce.Args = ce.Args[1:]
+	}
+	if guildFlag != "" {
+		guild = ce.Bridge.GetGuildByID(guildFlag, false)
+		if guild == nil {
+			ce.Reply("Guild `%s` not found", guildFlag)
+			return
+		}
+	} else if hasGuildFlag {
+		if ce.Portal != nil {
+			guild = ce.Portal.Guild
+		} else {
+			guild = ce.Bridge.GetGuildByMXID(ce.RoomID)
+		}
+		if guild == nil {
+			ce.Reply("This room is not a guild portal, please specify a guild ID with `--guild=<ID>`")
+			return
+		}
+	} else if ce.Portal != nil {
+		canManage, err := ce.Portal.CanManageConfig(ce.User)
+		if err != nil {
+			ce.ZLog.Warn().Err(err).Msg("Failed to check room power levels")
+			ce.Reply("Failed to get room power levels to see if you're allowed to use that command")
+			return
+		} else if !canManage {
+			ce.Reply("You must be a moderator in this room to manage its config")
+			return
+		}
+		target = ce.Portal
+	} else if guild = ce.Bridge.GetGuildByMXID(ce.RoomID); guild == nil {
+		ce.Reply("You must either run the command in a portal or guild space, or specify a guild with `--guild=<ID>`")
+		return
+	}
+	if guild != nil {
+		if !guild.CanManageConfig(ce.User) {
+			ce.Reply("You must have the Manage Server permission in the guild to manage its config")
+			return
+		}
+		target = guild
+	}
+
+	if len(ce.Args) == 0 {
+		ce.Reply(fullConfigHelp)
+		return
+	}
+	subcommand := strings.ToLower(ce.Args[0])
+	ce.Args = ce.Args[1:]
+	switch subcommand {
+	case "list":
+		fnConfigList(ce, target)
+	case "get":
+		fnConfigGet(ce, target)
+	case "set":
+		fnConfigSet(ce, target)
+	case "unset", "reset":
+		fnConfigUnset(ce, target)
+	case "help":
+		ce.Reply(fullConfigHelp)
+	default:
+		ce.Reply("Unknown subcommand `%s`\n\n"+smallConfigHelp, subcommand)
+	}
+}
+
+func describeConfigValue(target configOverrideTarget, key string) (string, error) {
+	value, err := target.BridgeConfig().GetOverridable(key)
+	if err != nil {
+		return "", err
+	}
+	source := "default"
+	if _, ok := target.GetConfigOverrides()[key]; ok {
+		source = "overridden"
+	} else if portal, ok := target.(*Portal); ok && portal.Guild != nil {
+		if _, ok = portal.Guild.GetConfigOverrides()[key]; ok {
+			source = "overridden by guild"
+		}
+	}
+	return fmt.Sprintf("`%s` = `%s` (%s)", key, value, source), nil
+}
+
+func fnConfigList(ce *WrappedCommandEvent, target configOverrideTarget) {
+	keys := config.OverridableKeys()
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		line, _ := describeConfigValue(target, key)
+		lines[i] = "* " + line
+	}
+	ce.Reply(strings.Join(lines, "\n"))
+}
+
+func replyConfigError(ce *WrappedCommandEvent, key string, err error) {
+	if errors.Is(err, config.ErrUnknownOverrideKey) {
+		ce.Reply("`%s` is not an overridable config option. Use `$cmdprefix config list` to see the available options.", key)
+	} else {
+		ce.Reply("Invalid value for `%s`: %v", key, err)
+	}
+}
+
+func fnConfigGet(ce *WrappedCommandEvent, target configOverrideTarget) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix config get <key>`")
+		return
+	}
+	line, err := describeConfigValue(target, ce.Args[0])
+	if err != nil {
+		replyConfigError(ce, ce.Args[0], err)
+	} else {
+		ce.Reply(line)
+	}
+}
+
+func fnConfigSet(ce *WrappedCommandEvent, target configOverrideTarget) {
+	if len(ce.Args) != 2 {
+		ce.Reply("**Usage**: `$cmdprefix config set <key> <value>`")
+		return
+	}
+	value, err := target.SetConfigOverride(ce.Args[0], ce.Args[1])
+	if err != nil {
+		replyConfigError(ce, ce.Args[0], err)
+	} else {
+		ce.Reply("Set `%s` to `%s`", ce.Args[0], value)
+	}
+}
+
+func fnConfigUnset(ce *WrappedCommandEvent, target configOverrideTarget) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix config unset <key>`")
+		return
+	}
+	if !config.IsOverridable(ce.Args[0]) {
+		replyConfigError(ce, ce.Args[0], config.ErrUnknownOverrideKey)
+	} else if !target.UnsetConfigOverride(ce.Args[0]) {
+		ce.Reply("`%s` is not overridden", ce.Args[0])
+	} else {
+		ce.Reply("Removed override for `%s`", ce.Args[0])
+	}
+}
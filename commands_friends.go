@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+var cmdFriends = &commands.FullHandler{
+	Func:    wrapCommand(fnFriends),
+	Name:    "friends",
+	Aliases: []string{"friend"},
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Manage your Discord friends and friend requests",
+		Args:        "<list/add/accept/ignore/remove/block/unblock/nick> [_user_] [...]",
+	},
+	RequiresLogin: true,
+}
+
+const smallFriendsHelp = "**Usage**: `$cmdprefix friends <help/list/add/accept/ignore/remove/block/unblock/nick> [user] [...]`"
+
+const fullFriendsHelp = smallFriendsHelp + `
+
+Users can be referred to by their Discord user ID, or by their username if they're already in your friend list.
+
+* **help** - View this help message.
+* **list** - View your friends, pending friend requests and blocked users.
+* **add <_username_>** - Send a friend request.
+* **accept <_user_>** - Accept an incoming friend request.
+* **ignore <_user_>** - Ignore an incoming friend request or cancel an outgoing one.
+* **remove <_user_>** - Remove a friend.
+* **block <_user ID_>** - Block a user.
+* **unblock <_user_>** - Unblock a user.
+* **nick <_user_> [_nickname_]** - Set or clear the nickname of a friend.`
+
+func fnFriends(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply(fullFriendsHelp)
+		return
+	} else if ce.User.Session == nil || !ce.User.Session.IsUser {
+		ce.Reply("Friends are only available when logged in with a user account")
+		return
+	}
+	subcommand := strings.ToLower(ce.Args[0])
+	ce.Args = ce.Args[1:]
+	switch subcommand {
+	case "list", "status":
+		fnListFriends(ce)
+	case "add", "request":
+		fnAddFriend(ce)
+	case "accept":
+		fnFriendRelationshipAction(ce, "accept", "Accepted friend request from %s", ce.User.acceptFriendRequest, discordgo.RelationshipIncomingRequest)
+	case "ignore", "cancel":
+		fnFriendRelationshipAction(ce, "ignore", "Removed friend request with %s", ce.User.deleteRelationship, discordgo.RelationshipIncomingRequest, discordgo.RelationshipOutgoingRequest)
+	case "remove", "delete":
+		fnFriendRelationshipAction(ce, "remove", "Removed %s from friends", ce.User.deleteRelationship, discordgo.RelationshipFriend)
+	case "block":
+		fnBlockUser(ce)
+	case "unblock":
+		fnFriendRelationshipAction(ce, "unblock", "Unblocked %s", ce.User.deleteRelationship, discordgo.RelationshipBlocked)
+	case "nick", "nickname":
+		fnFriendNickname(ce)
+	case "help":
+		ce.Reply(fullFriendsHelp)
+	default:
+		ce.Reply("Unknown subcommand `%s`\n\n"+smallFriendsHelp, subcommand)
+	}
+}
+
+func fnListFriends(ce *WrappedCommandEvent) {
+	groups := map[discordgo.RelationshipType][]string{}
+	ce.User.relationshipLock.RLock()
+	for _, rel := range ce.User.relationships {
+		line := "* " + formatRelationshipUser(rel)
+		if rel.Nickname != "" {
+			line += fmt.Sprintf(" (nickname: %s)", rel.Nickname)
+		}
+		groups[rel.Type] = append(groups[rel.Type], line)
+	}
+	ce.User.relationshipLock.RUnlock()
+	sections := []struct {
+		Type  discordgo.RelationshipType
+		Title string
+	}{
+		{discordgo.RelationshipFriend, "Friends"},
+		{discordgo.RelationshipIncomingRequest, "Incoming friend requests"},
+		{discordgo.RelationshipOutgoingRequest, "Outgoing friend requests"},
+		{discordgo.RelationshipBlocked, "Blocked users"},
+	}
+	var parts []string
+	for _, section := range sections {
+		lines := groups[section.Type]
+		if len(lines) == 0 {
+			continue
+		}
+		sort.Strings(lines)
+		parts = append(parts, fmt.Sprintf("**%s** (%d):\n\n%s", section.Title, len(lines), strings.Join(lines, "\n")))
+	}
+	if len(parts) == 0 {
+		ce.Reply("You don't have any friends or pending friend requests")
+	} else {
+		ce.Reply(strings.Join(parts, "\n\n"))
+	}
+}
+
+func fnAddFriend(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix friends add <username>`")
+	} else if err := ce.User.sendFriendRequest(strings.TrimPrefix(ce.Args[0], "@")); err != nil {
+		ce.Reply("Failed to send friend request: %v", err)
+	} else {
+		ce.Reply("Sent friend request to %s", ce.Args[0])
+	}
+}
+
+func fnFriendRelationshipAction(ce *WrappedCommandEvent, name, successMessage string, action func(string) error, allowedTypes ...discordgo.RelationshipType) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix friends %s <user>`", name)
+		return
+	}
+	rel := ce.User.findRelationship(ce.Args[0])
+	if rel == nil {
+		ce.Reply("User `%s` not found in your friend list", ce.Args[0])
+		return
+	}
+	allowed := false
+	for _, relType := range allowedTypes {
+		if rel.Type == relType {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		ce.Reply("Can't %s %s: %s", name, formatRelationshipUser(rel), describeRelationshipType(rel.Type))
+	} else if err := action(rel.ID); err != nil {
+		ce.Reply("Failed to %s %s: %v", name, formatRelationshipUser(rel), err)
+	} else {
+		ce.Reply(successMessage, formatRelationshipUser(rel))
+	}
+}
+
+func fnBlockUser(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix friends block <user>`")
+		return
+	}
+	userID := ce.Args[0]
+	name := fmt.Sprintf("`%s`", userID)
+	if rel := ce.User.findRelationship(userID); rel != nil {
+		if rel.Type == discordgo.RelationshipBlocked {
+			ce.Reply("%s is already blocked", formatRelationshipUser(rel))
+			return
+		}
+		userID = rel.ID
+		name = formatRelationshipUser(rel)
+	}
+	if err := ce.User.blockDiscordUser(userID); err != nil {
+		ce.Reply("Failed to block %s: %v", name, err)
+	} else {
+		ce.Reply("Blocked %s", name)
+	}
+}
+
+func fnFriendNickname(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage**: `$cmdprefix friends nick <user> [nickname]`")
+		return
+	}
+	rel := ce.User.findRelationship(ce.Args[0])
+	if rel == nil || rel.Type != discordgo.RelationshipFriend {
+		ce.Reply("User `%s` is not your friend", ce.Args[0])
+		return
+	}
+	nickname := strings.Join(ce.Args[1:], " ")
+	if err := ce.User.setFriendNickname(rel.ID, nickname); err != nil {
+		ce.Reply("Failed to set nickname: %v", err)
+	} else if nickname == "" {
+		ce.Reply("Cleared nickname of %s", formatRelationshipUser(rel))
+	} else {
+		ce.Reply("Set nickname of %s to %s", formatRelationshipUser(rel), nickname)
+	}
+}
+
+func describeRelationshipType(relType discordgo.RelationshipType) string {
+	switch relType {
+	case discordgo.RelationshipFriend:
+		return "they're already your friend"
+	case discordgo.RelationshipBlocked:
+		return "they're blocked"
+	case discordgo.RelationshipIncomingRequest:
+		return "they have a pending friend request to you"
+	case discordgo.RelationshipOutgoingRequest:
+		return "you have a pending friend request to them"
+	default:
+		return fmt.Sprintf("unknown relationship type %d", relType)
+	}
+}
@@ -19,8 +19,10 @@ package config
 import (
 	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 
@@ -35,6 +37,9 @@ type BridgeConfig struct {
 	PrivateChatPortalMeta     string `yaml:"private_chat_portal_meta"`
 	PrivateChannelCreateLimit int    `yaml:"startup_private_channel_create_limit"`
 
+	EmbedTemplate       string            `yaml:"embed_template"`
+	GuildEmbedTemplates map[string]string `yaml:"guild_embed_templates"`
+
 	PortalMessageBuffer int `yaml:"portal_message_buffer"`
 
 	PublicAddress  string `yaml:"public_address"`
@@ -46,6 +51,7 @@ type BridgeConfig struct {
 	RestrictedRooms             bool `yaml:"restricted_rooms"`
 	AutojoinThreadOnOpen        bool `yaml:"autojoin_thread_on_open"`
 	EmbedFieldsAsTables         bool `yaml:"embed_fields_as_tables"`
+	EmbedJSON                   bool `yaml:"embed_json"`
 	MuteChannelsOnCreate        bool `yaml:"mute_channels_on_create"`
 	SyncDirectChatList          bool `yaml:"sync_direct_chat_list"`
 	ResendBridgeInfo            bool `yaml:"resend_bridge_info"`
@@ -57,11 +63,24 @@ type BridgeConfig struct {
 	EnableWebhookAvatars        bool `yaml:"enable_webhook_avatars"`
 	UseDiscordCDNUpload         bool `yaml:"use_discord_cdn_upload"`
 	ForbidDMingStrangers        bool `yaml:"forbid_dming_strangers"`
+	LinkPreviewEmbeds           bool `yaml:"link_preview_embeds"`
+	RichContentEmbeds           bool `yaml:"rich_content_embeds"`
+
+	MediaBatchWindowMS int `yaml:"media_batch_window_ms"`
+
+	ViewingTimeoutSeconds int `yaml:"viewing_timeout_seconds"`
 
 	Proxy string `yaml:"proxy"`
 
-	CacheMedia  string      `yaml:"cache_media"`
-	DirectMedia DirectMedia `yaml:"direct_media"`
+	CacheMedia   string       `yaml:"cache_media"`
+	MediaCacheGC MediaCacheGC `yaml:"media_cache_gc"`
+	DirectMedia  DirectMedia  `yaml:"direct_media"`
+
+	NotificationSync NotificationSync `yaml:"notification_sync"`
+
+	Connection ConnectionConfig `yaml:"connection"`
+
+	ApplicationCommands ApplicationCommandsConfig `yaml:"application_commands"`
 
 	AnimatedSticker struct {
 		Target string `yaml:"target"`
@@ -82,7 +101,14 @@ type BridgeConfig struct {
 			Initial BackfillLimitPart `yaml:"initial"`
 			Missed  BackfillLimitPart `yaml:"missed"`
 		} `yaml:"forward_limits"`
-		MaxGuildMembers int `yaml:"max_guild_members"`
+		MaxGuildMembers  int  `yaml:"max_guild_members"`
+		CheckMissedEdits bool `yaml:"check_missed_edits"`
+		Reactions        bool `yaml:"reactions"`
+		RecurseThreads   int  `yaml:"recurse_threads"`
+		Reconcile        struct {
+			Limits            BackfillLimitPart `yaml:"limits"`
+			RequestIntervalMS int               `yaml:"request_interval_ms"`
+		} `yaml:"reconcile"`
 	} `yaml:"backfill"`
 
 	Encryption bridgeconfig.EncryptionConfig `yaml:"encryption"`
@@ -99,6 +125,34 @@ type BridgeConfig struct {
 	displaynameTemplate *template.Template `yaml:"-"`
 	channelNameTemplate *template.Template `yaml:"-"`
 	guildNameTemplate   *template.Template `yaml:"-"`
+
+	embedTemplate       *htmltemplate.Template            `yaml:"-"`
+	guildEmbedTemplates map[string]*htmltemplate.Template `yaml:"-"`
+}
+
+type ConnectionConfig struct {
+	MinBackoffSeconds       int `yaml:"min_backoff_seconds"`
+	MaxBackoffSeconds       int `yaml:"max_backoff_seconds"`
+	HeartbeatTimeoutSeconds int `yaml:"heartbeat_timeout_seconds"`
+	DispatchTimeoutSeconds  int `yaml:"dispatch_timeout_seconds"`
+	MaxConcurrentConnects   int `yaml:"max_concurrent_connects"`
+}
+
+type ApplicationCommandsConfig struct {
+	File               string `yaml:"file"`
+	BridgeInteractions bool   `yaml:"bridge_interactions"`
+}
+
+type NotificationSync struct {
+	Enabled             bool `yaml:"enabled"`
+	PollIntervalSeconds int  `yaml:"poll_interval_seconds"`
+}
+
+type MediaCacheGC struct {
+	MaxAgeDays           int  `yaml:"max_age_days"`
+	MaxSizeMB            int  `yaml:"max_size_mb"`
+	IntervalMinutes      int  `yaml:"interval_minutes"`
+	DeleteFromHomeserver bool `yaml:"delete_from_homeserver"`
 }
 
 type DirectMedia struct {
@@ -107,6 +161,8 @@ type DirectMedia struct {
 	WellKnownResponse string `yaml:"well_known_response"`
 	AllowProxy        bool   `yaml:"allow_proxy"`
 	ServerKey         string `yaml:"server_key"`
+
+	ThumbnailCacheSize int `yaml:"thumbnail_cache_size"`
 }
 
 type BackfillLimitPart struct {
@@ -171,6 +227,19 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	if bc.EmbedTemplate != "" {
+		bc.embedTemplate, err = htmltemplate.New("embed").Parse(bc.EmbedTemplate)
+		if err != nil {
+			return err
+		}
+	}
+	bc.guildEmbedTemplates = make(map[string]*htmltemplate.Template, len(bc.GuildEmbedTemplates))
+	for guildID, tpl := range bc.GuildEmbedTemplates {
+		bc.guildEmbedTemplates[guildID], err = htmltemplate.New("embed_" + guildID).Parse(tpl)
+		if err != nil {
+			return fmt.Errorf("failed to parse embed template for guild %s: %w", guildID, err)
+		}
+	}
 
 	return nil
 }
@@ -238,3 +307,45 @@ func (bc BridgeConfig) FormatGuildName(params GuildNameParams) string {
 	_ = bc.guildNameTemplate.Execute(&buffer, params)
 	return buffer.String()
 }
+
+type EmbedFieldParams struct {
+	Name   htmltemplate.HTML
+	Value  htmltemplate.HTML
+	Inline bool
+}
+
+type EmbedParams struct {
+	// Embed is the raw embed object from Discord.
+	Embed *discordgo.MessageEmbed
+	// Title, Description and the field names and values are rendered from Discord markdown into HTML.
+	Title       htmltemplate.HTML
+	Description htmltemplate.HTML
+	Fields      []EmbedFieldParams
+	// AuthorIcon, Image and FooterIcon are mxc:// URIs, or empty if the embed doesn't have the image.
+	AuthorIcon htmltemplate.URL
+	Image      htmltemplate.URL
+	FooterIcon htmltemplate.URL
+	// Color is the embed color as a hex code like #5865F2, or empty if the embed doesn't have a color.
+	Color     string
+	Timestamp time.Time
+}
+
+// HasEmbedTemplate checks whether a custom embed template is configured for the given guild.
+func (bc BridgeConfig) HasEmbedTemplate(guildID string) bool {
+	_, hasGuildTemplate := bc.guildEmbedTemplates[guildID]
+	return hasGuildTemplate || bc.embedTemplate != nil
+}
+
+// FormatEmbed renders an embed with the guild's custom template, or the global custom template if the guild doesn't have one.
+func (bc BridgeConfig) FormatEmbed(guildID string, params *EmbedParams) (string, error) {
+	tpl, ok := bc.guildEmbedTemplates[guildID]
+	if !ok {
+		tpl = bc.embedTemplate
+	}
+	if tpl == nil {
+		return "", fmt.Errorf("no embed template configured")
+	}
+	var buffer strings.Builder
+	err := tpl.Execute(&buffer, params)
+	return buffer.String(), err
+}
@@ -0,0 +1,135 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+var ErrUnknownOverrideKey = errors.New("unknown or non-overridable config key")
+
+// overridableFields contains the subset of BridgeConfig that can be overridden per guild or per portal.
+// The keys are the same dotted paths that are used in the config file (relative to the bridge section).
+var overridableFields = map[string]func(bc *BridgeConfig) any{
+	"embed_fields_as_tables":          func(bc *BridgeConfig) any { return &bc.EmbedFieldsAsTables },
+	"embed_json":                      func(bc *BridgeConfig) any { return &bc.EmbedJSON },
+	"mute_channels_on_create":         func(bc *BridgeConfig) any { return &bc.MuteChannelsOnCreate },
+	"prefix_webhook_messages":         func(bc *BridgeConfig) any { return &bc.PrefixWebhookMessages },
+	"custom_emoji_reactions":          func(bc *BridgeConfig) any { return &bc.CustomEmojiReactions },
+	"delete_portal_on_channel_delete": func(bc *BridgeConfig) any { return &bc.DeletePortalOnChannelDelete },
+
+	"backfill.forward_limits.initial.dm":      func(bc *BridgeConfig) any { return &bc.Backfill.Limits.Initial.DM },
+	"backfill.forward_limits.initial.channel": func(bc *BridgeConfig) any { return &bc.Backfill.Limits.Initial.Channel },
+	"backfill.forward_limits.initial.thread":  func(bc *BridgeConfig) any { return &bc.Backfill.Limits.Initial.Thread },
+	"backfill.forward_limits.missed.dm":       func(bc *BridgeConfig) any { return &bc.Backfill.Limits.Missed.DM },
+	"backfill.forward_limits.missed.channel":  func(bc *BridgeConfig) any { return &bc.Backfill.Limits.Missed.Channel },
+	"backfill.forward_limits.missed.thread":   func(bc *BridgeConfig) any { return &bc.Backfill.Limits.Missed.Thread },
+	"backfill.reactions":                      func(bc *BridgeConfig) any { return &bc.Backfill.Reactions },
+	"backfill.recurse_threads":                func(bc *BridgeConfig) any { return &bc.Backfill.RecurseThreads },
+	"backfill.reconcile.limits.dm":            func(bc *BridgeConfig) any { return &bc.Backfill.Reconcile.Limits.DM },
+	"backfill.reconcile.limits.channel":       func(bc *BridgeConfig) any { return &bc.Backfill.Reconcile.Limits.Channel },
+	"backfill.reconcile.limits.thread":        func(bc *BridgeConfig) any { return &bc.Backfill.Reconcile.Limits.Thread },
+}
+
+// OverridableKeys returns the sorted list of config keys that can be overridden per guild or per portal.
+func OverridableKeys() []string {
+	keys := make([]string, 0, len(overridableFields))
+	for key := range overridableFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// IsOverridable checks whether the given config key can be overridden per guild or per portal.
+func IsOverridable(key string) bool {
+	_, ok := overridableFields[key]
+	return ok
+}
+
+func setOverride(field any, value string) error {
+	switch typedField := field.(type) {
+	case *bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected a boolean, got %q", value)
+		}
+		*typedField = parsed
+	case *int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		*typedField = parsed
+	default:
+		panic(fmt.Errorf("unsupported overridable field type %T", field))
+	}
+	return nil
+}
+
+func formatOverride(field any) string {
+	switch typedField := field.(type) {
+	case *bool:
+		return strconv.FormatBool(*typedField)
+	case *int:
+		return strconv.Itoa(*typedField)
+	default:
+		panic(fmt.Errorf("unsupported overridable field type %T", field))
+	}
+}
+
+// NormalizeOverride checks that the given key can be overridden and that the value is valid for it,
+// and returns the value in the canonical form that should be stored in the database.
+func NormalizeOverride(key, value string) (string, error) {
+	getField, ok := overridableFields[key]
+	if !ok {
+		return "", ErrUnknownOverrideKey
+	}
+	var bc BridgeConfig
+	field := getField(&bc)
+	if err := setOverride(field, value); err != nil {
+		return "", err
+	}
+	return formatOverride(field), nil
+}
+
+// GetOverridable returns the current value of an overridable key formatted as a string.
+func (bc *BridgeConfig) GetOverridable(key string) (string, error) {
+	getField, ok := overridableFields[key]
+	if !ok {
+		return "", ErrUnknownOverrideKey
+	}
+	return formatOverride(getField(bc)), nil
+}
+
+// WithOverrides returns a shallow copy of the config with the given override layers applied in order.
+// Unknown keys and invalid values are ignored, as they're already validated before being stored.
+func (bc *BridgeConfig) WithOverrides(layers ...map[string]string) *BridgeConfig {
+	cfg := *bc
+	for _, layer := range layers {
+		for key, value := range layer {
+			getField, ok := overridableFields[key]
+			if ok {
+				_ = setOverride(getField(&cfg), value)
+			}
+		}
+	}
+	return &cfg
+}
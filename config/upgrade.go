@@ -30,6 +30,8 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str, "bridge", "displayname_template")
 	helper.Copy(up.Str, "bridge", "channel_name_template")
 	helper.Copy(up.Str, "bridge", "guild_name_template")
+	helper.Copy(up.Str|up.Null, "bridge", "embed_template")
+	helper.Copy(up.Map, "bridge", "guild_embed_templates")
 	if legacyPrivateChatPortalMeta, ok := helper.Get(up.Bool, "bridge", "private_chat_portal_meta"); ok {
 		updatedPrivateChatPortalMeta := "default"
 		if legacyPrivateChatPortalMeta == "true" {
@@ -53,6 +55,7 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "restricted_rooms")
 	helper.Copy(up.Bool, "bridge", "autojoin_thread_on_open")
 	helper.Copy(up.Bool, "bridge", "embed_fields_as_tables")
+	helper.Copy(up.Bool, "bridge", "embed_json")
 	helper.Copy(up.Bool, "bridge", "mute_channels_on_create")
 	helper.Copy(up.Bool, "bridge", "sync_direct_chat_list")
 	helper.Copy(up.Bool, "bridge", "resend_bridge_info")
@@ -64,12 +67,30 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "enable_webhook_avatars")
 	helper.Copy(up.Bool, "bridge", "use_discord_cdn_upload")
 	helper.Copy(up.Bool, "bridge", "forbid_dming_strangers")
+	helper.Copy(up.Bool, "bridge", "link_preview_embeds")
+	helper.Copy(up.Bool, "bridge", "rich_content_embeds")
+	helper.Copy(up.Int, "bridge", "media_batch_window_ms")
+	helper.Copy(up.Int, "bridge", "viewing_timeout_seconds")
 	helper.Copy(up.Str|up.Null, "bridge", "proxy")
+	helper.Copy(up.Int, "bridge", "connection", "min_backoff_seconds")
+	helper.Copy(up.Int, "bridge", "connection", "max_backoff_seconds")
+	helper.Copy(up.Int, "bridge", "connection", "heartbeat_timeout_seconds")
+	helper.Copy(up.Int, "bridge", "connection", "dispatch_timeout_seconds")
+	helper.Copy(up.Int, "bridge", "connection", "max_concurrent_connects")
+	helper.Copy(up.Str|up.Null, "bridge", "application_commands", "file")
+	helper.Copy(up.Bool, "bridge", "application_commands", "bridge_interactions")
 	helper.Copy(up.Str, "bridge", "cache_media")
+	helper.Copy(up.Int, "bridge", "media_cache_gc", "max_age_days")
+	helper.Copy(up.Int, "bridge", "media_cache_gc", "max_size_mb")
+	helper.Copy(up.Int, "bridge", "media_cache_gc", "interval_minutes")
+	helper.Copy(up.Bool, "bridge", "media_cache_gc", "delete_from_homeserver")
+	helper.Copy(up.Bool, "bridge", "notification_sync", "enabled")
+	helper.Copy(up.Int, "bridge", "notification_sync", "poll_interval_seconds")
 	helper.Copy(up.Bool, "bridge", "direct_media", "enabled")
 	helper.Copy(up.Str, "bridge", "direct_media", "server_name")
 	helper.Copy(up.Str|up.Null, "bridge", "direct_media", "well_known_response")
 	helper.Copy(up.Bool, "bridge", "direct_media", "allow_proxy")
+	helper.Copy(up.Int, "bridge", "direct_media", "thumbnail_cache_size")
 	if serverKey, ok := helper.Get(up.Str, "bridge", "direct_media", "server_key"); !ok || serverKey == "generate" {
 		serverKey = federation.GenerateSigningKey().SynapseString()
 		helper.Set(up.Str, serverKey, "bridge", "direct_media", "server_key")
@@ -96,6 +117,13 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Int, "bridge", "backfill", "forward_limits", "missed", "channel")
 	helper.Copy(up.Int, "bridge", "backfill", "forward_limits", "missed", "thread")
 	helper.Copy(up.Int, "bridge", "backfill", "max_guild_members")
+	helper.Copy(up.Bool, "bridge", "backfill", "check_missed_edits")
+	helper.Copy(up.Bool, "bridge", "backfill", "reactions")
+	helper.Copy(up.Int, "bridge", "backfill", "recurse_threads")
+	helper.Copy(up.Int, "bridge", "backfill", "reconcile", "limits", "dm")
+	helper.Copy(up.Int, "bridge", "backfill", "reconcile", "limits", "channel")
+	helper.Copy(up.Int, "bridge", "backfill", "reconcile", "limits", "thread")
+	helper.Copy(up.Int, "bridge", "backfill", "reconcile", "request_interval_ms")
 	helper.Copy(up.Bool, "bridge", "encryption", "allow")
 	helper.Copy(up.Bool, "bridge", "encryption", "default")
 	helper.Copy(up.Bool, "bridge", "encryption", "require")
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+// configOverrideCache holds the config overrides of a single guild or portal.
+// The map is never mutated after being stored, so readers can use it without holding the lock.
+type configOverrideCache struct {
+	values map[string]string
+	lock   sync.RWMutex
+}
+
+func (coc *configOverrideCache) get(load func() map[string]string) map[string]string {
+	coc.lock.RLock()
+	values := coc.values
+	coc.lock.RUnlock()
+	if values != nil {
+		return values
+	}
+	coc.lock.Lock()
+	defer coc.lock.Unlock()
+	if coc.values == nil {
+		coc.values = load()
+	}
+	return coc.values
+}
+
+func (coc *configOverrideCache) update(load func() map[string]string, fn func(values map[string]string)) {
+	coc.lock.Lock()
+	defer coc.lock.Unlock()
+	if coc.values == nil {
+		coc.values = load()
+	}
+	values := maps.Clone(coc.values)
+	fn(values)
+	coc.values = values
+}
+
+func (guild *Guild) loadConfigOverrides() map[string]string {
+	return guild.bridge.DB.ConfigOverride.GetForGuild(guild.ID)
+}
+
+func (guild *Guild) GetConfigOverrides() map[string]string {
+	return guild.configOverrides.get(guild.loadConfigOverrides)
+}
+
+func (guild *Guild) SetConfigOverride(key, value string) (string, error) {
+	normalized, err := config.NormalizeOverride(key, value)
+	if err != nil {
+		return "", err
+	}
+	guild.configOverrides.update(guild.loadConfigOverrides, func(values map[string]string) {
+		guild.bridge.DB.ConfigOverride.SetForGuild(guild.ID, key, normalized)
+		values[key] = normalized
+	})
+	return normalized, nil
+}
+
+func (guild *Guild) UnsetConfigOverride(key string) (existed bool) {
+	guild.configOverrides.update(guild.loadConfigOverrides, func(values map[string]string) {
+		if _, existed = values[key]; existed {
+			guild.bridge.DB.ConfigOverride.DeleteForGuild(guild.ID, key)
+			delete(values, key)
+		}
+	})
+	return
+}
+
+// BridgeConfig returns the bridge config with the guild's overrides applied.
+func (guild *Guild) BridgeConfig() *config.BridgeConfig {
+	overrides := guild.GetConfigOverrides()
+	if len(overrides) == 0 {
+		return &guild.bridge.Config.Bridge
+	}
+	return guild.bridge.Config.Bridge.WithOverrides(overrides)
+}
+
+// CanManageConfig checks whether the given user is allowed to change config overrides of the guild.
+// The overrides affect every user of the guild, so only bridge admins and members with the Manage Server
+// or Administrator permission on Discord can change them.
+func (guild *Guild) CanManageConfig(user *User) bool {
+	if user.PermissionLevel >= bridgeconfig.PermissionLevelAdmin {
+		return true
+	} else if !user.IsLoggedIn() || user.Session == nil {
+		return false
+	}
+	meta, err := user.Session.State.Guild(guild.ID)
+	if err != nil {
+		return false
+	} else if meta.OwnerID == user.DiscordID {
+		return true
+	}
+	member, err := user.Session.State.Member(guild.ID, user.DiscordID)
+	if errors.Is(err, discordgo.ErrStateNotFound) {
+		member, err = user.Session.GuildMember(guild.ID, user.DiscordID)
+	}
+	if err != nil {
+		user.log.Warn().Err(err).Str("guild_id", guild.ID).Msg("Failed to get own membership to check guild permissions")
+		return false
+	}
+	var perms int64
+	for _, role := range meta.Roles {
+		// The @everyone role has the same ID as the guild
+		if role.ID == guild.ID || slices.Contains(member.Roles, role.ID) {
+			perms |= role.Permissions
+		}
+	}
+	return perms&(discordgo.PermissionAdministrator|discordgo.PermissionManageGuild) != 0
+}
+
+func (portal *Portal) loadConfigOverrides() map[string]string {
+	return portal.bridge.DB.ConfigOverride.GetForPortal(portal.Key)
+}
+
+func (portal *Portal) GetConfigOverrides() map[string]string {
+	return portal.configOverrides.get(portal.loadConfigOverrides)
+}
+
+func (portal *Portal) SetConfigOverride(key, value string) (string, error) {
+	normalized, err := config.NormalizeOverride(key, value)
+	if err != nil {
+		return "", err
+	}
+	portal.configOverrides.update(portal.loadConfigOverrides, func(values map[string]string) {
+		portal.bridge.DB.ConfigOverride.SetForPortal(portal.Key, key, normalized)
+		values[key] = normalized
+	})
+	return normalized, nil
+}
+
+func (portal *Portal) UnsetConfigOverride(key string) (existed bool) {
+	portal.configOverrides.update(portal.loadConfigOverrides, func(values map[string]string) {
+		if _, existed = values[key]; existed {
+			portal.bridge.DB.ConfigOverride.DeleteForPortal(portal.Key, key)
+			delete(values, key)
+		}
+	})
+	return
+}
+
+// BridgeConfig returns the bridge config with the overrides of the portal's guild and the portal itself applied.
+func (portal *Portal) BridgeConfig() *config.BridgeConfig {
+	var guildOverrides map[string]string
+	if portal.Guild != nil {
+		guildOverrides = portal.Guild.GetConfigOverrides()
+	}
+	portalOverrides := portal.GetConfigOverrides()
+	if len(guildOverrides) == 0 && len(portalOverrides) == 0 {
+		return &portal.bridge.Config.Bridge
+	}
+	return portal.bridge.Config.Bridge.WithOverrides(guildOverrides, portalOverrides)
+}
+
+// CanManageConfig checks whether the given user is allowed to change config overrides of the portal.
+func (portal *Portal) CanManageConfig(user *User) (bool, error) {
+	return portal.isModerator(user)
+}
+
+// isModerator checks whether the given user is a bridge admin or has the moderator power level in the portal room.
+func (portal *Portal) isModerator(user *User) (bool, error) {
+	if user.PermissionLevel >= bridgeconfig.PermissionLevelAdmin {
+		return true, nil
+	} else if portal.MXID == "" {
+		return false, nil
+	}
+	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		return false, err
+	}
+	return levels.GetUserLevel(user.MXID) >= levels.GetEventLevel(roomModerator), nil
+}
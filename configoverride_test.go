@@ -0,0 +1,57 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestGuildCanManageConfig(t *testing.T) {
+	state := discordgo.NewState()
+	require.NoError(t, state.GuildAdd(&discordgo.Guild{
+		ID:      "1",
+		OwnerID: "100",
+		Roles: []*discordgo.Role{
+			{ID: "1", Permissions: discordgo.PermissionViewChannel},
+			{ID: "10", Permissions: discordgo.PermissionManageGuild},
+		},
+	}))
+	newUser := func(discordID string, roles ...string) *User {
+		require.NoError(t, state.MemberAdd(&discordgo.Member{GuildID: "1", User: &discordgo.User{ID: discordID}, Roles: roles}))
+		return &User{
+			User:    &database.User{DiscordID: discordID, DiscordToken: "token"},
+			log:     zerolog.Nop(),
+			Session: &discordgo.Session{State: state},
+		}
+	}
+	guild := &Guild{Guild: &database.Guild{ID: "1"}}
+
+	assert.True(t, guild.CanManageConfig(newUser("100")), "owner")
+	assert.True(t, guild.CanManageConfig(newUser("200", "10")), "manage server role")
+	assert.False(t, guild.CanManageConfig(newUser("300")), "normal member")
+	admin := newUser("400")
+	admin.PermissionLevel = bridgeconfig.PermissionLevelAdmin
+	assert.True(t, guild.CanManageConfig(admin), "bridge admin")
+}
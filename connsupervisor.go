@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridge/status"
+)
+
+const healthCheckInterval = 15 * time.Second
+
+// connectionSupervisor keeps a user's Discord gateway connection alive. It replaces the reconnection logic
+// built into discordgo with exponential backoff and jitter, and forces a reconnect when the connection
+// stops acknowledging heartbeats or goes silent without being closed.
+type connectionSupervisor struct {
+	user *User
+	log  zerolog.Logger
+
+	lock         sync.Mutex
+	session      *discordgo.Session
+	ctx          context.Context
+	cancel       context.CancelFunc
+	reconnecting bool
+	attempt      int
+
+	lastDispatch atomic.Int64
+}
+
+func newConnectionSupervisor(user *User) *connectionSupervisor {
+	return &connectionSupervisor{
+		user: user,
+		log:  user.log.With().Str("component", "connection supervisor").Logger(),
+	}
+}
+
+// backoff returns the delay before the given reconnection attempt (starting from 1).
+// The delay doubles after each attempt up to the configured maximum, minus up to 50% of random jitter.
+func (cs *connectionSupervisor) backoff(attempt int) time.Duration {
+	cfg := cs.user.bridge.Config.Bridge.Connection
+	return calculateBackoff(attempt, time.Duration(cfg.MinBackoffSeconds)*time.Second, time.Duration(cfg.MaxBackoffSeconds)*time.Second)
+}
+
+func calculateBackoff(attempt int, minDelay, maxDelay time.Duration) time.Duration {
+	if minDelay <= 0 {
+		minDelay = time.Second
+	}
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	delay := minDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// start begins supervising a freshly opened session.
+func (cs *connectionSupervisor) start(session *discordgo.Session) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.cancel != nil {
+		cs.cancel()
+	}
+	cs.ctx, cs.cancel = context.WithCancel(context.Background())
+	cs.session = session
+	cs.reconnecting = false
+	cs.attempt = 0
+	cs.markDispatch()
+	go cs.monitor(cs.ctx, session)
+}
+
+// stop must be called before intentionally closing the session, so that the disconnect isn't treated as an error.
+func (cs *connectionSupervisor) stop() {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.cancel != nil {
+		cs.cancel()
+		cs.cancel = nil
+	}
+	cs.session = nil
+	cs.reconnecting = false
+}
+
+// healthy returns true if the session is open and not currently being reconnected.
+func (cs *connectionSupervisor) healthy() bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.session != nil && !cs.reconnecting
+}
+
+func (cs *connectionSupervisor) markDispatch() {
+	cs.lastDispatch.Store(time.Now().UnixMilli())
+}
+
+// handleDisconnect is called when the gateway connection closes. Unless the close was intentional,
+// the session is reopened with backoff.
+func (cs *connectionSupervisor) handleDisconnect() {
+	cs.lock.Lock()
+	session := cs.session
+	if session == nil || cs.reconnecting {
+		cs.lock.Unlock()
+		return
+	}
+	cs.reconnecting = true
+	ctx := cs.ctx
+	cs.lock.Unlock()
+	cs.reconnect(ctx, session, "dc-transient-disconnect", "Disconnected from Discord")
+}
+
+// forceReconnect closes a connection that is open but unhealthy and reopens it.
+func (cs *connectionSupervisor) forceReconnect(session *discordgo.Session, errCode status.BridgeStateErrorCode, reason string) {
+	cs.lock.Lock()
+	if cs.session != session || cs.reconnecting {
+		cs.lock.Unlock()
+		return
+	}
+	cs.reconnecting = true
+	ctx := cs.ctx
+	cs.lock.Unlock()
+	cs.log.Warn().Str("reason", reason).Msg("Gateway connection is unhealthy, reconnecting")
+	// Closing with a non-1000 code keeps the gateway session resumable
+	err := session.CloseWithCode(websocket.CloseServiceRestart)
+	if err != nil {
+		cs.log.Warn().Err(err).Msg("Error closing unhealthy gateway connection")
+	}
+	cs.reconnect(ctx, session, errCode, reason)
+}
+
+func (cs *connectionSupervisor) reconnect(ctx context.Context, session *discordgo.Session, errCode status.BridgeStateErrorCode, reason string) {
+	for {
+		cs.lock.Lock()
+		cs.attempt++
+		attempt := cs.attempt
+		cs.lock.Unlock()
+		delay := cs.backoff(attempt)
+		cs.sendRetryState(errCode, reason, attempt, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		err := cs.user.bridge.acquireConnectSlot(ctx)
+		if err != nil {
+			return
+		}
+		cs.log.Debug().Int("attempt", attempt).Msg("Reopening gateway connection")
+		err = session.Open()
+		cs.user.bridge.releaseConnectSlot()
+		if err == nil || errors.Is(err, discordgo.ErrWSAlreadyOpen) {
+			cs.lock.Lock()
+			if cs.session == session {
+				cs.reconnecting = false
+				cs.attempt = 0
+			}
+			cs.lock.Unlock()
+			cs.markDispatch()
+			cs.log.Info().Int("attempt", attempt).Msg("Reconnected to Discord")
+			return
+		} else if isInvalidAuthError(err) {
+			cs.user.invalidAuthHandler(nil)
+			return
+		}
+		cs.log.Warn().Err(err).Int("attempt", attempt).Msg("Failed to reconnect to Discord")
+		errCode, reason = "dc-reconnect-failed", err.Error()
+	}
+}
+
+func (cs *connectionSupervisor) sendRetryState(errCode status.BridgeStateErrorCode, reason string, attempt int, delay time.Duration) {
+	retryAt := time.Now().Add(delay)
+	cs.user.BridgeState.Send(status.BridgeState{
+		StateEvent: status.StateTransientDisconnect,
+		Error:      errCode,
+		Message:    fmt.Sprintf("%s, reconnecting in %d seconds", reason, int(delay.Round(time.Second).Seconds())),
+		Info: map[string]interface{}{
+			"attempt":  attempt,
+			"retry_in": delay.Milliseconds(),
+			"retry_at": retryAt.UnixMilli(),
+		},
+	})
+}
+
+func (cs *connectionSupervisor) monitor(ctx context.Context, session *discordgo.Session) {
+	cfg := cs.user.bridge.Config.Bridge.Connection
+	heartbeatTimeout := time.Duration(cfg.HeartbeatTimeoutSeconds) * time.Second
+	dispatchTimeout := time.Duration(cfg.DispatchTimeoutSeconds) * time.Second
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cs.lock.Lock()
+		reconnecting := cs.reconnecting
+		cs.lock.Unlock()
+		if reconnecting {
+			continue
+		}
+		session.RLock()
+		lastAck, lastSent := session.LastHeartbeatAck, session.LastHeartbeatSent
+		session.RUnlock()
+		sinceDispatch := time.Since(time.UnixMilli(cs.lastDispatch.Load()))
+		if heartbeatTimeout > 0 && lastSent.After(lastAck) && time.Since(lastAck) > heartbeatTimeout {
+			go cs.forceReconnect(session, "dc-heartbeat-timeout", fmt.Sprintf("No heartbeat acknowledgement from Discord in %s", time.Since(lastAck).Round(time.Second)))
+		} else if dispatchTimeout > 0 && sinceDispatch > dispatchTimeout {
+			go cs.forceReconnect(session, "dc-dispatch-timeout", fmt.Sprintf("No events received from Discord in %s", sinceDispatch.Round(time.Second)))
+		}
+	}
+}
+
+// connectWithRetry makes the initial connection on startup, retrying with backoff until it succeeds
+// or the token turns out to be invalid.
+func (cs *connectionSupervisor) connectWithRetry() {
+	cs.user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
+	for attempt := 1; ; attempt++ {
+		err := cs.user.bridge.acquireConnectSlot(context.Background())
+		if err != nil {
+			return
+		}
+		err = cs.user.Connect()
+		cs.user.bridge.releaseConnectSlot()
+		if err == nil || errors.Is(err, ErrNotLoggedIn) {
+			return
+		}
+		cs.log.Error().Err(err).Int("attempt", attempt).Msg("Error connecting on startup")
+		if isInvalidAuthError(err) {
+			cs.user.invalidAuthHandler(nil)
+			return
+		}
+		delay := cs.backoff(attempt)
+		cs.sendRetryState("dc-unknown-websocket-error", err.Error(), attempt, delay)
+		time.Sleep(delay)
+		if !cs.user.IsLoggedIn() {
+			return
+		}
+	}
+}
+
+func isInvalidAuthError(err error) bool {
+	closeErr := &websocket.CloseError{}
+	return errors.As(err, &closeErr) && closeErr.Code == 4004
+}
+
+func (br *DiscordBridge) acquireConnectSlot(ctx context.Context) error {
+	return br.connectSemaphore.Acquire(ctx, 1)
+}
+
+func (br *DiscordBridge) releaseConnectSlot() {
+	br.connectSemaphore.Release(1)
+}
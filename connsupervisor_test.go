@@ -0,0 +1,40 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculateBackoff(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		delay := calculateBackoff(1, 2*time.Second, 300*time.Second)
+		assert.GreaterOrEqual(t, delay, 1*time.Second)
+		assert.LessOrEqual(t, delay, 2*time.Second)
+
+		delay = calculateBackoff(4, 2*time.Second, 300*time.Second)
+		assert.GreaterOrEqual(t, delay, 8*time.Second)
+		assert.LessOrEqual(t, delay, 16*time.Second)
+
+		delay = calculateBackoff(50, 2*time.Second, 300*time.Second)
+		assert.GreaterOrEqual(t, delay, 150*time.Second)
+		assert.LessOrEqual(t, delay, 300*time.Second)
+	}
+}
@@ -53,6 +53,9 @@ func (puppet *Puppet) StartCustomMXID(reloginOnFail bool) error {
 func (user *User) tryAutomaticDoublePuppeting() {
 	if !user.bridge.Config.CanAutoDoublePuppet(user.MXID) {
 		return
+	} else if user.Account != "" {
+		// Double puppets are looked up by Matrix user ID, so only the Discord puppet of the default account can have one
+		return
 	}
 	user.log.Debug().Msg("Checking if double puppeting needs to be enabled")
 	puppet := user.bridge.GetPuppetByID(user.DiscordID)
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+type AttachmentURLCacheQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// language=postgresql
+const (
+	attachmentURLCacheSelect = "SELECT url, expiry FROM attachment_url_cache WHERE channel_id=$1 AND attachment_id=$2"
+	attachmentURLCacheUpsert = `
+		INSERT INTO attachment_url_cache (channel_id, attachment_id, url, expiry) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (channel_id, attachment_id) DO UPDATE SET url=excluded.url, expiry=excluded.expiry
+	`
+	attachmentURLCacheDeleteExpired = "DELETE FROM attachment_url_cache WHERE expiry<$1"
+)
+
+type AttachmentURLCacheEntry struct {
+	URL    string
+	Expiry time.Time
+}
+
+func (aq *AttachmentURLCacheQuery) Get(channelID, attachmentID uint64) *AttachmentURLCacheEntry {
+	var entry AttachmentURLCacheEntry
+	var expiry int64
+	err := aq.db.QueryRow(attachmentURLCacheSelect, int64(channelID), int64(attachmentID)).Scan(&entry.URL, &expiry)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			aq.log.Errorln("Database scan failed:", err)
+			panic(err)
+		}
+		return nil
+	}
+	entry.Expiry = time.UnixMilli(expiry)
+	return &entry
+}
+
+func (aq *AttachmentURLCacheQuery) Put(channelID, attachmentID uint64, url string, expiry time.Time) {
+	_, err := aq.db.Exec(attachmentURLCacheUpsert, int64(channelID), int64(attachmentID), url, expiry.UnixMilli())
+	if err != nil {
+		aq.log.Warnfln("Failed to cache URL of attachment %d in %d: %v", attachmentID, channelID, err)
+		panic(err)
+	}
+}
+
+// DeleteExpired deletes all entries that expire before the given time and returns the number of deleted entries.
+func (aq *AttachmentURLCacheQuery) DeleteExpired(before time.Time) int64 {
+	res, err := aq.db.Exec(attachmentURLCacheDeleteExpired, before.UnixMilli())
+	if err != nil {
+		aq.log.Warnln("Failed to delete expired attachment URLs:", err)
+		panic(err)
+	}
+	deleted, _ := res.RowsAffected()
+	return deleted
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	log "maunium.net/go/maulogger/v2"
+)
+
+type ConfigOverrideQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// language=postgresql
+const (
+	guildConfigOverrideSelect = "SELECT key, value FROM guild_config_override WHERE dc_guild_id=$1"
+	guildConfigOverrideUpsert = `
+		INSERT INTO guild_config_override (dc_guild_id, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (dc_guild_id, key) DO UPDATE SET value=excluded.value
+	`
+	guildConfigOverrideDelete = "DELETE FROM guild_config_override WHERE dc_guild_id=$1 AND key=$2"
+
+	portalConfigOverrideSelect = "SELECT key, value FROM portal_config_override WHERE dc_chan_id=$1 AND dc_chan_receiver=$2"
+	portalConfigOverrideUpsert = `
+		INSERT INTO portal_config_override (dc_chan_id, dc_chan_receiver, key, value) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (dc_chan_id, dc_chan_receiver, key) DO UPDATE SET value=excluded.value
+	`
+	portalConfigOverrideDelete = "DELETE FROM portal_config_override WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND key=$3"
+)
+
+func (cq *ConfigOverrideQuery) getAll(query string, args ...any) map[string]string {
+	rows, err := cq.db.Query(query, args...)
+	if err != nil {
+		cq.log.Errorln("Failed to query config overrides:", err)
+		panic(err)
+	}
+	defer rows.Close()
+	overrides := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			cq.log.Errorln("Database scan failed:", err)
+			panic(err)
+		}
+		overrides[key] = value
+	}
+	return overrides
+}
+
+func (cq *ConfigOverrideQuery) GetForGuild(guildID string) map[string]string {
+	return cq.getAll(guildConfigOverrideSelect, guildID)
+}
+
+func (cq *ConfigOverrideQuery) GetForPortal(key PortalKey) map[string]string {
+	return cq.getAll(portalConfigOverrideSelect, key.ChannelID, key.Receiver)
+}
+
+func (cq *ConfigOverrideQuery) SetForGuild(guildID, key, value string) {
+	_, err := cq.db.Exec(guildConfigOverrideUpsert, guildID, key, value)
+	if err != nil {
+		cq.log.Warnfln("Failed to set %s for guild %s: %v", key, guildID, err)
+		panic(err)
+	}
+}
+
+func (cq *ConfigOverrideQuery) DeleteForGuild(guildID, key string) {
+	_, err := cq.db.Exec(guildConfigOverrideDelete, guildID, key)
+	if err != nil {
+		cq.log.Warnfln("Failed to delete %s for guild %s: %v", key, guildID, err)
+		panic(err)
+	}
+}
+
+func (cq *ConfigOverrideQuery) SetForPortal(portal PortalKey, key, value string) {
+	_, err := cq.db.Exec(portalConfigOverrideUpsert, portal.ChannelID, portal.Receiver, key, value)
+	if err != nil {
+		cq.log.Warnfln("Failed to set %s for portal %s: %v", key, portal, err)
+		panic(err)
+	}
+}
+
+func (cq *ConfigOverrideQuery) DeleteForPortal(portal PortalKey, key string) {
+	_, err := cq.db.Exec(portalConfigOverrideDelete, portal.ChannelID, portal.Receiver, key)
+	if err != nil {
+		cq.log.Warnfln("Failed to delete %s for portal %s: %v", key, portal, err)
+		panic(err)
+	}
+}
@@ -14,15 +14,20 @@ import (
 type Database struct {
 	*dbutil.Database
 
-	User     *UserQuery
-	Portal   *PortalQuery
-	Puppet   *PuppetQuery
-	Message  *MessageQuery
-	Thread   *ThreadQuery
-	Reaction *ReactionQuery
-	Guild    *GuildQuery
-	Role     *RoleQuery
-	File     *FileQuery
+	User        *UserQuery
+	Portal      *PortalQuery
+	Puppet      *PuppetQuery
+	Message     *MessageQuery
+	MessageEdit *MessageEditQuery
+	Thread      *ThreadQuery
+	Reaction    *ReactionQuery
+	Guild       *GuildQuery
+	Role        *RoleQuery
+	File        *FileQuery
+
+	AttachmentURLCache *AttachmentURLCacheQuery
+
+	ConfigOverride *ConfigOverrideQuery
 }
 
 func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
@@ -44,6 +49,10 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("Message"),
 	}
+	db.MessageEdit = &MessageEditQuery{
+		db:  db,
+		log: log.Sub("MessageEdit"),
+	}
 	db.Thread = &ThreadQuery{
 		db:  db,
 		log: log.Sub("Thread"),
@@ -64,6 +73,14 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("File"),
 	}
+	db.AttachmentURLCache = &AttachmentURLCacheQuery{
+		db:  db,
+		log: log.Sub("AttachmentURLCache"),
+	}
+	db.ConfigOverride = &ConfigOverrideQuery{
+		db:  db,
+		log: log.Sub("ConfigOverride"),
+	}
 	return db
 }
 
@@ -19,10 +19,17 @@ type FileQuery struct {
 
 // language=postgresql
 const (
-	fileSelect = "SELECT url, encrypted, mxc, id, emoji_name, size, width, height, mime_type, decryption_info, timestamp FROM discord_file"
+	fileSelect = `
+		SELECT url, encrypted, mxc, id, emoji_name, size, width, height, mime_type, decryption_info, timestamp,
+		       last_used, dc_chan_id, dc_guild_id
+		FROM discord_file
+	`
 	fileInsert = `
-		INSERT INTO discord_file (url, encrypted, mxc, id, emoji_name, size, width, height, mime_type, decryption_info, timestamp)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		INSERT INTO discord_file (
+			url, encrypted, mxc, id, emoji_name, size, width, height, mime_type, decryption_info, timestamp,
+			last_used, dc_chan_id, dc_guild_id
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 	`
 )
 
@@ -38,11 +45,68 @@ func (fq *FileQuery) Get(url string, encrypted bool) *File {
 	return fq.New().Scan(fq.db.QueryRow(query, url, encrypted))
 }
 
+func (fq *FileQuery) GetByMXC(mxc id.ContentURI) *File {
+	query := fileSelect + " WHERE mxc=$1 LIMIT 1"
+	return fq.New().Scan(fq.db.QueryRow(query, mxc.String()))
+}
+
 func (fq *FileQuery) GetEmojiByMXC(mxc id.ContentURI) *File {
 	query := fileSelect + " WHERE mxc=$1 AND emoji_name<>'' LIMIT 1"
 	return fq.New().Scan(fq.db.QueryRow(query, mxc.String()))
 }
 
+func (fq *FileQuery) getAll(query string, args ...any) (files []*File) {
+	rows, err := fq.db.Query(query, args...)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		files = append(files, fq.New().Scan(rows))
+	}
+	return
+}
+
+// Custom emojis are never removed from the media cache, as the mxc URIs are needed to bridge reactions back to Discord.
+// The queries below only return normal files for that reason.
+
+// GetLeastRecentlyUsed returns up to limit files ordered by when they were last used, oldest first.
+func (fq *FileQuery) GetLeastRecentlyUsed(limit int) []*File {
+	return fq.getAll(fileSelect+" WHERE COALESCE(emoji_name, '')='' ORDER BY last_used ASC LIMIT $1", limit)
+}
+
+func (fq *FileQuery) GetUnusedSince(before time.Time, limit int) []*File {
+	return fq.getAll(fileSelect+" WHERE last_used<$1 AND COALESCE(emoji_name, '')='' ORDER BY last_used ASC LIMIT $2", before.UnixMilli(), limit)
+}
+
+func (fq *FileQuery) GetAllByGuild(guildID string) []*File {
+	return fq.getAll(fileSelect+" WHERE dc_guild_id=$1 AND COALESCE(emoji_name, '')=''", guildID)
+}
+
+func (fq *FileQuery) GetAllByChannel(channelID string) []*File {
+	return fq.getAll(fileSelect+" WHERE dc_chan_id=$1 AND COALESCE(emoji_name, '')=''", channelID)
+}
+
+type FileStats struct {
+	Count      int
+	TotalSize  int64
+	OldestUsed time.Time
+}
+
+func (fq *FileQuery) GetStats() (stats FileStats) {
+	var oldest sql.NullInt64
+	err := fq.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0), MIN(last_used) FROM discord_file WHERE COALESCE(emoji_name, '')=''").
+		Scan(&stats.Count, &stats.TotalSize, &oldest)
+	if err != nil {
+		fq.log.Errorln("Failed to get media cache stats:", err)
+		panic(err)
+	}
+	if oldest.Valid {
+		stats.OldestUsed = time.UnixMilli(oldest.Int64).UTC()
+	}
+	return
+}
+
 type File struct {
 	db  *Database
 	log log.Logger
@@ -61,14 +125,22 @@ type File struct {
 
 	DecryptionInfo *attachment.EncryptedFile
 	Timestamp      time.Time
+	LastUsed       time.Time
+
+	// The channel and guild where the file was first bridged, if it was bridged as part of a message.
+	ChannelID string
+	GuildID   string
 }
 
 func (f *File) Scan(row dbutil.Scannable) *File {
-	var fileID, emojiName, decryptionInfo sql.NullString
+	var fileID, emojiName, decryptionInfo, channelID, guildID sql.NullString
 	var width, height sql.NullInt32
-	var timestamp int64
+	var timestamp, lastUsed int64
 	var mxc string
-	err := row.Scan(&f.URL, &f.Encrypted, &mxc, &fileID, &emojiName, &f.Size, &width, &height, &f.MimeType, &decryptionInfo, &timestamp)
+	err := row.Scan(
+		&f.URL, &f.Encrypted, &mxc, &fileID, &emojiName, &f.Size, &width, &height, &f.MimeType, &decryptionInfo, &timestamp,
+		&lastUsed, &channelID, &guildID,
+	)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			f.log.Errorln("Database scan failed:", err)
@@ -79,6 +151,9 @@ func (f *File) Scan(row dbutil.Scannable) *File {
 	f.ID = fileID.String
 	f.EmojiName = emojiName.String
 	f.Timestamp = time.UnixMilli(timestamp).UTC()
+	f.LastUsed = time.UnixMilli(lastUsed).UTC()
+	f.ChannelID = channelID.String
+	f.GuildID = guildID.String
 	f.Width = int(width.Int32)
 	f.Height = int(height.Int32)
 	f.MXC, err = id.ParseContentURI(mxc)
@@ -122,6 +197,7 @@ func (f *File) Insert(txn dbutil.Execable) {
 		f.URL, f.Encrypted, f.MXC.String(), strPtr(f.ID), strPtr(f.EmojiName), f.Size,
 		positiveIntToNullInt32(f.Width), positiveIntToNullInt32(f.Height), f.MimeType,
 		decryptionInfoStr, f.Timestamp.UnixMilli(),
+		f.Timestamp.UnixMilli(), strPtr(f.ChannelID), strPtr(f.GuildID),
 	)
 	if err != nil {
 		f.log.Warnfln("Failed to insert copied file %v: %v", f.MXC, err)
@@ -129,6 +205,16 @@ func (f *File) Insert(txn dbutil.Execable) {
 	}
 }
 
+// MarkUsed updates the last used timestamp of the file, which is used for garbage collecting the media cache.
+func (f *File) MarkUsed() {
+	f.LastUsed = time.Now().UTC()
+	_, err := f.db.Exec("UPDATE discord_file SET last_used=$1 WHERE url=$2 AND encrypted=$3", f.LastUsed.UnixMilli(), f.URL, f.Encrypted)
+	if err != nil {
+		f.log.Warnfln("Failed to update last used timestamp of copied file %v: %v", f.MXC, err)
+		panic(err)
+	}
+}
+
 func (f *File) Delete() {
 	_, err := f.db.Exec("DELETE FROM discord_file WHERE url=$1 AND encrypted=$2", f.URL, f.Encrypted)
 	if err != nil {
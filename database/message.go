@@ -69,11 +69,33 @@ func (mq *MessageQuery) GetLastInThread(key PortalKey, threadID string) *Message
 	return mq.New().Scan(mq.db.QueryRow(query, key.ChannelID, key.Receiver, threadID))
 }
 
+// GetLastNInThread returns all parts of the last n messages in the given thread (or the main channel if threadID is empty),
+// ordered from oldest to newest.
+func (mq *MessageQuery) GetLastNInThread(key PortalKey, threadID string, n int) []*Message {
+	query := messageSelect + `
+		WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dcid IN (
+			SELECT dcid FROM message
+			WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dc_thread_id=$3
+			GROUP BY dcid
+			ORDER BY MAX(timestamp) DESC
+			LIMIT $4
+		)
+		ORDER BY timestamp ASC, dc_attachment_id ASC
+	`
+	return mq.scanAll(mq.db.Query(query, key.ChannelID, key.Receiver, threadID, n))
+}
+
 func (mq *MessageQuery) GetLast(key PortalKey) *Message {
 	query := messageSelect + " WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 ORDER BY timestamp DESC LIMIT 1"
 	return mq.New().Scan(mq.db.QueryRow(query, key.ChannelID, key.Receiver))
 }
 
+// GetAll returns all message parts in the given portal, including threads, ordered from oldest to newest.
+func (mq *MessageQuery) GetAll(key PortalKey) []*Message {
+	query := messageSelect + " WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 ORDER BY timestamp ASC, dcid ASC, dc_attachment_id ASC"
+	return mq.scanAll(mq.db.Query(query, key.ChannelID, key.Receiver))
+}
+
 func (mq *MessageQuery) DeleteAll(key PortalKey) {
 	query := "DELETE FROM message WHERE dc_chan_id=$1 AND dc_chan_receiver=$2"
 	_, err := mq.db.Exec(query, key.ChannelID, key.Receiver)
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+)
+
+type MessageEditQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// language=postgresql
+const (
+	messageEditSelect = "SELECT dcid, dc_chan_id, dc_chan_receiver, dc_edit_timestamp, dc_sender, content, mxid FROM message_edit"
+	messageEditInsert = `
+		INSERT INTO message_edit (dcid, dc_chan_id, dc_chan_receiver, dc_edit_timestamp, dc_sender, content, mxid)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (dcid, dc_chan_id, dc_chan_receiver, dc_edit_timestamp) DO NOTHING
+	`
+	messageEditDeleteAll = "DELETE FROM message_edit WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dcid=$3"
+)
+
+func (meq *MessageEditQuery) New() *MessageEdit {
+	return &MessageEdit{
+		db:  meq.db,
+		log: meq.log,
+	}
+}
+
+// GetAllForMessage returns all stored edit revisions of the given message, oldest first.
+func (meq *MessageEditQuery) GetAllForMessage(key PortalKey, discordID string) []*MessageEdit {
+	query := messageEditSelect + " WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dcid=$3 ORDER BY dc_edit_timestamp ASC"
+	rows, err := meq.db.Query(query, key.ChannelID, key.Receiver, discordID)
+	if err != nil {
+		meq.log.Warnfln("Failed to query edits of %s@%s: %v", discordID, key, err)
+		panic(err)
+	}
+
+	var edits []*MessageEdit
+	for rows.Next() {
+		edit := meq.New().Scan(rows)
+		if edit != nil {
+			edits = append(edits, edit)
+		}
+	}
+	return edits
+}
+
+func (meq *MessageEditQuery) DeleteAllForMessage(key PortalKey, discordID string) {
+	_, err := meq.db.Exec(messageEditDeleteAll, key.ChannelID, key.Receiver, discordID)
+	if err != nil {
+		meq.log.Warnfln("Failed to delete edits of %s@%s: %v", discordID, key, err)
+		panic(err)
+	}
+}
+
+// MessageEdit is a single revision of a Discord message, either received from Discord or sent from Matrix.
+type MessageEdit struct {
+	db  *Database
+	log log.Logger
+
+	DiscordID     string
+	Channel       PortalKey
+	EditTimestamp time.Time
+	SenderID      string
+	Content       string
+
+	MXID id.EventID
+}
+
+func (me *MessageEdit) Scan(row dbutil.Scannable) *MessageEdit {
+	var editTS int64
+	err := row.Scan(&me.DiscordID, &me.Channel.ChannelID, &me.Channel.Receiver, &editTS, &me.SenderID, &me.Content, &me.MXID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			me.log.Errorln("Database scan failed:", err)
+			panic(err)
+		}
+
+		return nil
+	}
+	me.EditTimestamp = time.Unix(0, editTS).UTC()
+	return me
+}
+
+func (me *MessageEdit) Insert() {
+	_, err := me.db.Exec(messageEditInsert,
+		me.DiscordID, me.Channel.ChannelID, me.Channel.Receiver, me.EditTimestamp.UnixNano(), me.SenderID, me.Content, me.MXID)
+	if err != nil {
+		me.log.Warnfln("Failed to insert edit of %s@%s at %s: %v", me.DiscordID, me.Channel, me.EditTimestamp, err)
+		panic(err)
+	}
+}
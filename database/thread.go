@@ -36,6 +36,22 @@ func (tq *ThreadQuery) GetByDiscordID(discordID string) *Thread {
 	return tq.New().Scan(row)
 }
 
+func (tq *ThreadQuery) GetAllByParentID(parentID string) []*Thread {
+	query := threadSelect + " WHERE parent_chan_id=$1"
+
+	rows, err := tq.db.Query(query, parentID)
+	if err != nil || rows == nil {
+		return nil
+	}
+
+	var threads []*Thread
+	for rows.Next() {
+		threads = append(threads, tq.New().Scan(rows))
+	}
+
+	return threads
+}
+
 func (tq *ThreadQuery) GetByMatrixRootMsg(mxid id.EventID) *Thread {
 	query := threadSelect + " WHERE root_msg_mxid=$1"
 
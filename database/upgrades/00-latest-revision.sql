@@ -1,4 +1,4 @@
--- v0 -> v24 (compatible with v19+): Latest revision
+-- v0 -> v29 (compatible with v29+): Latest revision
 
 CREATE TABLE guild (
     dcid       TEXT PRIMARY KEY,
@@ -84,8 +84,9 @@ CREATE TABLE puppet (
 );
 
 CREATE TABLE "user" (
-    mxid TEXT PRIMARY KEY,
-    dcid TEXT UNIQUE,
+    mxid    TEXT,
+    account TEXT NOT NULL DEFAULT '',
+    dcid    TEXT UNIQUE,
 
     discord_token   TEXT,
     management_room TEXT,
@@ -93,18 +94,21 @@ CREATE TABLE "user" (
     dm_space_room   TEXT,
 
     read_state_version INTEGER NOT NULL DEFAULT 0,
-    heartbeat_session jsonb
+    heartbeat_session jsonb,
+
+    PRIMARY KEY (mxid, account)
 );
 
 CREATE TABLE user_portal (
-    discord_id TEXT,
-    user_mxid  TEXT,
-    type       TEXT NOT NULL,
-    in_space   BOOLEAN NOT NULL,
-    timestamp  BIGINT NOT NULL,
-
-    PRIMARY KEY (discord_id, user_mxid),
-    CONSTRAINT up_user_fkey FOREIGN KEY (user_mxid) REFERENCES "user" (mxid) ON DELETE CASCADE
+    discord_id   TEXT,
+    user_mxid    TEXT,
+    user_account TEXT NOT NULL DEFAULT '',
+    type         TEXT NOT NULL,
+    in_space     BOOLEAN NOT NULL,
+    timestamp    BIGINT NOT NULL,
+
+    PRIMARY KEY (discord_id, user_mxid, user_account),
+    CONSTRAINT up_user_fkey FOREIGN KEY (user_mxid, user_account) REFERENCES "user" (mxid, account) ON DELETE CASCADE
 );
 
 CREATE TABLE message (
@@ -124,6 +128,20 @@ CREATE TABLE message (
     CONSTRAINT message_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
 );
 
+CREATE TABLE message_edit (
+    dcid              TEXT,
+    dc_chan_id        TEXT,
+    dc_chan_receiver  TEXT,
+    dc_edit_timestamp BIGINT,
+    dc_sender         TEXT NOT NULL,
+    content           TEXT NOT NULL,
+
+    mxid TEXT NOT NULL,
+
+    PRIMARY KEY (dcid, dc_chan_id, dc_chan_receiver, dc_edit_timestamp),
+    CONSTRAINT message_edit_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
+
 CREATE TABLE reaction (
     dc_chan_id       TEXT,
     dc_chan_receiver TEXT,
@@ -173,8 +191,43 @@ CREATE TABLE discord_file (
     mime_type       TEXT NOT NULL,
     decryption_info jsonb,
     timestamp       BIGINT NOT NULL,
+    last_used       BIGINT NOT NULL DEFAULT 0,
+
+    dc_chan_id  TEXT,
+    dc_guild_id TEXT,
 
     PRIMARY KEY (url, encrypted)
 );
 
 CREATE INDEX discord_file_mxc_idx ON discord_file (mxc);
+CREATE INDEX discord_file_last_used_idx ON discord_file (last_used);
+
+CREATE TABLE guild_config_override (
+    dc_guild_id TEXT,
+    key         TEXT,
+    value       TEXT NOT NULL,
+
+    PRIMARY KEY (dc_guild_id, key),
+    CONSTRAINT guild_config_override_guild_fkey FOREIGN KEY (dc_guild_id) REFERENCES guild (dcid) ON DELETE CASCADE
+);
+
+CREATE TABLE portal_config_override (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    key              TEXT,
+    value            TEXT NOT NULL,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, key),
+    CONSTRAINT portal_config_override_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE attachment_url_cache (
+    channel_id    BIGINT,
+    attachment_id BIGINT,
+    url           TEXT   NOT NULL,
+    expiry        BIGINT NOT NULL,
+
+    PRIMARY KEY (channel_id, attachment_id)
+);
+
+CREATE INDEX attachment_url_cache_expiry_idx ON attachment_url_cache (expiry);
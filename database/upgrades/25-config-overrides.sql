@@ -0,0 +1,19 @@
+-- v25 (compatible with v19+): Add per-guild and per-portal config overrides
+CREATE TABLE guild_config_override (
+    dc_guild_id TEXT,
+    key         TEXT,
+    value       TEXT NOT NULL,
+
+    PRIMARY KEY (dc_guild_id, key),
+    CONSTRAINT guild_config_override_guild_fkey FOREIGN KEY (dc_guild_id) REFERENCES guild (dcid) ON DELETE CASCADE
+);
+
+CREATE TABLE portal_config_override (
+    dc_chan_id       TEXT,
+    dc_chan_receiver TEXT,
+    key              TEXT,
+    value            TEXT NOT NULL,
+
+    PRIMARY KEY (dc_chan_id, dc_chan_receiver, key),
+    CONSTRAINT portal_config_override_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,14 @@
+-- v26 (compatible with v19+): Store Discord message edit history
+CREATE TABLE message_edit (
+    dcid              TEXT,
+    dc_chan_id        TEXT,
+    dc_chan_receiver  TEXT,
+    dc_edit_timestamp BIGINT,
+    dc_sender         TEXT NOT NULL,
+    content           TEXT NOT NULL,
+
+    mxid TEXT NOT NULL,
+
+    PRIMARY KEY (dcid, dc_chan_id, dc_chan_receiver, dc_edit_timestamp),
+    CONSTRAINT message_edit_portal_fkey FOREIGN KEY (dc_chan_id, dc_chan_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE
+);
@@ -0,0 +1,11 @@
+-- v27 (compatible with v19+): Store direct media attachment URLs persistently
+CREATE TABLE attachment_url_cache (
+    channel_id    BIGINT,
+    attachment_id BIGINT,
+    url           TEXT   NOT NULL,
+    expiry        BIGINT NOT NULL,
+
+    PRIMARY KEY (channel_id, attachment_id)
+);
+
+CREATE INDEX attachment_url_cache_expiry_idx ON attachment_url_cache (expiry);
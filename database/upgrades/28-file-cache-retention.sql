@@ -0,0 +1,6 @@
+-- v28 (compatible with v19+): Track media cache usage for garbage collection
+ALTER TABLE discord_file ADD COLUMN last_used BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE discord_file ADD COLUMN dc_chan_id TEXT;
+ALTER TABLE discord_file ADD COLUMN dc_guild_id TEXT;
+UPDATE discord_file SET last_used=timestamp;
+CREATE INDEX discord_file_last_used_idx ON discord_file (last_used);
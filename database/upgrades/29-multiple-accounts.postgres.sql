@@ -0,0 +1,16 @@
+-- v29 (compatible with v29+): Allow multiple Discord accounts per Matrix user
+-- transaction: off
+BEGIN;
+
+ALTER TABLE user_portal DROP CONSTRAINT up_user_fkey;
+ALTER TABLE user_portal DROP CONSTRAINT user_portal_pkey;
+ALTER TABLE "user" DROP CONSTRAINT user_pkey;
+
+ALTER TABLE "user" ADD COLUMN account TEXT NOT NULL DEFAULT '';
+ALTER TABLE "user" ADD PRIMARY KEY (mxid, account);
+
+ALTER TABLE user_portal ADD COLUMN user_account TEXT NOT NULL DEFAULT '';
+ALTER TABLE user_portal ADD PRIMARY KEY (discord_id, user_mxid, user_account);
+ALTER TABLE user_portal ADD CONSTRAINT up_user_fkey FOREIGN KEY (user_mxid, user_account) REFERENCES "user" (mxid, account) ON DELETE CASCADE;
+
+COMMIT;
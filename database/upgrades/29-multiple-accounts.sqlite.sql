@@ -0,0 +1,44 @@
+-- v29 (compatible with v29+): Allow multiple Discord accounts per Matrix user
+-- transaction: off
+PRAGMA foreign_keys = OFF;
+BEGIN;
+
+CREATE TABLE user_new (
+    mxid    TEXT,
+    account TEXT NOT NULL DEFAULT '',
+    dcid    TEXT UNIQUE,
+
+    discord_token   TEXT,
+    management_room TEXT,
+    space_room      TEXT,
+    dm_space_room   TEXT,
+
+    read_state_version INTEGER NOT NULL DEFAULT 0,
+    heartbeat_session jsonb,
+
+    PRIMARY KEY (mxid, account)
+);
+INSERT INTO user_new (mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session)
+    SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session FROM "user";
+DROP TABLE "user";
+ALTER TABLE user_new RENAME TO "user";
+
+CREATE TABLE user_portal_new (
+    discord_id   TEXT,
+    user_mxid    TEXT,
+    user_account TEXT NOT NULL DEFAULT '',
+    type         TEXT NOT NULL,
+    in_space     BOOLEAN NOT NULL,
+    timestamp    BIGINT NOT NULL,
+
+    PRIMARY KEY (discord_id, user_mxid, user_account),
+    CONSTRAINT up_user_fkey FOREIGN KEY (user_mxid, user_account) REFERENCES "user" (mxid, account) ON DELETE CASCADE
+);
+INSERT INTO user_portal_new (discord_id, user_mxid, type, in_space, timestamp)
+    SELECT discord_id, user_mxid, type, in_space, timestamp FROM user_portal;
+DROP TABLE user_portal;
+ALTER TABLE user_portal_new RENAME TO user_portal;
+
+PRAGMA foreign_key_check;
+COMMIT;
+PRAGMA foreign_keys = ON;
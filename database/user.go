@@ -22,21 +22,37 @@ func (uq *UserQuery) New() *User {
 }
 
 func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
-	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session FROM "user" WHERE mxid=$1`
-	return uq.New().Scan(uq.db.QueryRow(query, userID))
+	return uq.GetByAccount(userID, "")
+}
+
+func (uq *UserQuery) GetByAccount(userID id.UserID, account string) *User {
+	query := `SELECT mxid, account, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session FROM "user" WHERE mxid=$1 AND account=$2`
+	return uq.New().Scan(uq.db.QueryRow(query, userID, account))
 }
 
 func (uq *UserQuery) GetByID(id string) *User {
-	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session FROM "user" WHERE dcid=$1`
+	query := `SELECT mxid, account, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session FROM "user" WHERE dcid=$1`
 	return uq.New().Scan(uq.db.QueryRow(query, id))
 }
 
 func (uq *UserQuery) GetAllWithToken() []*User {
 	query := `
-		SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session
+		SELECT mxid, account, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session
 		FROM "user" WHERE discord_token IS NOT NULL
 	`
-	rows, err := uq.db.Query(query)
+	return uq.getAll(query)
+}
+
+func (uq *UserQuery) GetAllAccounts(userID id.UserID) []*User {
+	query := `
+		SELECT mxid, account, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session
+		FROM "user" WHERE mxid=$1 ORDER BY account
+	`
+	return uq.getAll(query, userID)
+}
+
+func (uq *UserQuery) getAll(query string, args ...any) []*User {
+	rows, err := uq.db.Query(query, args...)
 	if err != nil || rows == nil {
 		return nil
 	}
@@ -56,6 +72,7 @@ type User struct {
 	log log.Logger
 
 	MXID             id.UserID
+	Account          string
 	DiscordID        string
 	DiscordToken     string
 	ManagementRoom   id.RoomID
@@ -68,7 +85,7 @@ type User struct {
 
 func (u *User) Scan(row dbutil.Scannable) *User {
 	var discordID, managementRoom, spaceRoom, dmSpaceRoom, discordToken sql.NullString
-	err := row.Scan(&u.MXID, &discordID, &discordToken, &managementRoom, &spaceRoom, &dmSpaceRoom, &u.ReadStateVersion, dbutil.JSON{Data: &u.HeartbeatSession})
+	err := row.Scan(&u.MXID, &u.Account, &discordID, &discordToken, &managementRoom, &spaceRoom, &dmSpaceRoom, &u.ReadStateVersion, dbutil.JSON{Data: &u.HeartbeatSession})
 	if err != nil {
 		if err != sql.ErrNoRows {
 			u.log.Errorln("Database scan failed:", err)
@@ -85,8 +102,8 @@ func (u *User) Scan(row dbutil.Scannable) *User {
 }
 
 func (u *User) Insert() {
-	query := `INSERT INTO "user" (mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	_, err := u.db.Exec(query, u.MXID, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, JSONPtr(u.HeartbeatSession))
+	query := `INSERT INTO "user" (mxid, account, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, heartbeat_session) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := u.db.Exec(query, u.MXID, u.Account, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, JSONPtr(u.HeartbeatSession))
 	if err != nil {
 		u.log.Warnfln("Failed to insert %s: %v", u.MXID, err)
 		panic(err)
@@ -94,10 +111,18 @@ func (u *User) Insert() {
 }
 
 func (u *User) Update() {
-	query := `UPDATE "user" SET dcid=$1, discord_token=$2, management_room=$3, space_room=$4, dm_space_room=$5, read_state_version=$6, heartbeat_session=$7 WHERE mxid=$8`
-	_, err := u.db.Exec(query, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, JSONPtr(u.HeartbeatSession), u.MXID)
+	query := `UPDATE "user" SET dcid=$1, discord_token=$2, management_room=$3, space_room=$4, dm_space_room=$5, read_state_version=$6, heartbeat_session=$7 WHERE mxid=$8 AND account=$9`
+	_, err := u.db.Exec(query, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, JSONPtr(u.HeartbeatSession), u.MXID, u.Account)
 	if err != nil {
 		u.log.Warnfln("Failed to update %q: %v", u.MXID, err)
 		panic(err)
 	}
 }
+
+func (u *User) Delete() {
+	_, err := u.db.Exec(`DELETE FROM "user" WHERE mxid=$1 AND account=$2`, u.MXID, u.Account)
+	if err != nil {
+		u.log.Warnfln("Failed to delete %q/%q: %v", u.MXID, u.Account, err)
+		panic(err)
+	}
+}
@@ -46,7 +46,7 @@ func (u *User) scanUserPortals(rows dbutil.Rows) []UserPortal {
 }
 
 func (db *Database) GetUsersInPortal(channelID string) []id.UserID {
-	rows, err := db.Query("SELECT user_mxid FROM user_portal WHERE discord_id=$1", channelID)
+	rows, err := db.Query("SELECT DISTINCT user_mxid FROM user_portal WHERE discord_id=$1", channelID)
 	if err != nil {
 		db.Portal.log.Errorln("Failed to get users in portal:", err)
 	}
@@ -64,7 +64,7 @@ func (db *Database) GetUsersInPortal(channelID string) []id.UserID {
 }
 
 func (u *User) GetPortals() []UserPortal {
-	rows, err := u.db.Query("SELECT discord_id, type, timestamp, in_space FROM user_portal WHERE user_mxid=$1", u.MXID)
+	rows, err := u.db.Query("SELECT discord_id, type, timestamp, in_space FROM user_portal WHERE user_mxid=$1 AND user_account=$2", u.MXID, u.Account)
 	if err != nil {
 		u.log.Errorln("Failed to get portals:", err)
 		panic(err)
@@ -73,8 +73,8 @@ func (u *User) GetPortals() []UserPortal {
 }
 
 func (u *User) IsInSpace(discordID string) (isIn bool) {
-	query := `SELECT in_space FROM user_portal WHERE user_mxid=$1 AND discord_id=$2`
-	err := u.db.QueryRow(query, u.MXID, discordID).Scan(&isIn)
+	query := `SELECT in_space FROM user_portal WHERE user_mxid=$1 AND user_account=$2 AND discord_id=$3`
+	err := u.db.QueryRow(query, u.MXID, u.Account, discordID).Scan(&isIn)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		u.log.Warnfln("Failed to scan in_space for %s/%s: %v", u.MXID, discordID, err)
 		panic(err)
@@ -83,8 +83,8 @@ func (u *User) IsInSpace(discordID string) (isIn bool) {
 }
 
 func (u *User) IsInPortal(discordID string) (isIn bool) {
-	query := `SELECT EXISTS(SELECT 1 FROM user_portal WHERE user_mxid=$1 AND discord_id=$2)`
-	err := u.db.QueryRow(query, u.MXID, discordID).Scan(&isIn)
+	query := `SELECT EXISTS(SELECT 1 FROM user_portal WHERE user_mxid=$1 AND user_account=$2 AND discord_id=$3)`
+	err := u.db.QueryRow(query, u.MXID, u.Account, discordID).Scan(&isIn)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		u.log.Warnfln("Failed to scan in_space for %s/%s: %v", u.MXID, discordID, err)
 		panic(err)
@@ -94,12 +94,12 @@ func (u *User) IsInPortal(discordID string) (isIn bool) {
 
 func (u *User) MarkInPortal(portal UserPortal) {
 	query := `
-		INSERT INTO user_portal (discord_id, type, user_mxid, timestamp, in_space)
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (discord_id, user_mxid) DO UPDATE
+		INSERT INTO user_portal (discord_id, type, user_mxid, user_account, timestamp, in_space)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (discord_id, user_mxid, user_account) DO UPDATE
 		    SET timestamp=excluded.timestamp, in_space=excluded.in_space
 	`
-	_, err := u.db.Exec(query, portal.DiscordID, portal.Type, u.MXID, portal.Timestamp.UnixMilli(), portal.InSpace)
+	_, err := u.db.Exec(query, portal.DiscordID, portal.Type, u.MXID, u.Account, portal.Timestamp.UnixMilli(), portal.InSpace)
 	if err != nil {
 		u.log.Errorfln("Failed to insert user portal %s/%s: %v", u.MXID, portal.DiscordID, err)
 		panic(err)
@@ -107,8 +107,8 @@ func (u *User) MarkInPortal(portal UserPortal) {
 }
 
 func (u *User) MarkNotInPortal(discordID string) {
-	query := `DELETE FROM user_portal WHERE user_mxid=$1 AND discord_id=$2`
-	_, err := u.db.Exec(query, u.MXID, discordID)
+	query := `DELETE FROM user_portal WHERE user_mxid=$1 AND user_account=$2 AND discord_id=$3`
+	_, err := u.db.Exec(query, u.MXID, u.Account, discordID)
 	if err != nil {
 		u.log.Errorfln("Failed to remove user portal %s/%s: %v", u.MXID, discordID, err)
 		panic(err)
@@ -116,8 +116,8 @@ func (u *User) MarkNotInPortal(discordID string) {
 }
 
 func (u *User) PortalHasOtherUsers(discordID string) (hasOtherUsers bool) {
-	query := `SELECT COUNT(*) > 0 FROM user_portal WHERE user_mxid<>$1 AND discord_id=$2`
-	err := u.db.QueryRow(query, u.MXID, discordID).Scan(&hasOtherUsers)
+	query := `SELECT COUNT(*) > 0 FROM user_portal WHERE (user_mxid<>$1 OR user_account<>$2) AND discord_id=$3`
+	err := u.db.QueryRow(query, u.MXID, u.Account, discordID).Scan(&hasOtherUsers)
 	if err != nil {
 		u.log.Errorfln("Failed to check if %s has users other than %s: %v", discordID, u.MXID, err)
 		panic(err)
@@ -128,10 +128,10 @@ func (u *User) PortalHasOtherUsers(discordID string) (hasOtherUsers bool) {
 func (u *User) PrunePortalList(beforeTS time.Time) []UserPortal {
 	query := `
 		DELETE FROM user_portal
-		WHERE user_mxid=$1 AND timestamp<$2 AND type IN ('dm', 'guild')
+		WHERE user_mxid=$1 AND user_account=$2 AND timestamp<$3 AND type IN ('dm', 'guild')
 		RETURNING discord_id, type, timestamp, in_space
 	`
-	rows, err := u.db.Query(query, u.MXID, beforeTS.UnixMilli())
+	rows, err := u.db.Query(query, u.MXID, u.Account, beforeTS.UnixMilli())
 	if err != nil {
 		u.log.Errorln("Failed to prune user guild list:", err)
 		panic(err)
@@ -33,13 +33,14 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/federation"
 	"maunium.net/go/mautrix/id"
@@ -57,8 +58,10 @@ type DirectMediaAPI struct {
 
 	signatureKey [32]byte
 
-	attachmentCache     map[AttachmentCacheKey]AttachmentCacheValue
-	attachmentCacheLock sync.Mutex
+	refreshBatcher     attachmentRefreshBatcher
+	thumbnailCache     *thumbnailCache
+	thumbnailGroup     singleflight.Group
+	thumbnailSemaphore *semaphore.Weighted
 }
 
 type AttachmentCacheKey struct {
@@ -87,7 +90,8 @@ func newDirectMediaAPI(br *DiscordBridge) *DirectMediaAPI {
 			},
 			Timeout: 60 * time.Second,
 		},
-		attachmentCache: make(map[AttachmentCacheKey]AttachmentCacheValue),
+		thumbnailCache:     newThumbnailCache(br.Config.Bridge.DirectMedia.ThumbnailCacheSize),
+		thumbnailSemaphore: semaphore.NewWeighted(maxConcurrentThumbnails),
 	}
 	r := br.AS.Router
 
@@ -135,7 +139,7 @@ func newDirectMediaAPI(br *DiscordBridge) *DirectMediaAPI {
 	addRoutes := func(version string) {
 		mediaRouter.HandleFunc("/"+version+"/download/{serverName}/{mediaID}", dma.DownloadMedia).Methods(http.MethodGet)
 		mediaRouter.HandleFunc("/"+version+"/download/{serverName}/{mediaID}/{fileName}", dma.DownloadMedia).Methods(http.MethodGet)
-		mediaRouter.HandleFunc("/"+version+"/thumbnail/{serverName}/{mediaID}", dma.DownloadMedia).Methods(http.MethodGet)
+		mediaRouter.HandleFunc("/"+version+"/thumbnail/{serverName}/{mediaID}", dma.DownloadThumbnail).Methods(http.MethodGet)
 		mediaRouter.HandleFunc("/"+version+"/upload/{serverName}/{mediaID}", dma.UploadNotSupported).Methods(http.MethodPut)
 		mediaRouter.HandleFunc("/"+version+"/upload", dma.UploadNotSupported).Methods(http.MethodPost)
 		mediaRouter.HandleFunc("/"+version+"/create", dma.UploadNotSupported).Methods(http.MethodPost)
@@ -144,7 +148,7 @@ func newDirectMediaAPI(br *DiscordBridge) *DirectMediaAPI {
 	}
 	clientMediaRouter.HandleFunc("/download/{serverName}/{mediaID}", dma.DownloadMedia).Methods(http.MethodGet)
 	clientMediaRouter.HandleFunc("/download/{serverName}/{mediaID}/{fileName}", dma.DownloadMedia).Methods(http.MethodGet)
-	clientMediaRouter.HandleFunc("/thumbnail/{serverName}/{mediaID}", dma.DownloadMedia).Methods(http.MethodGet)
+	clientMediaRouter.HandleFunc("/thumbnail/{serverName}/{mediaID}", dma.DownloadThumbnail).Methods(http.MethodGet)
 	clientMediaRouter.HandleFunc("/upload/{serverName}/{mediaID}", dma.UploadNotSupported).Methods(http.MethodPut)
 	clientMediaRouter.HandleFunc("/upload", dma.UploadNotSupported).Methods(http.MethodPost)
 	clientMediaRouter.HandleFunc("/create", dma.UploadNotSupported).Methods(http.MethodPost)
@@ -154,13 +158,14 @@ func newDirectMediaAPI(br *DiscordBridge) *DirectMediaAPI {
 	addRoutes("r0")
 	addRoutes("v1")
 	federationRouter.HandleFunc("/v1/media/download/{mediaID}", dma.DownloadMedia).Methods(http.MethodGet)
-	federationRouter.HandleFunc("/v1/media/thumbnail/{mediaID}", dma.DownloadMedia).Methods(http.MethodGet)
+	federationRouter.HandleFunc("/v1/media/thumbnail/{mediaID}", dma.DownloadThumbnail).Methods(http.MethodGet)
 	federationRouter.HandleFunc("/v1/version", dma.ks.GetServerVersion).Methods(http.MethodGet)
 	mediaRouter.NotFoundHandler = http.HandlerFunc(dma.UnknownEndpoint)
 	mediaRouter.MethodNotAllowedHandler = http.HandlerFunc(dma.UnsupportedMethod)
 	federationRouter.NotFoundHandler = http.HandlerFunc(dma.UnknownEndpoint)
 	federationRouter.MethodNotAllowedHandler = http.HandlerFunc(dma.UnsupportedMethod)
 	dma.ks.Register(r)
+	go dma.sweepAttachmentURLCache()
 
 	return dma
 }
@@ -193,18 +198,10 @@ func (dma *DirectMediaAPI) addAttachmentToCache(channelID uint64, att *discordgo
 	if err != nil {
 		return time.Time{}
 	}
-	expiry := parseExpiryTS(att.URL)
-	if expiry.IsZero() {
-		expiry = time.Now().Add(24 * time.Hour)
-	}
-	dma.attachmentCache[AttachmentCacheKey{
+	return dma.cacheAttachmentURL(AttachmentCacheKey{
 		ChannelID:    channelID,
 		AttachmentID: attachmentID,
-	}] = AttachmentCacheValue{
-		URL:    att.URL,
-		Expiry: expiry,
-	}
-	return expiry
+	}, att.URL)
 }
 
 func (dma *DirectMediaAPI) AttachmentMXC(channelID, messageID string, att *discordgo.MessageAttachment) (mxc id.ContentURI) {
@@ -226,9 +223,7 @@ func (dma *DirectMediaAPI) AttachmentMXC(channelID, messageID string, att *disco
 		dma.log.Warn().Str("attachment_id", att.ID).Msg("Got non-integer attachment ID")
 		return
 	}
-	dma.attachmentCacheLock.Lock()
 	dma.addAttachmentToCache(channelIDInt, att)
-	dma.attachmentCacheLock.Unlock()
 	return dma.makeMXC(&AttachmentMediaData{
 		ChannelID:    channelIDInt,
 		MessageID:    messageIDInt,
@@ -325,19 +320,17 @@ func (re *RespError) Error() string {
 var ErrNoUsersWithAccessFound = errors.New("no users found to fetch message")
 var ErrAttachmentNotFound = errors.New("attachment not found")
 
-func (dma *DirectMediaAPI) fetchNewAttachmentURL(ctx context.Context, meta *AttachmentMediaData) (string, time.Time, error) {
-	var client *discordgo.Session
-	channelIDStr := strconv.FormatUint(meta.ChannelID, 10)
-	portal := dma.bridge.GetExistingPortalByID(database.PortalKey{ChannelID: channelIDStr})
+// findClientForChannel finds a Discord session that can view the given channel, preferring bots over users.
+func (dma *DirectMediaAPI) findClientForChannel(channelIDStr string) (client *discordgo.Session, portal *Portal) {
+	portal = dma.bridge.GetExistingPortalByID(database.PortalKey{ChannelID: channelIDStr})
 	var users []id.UserID
 	if portal != nil && portal.GuildID != "" {
 		users = dma.bridge.DB.GetUsersInPortal(portal.GuildID)
 	} else {
 		users = dma.bridge.DB.GetUsersInPortal(channelIDStr)
 	}
-	for _, userID := range users {
-		user := dma.bridge.GetCachedUserByMXID(userID)
-		if user == nil || user.Session == nil {
+	for _, user := range dma.bridge.getCachedAccountsOf(users) {
+		if user.Session == nil {
 			continue
 		}
 		perms, err := user.Session.State.UserChannelPermissions(user.DiscordID, channelIDStr)
@@ -351,6 +344,12 @@ func (dma *DirectMediaAPI) fetchNewAttachmentURL(ctx context.Context, meta *Atta
 			}
 		}
 	}
+	return
+}
+
+func (dma *DirectMediaAPI) fetchNewAttachmentURL(ctx context.Context, meta *AttachmentMediaData) (string, time.Time, error) {
+	channelIDStr := strconv.FormatUint(meta.ChannelID, 10)
+	client, portal := dma.findClientForChannel(channelIDStr)
 	if client == nil {
 		return "", time.Time{}, ErrNoUsersWithAccessFound
 	}
@@ -405,7 +404,7 @@ func (dma *DirectMediaAPI) GetEmojiInfo(contentURI id.ContentURI) *EmojiMediaDat
 
 }
 
-func (dma *DirectMediaAPI) getMediaURL(ctx context.Context, encodedMediaID string) (url string, expiry time.Time, err error) {
+func (dma *DirectMediaAPI) getMediaURL(ctx context.Context, encodedMediaID string) (url string, expiry time.Time, data MediaIDData, err error) {
 	var mediaID *MediaID
 	mediaID, err = ParseMediaID(encodedMediaID, dma.signatureKey)
 	if err != nil {
@@ -416,20 +415,10 @@ func (dma *DirectMediaAPI) getMediaURL(ctx context.Context, encodedMediaID strin
 		}
 		return
 	}
+	data = mediaID.Data
 	switch mediaData := mediaID.Data.(type) {
 	case *AttachmentMediaData:
-		dma.attachmentCacheLock.Lock()
-		defer dma.attachmentCacheLock.Unlock()
-		cached, ok := dma.attachmentCache[mediaData.CacheKey()]
-		if ok && time.Until(cached.Expiry) > 5*time.Minute {
-			return cached.URL, cached.Expiry, nil
-		}
-		zerolog.Ctx(ctx).Debug().
-			Uint64("channel_id", mediaData.ChannelID).
-			Uint64("message_id", mediaData.MessageID).
-			Uint64("attachment_id", mediaData.AttachmentID).
-			Msg("Refreshing attachment URL")
-		url, expiry, err = dma.fetchNewAttachmentURL(ctx, mediaData)
+		url, expiry, err = dma.getAttachmentURL(ctx, mediaData)
 		if err != nil {
 			zerolog.Ctx(ctx).Err(err).Msg("Failed to refresh attachment URL")
 			msg := "Failed to refresh attachment URL"
@@ -554,12 +543,12 @@ func (dma *DirectMediaAPI) proxyDownload(ctx context.Context, w http.ResponseWri
 	}
 }
 
-func (dma *DirectMediaAPI) DownloadMedia(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	log := zerolog.Ctx(ctx)
-	isNewFederation := strings.HasPrefix(r.URL.Path, "/_matrix/federation/v1/media/")
+// resolveMediaRequest finds the Discord URL for the media ID in the request.
+// If it returns ok=false, an error response has already been written.
+func (dma *DirectMediaAPI) resolveMediaRequest(w http.ResponseWriter, r *http.Request) (url string, expiresAt time.Time, data MediaIDData, ok bool) {
+	log := zerolog.Ctx(r.Context())
 	vars := mux.Vars(r)
-	if !isNewFederation && vars["serverName"] != dma.cfg.ServerName {
+	if !isNewFederationMediaRequest(r) && vars["serverName"] != dma.cfg.ServerName {
 		jsonResponse(w, http.StatusNotFound, &mautrix.RespError{
 			ErrCode: mautrix.MNotFound.ErrCode,
 			Err:     fmt.Sprintf("This is a Discord media proxy for %q, other media downloads are not available here", dma.cfg.ServerName),
@@ -568,7 +557,7 @@ func (dma *DirectMediaAPI) DownloadMedia(w http.ResponseWriter, r *http.Request)
 	}
 	// TODO check destination header in X-Matrix auth when isNewFederation
 
-	url, expiresAt, err := dma.getMediaURL(ctx, vars["mediaID"])
+	url, expiresAt, data, err := dma.getMediaURL(r.Context(), vars["mediaID"])
 	if err != nil {
 		var respError *RespError
 		if errors.As(err, &respError) {
@@ -585,40 +574,71 @@ func (dma *DirectMediaAPI) DownloadMedia(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
-	if isNewFederation {
-		mp := multipart.NewWriter(w)
-		w.Header().Set("Content-Type", strings.Replace(mp.FormDataContentType(), "form-data", "mixed", 1))
-		var metaPart io.Writer
-		metaPart, err = mp.CreatePart(textproto.MIMEHeader{
-			"Content-Type": {"application/json"},
+	ok = true
+	return
+}
+
+func isNewFederationMediaRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/_matrix/federation/v1/media/")
+}
+
+// writeFederationMultipart writes a multipart/mixed response as required by the authenticated federation media endpoints.
+// The media part either contains the data directly or a redirect to the given URL.
+func writeFederationMultipart(w http.ResponseWriter, log *zerolog.Logger, url, contentType string, data []byte) {
+	mp := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", strings.Replace(mp.FormDataContentType(), "form-data", "mixed", 1))
+	metaPart, err := mp.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"application/json"},
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to create multipart metadata field")
+		return
+	}
+	_, err = metaPart.Write([]byte(`{}`))
+	if err != nil {
+		log.Err(err).Msg("Failed to write multipart metadata field")
+		return
+	}
+	if url != "" {
+		_, err = mp.CreatePart(textproto.MIMEHeader{
+			"Location": {url},
 		})
 		if err != nil {
-			log.Err(err).Msg("Failed to create multipart metadata field")
-			return
-		}
-		_, err = metaPart.Write([]byte(`{}`))
-		if err != nil {
-			log.Err(err).Msg("Failed to write multipart metadata field")
+			log.Err(err).Msg("Failed to create multipart redirect field")
 			return
 		}
-		_, err = mp.CreatePart(textproto.MIMEHeader{
-			"Location": {url},
+	} else {
+		var dataPart io.Writer
+		dataPart, err = mp.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {contentType},
 		})
 		if err != nil {
-			log.Err(err).Msg("Failed to create multipart redirect field")
+			log.Err(err).Msg("Failed to create multipart data field")
 			return
 		}
-		err = mp.Close()
+		_, err = dataPart.Write(data)
 		if err != nil {
-			log.Err(err).Msg("Failed to close multipart writer")
+			log.Err(err).Msg("Failed to write multipart data field")
 			return
 		}
+	}
+	err = mp.Close()
+	if err != nil {
+		log.Err(err).Msg("Failed to close multipart writer")
+	}
+}
+
+// serveMediaURL responds to a download request by redirecting to or proxying the given Discord URL.
+func (dma *DirectMediaAPI) serveMediaURL(w http.ResponseWriter, r *http.Request, url string, expiresAt time.Time) {
+	ctx := r.Context()
+	if isNewFederationMediaRequest(r) {
+		writeFederationMultipart(w, zerolog.Ctx(ctx), url, "", nil)
 		return
 	}
 	// Proxy if the config allows proxying and the request doesn't allow redirects.
 	// In any other case, redirect to the Discord CDN.
 	if dma.cfg.AllowProxy && r.URL.Query().Get("allow_redirect") != "true" {
-		dma.proxyDownload(ctx, w, url, vars["fileName"])
+		dma.proxyDownload(ctx, w, url, mux.Vars(r)["fileName"])
 		return
 	}
 	w.Header().Set("Location", url)
@@ -634,6 +654,14 @@ func (dma *DirectMediaAPI) DownloadMedia(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusTemporaryRedirect)
 }
 
+func (dma *DirectMediaAPI) DownloadMedia(w http.ResponseWriter, r *http.Request) {
+	url, expiresAt, _, ok := dma.resolveMediaRequest(w, r)
+	if !ok {
+		return
+	}
+	dma.serveMediaURL(w, r, url, expiresAt)
+}
+
 func (dma *DirectMediaAPI) UploadNotSupported(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, http.StatusNotImplemented, &mautrix.RespError{
 		ErrCode: mautrix.MUnrecognized.ErrCode,
@@ -0,0 +1,235 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// attachmentURLMinValidity is how long a cached URL must still be valid for it to be returned.
+	attachmentURLMinValidity = 5 * time.Minute
+	// expiredAttachmentURLRetention is how long expired URLs are kept, as refreshing needs the old URL.
+	expiredAttachmentURLRetention = 7 * 24 * time.Hour
+	attachmentCacheSweepInterval  = 1 * time.Hour
+
+	// attachmentRefreshBatchDelay is how long to wait for more expired attachments before calling refresh-urls.
+	attachmentRefreshBatchDelay = 50 * time.Millisecond
+	// attachmentRefreshMaxBatchSize is the maximum number of URLs refreshed with a single request.
+	attachmentRefreshMaxBatchSize = 50
+)
+
+// attachmentCacheMetrics are exposed at /debug/vars when the provisioning debug endpoints are enabled.
+var attachmentCacheMetrics = expvar.NewMap("direct_media_attachment_url_cache")
+
+const (
+	metricCacheHit         = "hits"
+	metricCacheMiss        = "misses"
+	metricRefreshed        = "refreshed"
+	metricRefreshBatches   = "refresh_batches"
+	metricRefreshFallbacks = "refresh_fallbacks"
+	metricRefreshErrors    = "refresh_errors"
+	metricEvicted          = "evicted"
+)
+
+type attachmentRefreshRequest struct {
+	key    AttachmentCacheKey
+	oldURL string
+	done   chan struct{}
+
+	result AttachmentCacheValue
+	err    error
+}
+
+type attachmentRefreshBatcher struct {
+	lock    sync.Mutex
+	pending map[AttachmentCacheKey]*attachmentRefreshRequest
+	timer   *time.Timer
+}
+
+type reqRefreshAttachmentURLs struct {
+	AttachmentURLs []string `json:"attachment_urls"`
+}
+
+type respRefreshAttachmentURLs struct {
+	RefreshedURLs []struct {
+		Original  string `json:"original"`
+		Refreshed string `json:"refreshed"`
+	} `json:"refreshed_urls"`
+}
+
+func (dma *DirectMediaAPI) cacheAttachmentURL(key AttachmentCacheKey, url string) time.Time {
+	expiry := parseExpiryTS(url)
+	if expiry.IsZero() {
+		expiry = time.Now().Add(24 * time.Hour)
+	}
+	dma.bridge.DB.AttachmentURLCache.Put(key.ChannelID, key.AttachmentID, url, expiry)
+	return expiry
+}
+
+// getAttachmentURL returns a valid CDN URL for the given attachment, refreshing it if the cached one has expired.
+func (dma *DirectMediaAPI) getAttachmentURL(ctx context.Context, meta *AttachmentMediaData) (string, time.Time, error) {
+	key := meta.CacheKey()
+	cached := dma.bridge.DB.AttachmentURLCache.Get(key.ChannelID, key.AttachmentID)
+	if cached != nil && time.Until(cached.Expiry) > attachmentURLMinValidity {
+		attachmentCacheMetrics.Add(metricCacheHit, 1)
+		return cached.URL, cached.Expiry, nil
+	}
+	attachmentCacheMetrics.Add(metricCacheMiss, 1)
+	log := zerolog.Ctx(ctx).With().
+		Uint64("channel_id", meta.ChannelID).
+		Uint64("message_id", meta.MessageID).
+		Uint64("attachment_id", meta.AttachmentID).
+		Logger()
+	if cached != nil {
+		log.Debug().Msg("Refreshing expired attachment URL")
+		value, err := dma.queueAttachmentRefresh(ctx, key, cached.URL)
+		if err == nil {
+			return value.URL, value.Expiry, nil
+		}
+		attachmentCacheMetrics.Add(metricRefreshErrors, 1)
+		log.Warn().Err(err).Msg("Failed to refresh attachment URL, fetching message instead")
+	}
+	log.Debug().Msg("Fetching message to get attachment URL")
+	attachmentCacheMetrics.Add(metricRefreshFallbacks, 1)
+	return dma.fetchNewAttachmentURL(ctx, meta)
+}
+
+// queueAttachmentRefresh adds the URL to the next refresh-urls batch and waits for the result.
+// Concurrent requests for the same attachment share the same refresh.
+func (dma *DirectMediaAPI) queueAttachmentRefresh(ctx context.Context, key AttachmentCacheKey, oldURL string) (AttachmentCacheValue, error) {
+	batcher := &dma.refreshBatcher
+	batcher.lock.Lock()
+	req, ok := batcher.pending[key]
+	if !ok {
+		req = &attachmentRefreshRequest{
+			key:    key,
+			oldURL: oldURL,
+			done:   make(chan struct{}),
+		}
+		if batcher.pending == nil {
+			batcher.pending = make(map[AttachmentCacheKey]*attachmentRefreshRequest)
+		}
+		batcher.pending[key] = req
+		if len(batcher.pending) >= attachmentRefreshMaxBatchSize {
+			go dma.flushAttachmentRefreshes(dma.takePendingRefreshes())
+		} else if batcher.timer == nil {
+			batcher.timer = time.AfterFunc(attachmentRefreshBatchDelay, func() {
+				batcher.lock.Lock()
+				pending := dma.takePendingRefreshes()
+				batcher.lock.Unlock()
+				dma.flushAttachmentRefreshes(pending)
+			})
+		}
+	}
+	batcher.lock.Unlock()
+	select {
+	case <-req.done:
+		return req.result, req.err
+	case <-ctx.Done():
+		return AttachmentCacheValue{}, ctx.Err()
+	}
+}
+
+// takePendingRefreshes must be called with the batcher lock held.
+func (dma *DirectMediaAPI) takePendingRefreshes() map[AttachmentCacheKey]*attachmentRefreshRequest {
+	batcher := &dma.refreshBatcher
+	pending := batcher.pending
+	batcher.pending = nil
+	if batcher.timer != nil {
+		batcher.timer.Stop()
+		batcher.timer = nil
+	}
+	return pending
+}
+
+var errAttachmentNotRefreshed = errors.New("attachment URL not included in refresh response")
+
+func (dma *DirectMediaAPI) flushAttachmentRefreshes(pending map[AttachmentCacheKey]*attachmentRefreshRequest) {
+	if len(pending) == 0 {
+		return
+	}
+	byURL := make(map[string]*attachmentRefreshRequest, len(pending))
+	var channelID uint64
+	body := reqRefreshAttachmentURLs{AttachmentURLs: make([]string, 0, len(pending))}
+	for _, req := range pending {
+		byURL[req.oldURL] = req
+		body.AttachmentURLs = append(body.AttachmentURLs, req.oldURL)
+		channelID = req.key.ChannelID
+	}
+	attachmentCacheMetrics.Add(metricRefreshBatches, 1)
+	var resp respRefreshAttachmentURLs
+	err := dma.refreshAttachmentURLs(strconv.FormatUint(channelID, 10), &body, &resp)
+	if err != nil {
+		dma.log.Warn().Err(err).Int("count", len(pending)).Msg("Failed to refresh attachment URLs")
+	} else {
+		for _, refreshed := range resp.RefreshedURLs {
+			req, ok := byURL[refreshed.Original]
+			if !ok || refreshed.Refreshed == "" {
+				continue
+			}
+			delete(byURL, refreshed.Original)
+			req.result.URL = refreshed.Refreshed
+			req.result.Expiry = dma.cacheAttachmentURL(req.key, refreshed.Refreshed)
+			attachmentCacheMetrics.Add(metricRefreshed, 1)
+			close(req.done)
+		}
+		err = errAttachmentNotRefreshed
+	}
+	for _, req := range byURL {
+		req.err = err
+		close(req.done)
+	}
+}
+
+func (dma *DirectMediaAPI) refreshAttachmentURLs(channelID string, body *reqRefreshAttachmentURLs, resp *respRefreshAttachmentURLs) error {
+	// The refresh endpoint doesn't care about the channel, but any session with access is used
+	// anyway to avoid needlessly using accounts that aren't related to the media.
+	client, _ := dma.findClientForChannel(channelID)
+	if client == nil {
+		return ErrNoUsersWithAccessFound
+	}
+	data, err := client.RequestWithBucketID(http.MethodPost, discordgo.EndpointAPI+"attachments/refresh-urls", body, discordgo.EndpointAPI+"attachments/refresh-urls")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, resp)
+}
+
+// sweepAttachmentURLCache periodically deletes URLs that have been expired for long enough to not be useful anymore.
+func (dma *DirectMediaAPI) sweepAttachmentURLCache() {
+	ticker := time.NewTicker(attachmentCacheSweepInterval)
+	defer ticker.Stop()
+	for {
+		deleted := dma.bridge.DB.AttachmentURLCache.DeleteExpired(time.Now().Add(-expiredAttachmentURLRetention))
+		if deleted > 0 {
+			attachmentCacheMetrics.Add(metricEvicted, deleted)
+			dma.log.Debug().Int64("count", deleted).Msg("Evicted expired attachment URLs from cache")
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,433 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+)
+
+const (
+	thumbnailMethodScale = "scale"
+	thumbnailMethodCrop  = "crop"
+
+	// maxThumbnailDimension is the largest thumbnail that will be generated, larger requests are clamped.
+	maxThumbnailDimension = 1024
+	// maxThumbnailSourceSize is the largest image that will be downloaded for generating thumbnails in-process.
+	maxThumbnailSourceSize = 32 * 1024 * 1024
+	// maxThumbnailSourcePixels prevents decoding images that would use huge amounts of memory.
+	maxThumbnailSourcePixels = 20_000_000
+	// maxConcurrentThumbnails limits how many thumbnails are generated at once, as the decoded source images
+	// can take up to maxThumbnailSourcePixels*4 bytes of memory each.
+	maxConcurrentThumbnails = 4
+
+	minDiscordCDNSize = 16
+	maxDiscordCDNSize = 4096
+)
+
+var errNotThumbnailable = errors.New("media can't be thumbnailed")
+
+type thumbnailParams struct {
+	Width    int
+	Height   int
+	Method   string
+	Animated bool
+}
+
+func (tp thumbnailParams) cacheKey(mediaID string) string {
+	return fmt.Sprintf("%s/%dx%d/%s/%t", mediaID, tp.Width, tp.Height, tp.Method, tp.Animated)
+}
+
+func parseThumbnailParams(query neturl.Values) (params thumbnailParams, err error) {
+	for _, dim := range []struct {
+		name string
+		into *int
+	}{{"width", &params.Width}, {"height", &params.Height}} {
+		value := query.Get(dim.name)
+		if value == "" {
+			return params, fmt.Errorf("missing %s parameter", dim.name)
+		}
+		*dim.into, err = strconv.Atoi(value)
+		if err != nil || *dim.into <= 0 {
+			return params, fmt.Errorf("invalid %s parameter", dim.name)
+		}
+		*dim.into = min(*dim.into, maxThumbnailDimension)
+	}
+	params.Method = query.Get("method")
+	switch params.Method {
+	case "":
+		params.Method = thumbnailMethodScale
+	case thumbnailMethodScale, thumbnailMethodCrop:
+	default:
+		return params, fmt.Errorf("unsupported method %q", params.Method)
+	}
+	params.Animated = query.Get("animated") == "true"
+	return params, nil
+}
+
+// discordCDNSize returns the smallest size supported by the Discord CDN that covers the requested thumbnail.
+func discordCDNSize(params thumbnailParams) int {
+	size := minDiscordCDNSize
+	for size < max(params.Width, params.Height) && size < maxDiscordCDNSize {
+		size *= 2
+	}
+	return size
+}
+
+func addQueryParams(rawURL string, params map[string]string) string {
+	parsed, err := neturl.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := parsed.Query()
+	for key, value := range params {
+		query.Set(key, value)
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// getCDNThumbnailURL returns a Discord CDN URL that serves a thumbnail of the given media,
+// or an empty string if Discord can't generate an appropriate thumbnail for it.
+func getCDNThumbnailURL(mediaData MediaIDData, url string, params thumbnailParams) string {
+	size := strconv.Itoa(discordCDNSize(params))
+	switch data := mediaData.(type) {
+	case *EmojiMediaData:
+		// Emojis and avatars are square, so scaling and cropping produce the same result.
+		if data.Animated && !params.Animated {
+			url = discordgo.EndpointEmoji(strconv.FormatUint(data.EmojiID, 10))
+		}
+		return addQueryParams(url, map[string]string{"size": size})
+	case *StickerMediaData:
+		if discordgo.StickerFormat(data.Format) == discordgo.StickerFormatTypeLottie {
+			return ""
+		}
+		return addQueryParams(url, map[string]string{"size": size})
+	case *UserAvatarMediaData:
+		if data.Animated && !params.Animated {
+			url = discordgo.EndpointUserAvatar(strconv.FormatUint(data.UserID, 10), fmt.Sprintf("%x", data.AvatarID))
+		}
+		return addQueryParams(url, map[string]string{"size": size})
+	case *GuildMemberAvatarMediaData:
+		if data.Animated && !params.Animated {
+			url = discordgo.EndpointGuildMemberAvatar(
+				strconv.FormatUint(data.GuildID, 10),
+				strconv.FormatUint(data.UserID, 10),
+				fmt.Sprintf("%x", data.AvatarID),
+			)
+		}
+		return addQueryParams(url, map[string]string{"size": size})
+	case *AttachmentMediaData:
+		// The media proxy only scales images while keeping the aspect ratio, crops are done in-process.
+		if params.Method != thumbnailMethodScale {
+			return ""
+		}
+		parsed, err := neturl.Parse(url)
+		if err != nil || parsed.Host != "cdn.discordapp.com" {
+			return ""
+		}
+		queryParams := map[string]string{
+			"width":  strconv.Itoa(params.Width),
+			"height": strconv.Itoa(params.Height),
+		}
+		switch strings.ToLower(path.Ext(parsed.Path)) {
+		case ".png", ".jpg", ".jpeg", ".webp":
+		case ".gif":
+			if !params.Animated {
+				queryParams["format"] = "png"
+			}
+		default:
+			return ""
+		}
+		parsed.Host = "media.discordapp.net"
+		return addQueryParams(parsed.String(), queryParams)
+	default:
+		return ""
+	}
+}
+
+type thumbnail struct {
+	Data     []byte
+	MimeType string
+}
+
+// thumbnailCache is a simple LRU cache for thumbnails generated in-process.
+type thumbnailCache struct {
+	lock       sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+}
+
+type thumbnailCacheEntry struct {
+	key   string
+	value *thumbnail
+}
+
+func newThumbnailCache(maxEntries int) *thumbnailCache {
+	return &thumbnailCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+func (tc *thumbnailCache) Get(key string) *thumbnail {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	elem, ok := tc.entries[key]
+	if !ok {
+		return nil
+	}
+	tc.order.MoveToFront(elem)
+	return elem.Value.(*thumbnailCacheEntry).value
+}
+
+func (tc *thumbnailCache) Put(key string, value *thumbnail) {
+	if tc.maxEntries <= 0 {
+		return
+	}
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if elem, ok := tc.entries[key]; ok {
+		elem.Value.(*thumbnailCacheEntry).value = value
+		tc.order.MoveToFront(elem)
+		return
+	}
+	tc.entries[key] = tc.order.PushFront(&thumbnailCacheEntry{key: key, value: value})
+	for tc.order.Len() > tc.maxEntries {
+		oldest := tc.order.Back()
+		tc.order.Remove(oldest)
+		delete(tc.entries, oldest.Value.(*thumbnailCacheEntry).key)
+	}
+}
+
+func (dma *DirectMediaAPI) downloadThumbnailSource(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range discordgo.DroidDownloadHeaders {
+		req.Header.Set(key, val)
+	}
+	resp, err := dma.proxy.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	} else if resp.ContentLength > maxThumbnailSourceSize {
+		return nil, fmt.Errorf("%w: source too large", errNotThumbnailable)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxThumbnailSourceSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxThumbnailSourceSize {
+		return nil, fmt.Errorf("%w: source too large", errNotThumbnailable)
+	}
+	return data, nil
+}
+
+func (dma *DirectMediaAPI) generateThumbnail(ctx context.Context, url string, params thumbnailParams) (*thumbnail, error) {
+	data, err := dma.downloadThumbnailSource(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errNotThumbnailable, err)
+	} else if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, fmt.Errorf("%w: source has too many pixels", errNotThumbnailable)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errNotThumbnailable, err)
+	}
+	thumb := resizeForThumbnail(src, params)
+	var buf bytes.Buffer
+	if thumb.Opaque() {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		return &thumbnail{Data: buf.Bytes(), MimeType: "image/jpeg"}, err
+	}
+	err = png.Encode(&buf, thumb)
+	return &thumbnail{Data: buf.Bytes(), MimeType: "image/png"}, err
+}
+
+// resizeForThumbnail scales and/or crops the image according to the Matrix thumbnail method semantics:
+// scale fits the whole image within the requested size while keeping the aspect ratio,
+// crop fills the requested size exactly and cuts off the overflowing parts from the middle.
+// Images are never scaled up.
+func resizeForThumbnail(src image.Image, params thumbnailParams) *image.RGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	widthRatio := float64(params.Width) / float64(srcW)
+	heightRatio := float64(params.Height) / float64(srcH)
+	cropRect := bounds
+	var ratio float64
+	if params.Method == thumbnailMethodCrop {
+		ratio = min(max(widthRatio, heightRatio), 1)
+		cropW := min(srcW, int(float64(params.Width)/ratio))
+		cropH := min(srcH, int(float64(params.Height)/ratio))
+		offset := image.Pt(bounds.Min.X+(srcW-cropW)/2, bounds.Min.Y+(srcH-cropH)/2)
+		cropRect = image.Rectangle{Min: offset, Max: offset.Add(image.Pt(cropW, cropH))}
+	} else {
+		ratio = min(widthRatio, heightRatio, 1)
+	}
+	dstW := max(int(float64(cropRect.Dx())*ratio), 1)
+	dstH := max(int(float64(cropRect.Dy())*ratio), 1)
+	return boxResize(src, cropRect, dstW, dstH)
+}
+
+// boxResize downscales the given area of the image by averaging all source pixels that fall into each
+// destination pixel. The source is converted to RGBA one destination row at a time, so that a full-size
+// copy of the source image is never made.
+func boxResize(src image.Image, rect image.Rectangle, dstW, dstH int) *image.RGBA {
+	srcW, srcH := rect.Dx(), rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	var strip *image.RGBA
+	for y := 0; y < dstH; y++ {
+		y0 := y * srcH / dstH
+		y1 := max((y+1)*srcH/dstH, y0+1)
+		stripRect := image.Rect(0, 0, srcW, y1-y0)
+		if strip == nil || strip.Rect.Dy() < stripRect.Dy() {
+			strip = image.NewRGBA(stripRect)
+		}
+		draw.Draw(strip, stripRect, src, image.Pt(rect.Min.X, rect.Min.Y+y0), draw.Src)
+		for x := 0; x < dstW; x++ {
+			x0 := x * srcW / dstW
+			x1 := max((x+1)*srcW/dstW, x0+1)
+			var r, g, b, a, count uint64
+			for sy := 0; sy < y1-y0; sy++ {
+				row := strip.Pix[sy*strip.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					pix := row[sx*4 : sx*4+4]
+					r += uint64(pix[0])
+					g += uint64(pix[1])
+					b += uint64(pix[2])
+					a += uint64(pix[3])
+					count++
+				}
+			}
+			out := dst.Pix[y*dst.Stride+x*4:]
+			out[0] = uint8(r / count)
+			out[1] = uint8(g / count)
+			out[2] = uint8(b / count)
+			out[3] = uint8(a / count)
+		}
+	}
+	return dst
+}
+
+func (dma *DirectMediaAPI) serveThumbnail(w http.ResponseWriter, r *http.Request, thumb *thumbnail) {
+	if isNewFederationMediaRequest(r) {
+		writeFederationMultipart(w, zerolog.Ctx(r.Context()), "", thumb.MimeType, thumb.Data)
+		return
+	}
+	w.Header().Set("Content-Type", thumb.MimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(thumb.Data)))
+	w.Header().Set("Content-Disposition", "inline")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(thumb.Data)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Debug().Err(err).Msg("Failed to write thumbnail response")
+	}
+}
+
+func (dma *DirectMediaAPI) DownloadThumbnail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zerolog.Ctx(ctx)
+	params, err := parseThumbnailParams(r.URL.Query())
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, &mautrix.RespError{
+			ErrCode: mautrix.MInvalidParam.ErrCode,
+			Err:     err.Error(),
+		})
+		return
+	}
+	url, expiresAt, mediaData, ok := dma.resolveMediaRequest(w, r)
+	if !ok {
+		return
+	}
+	if cdnURL := getCDNThumbnailURL(mediaData, url, params); cdnURL != "" {
+		dma.serveMediaURL(w, r, cdnURL, expiresAt)
+		return
+	}
+	thumb, err := dma.getThumbnail(ctx, params.cacheKey(mux.Vars(r)["mediaID"]), url, params)
+	if errors.Is(err, errNotThumbnailable) {
+		// Fall back to the original file for things that aren't images (e.g. lottie stickers)
+		log.Debug().Err(err).Msg("Media can't be thumbnailed, serving original file")
+		dma.serveMediaURL(w, r, url, expiresAt)
+		return
+	} else if err != nil {
+		log.Err(err).Msg("Failed to generate thumbnail")
+		jsonResponse(w, http.StatusBadGateway, &mautrix.RespError{
+			ErrCode: "M_UNKNOWN",
+			Err:     "Failed to generate thumbnail",
+		})
+		return
+	}
+	dma.serveThumbnail(w, r, thumb)
+}
+
+// getThumbnail returns the thumbnail from the cache or generates it. Concurrent requests for the same thumbnail
+// share a single generation, and the total number of thumbnails being generated at once is limited.
+func (dma *DirectMediaAPI) getThumbnail(ctx context.Context, cacheKey, url string, params thumbnailParams) (*thumbnail, error) {
+	if thumb := dma.thumbnailCache.Get(cacheKey); thumb != nil {
+		return thumb, nil
+	}
+	result, err, _ := dma.thumbnailGroup.Do(cacheKey, func() (any, error) {
+		// The generation is shared with other requests, so it shouldn't be cancelled if the first request is
+		ctx := context.WithoutCancel(ctx)
+		err := dma.thumbnailSemaphore.Acquire(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+		defer dma.thumbnailSemaphore.Release(1)
+		thumb, err := dma.generateThumbnail(ctx, url, params)
+		if err != nil {
+			return nil, err
+		}
+		dma.thumbnailCache.Put(cacheKey, thumb)
+		return thumb, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*thumbnail), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+// discordEmbedMedia contains the Matrix URIs of reuploaded images in a rich embed.
+type discordEmbedMedia struct {
+	AuthorIcon id.ContentURIString `json:"author_icon_mxc,omitempty"`
+	Image      id.ContentURIString `json:"image_mxc,omitempty"`
+	FooterIcon id.ContentURIString `json:"footer_icon_mxc,omitempty"`
+}
+
+// matrixEmbedJSON is the format of embeds in the fi.mau.discord.embeds field of Matrix events:
+// the raw Discord embed object with the mxc:// URIs of reuploaded images added.
+type matrixEmbedJSON struct {
+	*discordgo.MessageEmbed
+	discordEmbedMedia
+}
+
+func (portal *Portal) reuploadDiscordEmbedImage(ctx context.Context, intent *appservice.IntentAPI, url, name string) id.ContentURIString {
+	if url == "" {
+		return ""
+	}
+	dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, url, false, portal.attachmentMeta())
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msgf("Failed to reupload %s in embed", name)
+		return ""
+	}
+	return dbFile.MXC.CUString()
+}
+
+func (portal *Portal) reuploadDiscordEmbedMedia(ctx context.Context, intent *appservice.IntentAPI, embed *discordgo.MessageEmbed) (media *discordEmbedMedia) {
+	media = &discordEmbedMedia{}
+	if embed.Author != nil {
+		media.AuthorIcon = portal.reuploadDiscordEmbedImage(ctx, intent, embed.Author.ProxyIconURL, "author icon")
+	}
+	if embed.Image != nil {
+		media.Image = portal.reuploadDiscordEmbedImage(ctx, intent, embed.Image.ProxyURL, "image")
+	}
+	if embed.Footer != nil {
+		media.FooterIcon = portal.reuploadDiscordEmbedImage(ctx, intent, embed.Footer.ProxyIconURL, "footer icon")
+	}
+	return
+}
+
+// renderDiscordEmbedTemplate renders a rich embed with the custom template from the config.
+// If the template fails, it returns an empty string and the built-in rendering should be used instead.
+func (portal *Portal) renderDiscordEmbedTemplate(ctx context.Context, cfg *config.BridgeConfig, embed *discordgo.MessageEmbed, media *discordEmbedMedia) string {
+	params := &config.EmbedParams{
+		Embed:       embed,
+		Title:       htmltemplate.HTML(portal.renderDiscordMarkdownOnlyHTML(embed.Title, false)),
+		Description: htmltemplate.HTML(portal.renderDiscordMarkdownOnlyHTML(embed.Description, true)),
+		Fields:      make([]config.EmbedFieldParams, len(embed.Fields)),
+		AuthorIcon:  htmltemplate.URL(media.AuthorIcon),
+		Image:       htmltemplate.URL(media.Image),
+		FooterIcon:  htmltemplate.URL(media.FooterIcon),
+	}
+	for i, field := range embed.Fields {
+		params.Fields[i] = config.EmbedFieldParams{
+			Name:   htmltemplate.HTML(portal.renderDiscordMarkdownOnlyHTML(field.Name, false)),
+			Value:  htmltemplate.HTML(portal.renderDiscordMarkdownOnlyHTML(field.Value, true)),
+			Inline: field.Inline,
+		}
+	}
+	if embed.Color != 0 {
+		params.Color = fmt.Sprintf("#%06X", embed.Color)
+	}
+	if embed.Timestamp != "" {
+		params.Timestamp, _ = time.Parse(time.RFC3339, embed.Timestamp)
+	}
+	rendered, err := cfg.FormatEmbed(portal.GuildID, params)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to render embed with custom template, falling back to default")
+		return ""
+	}
+	return strings.TrimSpace(rendered)
+}
+
+// convertDiscordRichEmbedPlain renders a rich embed as plain text for the body of the Matrix event.
+// The automatically generated plain text of the HTML is hard to read, especially when fields are rendered as tables.
+func (portal *Portal) convertDiscordRichEmbedPlain(embed *discordgo.MessageEmbed) string {
+	markdownToText := func(text string, allowInlineLinks bool) string {
+		return strings.TrimSpace(format.HTMLToText(portal.renderDiscordMarkdownOnlyHTML(text, allowInlineLinks)))
+	}
+	var lines []string
+	if embed.Author != nil && embed.Author.Name != "" {
+		lines = append(lines, embed.Author.Name)
+	}
+	if embed.Title != "" {
+		title := markdownToText(embed.Title, false)
+		if embed.URL != "" {
+			title = fmt.Sprintf("%s (%s)", title, embed.URL)
+		}
+		lines = append(lines, title)
+	}
+	if embed.Description != "" {
+		lines = append(lines, markdownToText(embed.Description, true))
+	}
+	for _, field := range embed.Fields {
+		lines = append(lines, fmt.Sprintf("%s: %s", markdownToText(field.Name, false), markdownToText(field.Value, true)))
+	}
+	var footerParts []string
+	if embed.Footer != nil && embed.Footer.Text != "" {
+		footerParts = append(footerParts, embed.Footer.Text)
+	}
+	if embed.Timestamp != "" {
+		if parsedTS, err := time.Parse(time.RFC3339, embed.Timestamp); err == nil {
+			footerParts = append(footerParts, parsedTS.Format(discordTimestampStyle('F').Format()))
+		}
+	}
+	if len(footerParts) > 0 {
+		lines = append(lines, strings.Join(footerParts, embedFooterDateSeparator))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	// Quote the embed to separate it from the message text
+	return "> " + strings.ReplaceAll(strings.Join(lines, "\n"), "\n", "\n> ")
+}
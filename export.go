@@ -0,0 +1,560 @@
+package main
+
+import (
+	"archive/zip"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+var (
+	errNoManagementRoom  = errors.New("you don't have a management room with the bridge bot")
+	errExportInProgress  = errors.New("an export of this portal is already in progress")
+	errNothingToExport   = errors.New("there are no bridged messages in this portal")
+	errPortalHasNoMatrix = errors.New("portal doesn't have a Matrix room")
+)
+
+//go:embed export.html.tmpl
+var exportHTMLTemplateSource string
+
+var exportHTMLTemplate = template.Must(template.New("export").Funcs(template.FuncMap{
+	"formatTime": func(ts time.Time) string {
+		return ts.UTC().Format("2006-01-02 15:04:05 MST")
+	},
+	"isImage": func(fileName string) bool {
+		switch strings.ToLower(path.Ext(fileName)) {
+		case ".png", ".jpg", ".jpeg", ".gif", ".webp":
+			return true
+		}
+		return false
+	},
+}).Parse(exportHTMLTemplateSource))
+
+// The dce* types implement the JSON format used by DiscordChatExporter, so that existing tools can read the exports.
+
+type dceExport struct {
+	Guild        dceGuild      `json:"guild"`
+	Channel      dceChannel    `json:"channel"`
+	DateRange    dceDateRange  `json:"dateRange"`
+	ExportedAt   time.Time     `json:"exportedAt"`
+	Messages     []*dceMessage `json:"messages"`
+	MessageCount int           `json:"messageCount"`
+}
+
+type dceGuild struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	IconURL string `json:"iconUrl"`
+}
+
+type dceChannel struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	CategoryID string `json:"categoryId"`
+	Category   string `json:"category"`
+	Name       string `json:"name"`
+	Topic      string `json:"topic"`
+}
+
+type dceDateRange struct {
+	After  *time.Time `json:"after"`
+	Before *time.Time `json:"before"`
+}
+
+type dceMessage struct {
+	ID                 string           `json:"id"`
+	Type               string           `json:"type"`
+	Timestamp          time.Time        `json:"timestamp"`
+	TimestampEdited    *time.Time       `json:"timestampEdited"`
+	CallEndedTimestamp *time.Time       `json:"callEndedTimestamp"`
+	IsPinned           bool             `json:"isPinned"`
+	Content            string           `json:"content"`
+	Author             *dceAuthor       `json:"author"`
+	Attachments        []*dceAttachment `json:"attachments"`
+	Embeds             []any            `json:"embeds"`
+	Stickers           []any            `json:"stickers"`
+	Reactions          []*dceReaction   `json:"reactions"`
+	Mentions           []any            `json:"mentions"`
+	Reference          *dceReference    `json:"reference,omitempty"`
+
+	// Thread is only used for the HTML rendering.
+	Thread *dceExport `json:"-"`
+}
+
+type dceAuthor struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Discriminator string `json:"discriminator"`
+	Nickname      string `json:"nickname"`
+	Color         *int   `json:"color"`
+	IsBot         bool   `json:"isBot"`
+	Roles         []any  `json:"roles"`
+	AvatarURL     string `json:"avatarUrl"`
+}
+
+type dceAttachment struct {
+	ID            string `json:"id"`
+	URL           string `json:"url"`
+	FileName      string `json:"fileName"`
+	FileSizeBytes int    `json:"fileSizeBytes"`
+}
+
+type dceReaction struct {
+	Emoji dceEmoji     `json:"emoji"`
+	Count int          `json:"count"`
+	Users []*dceAuthor `json:"users"`
+}
+
+type dceEmoji struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Code       string `json:"code"`
+	IsAnimated bool   `json:"isAnimated"`
+	ImageURL   string `json:"imageUrl"`
+}
+
+type dceReference struct {
+	MessageID string `json:"messageId"`
+	ChannelID string `json:"channelId"`
+	GuildID   string `json:"guildId"`
+}
+
+type historyExporter struct {
+	portal       *Portal
+	log          zerolog.Logger
+	includeMedia bool
+
+	zip        *zip.Writer
+	authors    map[string]*dceAuthor
+	mediaPaths map[id.ContentURI]string
+}
+
+// CanExportHistory checks whether the given user is allowed to export the history of the portal.
+// The archive includes messages from before the user joined the room, so it's limited to moderators.
+func (portal *Portal) CanExportHistory(user *User) (bool, error) {
+	return portal.isModerator(user)
+}
+
+// ExportHistory builds an archive of all messages bridged into the portal and uploads it to the user's management room.
+// The archive contains the history in the DiscordChatExporter JSON format, a static HTML rendering and optionally media.
+func (portal *Portal) ExportHistory(user *User, includeMedia bool) (id.EventID, error) {
+	if portal.MXID == "" {
+		return "", errPortalHasNoMatrix
+	} else if user.GetManagementRoomID() == "" {
+		return "", errNoManagementRoom
+	} else if !portal.exportLock.TryLock() {
+		return "", errExportInProgress
+	}
+	defer portal.exportLock.Unlock()
+
+	log := portal.log.With().
+		Str("action", "export history").
+		Str("user_id", user.MXID.String()).
+		Bool("include_media", includeMedia).
+		Logger()
+	messages := portal.bridge.DB.Message.GetAll(portal.Key)
+	if len(messages) == 0 {
+		return "", errNothingToExport
+	}
+	log.Info().Int("message_parts", len(messages)).Msg("Exporting portal history")
+
+	file, err := os.CreateTemp("", "mautrix-discord-export-*.zip")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+	exp := &historyExporter{
+		portal:       portal,
+		log:          log,
+		includeMedia: includeMedia,
+		zip:          zip.NewWriter(file),
+		authors:      make(map[string]*dceAuthor),
+		mediaPaths:   make(map[id.ContentURI]string),
+	}
+	if err = exp.writeArchive(messages); err != nil {
+		return "", err
+	} else if err = exp.zip.Close(); err != nil {
+		return "", fmt.Errorf("failed to finish zip file: %w", err)
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("failed to get archive size: %w", err)
+	} else if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to seek archive: %w", err)
+	}
+
+	fileName := fmt.Sprintf("%s-%s.zip", exportFileName(portal.PlainName, portal.Key.ChannelID), time.Now().UTC().Format("2006-01-02"))
+	bot := portal.bridge.Bot
+	resp, err := bot.UploadMedia(mautrix.ReqUploadMedia{
+		Content:       file,
+		ContentLength: size,
+		ContentType:   "application/zip",
+		FileName:      fileName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload archive: %w", err)
+	}
+	sendResp, err := bot.SendMessageEvent(user.GetManagementRoomID(), event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgFile,
+		Body:    fileName,
+		URL:     resp.ContentURI.CUString(),
+		Info: &event.FileInfo{
+			MimeType: "application/zip",
+			Size:     int(size),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to send archive: %w", err)
+	}
+	log.Info().Int64("size", size).Str("event_id", sendResp.EventID.String()).Msg("Finished exporting portal history")
+	return sendResp.EventID, nil
+}
+
+// exportFileName makes a name safe to use as a file name, falling back to the given ID if nothing is left.
+func exportFileName(name, fallback string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r == ' ', r == '.':
+			return '-'
+		default:
+			return -1
+		}
+	}, name)
+	if safe == "" {
+		return fallback
+	}
+	return safe
+}
+
+func (exp *historyExporter) writeArchive(messages []*database.Message) error {
+	portal := exp.portal
+	threads := make(map[string]*database.Thread)
+	for _, thread := range portal.bridge.DB.Thread.GetAllByParentID(portal.Key.ChannelID) {
+		threads[thread.ID] = thread
+	}
+
+	groups := make(map[string][]*dceMessage)
+	messagesByID := make(map[string]*dceMessage)
+	for len(messages) > 0 {
+		partCount := 1
+		for partCount < len(messages) && messages[partCount].DiscordID == messages[0].DiscordID {
+			partCount++
+		}
+		parts := messages[:partCount]
+		messages = messages[partCount:]
+		msg := exp.convertMessage(parts)
+		groups[parts[0].ThreadID] = append(groups[parts[0].ThreadID], msg)
+		messagesByID[msg.ID] = msg
+	}
+
+	mainExport := exp.makeExport(portal.Key.ChannelID, false, groups[""])
+	if err := exp.writeJSON("messages.json", mainExport); err != nil {
+		return err
+	}
+	for threadID, threadMessages := range groups {
+		if threadID == "" {
+			continue
+		}
+		threadExport := exp.makeExport(threadID, true, threadMessages)
+		if err := exp.writeJSON(path.Join("threads", threadID+".json"), threadExport); err != nil {
+			return err
+		}
+		if thread, ok := threads[threadID]; ok {
+			if root, ok := messagesByID[thread.RootDiscordID]; ok {
+				root.Thread = threadExport
+			}
+		}
+	}
+	writer, err := exp.zip.Create("messages.html")
+	if err != nil {
+		return fmt.Errorf("failed to create HTML file in archive: %w", err)
+	} else if err = exportHTMLTemplate.Execute(writer, mainExport); err != nil {
+		return fmt.Errorf("failed to render HTML: %w", err)
+	}
+	return nil
+}
+
+func (exp *historyExporter) writeJSON(name string, data *dceExport) error {
+	writer, err := exp.zip.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create %s in archive: %w", name, err)
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+func (exp *historyExporter) makeExport(channelID string, isThread bool, messages []*dceMessage) *dceExport {
+	portal := exp.portal
+	export := &dceExport{
+		Guild: dceGuild{
+			ID:   "0",
+			Name: "Direct Messages",
+		},
+		Channel: dceChannel{
+			ID:    channelID,
+			Name:  portal.PlainName,
+			Topic: portal.Topic,
+		},
+		ExportedAt:   time.Now().UTC(),
+		Messages:     messages,
+		MessageCount: len(messages),
+	}
+	if export.Messages == nil {
+		export.Messages = []*dceMessage{}
+	}
+	if portal.Guild != nil {
+		export.Guild.ID = portal.Guild.ID
+		export.Guild.Name = portal.Guild.PlainName
+		if portal.Guild.Avatar != "" {
+			export.Guild.IconURL = discordgo.EndpointGuildIcon(portal.Guild.ID, portal.Guild.Avatar)
+		}
+	}
+	if portal.ParentID != "" {
+		export.Channel.CategoryID = portal.ParentID
+		if parent := portal.bridge.GetExistingPortalByID(database.NewPortalKey(portal.ParentID, "")); parent != nil {
+			export.Channel.Category = parent.PlainName
+		}
+	}
+	switch {
+	case isThread:
+		export.Channel.Type = "GuildPublicThread"
+		export.Channel.CategoryID = portal.Key.ChannelID
+		export.Channel.Category = portal.PlainName
+		export.Channel.Name = fmt.Sprintf("Thread %s", channelID)
+	case portal.Type == discordgo.ChannelTypeDM:
+		export.Channel.Type = "DirectTextChat"
+	case portal.Type == discordgo.ChannelTypeGroupDM:
+		export.Channel.Type = "DirectGroupTextChat"
+	case portal.Type == discordgo.ChannelTypeGuildNews:
+		export.Channel.Type = "GuildNews"
+	default:
+		export.Channel.Type = "GuildTextChat"
+	}
+	return export
+}
+
+func (exp *historyExporter) getAuthor(userID string) *dceAuthor {
+	author, ok := exp.authors[userID]
+	if ok {
+		return author
+	}
+	puppet := exp.portal.bridge.GetPuppetByID(userID)
+	author = &dceAuthor{
+		ID:            userID,
+		Name:          puppet.Username,
+		Discriminator: puppet.Discriminator,
+		Nickname:      puppet.Name,
+		IsBot:         puppet.IsBot,
+		Roles:         []any{},
+	}
+	if author.Name == "" {
+		author.Name = puppet.Name
+	}
+	if author.Discriminator == "" || author.Discriminator == "0" {
+		author.Discriminator = "0000"
+	}
+	if puppet.Avatar != "" {
+		if strings.HasPrefix(puppet.Avatar, "a_") {
+			author.AvatarURL = discordgo.EndpointUserAvatarAnimated(userID, puppet.Avatar)
+		} else {
+			author.AvatarURL = discordgo.EndpointUserAvatar(userID, puppet.Avatar)
+		}
+	}
+	exp.authors[userID] = author
+	return author
+}
+
+func (exp *historyExporter) convertMessage(parts []*database.Message) *dceMessage {
+	portal := exp.portal
+	first := parts[0]
+	msg := &dceMessage{
+		ID:          first.DiscordID,
+		Type:        "Default",
+		Timestamp:   first.Timestamp,
+		Author:      exp.getAuthor(first.SenderID),
+		Attachments: []*dceAttachment{},
+		Embeds:      []any{},
+		Stickers:    []any{},
+		Reactions:   []*dceReaction{},
+		Mentions:    []any{},
+	}
+	if !first.EditTimestamp.IsZero() {
+		editTS := first.EditTimestamp
+		msg.TimestampEdited = &editTS
+	}
+	log := exp.log.With().Str("message_id", first.DiscordID).Logger()
+
+	var textParts []string
+	for _, part := range parts {
+		evt, err := portal.getEvent(part.MXID)
+		if err != nil {
+			log.Warn().Err(err).Str("event_id", part.MXID.String()).Msg("Failed to get event for export")
+			continue
+		}
+		content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+		if !ok {
+			continue
+		}
+		if msg.Reference == nil {
+			if replyTo := content.RelatesTo.GetReplyTo(); replyTo != "" {
+				if target := portal.bridge.DB.Message.GetByMXID(portal.Key, replyTo); target != nil {
+					msg.Type = "Reply"
+					msg.Reference = &dceReference{
+						MessageID: target.DiscordID,
+						ChannelID: target.DiscordProtoChannelID(),
+						GuildID:   portal.GuildID,
+					}
+				}
+			}
+		}
+		switch content.MsgType {
+		case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+			msg.Attachments = append(msg.Attachments, exp.convertAttachment(log, part, content))
+		default:
+			if evt.Type == event.EventSticker {
+				msg.Attachments = append(msg.Attachments, exp.convertAttachment(log, part, content))
+			} else {
+				textParts = append(textParts, content.Body)
+			}
+		}
+	}
+	msg.Content = strings.Join(textParts, "\n")
+	// Prefer the original Discord markdown of the latest edit if it's known.
+	if edits := portal.bridge.DB.MessageEdit.GetAllForMessage(portal.Key, first.DiscordID); len(edits) > 0 {
+		msg.Content = edits[len(edits)-1].Content
+	}
+
+	reactionsByEmoji := make(map[string]*dceReaction)
+	for _, reaction := range portal.bridge.DB.Reaction.GetAllForMessage(portal.Key, first.DiscordID) {
+		converted, ok := reactionsByEmoji[reaction.EmojiName]
+		if !ok {
+			emoji := emojiFromAPIName(reaction.EmojiName)
+			converted = &dceReaction{
+				Emoji: dceEmoji{
+					ID:   emoji.ID,
+					Name: emoji.Name,
+					Code: emoji.Name,
+				},
+			}
+			if emoji.ID != "" {
+				converted.Emoji.ImageURL = discordgo.EndpointEmoji(emoji.ID)
+			}
+			reactionsByEmoji[reaction.EmojiName] = converted
+			msg.Reactions = append(msg.Reactions, converted)
+		}
+		converted.Count++
+		converted.Users = append(converted.Users, exp.getAuthor(reaction.Sender))
+	}
+	return msg
+}
+
+func (exp *historyExporter) convertAttachment(log zerolog.Logger, part *database.Message, content *event.MessageEventContent) *dceAttachment {
+	att := &dceAttachment{
+		ID:       part.AttachmentID,
+		FileName: content.FileName,
+	}
+	if att.FileName == "" {
+		att.FileName = content.Body
+	}
+	if content.Info != nil {
+		att.FileSizeBytes = content.Info.Size
+	}
+	rawMXC := content.URL
+	if content.File != nil {
+		rawMXC = content.File.URL
+	}
+	mxc, err := rawMXC.Parse()
+	if err != nil {
+		log.Warn().Err(err).Str("mxc", string(rawMXC)).Msg("Failed to parse attachment URL for export")
+		return att
+	}
+	if content.File == nil {
+		// The media proxy serves files as-is, so encrypted files can only be linked through the Discord URL
+		att.URL = exp.portal.bridge.makeMediaProxyURL(mxc)
+	}
+	cached := exp.portal.bridge.DB.File.GetByMXC(mxc)
+	if cached != nil {
+		if att.URL == "" {
+			// Discord CDN URLs expire, so they're only used when the file can't be linked through the media proxy
+			att.URL = cached.URL
+		}
+		if cached.Size > 0 {
+			att.FileSizeBytes = cached.Size
+		}
+	}
+	if exp.includeMedia {
+		if mediaPath, err := exp.addMedia(mxc, part, att.FileName, cached, content.File); err != nil {
+			log.Warn().Err(err).Str("mxc", mxc.String()).Msg("Failed to add attachment to export")
+		} else {
+			att.URL = mediaPath
+		}
+	}
+	return att
+}
+
+func (exp *historyExporter) addMedia(mxc id.ContentURI, part *database.Message, fileName string, cached *database.File, file *event.EncryptedFileInfo) (string, error) {
+	if existing, ok := exp.mediaPaths[mxc]; ok {
+		return existing, nil
+	}
+	var decryptionInfo *attachment.EncryptedFile
+	if cached != nil && cached.DecryptionInfo != nil {
+		decryptionInfo = cached.DecryptionInfo
+	} else if file != nil {
+		decryptionInfo = &file.EncryptedFile
+	}
+	if decryptionInfo != nil {
+		if err := decryptionInfo.PrepareForDecryption(); err != nil {
+			return "", fmt.Errorf("failed to prepare decryption: %w", err)
+		}
+	}
+	body, err := exp.portal.MainIntent().Download(mxc)
+	if err != nil {
+		return "", fmt.Errorf("failed to download: %w", err)
+	}
+	defer body.Close()
+	var reader io.ReadCloser = body
+	if decryptionInfo != nil {
+		reader = decryptionInfo.DecryptStream(body)
+	}
+	attachmentID := part.AttachmentID
+	if attachmentID == "" {
+		attachmentID = part.DiscordID
+	}
+	mediaPath := path.Join("media", fmt.Sprintf("%s-%s", attachmentID, path.Base(fileName)))
+	writer, err := exp.zip.Create(mediaPath)
+	if err != nil {
+		return "", err
+	} else if _, err = io.Copy(writer, reader); err != nil {
+		return "", fmt.Errorf("failed to download: %w", err)
+	} else if err = reader.Close(); err != nil {
+		// Closing the decryption stream validates the hash of the file
+		return "", fmt.Errorf("failed to decrypt: %w", err)
+	}
+	exp.mediaPaths[mxc] = mediaPath
+	return mediaPath, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+var errFriendsNotUserAccount = errors.New("friends are only available for user accounts")
+
+// Reactions that are added to friend request notices in the management room as quick actions.
+const (
+	friendRequestAcceptReaction = "✅"
+	friendRequestIgnoreReaction = "❌"
+	friendRequestBlockReaction  = "🚫"
+)
+
+// friendRequestNoticeKey is the custom field in friend request notices that contains the Discord user IDs of the
+// requester and the receiving account, so that the quick actions still work after the bridge is restarted.
+const friendRequestNoticeKey = "fi.mau.discord.friend_request"
+
+func (user *User) relationshipRequest(method, userID string, data any) error {
+	if user.Session == nil {
+		return ErrNotConnected
+	} else if !user.Session.IsUser {
+		return errFriendsNotUserAccount
+	}
+	endpoint := discordgo.EndpointUsers + "@me/relationships"
+	bucket := endpoint
+	if userID != "" {
+		endpoint += "/" + userID
+	}
+	_, err := user.Session.RequestWithBucketID(method, endpoint, data, bucket)
+	return err
+}
+
+// sendFriendRequest sends a friend request by username. Legacy usernames with a discriminator are also accepted.
+func (user *User) sendFriendRequest(username string) error {
+	req := map[string]any{"username": username, "discriminator": nil}
+	if name, discriminator, found := strings.Cut(username, "#"); found {
+		req["username"] = name
+		req["discriminator"] = discriminator
+	}
+	return user.relationshipRequest(http.MethodPost, "", req)
+}
+
+func (user *User) acceptFriendRequest(userID string) error {
+	return user.relationshipRequest(http.MethodPut, userID, struct{}{})
+}
+
+func (user *User) blockDiscordUser(userID string) error {
+	return user.relationshipRequest(http.MethodPut, userID, map[string]any{"type": discordgo.RelationshipBlocked})
+}
+
+// deleteRelationship removes a friend, ignores or cancels a friend request, or unblocks a user.
+func (user *User) deleteRelationship(userID string) error {
+	return user.relationshipRequest(http.MethodDelete, userID, nil)
+}
+
+func (user *User) setFriendNickname(userID, nickname string) error {
+	var nicknameVal *string
+	if nickname != "" {
+		nicknameVal = &nickname
+	}
+	return user.relationshipRequest(http.MethodPatch, userID, map[string]any{"nickname": nicknameVal})
+}
+
+func (user *User) getRelationship(userID string) *discordgo.Relationship {
+	user.relationshipLock.RLock()
+	defer user.relationshipLock.RUnlock()
+	return user.relationships[userID]
+}
+
+// findRelationship finds a relationship by Discord user ID or username.
+func (user *User) findRelationship(query string) *discordgo.Relationship {
+	user.relationshipLock.RLock()
+	defer user.relationshipLock.RUnlock()
+	if rel, ok := user.relationships[query]; ok {
+		return rel
+	}
+	query = strings.TrimPrefix(query, "@")
+	for _, rel := range user.relationships {
+		if rel.User != nil && strings.EqualFold(rel.User.Username, query) {
+			return rel
+		}
+	}
+	return nil
+}
+
+func formatRelationshipUser(rel *discordgo.Relationship) string {
+	if rel.User == nil {
+		return fmt.Sprintf("`%s`", rel.ID)
+	}
+	name := rel.User.DisplayName()
+	if name != rel.User.Username {
+		name = fmt.Sprintf("%s (@%s)", name, rel.User.Username)
+	}
+	return fmt.Sprintf("%s - `%s`", name, rel.ID)
+}
+
+// sendFriendRequestNotice notifies the user about an incoming friend request in the management room.
+// The notice has reactions that can be used to accept, ignore or block the request.
+func (user *User) sendFriendRequestNotice(rel *discordgo.Relationship) {
+	managementRoom := user.GetManagementRoomID()
+	if managementRoom == "" {
+		return
+	}
+	log := user.log.With().Str("action", "send friend request notice").Str("other_user_id", rel.ID).Logger()
+	content := format.RenderMarkdown(user.formatAccountNotice(fmt.Sprintf(
+		"%s sent you a friend request. React with %s to accept, %s to ignore or %s to block them.",
+		formatRelationshipUser(rel), friendRequestAcceptReaction, friendRequestIgnoreReaction, friendRequestBlockReaction,
+	)), true, false)
+	content.MsgType = event.MsgNotice
+	resp, err := user.bridge.Bot.SendMessageEvent(managementRoom, event.EventMessage, &event.Content{
+		Parsed: &content,
+		Raw: map[string]any{
+			friendRequestNoticeKey: map[string]any{
+				"user_id":    rel.ID,
+				"account_id": user.DiscordID,
+			},
+		},
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to send friend request notice")
+		return
+	}
+	user.friendRequestNotices.Set(resp.EventID, rel.ID)
+	for _, key := range []string{friendRequestAcceptReaction, friendRequestIgnoreReaction, friendRequestBlockReaction} {
+		_, err = user.bridge.Bot.SendReaction(managementRoom, resp.EventID, key)
+		if err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("Failed to add quick action reaction to friend request notice")
+		}
+	}
+}
+
+// HandleFriendRequestReaction handles reactions to friend request notices in management rooms.
+func (br *DiscordBridge) HandleFriendRequestReaction(evt *event.Event) {
+	content := evt.Content.AsReaction()
+	var accounts []*User
+	for _, account := range br.GetCachedUserAccounts(evt.Sender) {
+		if account.GetManagementRoomID() == evt.RoomID {
+			accounts = append(accounts, account)
+		}
+	}
+	if len(accounts) == 0 {
+		return
+	}
+	var user *User
+	var otherUserID string
+	for _, account := range accounts {
+		var ok bool
+		if otherUserID, ok = account.friendRequestNotices.Get(content.RelatesTo.EventID); ok {
+			user = account
+			break
+		}
+	}
+	if user == nil {
+		// The notice may have been sent before the bridge was restarted, so check the event itself.
+		var accountID string
+		otherUserID, accountID = br.getFriendRequestNoticeInfo(evt.RoomID, content.RelatesTo.EventID)
+		if otherUserID == "" {
+			return
+		}
+		for _, account := range accounts {
+			if account.DiscordID == accountID {
+				user = account
+				break
+			}
+		}
+		if user == nil {
+			return
+		}
+	}
+	log := user.log.With().
+		Str("action", "handle friend request reaction").
+		Str("other_user_id", otherUserID).
+		Str("key", content.RelatesTo.Key).
+		Logger()
+	rel := user.getRelationship(otherUserID)
+	if rel == nil || rel.Type != discordgo.RelationshipIncomingRequest {
+		user.friendRequestNotices.Delete(content.RelatesTo.EventID)
+		return
+	}
+	var err error
+	var result string
+	otherUser := formatRelationshipUser(rel)
+	switch strings.TrimSuffix(content.RelatesTo.Key, "\ufe0f") {
+	case friendRequestAcceptReaction:
+		err = user.acceptFriendRequest(otherUserID)
+		result = fmt.Sprintf("Accepted friend request from %s", otherUser)
+	case friendRequestIgnoreReaction:
+		err = user.deleteRelationship(otherUserID)
+		result = fmt.Sprintf("Ignored friend request from %s", otherUser)
+	case friendRequestBlockReaction:
+		err = user.blockDiscordUser(otherUserID)
+		result = fmt.Sprintf("Blocked %s", otherUser)
+	default:
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to handle friend request")
+		result = fmt.Sprintf("Failed to handle friend request from %s: %v", otherUser, err)
+	} else {
+		user.friendRequestNotices.Delete(content.RelatesTo.EventID)
+	}
+	reply := format.RenderMarkdown(user.formatAccountNotice(result), true, false)
+	reply.MsgType = event.MsgNotice
+	reply.RelatesTo = (&event.RelatesTo{}).SetReplyTo(content.RelatesTo.EventID)
+	_, err = user.bridge.Bot.SendMessageEvent(evt.RoomID, event.EventMessage, &reply)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to send friend request result notice")
+	}
+}
+
+// getFriendRequestNoticeInfo fetches the given event and returns the requester and receiving account
+// Discord user IDs if it's a friend request notice sent by the bridge bot.
+func (br *DiscordBridge) getFriendRequestNoticeInfo(roomID id.RoomID, eventID id.EventID) (otherUserID, accountID string) {
+	evt, err := br.Bot.GetEvent(roomID, eventID)
+	if err != nil {
+		br.ZLog.Warn().Err(err).
+			Str("room_id", roomID.String()).
+			Str("event_id", eventID.String()).
+			Msg("Failed to get reacted event to check if it's a friend request notice")
+		return
+	}
+	_ = evt.Content.ParseRaw(evt.Type)
+	if evt.Type == event.EventEncrypted && br.Crypto != nil {
+		evt, err = br.Crypto.Decrypt(evt)
+		if err != nil {
+			br.ZLog.Warn().Err(err).
+				Str("room_id", roomID.String()).
+				Str("event_id", eventID.String()).
+				Msg("Failed to decrypt reacted event to check if it's a friend request notice")
+			return
+		}
+	}
+	if evt.Sender != br.Bot.UserID {
+		return
+	}
+	info, ok := evt.Content.Raw[friendRequestNoticeKey].(map[string]any)
+	if !ok {
+		return
+	}
+	otherUserID, _ = info["user_id"].(string)
+	accountID, _ = info["account_id"].(string)
+	return
+}
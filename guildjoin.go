@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+var (
+	errInvalidInvite            = errors.New("invalid invite code")
+	errJoinGuildNotUserAccount  = errors.New("only user accounts can join guilds with invites")
+	errInviteHasNoGuild         = errors.New("invite doesn't point to a guild")
+	errCantBridgeWithoutJoining = errors.New("can't bridge a guild before joining it")
+)
+
+var inviteHosts = map[string]string{
+	"discord.gg":         "/",
+	"discord.com":        "/invite/",
+	"discordapp.com":     "/invite/",
+	"ptb.discord.com":    "/invite/",
+	"canary.discord.com": "/invite/",
+}
+
+// parseInviteCode extracts the invite code from an invite link, or returns the input if it's a plain code.
+func parseInviteCode(input string) string {
+	input = strings.TrimSpace(input)
+	if !strings.Contains(input, "/") {
+		return input
+	}
+	if !strings.Contains(input, "://") {
+		input = "https://" + input
+	}
+	parsed, err := url.Parse(input)
+	if err != nil {
+		return ""
+	}
+	prefix, ok := inviteHosts[strings.ToLower(parsed.Host)]
+	if !ok || !strings.HasPrefix(parsed.Path, prefix) {
+		return ""
+	}
+	code := strings.TrimSuffix(strings.TrimPrefix(parsed.Path, prefix), "/")
+	if code == "" || strings.Contains(code, "/") {
+		return ""
+	}
+	return code
+}
+
+// resolveInvite fetches the guild and channel info of an invite along with approximate member counts.
+func (user *User) resolveInvite(input string) (*discordgo.Invite, error) {
+	code := parseInviteCode(input)
+	if code == "" {
+		return nil, errInvalidInvite
+	} else if user.Session == nil {
+		return nil, ErrNotConnected
+	}
+	invite, err := user.Session.InviteWithCounts(code)
+	if err != nil {
+		return nil, err
+	} else if invite.Guild == nil {
+		return nil, errInviteHasNoGuild
+	}
+	return invite, nil
+}
+
+func formatInviteInfo(invite *discordgo.Invite) string {
+	info := fmt.Sprintf("**%s** (`%s`)", invite.Guild.Name, invite.Guild.ID)
+	if invite.ApproximateMemberCount > 0 {
+		info += fmt.Sprintf(" with %d members (%d online)", invite.ApproximateMemberCount, invite.ApproximatePresenceCount)
+	}
+	if invite.Channel != nil {
+		info += fmt.Sprintf(", invite to #%s", invite.Channel.Name)
+	}
+	return info
+}
+
+// joinGuildByInvite joins the guild of the given invite. If a bridging mode other than nothing is specified,
+// the guild is bridged with that mode as soon as the guild create event arrives.
+func (user *User) joinGuildByInvite(invite *discordgo.Invite, mode database.GuildBridgingMode) (alreadyJoined bool, err error) {
+	if user.Session == nil {
+		return false, ErrNotConnected
+	} else if !user.Session.IsUser {
+		return false, errJoinGuildNotUserAccount
+	}
+	guildID := invite.Guild.ID
+	if _, err = user.Session.State.Guild(guildID); err == nil {
+		return true, user.applyJoinedGuildBridgingMode(guildID, mode)
+	}
+	log := user.log.With().Str("action", "join guild").Str("guild_id", guildID).Str("invite_code", invite.Code).Logger()
+	if mode > database.GuildBridgeNothing {
+		// The guild create event may arrive before the join request returns, so mark it as pending beforehand
+		user.pendingGuildJoins.Set(guildID, mode)
+	}
+	_, err = user.Session.RequestWithBucketID("POST", discordgo.EndpointInvite(invite.Code), struct{}{}, discordgo.EndpointInvite(""))
+	if err != nil {
+		user.pendingGuildJoins.Delete(guildID)
+		return false, err
+	}
+	log.Info().Str("bridging_mode", mode.String()).Msg("Joined guild with invite")
+	return false, nil
+}
+
+func (user *User) applyJoinedGuildBridgingMode(guildID string, mode database.GuildBridgingMode) error {
+	if mode <= database.GuildBridgeNothing {
+		return nil
+	} else if _, err := user.Session.State.Guild(guildID); err != nil {
+		return errCantBridgeWithoutJoining
+	}
+	err := user.bridgeGuild(guildID, mode == database.GuildBridgeEverything)
+	if err != nil {
+		return err
+	}
+	guild := user.bridge.GetGuildByID(guildID, false)
+	if guild.BridgingMode != mode {
+		guild.BridgingMode = mode
+		guild.Update()
+	}
+	return nil
+}
+
+// handlePendingGuildJoin bridges a newly joined guild if the user asked for it when joining.
+func (user *User) handlePendingGuildJoin(guildID string) {
+	mode, ok := user.pendingGuildJoins.Pop(guildID)
+	if !ok {
+		return
+	}
+	log := user.log.With().Str("action", "bridge joined guild").Str("guild_id", guildID).Logger()
+	err := user.applyJoinedGuildBridgingMode(guildID, mode)
+	if err != nil {
+		log.Err(err).Msg("Failed to bridge newly joined guild")
+		user.sendManagementNotice("Failed to bridge newly joined guild `%s`: %v", guildID, err)
+	} else {
+		log.Info().Str("bridging_mode", mode.String()).Msg("Bridged newly joined guild")
+	}
+}
+
+// leaveGuild leaves a Discord guild. The guild delete event that follows takes care of cleaning up
+// the portals if delete_guild_on_leave is enabled.
+func (user *User) leaveGuild(guildID string) error {
+	if user.Session == nil {
+		return ErrNotConnected
+	} else if _, err := user.Session.State.Guild(guildID); err != nil {
+		return errors.New("you're not in that guild")
+	}
+	return user.Session.GuildLeave(guildID)
+}
@@ -0,0 +1,41 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInviteCode(t *testing.T) {
+	tests := map[string]string{
+		"abcDEF":                                "abcDEF",
+		"  abcDEF ":                             "abcDEF",
+		"discord.gg/abcDEF":                     "abcDEF",
+		"https://discord.gg/abcDEF":             "abcDEF",
+		"https://discord.com/invite/abcDEF":     "abcDEF",
+		"https://discordapp.com/invite/abcDEF/": "abcDEF",
+		"https://canary.discord.com/invite/a1":  "a1",
+		"https://example.com/invite/abcDEF":     "",
+		"https://discord.com/channels/1/2":      "",
+		"https://discord.gg/":                   "",
+	}
+	for input, expected := range tests {
+		assert.Equal(t, expected, parseInviteCode(input), input)
+	}
+}
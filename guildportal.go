@@ -41,6 +41,8 @@ type Guild struct {
 	log    log.Logger
 
 	roomCreateLock sync.Mutex
+
+	configOverrides configOverrideCache
 }
 
 func (br *DiscordBridge) loadGuild(dbGuild *database.Guild, id string, createIfNotExist bool) *Guild {
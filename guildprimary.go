@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Guild portals are shared by every logged-in member of the guild, so each member's session receives the same
+// events. To avoid handling everything several times and making redundant API requests, one healthy session per
+// guild is elected as the primary, which is used for ingesting events, syncing metadata and backfilling.
+// Other sessions only handle events in channels that the primary can't see.
+
+// isHealthyGuildMember checks whether the user's session is connected and can see the given guild.
+func (user *User) isHealthyGuildMember(guildID string) bool {
+	if !user.connSupervisor.healthy() {
+		return false
+	}
+	session := user.Session
+	if session == nil {
+		return false
+	}
+	_, err := session.State.Guild(guildID)
+	return err == nil
+}
+
+// GetGuildPrimary returns the primary session for the guild, electing a new one if the previous primary
+// is no longer connected or has lost access to the guild. It returns nil if no user can see the guild.
+func (br *DiscordBridge) GetGuildPrimary(guildID string) *User {
+	br.guildPrimariesLock.Lock()
+	previous := br.guildPrimaries[guildID]
+	br.guildPrimariesLock.Unlock()
+	if previous != nil && previous.isHealthyGuildMember(guildID) {
+		return previous
+	}
+	// The candidates must be collected without holding guildPrimariesLock, as usersLock is held
+	// while logging out users, which releases their guilds.
+	candidates := br.getAllLoadedUsers()
+	// Sort the candidates to make elections deterministic
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].MXID != candidates[j].MXID {
+			return candidates[i].MXID < candidates[j].MXID
+		}
+		return candidates[i].Account < candidates[j].Account
+	})
+
+	br.guildPrimariesLock.Lock()
+	defer br.guildPrimariesLock.Unlock()
+	if current := br.guildPrimaries[guildID]; current != previous && current != nil && current.isHealthyGuildMember(guildID) {
+		// Another event elected a primary in the meantime
+		return current
+	}
+	var elected *User
+	for _, candidate := range candidates {
+		if candidate.isHealthyGuildMember(guildID) {
+			elected = candidate
+			break
+		}
+	}
+	if elected == nil {
+		delete(br.guildPrimaries, guildID)
+		return nil
+	}
+	br.guildPrimaries[guildID] = elected
+	log := elected.log.With().Str("guild_id", guildID).Logger()
+	if previous != nil {
+		log.Info().
+			Str("previous_user_id", previous.MXID.String()).
+			Str("previous_account", previous.AccountName()).
+			Msg("Failed over guild to new primary session")
+		// Guild subscriptions were only made by the previous primary
+		go elected.subscribeGuild(guildID)
+	} else {
+		log.Debug().Msg("Elected primary session for guild")
+	}
+	return elected
+}
+
+// releaseGuildPrimary makes the user stop being the primary for the given guild,
+// or for all guilds if the guild ID is empty. The next event will elect a new primary.
+func (br *DiscordBridge) releaseGuildPrimary(user *User, guildID string) {
+	br.guildPrimariesLock.Lock()
+	defer br.guildPrimariesLock.Unlock()
+	for primaryGuildID, primary := range br.guildPrimaries {
+		if primary == user && (guildID == "" || guildID == primaryGuildID) {
+			delete(br.guildPrimaries, primaryGuildID)
+		}
+	}
+}
+
+// isGuildPrimary returns true if the user should handle metadata syncing and backfilling for the guild.
+// DMs and group DMs aren't shared between users, so they're always handled.
+func (user *User) isGuildPrimary(guildID string) bool {
+	if guildID == "" {
+		return true
+	}
+	primary := user.bridge.GetGuildPrimary(guildID)
+	return primary == nil || primary == user
+}
+
+// shouldHandleGuildChannel returns true if the user should handle events and metadata of the given guild channel.
+// In addition to the primary, other members handle channels that the primary can't see, so that events
+// in channels with restricted permissions aren't lost.
+func (user *User) shouldHandleGuildChannel(guildID, channelID string) bool {
+	if guildID == "" {
+		return true
+	}
+	primary := user.bridge.GetGuildPrimary(guildID)
+	if primary == nil || primary == user {
+		return true
+	}
+	session := primary.Session
+	if session == nil {
+		return true
+	}
+	channel, err := session.State.Channel(channelID)
+	if err != nil {
+		return true
+	} else if channel.IsThread() {
+		channel, err = session.State.Channel(channel.ParentID)
+		if err != nil {
+			return true
+		}
+	}
+	return !primary.canSeeChannelCached(channel)
+}
+
+// canSeeChannelCached checks if the user can view the given guild channel using only the session state cache.
+// Unlike channelIsBridgeable, it never makes requests, as it's called for every event received by non-primary
+// sessions. If the permissions can't be determined from the cache, the channel is assumed to be hidden,
+// so that the caller handles the event itself rather than possibly losing it.
+func (user *User) canSeeChannelCached(channel *discordgo.Channel) bool {
+	switch channel.Type {
+	case discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews:
+	default:
+		return false
+	}
+	session := user.Session
+	if session == nil {
+		return false
+	} else if _, err := session.State.Member(channel.GuildID, user.DiscordID); err != nil {
+		return false
+	}
+	perms, err := session.State.UserChannelPermissions(user.DiscordID, channel.ID)
+	return err == nil && perms&discordgo.PermissionViewChannel > 0
+}
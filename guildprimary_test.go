@@ -0,0 +1,121 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func newTestGuildMember(t *testing.T, br *DiscordBridge, mxid id.UserID, guildIDs ...string) *User {
+	session := &discordgo.Session{State: discordgo.NewState()}
+	for _, guildID := range guildIDs {
+		assert.NoError(t, session.State.GuildAdd(&discordgo.Guild{ID: guildID}))
+	}
+	user := &User{User: &database.User{MXID: mxid}, bridge: br, log: zerolog.Nop(), Session: session}
+	user.connSupervisor = &connectionSupervisor{user: user, session: session}
+	br.usersByMXID[mxid] = user
+	return user
+}
+
+func TestGetGuildPrimary(t *testing.T) {
+	br := &DiscordBridge{
+		usersByMXID:    make(map[id.UserID]*User),
+		guildPrimaries: make(map[string]*User),
+	}
+	alice := newTestGuildMember(t, br, "@alice:example.com", "1", "2")
+	bob := newTestGuildMember(t, br, "@bob:example.com", "1")
+
+	assert.Equal(t, alice, br.GetGuildPrimary("1"))
+	assert.True(t, alice.isGuildPrimary("1"))
+	assert.False(t, bob.isGuildPrimary("1"))
+	assert.True(t, bob.isGuildPrimary(""))
+	assert.Nil(t, br.GetGuildPrimary("3"))
+
+	// Reconnecting sessions aren't healthy, so the guild fails over to another member
+	alice.connSupervisor.reconnecting = true
+	assert.Equal(t, bob, br.GetGuildPrimary("1"))
+	assert.Nil(t, br.GetGuildPrimary("2"))
+
+	// Once elected, the primary is kept even if the previous one becomes healthy again
+	alice.connSupervisor.reconnecting = false
+	assert.Equal(t, bob, br.GetGuildPrimary("1"))
+	br.releaseGuildPrimary(bob, "")
+	assert.Equal(t, alice, br.GetGuildPrimary("1"))
+}
+
+func TestHandleGuildChannelInvitesNonPrimary(t *testing.T) {
+	var lock sync.Mutex
+	var invited []string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/state/m.room.member/") {
+			lock.Lock()
+			invited = append(invited, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+			lock.Unlock()
+		}
+		_, _ = w.Write([]byte(`{"event_id":"$event","room_id":"!room:example.com"}`))
+	}))
+	defer hs.Close()
+	as := appservice.Create()
+	as.HomeserverDomain = "example.com"
+	as.Registration = &appservice.Registration{SenderLocalpart: "discordbot"}
+	require.NoError(t, as.SetHomeserverURL(hs.URL))
+
+	br := &DiscordBridge{
+		Bridge:              bridge.Bridge{AS: as, Bot: as.BotIntent()},
+		usersByMXID:         make(map[id.UserID]*User),
+		guildPrimaries:      make(map[string]*User),
+		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
+	}
+	alice := newTestGuildMember(t, br, "@alice:example.com", "1")
+	alice.User.DiscordID = "100"
+	bob := newTestGuildMember(t, br, "@bob:example.com", "1")
+	bob.User.DiscordID = "200"
+	// Bob doesn't have double puppeting, so the invite isn't auto-accepted
+	br.puppetsByCustomMXID[bob.MXID] = &Puppet{}
+	guild, err := alice.Session.State.Guild("1")
+	require.NoError(t, err)
+	guild.OwnerID = alice.DiscordID
+	require.NoError(t, alice.Session.State.MemberAdd(&discordgo.Member{GuildID: "1", User: &discordgo.User{ID: alice.DiscordID}}))
+	channel := &discordgo.Channel{ID: "10", GuildID: "1", Type: discordgo.ChannelTypeGuildText}
+	require.NoError(t, alice.Session.State.ChannelAdd(channel))
+	require.Equal(t, alice, br.GetGuildPrimary("1"))
+	require.False(t, bob.shouldHandleGuildChannel("1", channel.ID))
+
+	portal := &Portal{
+		Portal: &database.Portal{Key: database.PortalKey{ChannelID: channel.ID}, GuildID: "1", MXID: "!room:example.com"},
+		bridge: br,
+		log:    zerolog.Nop(),
+	}
+	bob.handleGuildChannel(&Guild{Guild: &database.Guild{ID: "1"}}, &discordgo.Guild{ID: "1"}, portal, channel)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Contains(t, invited, bob.MXID.String())
+}
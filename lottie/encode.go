@@ -0,0 +1,185 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package lottie
+
+import (
+	"cmp"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"slices"
+)
+
+const (
+	// paletteSampleFrames is the number of frames used for choosing the GIF palette.
+	paletteSampleFrames = 8
+	// gifAlphaThreshold is the minimum alpha for a pixel to be opaque, as GIFs only support binary transparency.
+	gifAlphaThreshold = 128
+)
+
+func (anim *Animation) frameCount(fps int) int {
+	return max(int(math.Ceil((anim.OutPoint-anim.InPoint)/anim.FrameRate*float64(fps))), 1)
+}
+
+func (anim *Animation) frameAt(index, fps int) float64 {
+	return anim.InPoint + float64(index)*anim.FrameRate/float64(fps)
+}
+
+// EncodePNG renders the first frame of the animation as a PNG image.
+func (anim *Animation) EncodePNG(w io.Writer, width, height int) error {
+	return png.Encode(w, anim.RenderFrame(anim.InPoint, width, height))
+}
+
+// EncodeGIF renders the animation with the given size and frame rate and encodes it as an animated GIF.
+func (anim *Animation) EncodeGIF(w io.Writer, width, height, fps int) error {
+	fps = max(fps, 1)
+	count := anim.frameCount(fps)
+	var histogram colorHistogram
+	for i := range min(count, paletteSampleFrames) {
+		histogram.add(anim.RenderFrame(anim.frameAt(i*count/min(count, paletteSampleFrames), fps), width, height))
+	}
+	quantizer := newQuantizer(histogram.palette())
+	// GIF delays are in 1/100ths of a second and most viewers don't support delays shorter than 2
+	delay := max(int(math.Round(100/float64(fps))), 2)
+	out := &gif.GIF{
+		Image:    make([]*image.Paletted, count),
+		Delay:    make([]int, count),
+		Disposal: make([]byte, count),
+	}
+	for i := range count {
+		out.Image[i] = quantizer.convert(anim.RenderFrame(anim.frameAt(i, fps), width, height))
+		out.Delay[i] = delay
+		out.Disposal[i] = gif.DisposalBackground
+	}
+	return gif.EncodeAll(w, out)
+}
+
+// colorKey reduces a color to 5 bits per channel.
+func colorKey(r, g, b uint8) uint16 {
+	return uint16(r>>3)<<10 | uint16(g>>3)<<5 | uint16(b>>3)
+}
+
+// unpremultiply returns the non-premultiplied color of a pixel in an RGBA image.
+func unpremultiply(pix []uint8) (r, g, b uint8) {
+	a := uint32(pix[3])
+	return uint8(min(uint32(pix[0])*255/a, 255)), uint8(min(uint32(pix[1])*255/a, 255)), uint8(min(uint32(pix[2])*255/a, 255))
+}
+
+type colorBucket struct {
+	count      int
+	r, g, b    int
+	averageKey uint16
+}
+
+type colorHistogram struct {
+	buckets map[uint16]*colorBucket
+}
+
+func (h *colorHistogram) add(img *image.RGBA) {
+	if h.buckets == nil {
+		h.buckets = make(map[uint16]*colorBucket)
+	}
+	for i := 0; i < len(img.Pix); i += 4 {
+		pix := img.Pix[i : i+4]
+		if pix[3] < gifAlphaThreshold {
+			continue
+		}
+		r, g, b := unpremultiply(pix)
+		key := colorKey(r, g, b)
+		bucket, ok := h.buckets[key]
+		if !ok {
+			bucket = &colorBucket{averageKey: key}
+			h.buckets[key] = bucket
+		}
+		bucket.count++
+		bucket.r += int(r)
+		bucket.g += int(g)
+		bucket.b += int(b)
+	}
+}
+
+// palette returns the most common colors, with a transparent color at index 0.
+// Lottie stickers are mostly flat colors, so a popularity-based palette works well.
+func (h *colorHistogram) palette() color.Palette {
+	buckets := make([]*colorBucket, 0, len(h.buckets))
+	for _, bucket := range h.buckets {
+		buckets = append(buckets, bucket)
+	}
+	slices.SortFunc(buckets, func(a, b *colorBucket) int {
+		if a.count != b.count {
+			return b.count - a.count
+		}
+		return cmp.Compare(a.averageKey, b.averageKey)
+	})
+	pal := color.Palette{color.RGBA{}}
+	for _, bucket := range buckets[:min(len(buckets), 255)] {
+		pal = append(pal, color.RGBA{
+			R: uint8(bucket.r / bucket.count),
+			G: uint8(bucket.g / bucket.count),
+			B: uint8(bucket.b / bucket.count),
+			A: 255,
+		})
+	}
+	return pal
+}
+
+// quantizer maps colors to the closest palette entry, caching the result for each 15-bit color.
+type quantizer struct {
+	palette color.Palette
+	cache   [1 << 15]int16
+}
+
+func newQuantizer(pal color.Palette) *quantizer {
+	q := &quantizer{palette: pal}
+	for i := range q.cache {
+		q.cache[i] = -1
+	}
+	return q
+}
+
+func (q *quantizer) index(r, g, b uint8) uint8 {
+	key := colorKey(r, g, b)
+	if cached := q.cache[key]; cached >= 0 {
+		return uint8(cached)
+	}
+	best, bestDistance := 0, math.MaxInt
+	// Index 0 is the transparent color
+	for i := 1; i < len(q.palette); i++ {
+		c := q.palette[i].(color.RGBA)
+		dr, dg, db := int(c.R)-int(r), int(c.G)-int(g), int(c.B)-int(b)
+		if distance := dr*dr + dg*dg + db*db; distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	q.cache[key] = int16(best)
+	return uint8(best)
+}
+
+func (q *quantizer) convert(img *image.RGBA) *image.Paletted {
+	out := image.NewPaletted(img.Rect, q.palette)
+	for i, j := 0, 0; i < len(img.Pix); i, j = i+4, j+1 {
+		pix := img.Pix[i : i+4]
+		if pix[3] < gifAlphaThreshold || len(q.palette) == 1 {
+			continue
+		}
+		out.Pix[j] = q.index(unpremultiply(pix))
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package lottie
+
+import (
+	"math"
+)
+
+// valueOr returns the value of the property at the given frame.
+// Missing components are filled in from the given defaults.
+func (p *floatProp) valueOr(frame float64, defaults ...float64) floats {
+	val := p.value(frame, lerpFloats)
+	if len(val) >= len(defaults) {
+		return val
+	}
+	filled := make(floats, len(defaults))
+	copy(filled, defaults)
+	copy(filled, val)
+	return filled
+}
+
+func (p *property[T]) value(frame float64, lerp func(a, b T, t float64) T) T {
+	kfs := p.keyframes
+	if len(kfs) == 0 {
+		return p.static
+	} else if len(kfs) == 1 || frame <= kfs[0].Time {
+		return kfs[0].Start
+	}
+	for i := 0; i < len(kfs)-1; i++ {
+		kf, next := kfs[i], kfs[i+1]
+		if frame >= next.Time {
+			continue
+		}
+		end := kf.End
+		if len(end) == 0 {
+			end = next.Start
+		}
+		if kf.Hold != 0 || len(end) == 0 || next.Time <= kf.Time {
+			return kf.Start
+		}
+		progress := (frame - kf.Time) / (next.Time - kf.Time)
+		if kf.Out != nil && kf.In != nil && len(kf.Out.X) > 0 && len(kf.Out.Y) > 0 && len(kf.In.X) > 0 && len(kf.In.Y) > 0 {
+			progress = cubicBezierEase(progress, kf.Out.X[0], kf.Out.Y[0], kf.In.X[0], kf.In.Y[0])
+		}
+		return lerp(kf.Start, end, progress)
+	}
+	// Past the last keyframe: old files only have the end value in the second to last keyframe
+	last := kfs[len(kfs)-1]
+	if len(last.Start) > 0 {
+		return last.Start
+	}
+	return kfs[len(kfs)-2].End
+}
+
+func lerpFloats(a, b floats, t float64) floats {
+	out := make(floats, min(len(a), len(b)))
+	for i := range out {
+		out[i] = a[i] + (b[i]-a[i])*t
+	}
+	return out
+}
+
+func lerpPoints(a, b [][]float64, t float64) [][]float64 {
+	out := make([][]float64, len(a))
+	for i := range a {
+		out[i] = lerpFloats(a[i], b[i], t)
+	}
+	return out
+}
+
+func lerpBeziers(a, b beziers, t float64) beziers {
+	if len(a) == 0 || len(b) == 0 || len(a[0].V) != len(b[0].V) || len(a[0].In) != len(b[0].In) || len(a[0].Out) != len(b[0].Out) {
+		return a
+	}
+	return beziers{{
+		Closed: a[0].Closed,
+		V:      lerpPoints(a[0].V, b[0].V, t),
+		In:     lerpPoints(a[0].In, b[0].In, t),
+		Out:    lerpPoints(a[0].Out, b[0].Out, t),
+	}}
+}
+
+// cubicBezierEase evaluates a CSS-style cubic bezier timing function with control points (x1, y1) and (x2, y2).
+func cubicBezierEase(t, x1, y1, x2, y2 float64) float64 {
+	if t <= 0 || t >= 1 {
+		return t
+	}
+	bez := func(u, p1, p2 float64) float64 {
+		inv := 1 - u
+		return 3*inv*inv*u*p1 + 3*inv*u*u*p2 + u*u*u
+	}
+	// Find u such that x(u) = t with bisection, which is robust for all valid control points
+	lo, hi := 0.0, 1.0
+	u := t
+	for range 32 {
+		x := bez(u, x1, x2)
+		if math.Abs(x-t) < 1e-6 {
+			break
+		} else if x < t {
+			lo = u
+		} else {
+			hi = u
+		}
+		u = (lo + hi) / 2
+	}
+	return bez(u, y1, y2)
+}
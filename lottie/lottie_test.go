@@ -0,0 +1,219 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package lottie
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "overwrite the golden frames in testdata with the current output")
+
+func loadSample(t *testing.T, name string) *Animation {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	anim, err := Parse(data)
+	require.NoError(t, err)
+	return anim
+}
+
+type rgba struct {
+	R, G, B, A uint8
+}
+
+func pixelAt(img *image.RGBA, x, y int) rgba {
+	pix := img.Pix[img.PixOffset(x, y):]
+	return rgba{pix[0], pix[1], pix[2], pix[3]}
+}
+
+var (
+	transparent = rgba{0, 0, 0, 0}
+	red         = rgba{255, 0, 0, 255}
+	green       = rgba{0, 255, 0, 255}
+	blue        = rgba{0, 0, 255, 255}
+	yellow      = rgba{255, 255, 0, 255}
+	black       = rgba{0, 0, 0, 255}
+)
+
+func TestRender(t *testing.T) {
+	type pixelTest struct {
+		frame    float64
+		x, y     int
+		expected rgba
+	}
+	tests := []struct {
+		sample string
+		pixels []pixelTest
+	}{
+		{"rotating_square.json", []pixelTest{
+			{0, 50, 50, red},
+			{0, 5, 5, transparent},
+			{0, 68, 68, red},
+			// The square is rotated 45 degrees halfway through, so the corners are empty
+			{15, 68, 68, transparent},
+			{15, 50, 23, red},
+			{29, 50, 50, red},
+		}},
+		{"bouncing_ball.json", []pixelTest{
+			{0, 20, 50, blue},
+			{0, 80, 50, transparent},
+			{25, 50, 50, blue},
+			{25, 20, 50, transparent},
+			{49, 78, 50, blue},
+		}},
+		{"outlined_diamond.json", []pixelTest{
+			{0, 50, 50, green},
+			{0, 50, 26, transparent},
+			{0, 50, 30, black},
+			{20, 50, 26, green},
+			{20, 50, 20, black},
+			{20, 50, 15, transparent},
+		}},
+		{"precomp.json", []pixelTest{
+			{0, 50, 50, yellow},
+			{0, 30, 30, yellow},
+			{0, 10, 10, transparent},
+			{0, 90, 50, transparent},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.sample, func(t *testing.T) {
+			anim := loadSample(t, test.sample)
+			for _, pt := range test.pixels {
+				img := anim.RenderFrame(pt.frame, 100, 100)
+				assert.Equal(t, pt.expected, pixelAt(img, pt.x, pt.y), "frame %v at (%d, %d)", pt.frame, pt.x, pt.y)
+			}
+		})
+	}
+}
+
+// sticker_wave.json has the structure of a sticker exported from After Effects with Bodymovin: a parented null
+// controller, a precomp, eased keyframes with spatial tangents, a gradient fill, a layer mask, a track matte and
+// trim paths. The golden frames catch regressions in how those features are rendered or skipped.
+func TestRender_GoldenFrames(t *testing.T) {
+	const size = 128
+	// Allow small differences, e.g. from fused multiply-add on some architectures
+	const (
+		channelTolerance   = 8
+		maxDifferentPixels = size * size / 200
+	)
+	anim := loadSample(t, "sticker_wave.json")
+	for _, frame := range []float64{0, 30, 56, 90} {
+		t.Run(fmt.Sprintf("frame %v", frame), func(t *testing.T) {
+			img := anim.RenderFrame(frame, size, size)
+			goldenPath := filepath.Join("testdata", fmt.Sprintf("sticker_wave_%v.golden.png", frame))
+			if *updateGolden {
+				var buf bytes.Buffer
+				require.NoError(t, png.Encode(&buf, img))
+				require.NoError(t, os.WriteFile(goldenPath, buf.Bytes(), 0644))
+				return
+			}
+			file, err := os.Open(goldenPath)
+			require.NoError(t, err)
+			defer file.Close()
+			golden, err := png.Decode(file)
+			require.NoError(t, err)
+			require.Equal(t, img.Bounds(), golden.Bounds())
+			var different int
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					if !colorsClose(img.At(x, y), golden.At(x, y), channelTolerance) {
+						different++
+					}
+				}
+			}
+			assert.LessOrEqual(t, different, maxDifferentPixels, "too many pixels differ from the golden frame")
+		})
+	}
+}
+
+func colorsClose(a, b color.Color, tolerance uint32) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	diff := func(x, y uint32) uint32 {
+		if x > y {
+			return (x - y) >> 8
+		}
+		return (y - x) >> 8
+	}
+	return diff(ar, br) <= tolerance && diff(ag, bg) <= tolerance && diff(ab, bb) <= tolerance && diff(aa, ba) <= tolerance
+}
+
+func TestRender_NonSquareOutput(t *testing.T) {
+	anim := loadSample(t, "precomp.json")
+	img := anim.RenderFrame(0, 200, 100)
+	// The animation is centered, so the square is between x=75 and x=125
+	assert.Equal(t, yellow, pixelAt(img, 100, 50))
+	assert.Equal(t, transparent, pixelAt(img, 60, 50))
+	assert.Equal(t, transparent, pixelAt(img, 140, 50))
+}
+
+func TestEncodeGIF(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	require.NoError(t, err)
+	require.NotEmpty(t, samples)
+	for _, sample := range samples {
+		t.Run(filepath.Base(sample), func(t *testing.T) {
+			anim := loadSample(t, filepath.Base(sample))
+			var buf bytes.Buffer
+			require.NoError(t, anim.EncodeGIF(&buf, 64, 64, 10))
+			decoded, err := gif.DecodeAll(&buf)
+			require.NoError(t, err)
+			assert.Len(t, decoded.Image, anim.frameCount(10))
+			assert.Equal(t, 64, decoded.Config.Width)
+			assert.Equal(t, 10, decoded.Delay[0])
+			_, _, _, alpha := decoded.Image[0].Palette[0].RGBA()
+			assert.Zero(t, alpha, "first palette entry should be transparent")
+		})
+	}
+}
+
+func TestEncodePNG(t *testing.T) {
+	anim := loadSample(t, "rotating_square.json")
+	var buf bytes.Buffer
+	require.NoError(t, anim.EncodePNG(&buf, 32, 32))
+	cfg, format, err := image.DecodeConfig(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, 32, cfg.Width)
+}
+
+func TestParse_Invalid(t *testing.T) {
+	_, err := Parse([]byte("not json"))
+	assert.ErrorIs(t, err, ErrInvalidAnimation)
+	_, err = Parse([]byte(`{"w": 100, "h": 100, "ip": 0, "op": 10, "layers": []}`))
+	assert.ErrorIs(t, err, ErrInvalidAnimation)
+}
+
+func TestCubicBezierEase(t *testing.T) {
+	assert.InDelta(t, 0.5, cubicBezierEase(0.5, 0.5, 0.5, 0.5, 0.5), 1e-6)
+	assert.InDelta(t, 0.5, cubicBezierEase(0.5, 0.33, 0, 0.67, 1), 1e-3)
+	assert.Less(t, cubicBezierEase(0.25, 0.33, 0, 0.67, 1), 0.25)
+	assert.Equal(t, 0.0, cubicBezierEase(0, 0.33, 0, 0.67, 1))
+	assert.Equal(t, 1.0, cubicBezierEase(1, 0.33, 0, 0.67, 1))
+}
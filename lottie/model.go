@@ -0,0 +1,257 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package lottie implements a minimal Lottie renderer in pure Go.
+//
+// It supports the subset of Lottie that Discord stickers commonly use: shape and precomposition layers,
+// parenting, transforms, groups, paths, rectangles, ellipses, fills, strokes and keyframe easing.
+// Unsupported features like masks, mattes, trim paths and gradients are ignored or approximated.
+package lottie
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	layerTypePrecomp = 0
+	layerTypeNull    = 3
+	layerTypeShape   = 4
+)
+
+var ErrInvalidAnimation = errors.New("invalid lottie animation")
+
+type Animation struct {
+	FrameRate float64  `json:"fr"`
+	InPoint   float64  `json:"ip"`
+	OutPoint  float64  `json:"op"`
+	Width     float64  `json:"w"`
+	Height    float64  `json:"h"`
+	Layers    []*layer `json:"layers"`
+	Assets    []*asset `json:"assets"`
+
+	assets map[string]*asset
+}
+
+type asset struct {
+	ID     string   `json:"id"`
+	Layers []*layer `json:"layers"`
+}
+
+type layer struct {
+	Type        int       `json:"ty"`
+	Index       *int      `json:"ind"`
+	Parent      *int      `json:"parent"`
+	InPoint     float64   `json:"ip"`
+	OutPoint    float64   `json:"op"`
+	StartTime   float64   `json:"st"`
+	Stretch     float64   `json:"sr"`
+	Transform   transform `json:"ks"`
+	Shapes      []*shape  `json:"shapes"`
+	RefID       string    `json:"refId"`
+	Hidden      bool      `json:"hd"`
+	MatteSource int       `json:"td"`
+}
+
+type transform struct {
+	Anchor   floatProp `json:"a"`
+	Position position  `json:"p"`
+	Scale    floatProp `json:"s"`
+	Rotation floatProp `json:"r"`
+	Opacity  floatProp `json:"o"`
+}
+
+// shape is any item in a shape list. The meaning of the single-letter properties depends on the type,
+// e.g. s is the size of rectangles and ellipses, but the scale of group transforms.
+type shape struct {
+	Type   string   `json:"ty"`
+	Hidden bool     `json:"hd"`
+	Items  []*shape `json:"it"`
+
+	Path     pathProp  `json:"ks"`
+	Position position  `json:"p"`
+	Anchor   floatProp `json:"a"`
+	S        floatProp `json:"s"`
+	R        floatProp `json:"r"`
+	Opacity  floatProp `json:"o"`
+	Color    floatProp `json:"c"`
+	Width    floatProp `json:"w"`
+	Gradient *gradient `json:"g"`
+}
+
+type gradient struct {
+	Count  int       `json:"p"`
+	Colors floatProp `json:"k"`
+}
+
+type bezier struct {
+	Closed bool        `json:"c"`
+	V      [][]float64 `json:"v"`
+	In     [][]float64 `json:"i"`
+	Out    [][]float64 `json:"o"`
+}
+
+// beziers is a list of paths. In keyframes, paths are wrapped in an array, while static values are plain objects.
+type beziers []bezier
+
+func (b *beziers) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var single bezier
+		err := json.Unmarshal(data, &single)
+		*b = beziers{single}
+		return err
+	}
+	return json.Unmarshal(data, (*[]bezier)(b))
+}
+
+// floats is a list of numbers that may be represented as a single number in the JSON.
+type floats []float64
+
+func (f *floats) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, (*[]float64)(f))
+	}
+	var num float64
+	if err := json.Unmarshal(data, &num); err != nil {
+		return err
+	}
+	*f = floats{num}
+	return nil
+}
+
+type easing struct {
+	X floats `json:"x"`
+	Y floats `json:"y"`
+}
+
+type keyframe[T floats | beziers] struct {
+	Time  float64 `json:"t"`
+	Start T       `json:"s"`
+	End   T       `json:"e"`
+	In    *easing `json:"i"`
+	Out   *easing `json:"o"`
+	Hold  int     `json:"h"`
+}
+
+// property is a value that may be animated with keyframes.
+type property[T floats | beziers] struct {
+	static    T
+	keyframes []keyframe[T]
+}
+
+type floatProp struct {
+	property[floats]
+}
+
+type pathProp struct {
+	property[beziers]
+}
+
+func (p *property[T]) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] != '{' {
+		// Some properties (like the fill rule) are plain values
+		return json.Unmarshal(data, &p.static)
+	}
+	var raw struct {
+		K json.RawMessage `json:"k"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	} else if len(raw.K) == 0 {
+		return nil
+	}
+	if isKeyframeList(raw.K) {
+		return json.Unmarshal(raw.K, &p.keyframes)
+	}
+	return json.Unmarshal(raw.K, &p.static)
+}
+
+func isKeyframeList(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) < 2 || data[0] != '[' {
+		return false
+	}
+	rest := bytes.TrimSpace(data[1:])
+	if len(rest) == 0 || rest[0] != '{' {
+		return false
+	}
+	// Keyframes always have a time field, which is what separates them from lists of paths.
+	var first []map[string]json.RawMessage
+	if json.Unmarshal(data, &first) != nil || len(first) == 0 {
+		return false
+	}
+	_, hasTime := first[0]["t"]
+	return hasTime
+}
+
+// position is a multidimensional property that may also be split into separate x and y properties.
+type position struct {
+	floatProp
+	split bool
+	x, y  floatProp
+}
+
+func (p *position) UnmarshalJSON(data []byte) error {
+	var split struct {
+		Split bool      `json:"s"`
+		X     floatProp `json:"x"`
+		Y     floatProp `json:"y"`
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &split); err == nil && split.Split {
+			p.split = true
+			p.x = split.X
+			p.y = split.Y
+			return nil
+		}
+	}
+	return p.floatProp.UnmarshalJSON(data)
+}
+
+func (p *position) value(frame float64) floats {
+	if p.split {
+		return floats{p.x.valueOr(frame, 0)[0], p.y.valueOr(frame, 0)[0]}
+	}
+	return p.valueOr(frame, 0, 0)
+}
+
+// Parse parses a Lottie JSON animation.
+func Parse(data []byte) (*Animation, error) {
+	var anim Animation
+	if err := json.Unmarshal(data, &anim); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAnimation, err)
+	}
+	if anim.FrameRate <= 0 || anim.OutPoint <= anim.InPoint || anim.Width <= 0 || anim.Height <= 0 {
+		return nil, fmt.Errorf("%w: missing frame rate, duration or size", ErrInvalidAnimation)
+	}
+	anim.assets = make(map[string]*asset, len(anim.Assets))
+	for _, a := range anim.Assets {
+		anim.assets[a.ID] = a
+	}
+	return &anim, nil
+}
+
+// Duration returns the length of the animation.
+func (anim *Animation) Duration() time.Duration {
+	return time.Duration((anim.OutPoint - anim.InPoint) / anim.FrameRate * float64(time.Second))
+}
@@ -0,0 +1,378 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package lottie
+
+import (
+	"image"
+	"math"
+	"slices"
+)
+
+type point struct {
+	X, Y float64
+}
+
+// matrix is a 2D affine transformation: x' = A*x + C*y + E, y' = B*x + D*y + F.
+type matrix struct {
+	A, B, C, D, E, F float64
+}
+
+var identity = matrix{A: 1, D: 1}
+
+// Mul returns the transformation that applies other first and then m.
+func (m matrix) Mul(other matrix) matrix {
+	return matrix{
+		A: m.A*other.A + m.C*other.B,
+		B: m.B*other.A + m.D*other.B,
+		C: m.A*other.C + m.C*other.D,
+		D: m.B*other.C + m.D*other.D,
+		E: m.A*other.E + m.C*other.F + m.E,
+		F: m.B*other.E + m.D*other.F + m.F,
+	}
+}
+
+func (m matrix) Apply(p point) point {
+	return point{X: m.A*p.X + m.C*p.Y + m.E, Y: m.B*p.X + m.D*p.Y + m.F}
+}
+
+// Scale returns the average scaling factor of the transformation, used for stroke widths.
+func (m matrix) Scale() float64 {
+	return math.Sqrt(math.Abs(m.A*m.D - m.B*m.C))
+}
+
+func translate(x, y float64) matrix {
+	return matrix{A: 1, D: 1, E: x, F: y}
+}
+
+func scale(x, y float64) matrix {
+	return matrix{A: x, D: y}
+}
+
+func rotate(degrees float64) matrix {
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	return matrix{A: cos, B: sin, C: -sin, D: cos}
+}
+
+// polygon is a list of closed contours.
+type polygon [][]point
+
+func (poly polygon) transform(m matrix) polygon {
+	out := make(polygon, len(poly))
+	for i, contour := range poly {
+		out[i] = make([]point, len(contour))
+		for j, p := range contour {
+			out[i][j] = m.Apply(p)
+		}
+	}
+	return out
+}
+
+// flattenBezier converts a cubic bezier segment into line segments, appending the points after p0 to the output.
+func flattenBezier(out []point, p0, c1, c2, p3 point) []point {
+	if c1 == p0 && c2 == p3 {
+		return append(out, p3)
+	}
+	length := math.Hypot(c1.X-p0.X, c1.Y-p0.Y) + math.Hypot(c2.X-c1.X, c2.Y-c1.Y) + math.Hypot(p3.X-c2.X, p3.Y-c2.Y)
+	steps := min(max(int(length/2), 4), 64)
+	for i := 1; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		inv := 1 - t
+		out = append(out, point{
+			X: inv*inv*inv*p0.X + 3*inv*inv*t*c1.X + 3*inv*t*t*c2.X + t*t*t*p3.X,
+			Y: inv*inv*inv*p0.Y + 3*inv*inv*t*c1.Y + 3*inv*t*t*c2.Y + t*t*t*p3.Y,
+		})
+	}
+	return out
+}
+
+func toPoint(coords []float64) point {
+	if len(coords) < 2 {
+		return point{}
+	}
+	return point{X: coords[0], Y: coords[1]}
+}
+
+// flatten converts a Lottie path into a polyline. The tangents are relative to their vertices.
+func (b *bezier) flatten(m matrix) []point {
+	if len(b.V) == 0 {
+		return nil
+	}
+	vertex := func(i int) (v, in, out point) {
+		v = toPoint(b.V[i])
+		if i < len(b.In) {
+			tangent := toPoint(b.In[i])
+			in = point{X: v.X + tangent.X, Y: v.Y + tangent.Y}
+		} else {
+			in = v
+		}
+		if i < len(b.Out) {
+			tangent := toPoint(b.Out[i])
+			out = point{X: v.X + tangent.X, Y: v.Y + tangent.Y}
+		} else {
+			out = v
+		}
+		return
+	}
+	first, _, _ := vertex(0)
+	points := []point{first}
+	segments := len(b.V) - 1
+	if b.Closed {
+		segments++
+	}
+	for i := 0; i < segments; i++ {
+		from, _, c1 := vertex(i)
+		to, c2, _ := vertex((i + 1) % len(b.V))
+		points = flattenBezier(points, from, c1, c2, to)
+	}
+	for i, p := range points {
+		points[i] = m.Apply(p)
+	}
+	return points
+}
+
+func ellipse(center point, rx, ry float64) []point {
+	const steps = 64
+	points := make([]point, steps)
+	for i := range points {
+		sin, cos := math.Sincos(2 * math.Pi * float64(i) / steps)
+		points[i] = point{X: center.X + rx*cos, Y: center.Y + ry*sin}
+	}
+	return points
+}
+
+func roundedRect(center point, width, height, radius float64) []point {
+	x0, y0 := center.X-width/2, center.Y-height/2
+	x1, y1 := center.X+width/2, center.Y+height/2
+	radius = min(radius, width/2, height/2)
+	if radius <= 0 {
+		return []point{{x1, y0}, {x1, y1}, {x0, y1}, {x0, y0}}
+	}
+	const cornerSteps = 8
+	var points []point
+	corners := []struct {
+		cx, cy, startAngle float64
+	}{
+		{x1 - radius, y0 + radius, -90},
+		{x1 - radius, y1 - radius, 0},
+		{x0 + radius, y1 - radius, 90},
+		{x0 + radius, y0 + radius, 180},
+	}
+	for _, corner := range corners {
+		for i := 0; i <= cornerSteps; i++ {
+			angle := (corner.startAngle + 90*float64(i)/cornerSteps) * math.Pi / 180
+			sin, cos := math.Sincos(angle)
+			points = append(points, point{X: corner.cx + radius*cos, Y: corner.cy + radius*sin})
+		}
+	}
+	return points
+}
+
+func signedArea(contour []point) float64 {
+	var area float64
+	for i, p := range contour {
+		next := contour[(i+1)%len(contour)]
+		area += p.X*next.Y - next.X*p.Y
+	}
+	return area / 2
+}
+
+// strokePolyline converts a polyline into a polygon covering a stroke of the given width with round joins.
+// All contours have the same orientation, so the result must be filled with the non-zero rule.
+func strokePolyline(points []point, closed bool, width float64) polygon {
+	var poly polygon
+	half := width / 2
+	addContour := func(contour []point) {
+		if signedArea(contour) < 0 {
+			slices.Reverse(contour)
+		}
+		poly = append(poly, contour)
+	}
+	segments := len(points) - 1
+	if closed {
+		segments++
+	}
+	for i := 0; i < segments; i++ {
+		p0, p1 := points[i], points[(i+1)%len(points)]
+		dx, dy := p1.X-p0.X, p1.Y-p0.Y
+		length := math.Hypot(dx, dy)
+		if length == 0 {
+			continue
+		}
+		nx, ny := -dy/length*half, dx/length*half
+		addContour([]point{
+			{p0.X + nx, p0.Y + ny},
+			{p1.X + nx, p1.Y + ny},
+			{p1.X - nx, p1.Y - ny},
+			{p0.X - nx, p0.Y - ny},
+		})
+	}
+	if half >= 0.5 {
+		for _, p := range points {
+			addContour(ellipse(p, half, half))
+		}
+	}
+	return poly
+}
+
+type edge struct {
+	x0, y0, x1, y1 float64
+	dir            int
+}
+
+// rasterizer fills polygons with anti-aliasing. Coverage is computed exactly in the horizontal direction
+// and by sampling multiple sub-scanlines per pixel in the vertical direction.
+type rasterizer struct {
+	width, height int
+	coverage      []float32
+	edges         []edge
+	crossings     []crossing
+}
+
+type crossing struct {
+	x   float64
+	dir int
+}
+
+const subScanlines = 4
+
+func newRasterizer(width, height int) *rasterizer {
+	return &rasterizer{
+		width:    width,
+		height:   height,
+		coverage: make([]float32, width*height),
+	}
+}
+
+// fill computes the coverage of the polygon and composites the color onto the target image.
+// The color components are non-premultiplied values between 0 and 1.
+func (r *rasterizer) fill(target *image.RGBA, poly polygon, evenOdd bool, red, green, blue, alpha float64) {
+	if alpha <= 0 {
+		return
+	}
+	r.edges = r.edges[:0]
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, contour := range poly {
+		for i, p0 := range contour {
+			p1 := contour[(i+1)%len(contour)]
+			if p0.Y == p1.Y {
+				continue
+			}
+			e := edge{x0: p0.X, y0: p0.Y, x1: p1.X, y1: p1.Y, dir: 1}
+			if e.y0 > e.y1 {
+				e = edge{x0: p1.X, y0: p1.Y, x1: p0.X, y1: p0.Y, dir: -1}
+			}
+			r.edges = append(r.edges, e)
+			minY = min(minY, e.y0)
+			maxY = max(maxY, e.y1)
+		}
+	}
+	if len(r.edges) == 0 {
+		return
+	}
+	slices.SortFunc(r.edges, func(a, b edge) int {
+		if a.y0 < b.y0 {
+			return -1
+		} else if a.y0 > b.y0 {
+			return 1
+		}
+		return 0
+	})
+	startRow := max(int(math.Floor(minY)), 0)
+	endRow := min(int(math.Ceil(maxY)), r.height)
+	if startRow >= endRow {
+		return
+	}
+	clear(r.coverage[startRow*r.width : endRow*r.width])
+
+	active := make([]edge, 0, 16)
+	nextEdge := 0
+	for sub := startRow * subScanlines; sub < endRow*subScanlines; sub++ {
+		y := (float64(sub) + 0.5) / subScanlines
+		for nextEdge < len(r.edges) && r.edges[nextEdge].y0 <= y {
+			active = append(active, r.edges[nextEdge])
+			nextEdge++
+		}
+		active = slices.DeleteFunc(active, func(e edge) bool {
+			return e.y1 <= y
+		})
+		r.crossings = r.crossings[:0]
+		for _, e := range active {
+			if e.y0 > y {
+				continue
+			}
+			x := e.x0 + (y-e.y0)/(e.y1-e.y0)*(e.x1-e.x0)
+			r.crossings = append(r.crossings, crossing{x: x, dir: e.dir})
+		}
+		slices.SortFunc(r.crossings, func(a, b crossing) int {
+			if a.x < b.x {
+				return -1
+			} else if a.x > b.x {
+				return 1
+			}
+			return 0
+		})
+		row := r.coverage[(sub/subScanlines)*r.width : (sub/subScanlines+1)*r.width]
+		winding := 0
+		for i, c := range r.crossings {
+			winding += c.dir
+			inside := winding != 0
+			if evenOdd {
+				inside = winding%2 != 0
+			}
+			if inside && i+1 < len(r.crossings) {
+				addSpan(row, c.x, r.crossings[i+1].x)
+			}
+		}
+	}
+
+	for y := startRow; y < endRow; y++ {
+		row := r.coverage[y*r.width : (y+1)*r.width]
+		for x, cov := range row {
+			if cov <= 0 {
+				continue
+			}
+			a := min(float64(cov), 1) * alpha
+			offset := target.PixOffset(x, y)
+			pix := target.Pix[offset : offset+4 : offset+4]
+			inv := 1 - a
+			pix[0] = uint8(math.Round(red*a*255 + float64(pix[0])*inv))
+			pix[1] = uint8(math.Round(green*a*255 + float64(pix[1])*inv))
+			pix[2] = uint8(math.Round(blue*a*255 + float64(pix[2])*inv))
+			pix[3] = uint8(math.Round(a*255 + float64(pix[3])*inv))
+		}
+	}
+}
+
+// addSpan adds the coverage of a horizontal span on one sub-scanline to the pixel row.
+func addSpan(row []float32, x0, x1 float64) {
+	x0 = max(x0, 0)
+	x1 = min(x1, float64(len(row)))
+	if x1 <= x0 {
+		return
+	}
+	const weight = 1.0 / subScanlines
+	first, last := int(x0), int(math.Ceil(x1))-1
+	if first == last {
+		row[first] += float32((x1 - x0) * weight)
+		return
+	}
+	row[first] += float32((float64(first+1) - x0) * weight)
+	for x := first + 1; x < last; x++ {
+		row[x] += weight
+	}
+	row[last] += float32((x1 - float64(last)) * weight)
+}
@@ -0,0 +1,234 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package lottie
+
+import (
+	"image"
+)
+
+// maxNestingDepth limits precomposition nesting and parent chains to avoid infinite loops in malformed files.
+const maxNestingDepth = 16
+
+type renderer struct {
+	anim   *Animation
+	img    *image.RGBA
+	raster *rasterizer
+}
+
+// RenderFrame renders the given frame of the animation into an image of the given size.
+// The animation is scaled to fit the image while keeping its aspect ratio.
+func (anim *Animation) RenderFrame(frame float64, width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	ratio := min(float64(width)/anim.Width, float64(height)/anim.Height)
+	base := translate((float64(width)-anim.Width*ratio)/2, (float64(height)-anim.Height*ratio)/2).Mul(scale(ratio, ratio))
+	r := &renderer{anim: anim, img: img, raster: newRasterizer(width, height)}
+	r.renderLayers(anim.Layers, frame, base, 1, 0)
+	return img
+}
+
+func (l *layer) localFrame(frame float64) float64 {
+	stretch := l.Stretch
+	if stretch <= 0 {
+		stretch = 1
+	}
+	return (frame - l.StartTime) / stretch
+}
+
+func (r *renderer) renderLayers(layers []*layer, frame float64, base matrix, opacity float64, depth int) {
+	if depth > maxNestingDepth {
+		return
+	}
+	byIndex := make(map[int]*layer, len(layers))
+	for _, l := range layers {
+		if l.Index != nil {
+			byIndex[*l.Index] = l
+		}
+	}
+	// The first layer is the topmost one, so draw in reverse order
+	for i := len(layers) - 1; i >= 0; i-- {
+		l := layers[i]
+		// Matte sources are only used for masking other layers, which isn't supported, so just skip them.
+		if l.Hidden || l.MatteSource != 0 || l.Type == layerTypeNull || frame < l.InPoint || frame >= l.OutPoint {
+			continue
+		}
+		local := l.localFrame(frame)
+		layerMatrix := base.Mul(layerTransform(l, byIndex, frame))
+		layerOpacity := opacity * l.Transform.Opacity.valueOr(local, 100)[0] / 100
+		if layerOpacity <= 0 {
+			continue
+		}
+		switch l.Type {
+		case layerTypeShape:
+			r.renderShapes(l.Shapes, local, layerMatrix, layerOpacity)
+		case layerTypePrecomp:
+			if precomp, ok := r.anim.assets[l.RefID]; ok {
+				r.renderLayers(precomp.Layers, local, layerMatrix, layerOpacity, depth+1)
+			}
+		}
+	}
+}
+
+// layerTransform returns the transformation of the layer including all its parents.
+func layerTransform(l *layer, byIndex map[int]*layer, frame float64) matrix {
+	m := l.Transform.matrix(l.localFrame(frame))
+	current := l
+	for range maxNestingDepth {
+		if current.Parent == nil {
+			break
+		}
+		parent, ok := byIndex[*current.Parent]
+		if !ok || parent == current {
+			break
+		}
+		m = parent.Transform.matrix(parent.localFrame(frame)).Mul(m)
+		current = parent
+	}
+	return m
+}
+
+func makeTransform(frame float64, anchorProp *floatProp, positionProp *position, scaleProp, rotationProp *floatProp) matrix {
+	anchor := anchorProp.valueOr(frame, 0, 0)
+	pos := positionProp.value(frame)
+	scaleVal := scaleProp.valueOr(frame, 100, 100)
+	rotation := rotationProp.valueOr(frame, 0)
+	return translate(pos[0], pos[1]).
+		Mul(rotate(rotation[0])).
+		Mul(scale(scaleVal[0]/100, scaleVal[1]/100)).
+		Mul(translate(-anchor[0], -anchor[1]))
+}
+
+func (t *transform) matrix(frame float64) matrix {
+	return makeTransform(frame, &t.Anchor, &t.Position, &t.Scale, &t.Rotation)
+}
+
+// groupTransform finds the transform item of a shape group and returns its matrix and opacity.
+func groupTransform(items []*shape, frame float64) (matrix, float64) {
+	for _, item := range items {
+		if item.Type == "tr" {
+			return makeTransform(frame, &item.Anchor, &item.Position, &item.S, &item.R), item.Opacity.valueOr(frame, 100)[0] / 100
+		}
+	}
+	return identity, 1
+}
+
+// renderShapes draws a shape list. Styles (fills and strokes) apply to all geometry before them in the same list,
+// including geometry in nested groups, and items earlier in the list are drawn on top of later items.
+func (r *renderer) renderShapes(items []*shape, frame float64, m matrix, opacity float64) {
+	groupMatrix, groupOpacity := groupTransform(items, frame)
+	m = m.Mul(groupMatrix)
+	opacity *= groupOpacity
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		if item.Hidden {
+			continue
+		}
+		switch item.Type {
+		case "gr":
+			r.renderShapes(item.Items, frame, m, opacity)
+		case "fl", "gf":
+			var paths []path
+			paths = collectGeometry(paths, items[:i], frame, m, 0)
+			var poly polygon
+			for _, p := range paths {
+				if len(p.points) > 2 {
+					poly = append(poly, p.points)
+				}
+			}
+			red, green, blue := item.color(frame)
+			evenOdd := len(item.R.static) > 0 && item.R.static[0] == 2
+			r.raster.fill(r.img, poly, evenOdd, red, green, blue, opacity*item.Opacity.valueOr(frame, 100)[0]/100)
+		case "st", "gs":
+			var paths []path
+			paths = collectGeometry(paths, items[:i], frame, m, 0)
+			width := item.Width.valueOr(frame, 1)[0] * m.Scale()
+			var poly polygon
+			for _, p := range paths {
+				poly = append(poly, strokePolyline(p.points, p.closed, width)...)
+			}
+			red, green, blue := item.color(frame)
+			r.raster.fill(r.img, poly, false, red, green, blue, opacity*item.Opacity.valueOr(frame, 100)[0]/100)
+		}
+	}
+}
+
+type path struct {
+	points []point
+	closed bool
+}
+
+func collectGeometry(out []path, items []*shape, frame float64, m matrix, depth int) []path {
+	if depth > maxNestingDepth {
+		return out
+	}
+	for _, item := range items {
+		if item.Hidden {
+			continue
+		}
+		switch item.Type {
+		case "sh":
+			for _, b := range item.Path.value(frame, lerpBeziers) {
+				if points := b.flatten(m); len(points) > 1 {
+					out = append(out, path{points: points, closed: b.Closed})
+				}
+			}
+		case "rc":
+			center := toPoint(item.Position.value(frame))
+			size := item.S.valueOr(frame, 0, 0)
+			radius := item.R.valueOr(frame, 0)[0]
+			points := polygon{roundedRect(center, size[0], size[1], radius)}.transform(m)[0]
+			out = append(out, path{points: points, closed: true})
+		case "el":
+			center := toPoint(item.Position.value(frame))
+			size := item.S.valueOr(frame, 0, 0)
+			points := polygon{ellipse(center, size[0]/2, size[1]/2)}.transform(m)[0]
+			out = append(out, path{points: points, closed: true})
+		case "gr":
+			groupMatrix, _ := groupTransform(item.Items, frame)
+			out = collectGeometry(out, item.Items, frame, m.Mul(groupMatrix), depth+1)
+		}
+	}
+	return out
+}
+
+// color returns the color of a fill or stroke. Gradients are approximated with the average of their color stops.
+func (s *shape) color(frame float64) (red, green, blue float64) {
+	var rgb []float64
+	if s.Gradient != nil {
+		stops := s.Gradient.Colors.valueOr(frame)
+		count := s.Gradient.Count
+		if count <= 0 || count*4 > len(stops) {
+			count = len(stops) / 4
+		}
+		if count == 0 {
+			return 0, 0, 0
+		}
+		rgb = make([]float64, 3)
+		for i := range count {
+			for j := range rgb {
+				rgb[j] += stops[i*4+1+j] / float64(count)
+			}
+		}
+	} else {
+		rgb = s.Color.valueOr(frame, 0, 0, 0)
+	}
+	red, green, blue = rgb[0], rgb[1], rgb[2]
+	// Very old files use 0-255 instead of 0-1
+	if red > 1 || green > 1 || blue > 1 {
+		red, green, blue = red/255, green/255, blue/255
+	}
+	return min(max(red, 0), 1), min(max(green, 0), 1), min(max(blue, 0), 1)
+}
@@ -20,6 +20,7 @@ import (
 	_ "embed"
 	"net/http"
 	"sync"
+	"time"
 
 	"go.mau.fi/util/configupgrade"
 	"go.mau.fi/util/exsync"
@@ -57,6 +58,8 @@ type DiscordBridge struct {
 	usersByID   map[string]*User
 	usersLock   sync.Mutex
 
+	extraAccountsByMXID map[id.UserID]map[string]*User
+
 	managementRooms     map[id.RoomID]*User
 	managementRoomsLock sync.Mutex
 
@@ -73,12 +76,18 @@ type DiscordBridge struct {
 	guildsByID   map[string]*Guild
 	guildsLock   sync.Mutex
 
+	guildPrimaries     map[string]*User
+	guildPrimariesLock sync.Mutex
+
 	puppets             map[string]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
 
 	attachmentTransfers         *exsync.Map[attachmentKey, *exsync.ReturnableOnce[*database.File]]
 	parallelAttachmentSemaphore *semaphore.Weighted
+
+	reconcileLimiter *requestLimiter
+	connectSemaphore *semaphore.Weighted
 }
 
 func (br *DiscordBridge) GetExampleConfig() string {
@@ -94,13 +103,16 @@ func (br *DiscordBridge) GetConfigPtr() interface{} {
 }
 
 func (br *DiscordBridge) Init() {
-	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
+	br.CommandProcessor = &accountCommandProcessor{commands.NewProcessor(&br.Bridge), br}
 	br.RegisterCommands()
 	br.EventProcessor.On(event.StateTombstone, br.HandleTombstone)
+	br.EventProcessor.On(event.EventReaction, br.HandleFriendRequestReaction)
 
 	matrixHTMLParser.PillConverter = br.pillConverter
 
 	br.DB = database.New(br.Bridge.DB, br.Log.Sub("Database"))
+	br.connectSemaphore = semaphore.NewWeighted(int64(max(br.Config.Bridge.Connection.MaxConcurrentConnects, 1)))
+	br.reconcileLimiter = newRequestLimiter(time.Duration(br.Config.Bridge.Backfill.Reconcile.RequestIntervalMS) * time.Millisecond)
 	discordLog = br.ZLog.With().Str("component", "discordgo").Logger()
 }
 
@@ -112,17 +124,21 @@ func (br *DiscordBridge) Start() {
 		br.AS.Router.HandleFunc("/mautrix-discord/avatar/{server}/{mediaID}/{checksum}", br.serveMediaProxy).Methods(http.MethodGet)
 	}
 	br.DMA = newDirectMediaAPI(br)
+	go br.runMediaCacheGC()
+	go br.runNotificationSync()
+	go br.runViewingExpiry()
 	br.WaitWebsocketConnected()
 	go br.startUsers()
 }
 
 func (br *DiscordBridge) Stop() {
-	for _, user := range br.usersByMXID {
+	for _, user := range br.getAllLoadedUsers() {
 		if user.Session == nil {
 			continue
 		}
 
 		br.Log.Debugln("Disconnecting", user.MXID)
+		user.connSupervisor.stop()
 		user.Session.Close()
 	}
 }
@@ -156,8 +172,9 @@ func (br *DiscordBridge) GetIGhost(mxid id.UserID) bridge.Ghost {
 	return p
 }
 
-func (br *DiscordBridge) CreatePrivatePortal(id id.RoomID, user bridge.User, ghost bridge.Ghost) {
-	//TODO implement
+func (br *DiscordBridge) CreatePrivatePortal(roomID id.RoomID, user bridge.User, ghost bridge.Ghost) {
+	puppet := ghost.(*Puppet)
+	br.createPrivatePortalFromInvite(roomID, user.(*User).accountForDiscordUser(puppet.ID), puppet)
 }
 
 func main() {
@@ -165,6 +182,8 @@ func main() {
 		usersByMXID: make(map[id.UserID]*User),
 		usersByID:   make(map[string]*User),
 
+		extraAccountsByMXID: make(map[id.UserID]map[string]*User),
+
 		managementRooms: make(map[id.RoomID]*User),
 
 		portalsByMXID: make(map[id.RoomID]*Portal),
@@ -177,6 +196,8 @@ func main() {
 		guildsByID:   make(map[string]*Guild),
 		guildsByMXID: make(map[id.RoomID]*Guild),
 
+		guildPrimaries: make(map[string]*User),
+
 		puppets:             make(map[string]*Puppet),
 		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
 
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	maxEmbedsPerMessage       = 10
+	maxEmbedTitleLength       = 256
+	maxEmbedDescriptionLength = 4096
+	// maxEmbedTotalLength is the limit of characters in all embeds of a message combined.
+	maxEmbedTotalLength = 6000
+)
+
+// canSendEmbeds checks if messages sent with the given session can have embeds.
+// Discord ignores embeds from user accounts, so only bots and relay webhooks (nil session) can send them.
+func canSendEmbeds(sess *discordgo.Session) bool {
+	return sess == nil || !sess.IsUser
+}
+
+func truncateEmbedText(text string, maxLength int) string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) <= maxLength {
+		return string(runes)
+	}
+	return string(runes[:maxLength-1]) + "…"
+}
+
+func embedTextLength(embed *discordgo.MessageEmbed) int {
+	length := utf8.RuneCountInString(embed.Title) + utf8.RuneCountInString(embed.Description)
+	if embed.Footer != nil {
+		length += utf8.RuneCountInString(embed.Footer.Text)
+	}
+	if embed.Author != nil {
+		length += utf8.RuneCountInString(embed.Author.Name)
+	}
+	for _, field := range embed.Fields {
+		length += utf8.RuneCountInString(field.Name) + utf8.RuneCountInString(field.Value)
+	}
+	return length
+}
+
+// limitEmbeds drops embeds that don't fit in a single Discord message. The description of the first embed
+// that doesn't fit is truncated if possible, and all embeds after it are dropped to keep their order.
+func limitEmbeds(embeds []*discordgo.MessageEmbed) []*discordgo.MessageEmbed {
+	if len(embeds) > maxEmbedsPerMessage {
+		embeds = embeds[:maxEmbedsPerMessage]
+	}
+	remaining := maxEmbedTotalLength
+	for i, embed := range embeds {
+		length := embedTextLength(embed)
+		if length <= remaining {
+			remaining -= length
+			continue
+		}
+		descriptionLength := utf8.RuneCountInString(embed.Description)
+		if fitLength := remaining - (length - descriptionLength); fitLength > 1 && embed.Description != "" {
+			trimmed := *embed
+			trimmed.Description = truncateEmbedText(embed.Description, fitLength)
+			return append(slices.Clone(embeds[:i]), &trimmed)
+		}
+		return embeds[:i]
+	}
+	return embeds
+}
+
+// convertMatrixLinkPreviews converts Beeper link previews in a Matrix message into Discord embeds.
+// It also returns the URLs that were converted, so that Discord's own previews can be disabled for them.
+func (portal *Portal) convertMatrixLinkPreviews(raw map[string]any) (embeds []*discordgo.MessageEmbed, convertedURLs []string) {
+	rawPreviews, ok := raw["com.beeper.linkpreviews"]
+	if !ok {
+		return
+	}
+	var previews []*BeeperLinkPreview
+	data, err := json.Marshal(rawPreviews)
+	if err == nil {
+		err = json.Unmarshal(data, &previews)
+	}
+	if err != nil {
+		portal.log.Debug().Err(err).Msg("Failed to parse link previews in Matrix message")
+		return
+	}
+	for _, preview := range previews {
+		if preview == nil || (preview.Title == "" && preview.Description == "") {
+			continue
+		}
+		embed := &discordgo.MessageEmbed{
+			URL:         preview.CanonicalURL,
+			Title:       truncateEmbedText(preview.Title, maxEmbedTitleLength),
+			Description: truncateEmbedText(preview.Description, maxEmbedDescriptionLength),
+		}
+		if embed.URL == "" {
+			embed.URL = preview.MatchedURL
+		}
+		// Encrypted images can't be used, as the media proxy only serves files as-is
+		if preview.ImageURL != "" && preview.ImageEncryption == nil {
+			if mxc, err := preview.ImageURL.Parse(); err == nil {
+				if imageURL := portal.bridge.makeMediaProxyURL(mxc); imageURL != "" {
+					embed.Thumbnail = &discordgo.MessageEmbedThumbnail{
+						URL:    imageURL,
+						Width:  preview.ImageWidth,
+						Height: preview.ImageHeight,
+					}
+				}
+			}
+		}
+		embeds = append(embeds, embed)
+		if preview.MatchedURL != "" {
+			convertedURLs = append(convertedURLs, preview.MatchedURL)
+		}
+	}
+	return
+}
+
+// withoutConvertedPreviews removes converted link preview URLs from the list of links that Discord is allowed to preview.
+func withoutConvertedPreviews(allowedLinkPreviews, convertedURLs []string) []string {
+	if allowedLinkPreviews == nil || len(convertedURLs) == 0 {
+		return allowedLinkPreviews
+	}
+	return slices.DeleteFunc(slices.Clone(allowedLinkPreviews), func(url string) bool {
+		return slices.Contains(convertedURLs, url)
+	})
+}
+
+// extractMatrixHTMLEmbeds converts top-level <details> blocks and blockquotes that start with a bold title
+// into Discord embeds. It returns the content without the converted parts.
+func (portal *Portal) extractMatrixHTMLEmbeds(content *event.MessageEventContent, allowedLinkPreviews []string) (*event.MessageEventContent, []*discordgo.MessageEmbed) {
+	if content.Format != event.FormatHTML || content.FormattedBody == "" {
+		return content, nil
+	}
+	nodes, err := html.ParseFragment(strings.NewReader(content.FormattedBody), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return content, nil
+	}
+	var embeds []*discordgo.MessageEmbed
+	var remaining strings.Builder
+	for _, node := range nodes {
+		var title string
+		var body []*html.Node
+		switch node.DataAtom {
+		case atom.Details:
+			title, body = splitDetailsNode(node)
+		case atom.Blockquote:
+			title, body = splitTitledBlockquote(node)
+		}
+		if title == "" {
+			_ = html.Render(&remaining, node)
+			continue
+		}
+		var bodyHTML strings.Builder
+		for _, child := range body {
+			_ = html.Render(&bodyHTML, child)
+		}
+		description, _ := portal.parseMatrixHTML(&event.MessageEventContent{
+			Format:        event.FormatHTML,
+			FormattedBody: bodyHTML.String(),
+		}, allowedLinkPreviews)
+		embeds = append(embeds, &discordgo.MessageEmbed{
+			Title:       truncateEmbedText(title, maxEmbedTitleLength),
+			Description: truncateEmbedText(description, maxEmbedDescriptionLength),
+		})
+	}
+	if len(embeds) == 0 {
+		return content, nil
+	}
+	newContent := *content
+	newContent.FormattedBody = strings.TrimSpace(remaining.String())
+	if newContent.FormattedBody == "" {
+		newContent.Body = ""
+	}
+	return &newContent, embeds
+}
+
+func nodeText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	var text strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		text.WriteString(nodeText(child))
+	}
+	return text.String()
+}
+
+func isBlankText(node *html.Node) bool {
+	return node.Type == html.TextNode && strings.TrimSpace(node.Data) == ""
+}
+
+// elementChildren returns the children of a node, skipping whitespace between elements.
+func elementChildren(node *html.Node) []*html.Node {
+	var children []*html.Node
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if !isBlankText(child) && child.Type != html.CommentNode {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+func isBold(node *html.Node) bool {
+	return node.DataAtom == atom.Strong || node.DataAtom == atom.B
+}
+
+// siblingsAfter returns all nodes after the given one, including whitespace.
+func siblingsAfter(node *html.Node) (nodes []*html.Node) {
+	for next := node.NextSibling; next != nil; next = next.NextSibling {
+		nodes = append(nodes, next)
+	}
+	return
+}
+
+func splitDetailsNode(node *html.Node) (title string, body []*html.Node) {
+	children := elementChildren(node)
+	if len(children) == 0 || children[0].DataAtom != atom.Summary {
+		return "", nil
+	}
+	return strings.TrimSpace(nodeText(children[0])), siblingsAfter(children[0])
+}
+
+// splitTitledBlockquote finds the title of a blockquote that starts with a heading, a paragraph containing only bold text,
+// or bold text followed by a line break.
+func splitTitledBlockquote(node *html.Node) (title string, body []*html.Node) {
+	children := elementChildren(node)
+	if len(children) == 0 {
+		return "", nil
+	}
+	first := children[0]
+	switch first.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		return strings.TrimSpace(nodeText(first)), siblingsAfter(first)
+	case atom.P:
+		if inner := elementChildren(first); len(inner) == 1 && isBold(inner[0]) {
+			return strings.TrimSpace(nodeText(inner[0])), siblingsAfter(first)
+		}
+	case atom.Strong, atom.B:
+		// Bold text followed by other inline content is just emphasis, not a title
+		if len(children) == 1 {
+			return strings.TrimSpace(nodeText(first)), nil
+		} else if children[1].DataAtom == atom.Br {
+			return strings.TrimSpace(nodeText(first)), siblingsAfter(children[1])
+		}
+	}
+	return "", nil
+}
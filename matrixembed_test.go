@@ -0,0 +1,100 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestExtractMatrixHTMLEmbeds(t *testing.T) {
+	type embedTest struct {
+		name              string
+		html              string
+		expectedRemaining string
+		expectedEmbeds    []*discordgo.MessageEmbed
+	}
+
+	tests := []embedTest{
+		{"Plain text", "hello <b>world</b>", "hello <b>world</b>", nil},
+		{"Details", "<details><summary>Spoiler title</summary>hidden <i>text</i></details>", "", []*discordgo.MessageEmbed{
+			{Title: "Spoiler title", Description: "hidden *text*"},
+		}},
+		{"Details without summary", "<details>hidden</details>", "<details>hidden</details>", nil},
+		{"Blockquote with heading", "<blockquote><h3>Note</h3><p>body</p></blockquote>", "", []*discordgo.MessageEmbed{
+			{Title: "Note", Description: "body"},
+		}},
+		{"Blockquote with bold paragraph", "<blockquote><p><strong>Warning</strong></p><p>careful</p></blockquote>", "", []*discordgo.MessageEmbed{
+			{Title: "Warning", Description: "careful"},
+		}},
+		{"Blockquote with bold and line break", "<blockquote><b>Tip</b><br>do this</blockquote>", "", []*discordgo.MessageEmbed{
+			{Title: "Tip", Description: "do this"},
+		}},
+		{"Bold emphasis in blockquote", "<blockquote><b>Very</b> important</blockquote>", "<blockquote><b>Very</b> important</blockquote>", nil},
+		{"Plain blockquote", "<blockquote>quoted</blockquote>", "<blockquote>quoted</blockquote>", nil},
+		{"Text around embed", "before<details><summary>Title</summary>body</details>after", "beforeafter", []*discordgo.MessageEmbed{
+			{Title: "Title", Description: "body"},
+		}},
+	}
+
+	portal := &Portal{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content, embeds := portal.extractMatrixHTMLEmbeds(&event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Body:          "fallback",
+				Format:        event.FormatHTML,
+				FormattedBody: test.html,
+			}, nil)
+			assert.Equal(t, test.expectedRemaining, content.FormattedBody)
+			assert.Equal(t, test.expectedEmbeds, embeds)
+		})
+	}
+}
+
+func TestLimitEmbeds(t *testing.T) {
+	long := strings.Repeat("a", maxEmbedDescriptionLength)
+	embeds := []*discordgo.MessageEmbed{
+		{Title: "first", Description: long},
+		{Title: "second", Description: long},
+		{Title: "third", Description: "short"},
+	}
+	limited := limitEmbeds(embeds)
+	if assert.Len(t, limited, 2) {
+		assert.Equal(t, long, limited[0].Description)
+		assert.Equal(t, "second", limited[1].Title)
+		assert.Equal(t, maxEmbedTotalLength, embedTextLength(limited[0])+embedTextLength(limited[1]))
+	}
+	// The original embeds must not be modified
+	assert.Equal(t, long, embeds[1].Description)
+
+	many := make([]*discordgo.MessageEmbed, maxEmbedsPerMessage+2)
+	for i := range many {
+		many[i] = &discordgo.MessageEmbed{Title: "title"}
+	}
+	assert.Len(t, limitEmbeds(many), maxEmbedsPerMessage)
+
+	tooLongTitle := []*discordgo.MessageEmbed{
+		{Description: strings.Repeat("a", maxEmbedTotalLength)},
+		{Title: "no room"},
+	}
+	assert.Len(t, limitEmbeds(tooLongTitle), 1)
+}
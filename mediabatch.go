@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// maxDiscordAttachments is the maximum number of attachments in a single Discord message.
+const maxDiscordAttachments = 10
+
+// matrixMediaBatch collects consecutive media events from one Matrix user, so that albums can be sent
+// to Discord as a single message with multiple attachments like the official client does.
+type matrixMediaBatch struct {
+	sender     *User
+	threadID   string
+	threadRoot id.EventID
+
+	events  []*event.Event
+	caption *event.Event
+	req     discordgo.MessageSend
+	files   []*spooledFile
+	size    int64
+	timer   *time.Timer
+}
+
+// canContinue checks if the given event can be added to the batch as another attachment or the caption.
+func (batch *matrixMediaBatch) canContinue(sender *User, evt *event.Event) bool {
+	if sender != batch.sender || evt.Type != event.EventMessage {
+		return false
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || content.GetRelatesTo().GetReplaceID() != "" || content.RelatesTo.GetNonFallbackReplyTo() != "" {
+		return false
+	}
+	return content.RelatesTo.GetThreadParent() == batch.threadRoot
+}
+
+func (batch *matrixMediaBatch) add(evt *event.Event, req *discordgo.MessageSend, file *spooledFile) {
+	// The attachment IDs are indexes in the list of files (or in the list of pre-uploaded attachments)
+	index := strconv.Itoa(len(batch.events))
+	batch.events = append(batch.events, evt)
+	batch.files = append(batch.files, file)
+	batch.size += file.Size()
+	if len(req.Files) > 0 {
+		att := &discordgo.MessageAttachment{ID: index, Filename: req.Files[0].Name}
+		if len(req.Attachments) > 0 {
+			att.Description = req.Attachments[0].Description
+		}
+		batch.req.Files = append(batch.req.Files, req.Files[0])
+		batch.req.Attachments = append(batch.req.Attachments, att)
+	} else if len(req.Attachments) > 0 {
+		att := req.Attachments[0]
+		att.ID = index
+		batch.req.Attachments = append(batch.req.Attachments, att)
+	}
+}
+
+func (batch *matrixMediaBatch) setCaption(evt *event.Event, req *discordgo.MessageSend) {
+	batch.caption = evt
+	batch.req.Content = req.Content
+	batch.req.Embeds = limitEmbeds(append(batch.req.Embeds, req.Embeds...))
+	if req.AllowedMentions != nil {
+		batch.req.AllowedMentions = req.AllowedMentions
+	}
+}
+
+// addToMediaBatch adds a prepared single-attachment message to the current media batch, starting a new batch if necessary.
+// If it returns true, the batch took ownership of the file and the message must not be sent separately.
+func (portal *Portal) addToMediaBatch(sender *User, evt *event.Event, threadID string, req *discordgo.MessageSend, file *spooledFile) bool {
+	window := time.Duration(portal.bridge.Config.Bridge.MediaBatchWindowMS) * time.Millisecond
+	if window <= 0 || file == nil {
+		return false
+	}
+	batch := portal.mediaBatch
+	if batch != nil && (!batch.canContinue(sender, evt) ||
+		len(batch.events) >= maxDiscordAttachments ||
+		batch.size+file.Size() > portal.discordUploadLimit(sender.Session)) {
+		portal.flushMediaBatch()
+		batch = nil
+	}
+	if batch == nil {
+		batch = &matrixMediaBatch{
+			sender:     sender,
+			threadID:   threadID,
+			threadRoot: evt.Content.AsMessage().RelatesTo.GetThreadParent(),
+			// The first event decides the reply and other message-level fields
+			req: *req,
+		}
+		batch.req.Files = nil
+		batch.req.Attachments = nil
+		batch.timer = time.AfterFunc(window, func() {
+			portal.forwardBackfillLock.Lock()
+			defer portal.forwardBackfillLock.Unlock()
+			if portal.mediaBatch == batch {
+				portal.flushMediaBatch()
+			}
+		})
+		portal.mediaBatch = batch
+	} else {
+		batch.timer.Reset(window)
+	}
+	batch.add(evt, req, file)
+	portal.log.Debug().
+		Str("event_id", evt.ID.String()).
+		Int("batch_size", len(batch.events)).
+		Msg("Added media event to batch")
+	return true
+}
+
+// flushMediaBatch sends the current media batch to Discord. The caller must hold forwardBackfillLock.
+func (portal *Portal) flushMediaBatch() {
+	batch := portal.mediaBatch
+	if batch == nil {
+		return
+	}
+	portal.mediaBatch = nil
+	batch.timer.Stop()
+	defer func() {
+		for _, file := range batch.files {
+			_ = file.Close()
+		}
+	}()
+
+	msg, err := portal.sendDiscordMessage(batch.sender, batch.threadID, &batch.req)
+	events := batch.events
+	if batch.caption != nil {
+		events = append(events, batch.caption)
+	}
+	for _, evt := range events {
+		go portal.sendMessageMetrics(evt, err, "Error sending")
+	}
+	if msg == nil {
+		return
+	}
+	// Each Matrix event gets its own part, so that redactions and reactions can target individual attachments
+	parts := make([]database.MessagePart, 0, len(events))
+	for i, evt := range batch.events {
+		if i >= len(msg.Attachments) {
+			portal.log.Warn().
+				Str("message_id", msg.ID).
+				Int("expected_attachments", len(batch.events)).
+				Int("actual_attachments", len(msg.Attachments)).
+				Msg("Discord returned fewer attachments than were sent")
+			break
+		}
+		parts = append(parts, database.MessagePart{AttachmentID: msg.Attachments[i].ID, MXID: evt.ID})
+	}
+	if batch.caption != nil {
+		parts = append(parts, database.MessagePart{MXID: batch.caption.ID})
+	}
+	if len(parts) > 0 {
+		portal.markMatrixMessageSent(batch.sender, msg, batch.threadID, parts)
+	}
+}
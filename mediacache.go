@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"maunium.net/go/mautrix"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+const mediaCacheGCBatchSize = 100
+
+// runMediaCacheGC periodically removes old files from the media cache according to the retention config.
+func (br *DiscordBridge) runMediaCacheGC() {
+	cfg := br.Config.Bridge.MediaCacheGC
+	if cfg.MaxAgeDays <= 0 && cfg.MaxSizeMB <= 0 {
+		return
+	}
+	interval := time.Duration(max(cfg.IntervalMinutes, 1)) * time.Minute
+	for {
+		count, size := br.collectMediaCacheGarbage()
+		if count > 0 {
+			br.ZLog.Info().
+				Int("count", count).
+				Int64("size", size).
+				Msg("Removed old files from media cache")
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (br *DiscordBridge) collectMediaCacheGarbage() (count int, size int64) {
+	cfg := br.Config.Bridge.MediaCacheGC
+	if cfg.MaxAgeDays > 0 {
+		before := time.Now().Add(-time.Duration(cfg.MaxAgeDays) * 24 * time.Hour)
+		for {
+			files := br.DB.File.GetUnusedSince(before, mediaCacheGCBatchSize)
+			for _, file := range files {
+				br.deleteCachedFile(file)
+				count++
+				size += int64(file.Size)
+			}
+			if len(files) < mediaCacheGCBatchSize {
+				break
+			}
+		}
+	}
+	if cfg.MaxSizeMB > 0 {
+		excess := br.DB.File.GetStats().TotalSize - int64(cfg.MaxSizeMB)*1024*1024
+		for excess > 0 {
+			files := br.DB.File.GetLeastRecentlyUsed(mediaCacheGCBatchSize)
+			if len(files) == 0 {
+				break
+			}
+			for _, file := range files {
+				if excess <= 0 {
+					break
+				}
+				br.deleteCachedFile(file)
+				count++
+				size += int64(file.Size)
+				excess -= int64(file.Size)
+			}
+		}
+	}
+	return
+}
+
+// purgeCachedFiles removes the given files from the media cache and returns the total size of the removed files.
+func (br *DiscordBridge) purgeCachedFiles(files []*database.File) (size int64) {
+	for _, file := range files {
+		br.deleteCachedFile(file)
+		size += int64(file.Size)
+	}
+	return
+}
+
+// deleteCachedFile removes the file from the media cache, and if enabled in the config,
+// deletes the media from the homeserver too.
+func (br *DiscordBridge) deleteCachedFile(file *database.File) {
+	file.Delete()
+	if !br.Config.Bridge.MediaCacheGC.DeleteFromHomeserver || file.MXC.Homeserver != br.AS.HomeserverDomain {
+		return
+	} else if br.DB.File.GetByMXC(file.MXC) != nil {
+		// Another cache entry still points at the same media
+		return
+	}
+	_, err := br.Bot.MakeRequest(http.MethodDelete, br.Bot.BuildURL(mautrix.SynapseAdminURLPath{"v1", "media", file.MXC.Homeserver, file.MXC.FileID}), nil, nil)
+	if err != nil {
+		br.ZLog.Warn().Err(err).
+			Str("mxc", file.MXC.String()).
+			Msg("Failed to delete cached media from homeserver")
+	}
+}
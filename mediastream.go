@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// maxInMemoryMediaSize is the maximum amount of media that is buffered in memory per transfer.
+	// Anything larger is spilled into a temporary file.
+	maxInMemoryMediaSize = 4 * 1024 * 1024
+	// mediaSniffSize is the amount of data that is peeked from the start of a stream to detect the mime type and image size.
+	mediaSniffSize = 64 * 1024
+
+	defaultDiscordUploadLimit = 10 * 1024 * 1024
+)
+
+// spooledFile buffers written data in memory up to a limit and spills everything into a temporary file after that.
+type spooledFile struct {
+	maxMemory int
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+}
+
+func newSpooledFile(maxMemory int) *spooledFile {
+	return &spooledFile{maxMemory: maxMemory}
+}
+
+func (sf *spooledFile) Write(p []byte) (n int, err error) {
+	if sf.file == nil && sf.buf.Len()+len(p) > sf.maxMemory {
+		sf.file, err = os.CreateTemp("", "mautrix-discord-media-*")
+		if err != nil {
+			return 0, err
+		}
+		if _, err = sf.file.Write(sf.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		sf.buf = bytes.Buffer{}
+	}
+	if sf.file != nil {
+		n, err = sf.file.Write(p)
+	} else {
+		n, err = sf.buf.Write(p)
+	}
+	sf.size += int64(n)
+	return
+}
+
+// Size returns the total number of bytes written.
+func (sf *spooledFile) Size() int64 {
+	return sf.size
+}
+
+// Reader returns a reader for the data written so far. It must not be used concurrently with Write.
+func (sf *spooledFile) Reader() (io.Reader, error) {
+	if sf.file == nil {
+		return bytes.NewReader(sf.buf.Bytes()), nil
+	}
+	if _, err := sf.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return sf.file, nil
+}
+
+// Bytes reads the whole file into memory. This should only be used for small files.
+func (sf *spooledFile) Bytes() ([]byte, error) {
+	if sf.file == nil {
+		return sf.buf.Bytes(), nil
+	}
+	reader, err := sf.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// Close deletes the temporary file, if one was created.
+func (sf *spooledFile) Close() error {
+	sf.buf = bytes.Buffer{}
+	if sf.file == nil {
+		return nil
+	}
+	_ = sf.file.Close()
+	return os.Remove(sf.file.Name())
+}
+
+// discordUploadLimit returns the maximum size of files that the given session can upload into the portal.
+// Relay webhooks (nil session) only get the default limit, as the guild's boost level isn't known.
+func (portal *Portal) discordUploadLimit(sess *discordgo.Session) int64 {
+	limit := int64(defaultDiscordUploadLimit)
+	if sess == nil || sess.State == nil {
+		return limit
+	}
+	if portal.GuildID != "" {
+		guild, err := sess.State.Guild(portal.GuildID)
+		if err == nil {
+			switch guild.PremiumTier {
+			case discordgo.PremiumTier2:
+				limit = 50 * 1024 * 1024
+			case discordgo.PremiumTier3:
+				limit = 100 * 1024 * 1024
+			}
+		}
+	}
+	if sess.State.User != nil {
+		switch sess.State.User.PremiumType {
+		case 1, 3: // Nitro Classic, Nitro Basic
+			limit = max(limit, 50*1024*1024)
+		case 2: // Nitro
+			limit = max(limit, 500*1024*1024)
+		}
+	}
+	return limit
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// Values of message_notifications in Discord user guild settings.
+const (
+	discordNotifyAllMessages  = 0
+	discordNotifyOnlyMentions = 1
+	discordNotifyNoMessages   = 2
+	discordNotifyParent       = 3
+)
+
+type portalNotificationLevel int
+
+const (
+	portalNotifyAll portalNotificationLevel = iota
+	portalNotifyMentions
+	portalNotifyMuted
+)
+
+func (level portalNotificationLevel) String() string {
+	switch level {
+	case portalNotifyAll:
+		return "all"
+	case portalNotifyMentions:
+		return "mentions"
+	case portalNotifyMuted:
+		return "muted"
+	default:
+		return "unknown"
+	}
+}
+
+func notificationLevelFromDiscord(messageNotifications int) portalNotificationLevel {
+	switch messageNotifications {
+	case discordNotifyOnlyMentions:
+		return portalNotifyMentions
+	case discordNotifyNoMessages:
+		return portalNotifyMuted
+	default:
+		return portalNotifyAll
+	}
+}
+
+const suppressEveryonePushRulePrefix = "fi.mau.discord.suppress_everyone."
+
+type discordMuteConfig struct {
+	EndTime            *time.Time `json:"end_time"`
+	SelectedTimeWindow int        `json:"selected_time_window"`
+}
+
+func isDiscordMuteActive(muted bool, cfg *discordMuteConfig) bool {
+	return muted && (cfg == nil || cfg.EndTime == nil || cfg.EndTime.After(time.Now()))
+}
+
+type discordChannelNotificationOverride struct {
+	ChannelID            string             `json:"channel_id,omitempty"`
+	Muted                bool               `json:"muted"`
+	MuteConfig           *discordMuteConfig `json:"mute_config"`
+	MessageNotifications int                `json:"message_notifications"`
+}
+
+// discordUserGuildSettings is the notification settings object of a single guild. DM settings have an empty guild ID.
+type discordUserGuildSettings struct {
+	GuildID              string                                `json:"guild_id"`
+	Muted                bool                                  `json:"muted"`
+	MuteConfig           *discordMuteConfig                    `json:"mute_config"`
+	MessageNotifications int                                   `json:"message_notifications"`
+	SuppressEveryone     bool                                  `json:"suppress_everyone"`
+	ChannelOverrides     []*discordChannelNotificationOverride `json:"channel_overrides"`
+}
+
+func defaultUserGuildSettings(guildID string) *discordUserGuildSettings {
+	return &discordUserGuildSettings{GuildID: guildID, MessageNotifications: discordNotifyParent}
+}
+
+func (settings *discordUserGuildSettings) channelOverride(channelID string) *discordChannelNotificationOverride {
+	if channelID == "" {
+		return nil
+	}
+	for _, override := range settings.ChannelOverrides {
+		if override.ChannelID == channelID {
+			return override
+		}
+	}
+	return nil
+}
+
+// notificationLevel finds the effective notification level of a channel. Guild mutes take precedence over everything,
+// then channel and category mutes, then the first explicit notification level (channel, category, guild, guild default).
+func (settings *discordUserGuildSettings) notificationLevel(channelID, categoryID string, guildDefault int) portalNotificationLevel {
+	if isDiscordMuteActive(settings.Muted, settings.MuteConfig) {
+		return portalNotifyMuted
+	}
+	overrides := []*discordChannelNotificationOverride{settings.channelOverride(channelID), settings.channelOverride(categoryID)}
+	for _, override := range overrides {
+		if override != nil && isDiscordMuteActive(override.Muted, override.MuteConfig) {
+			return portalNotifyMuted
+		}
+	}
+	for _, override := range overrides {
+		if override != nil && override.MessageNotifications != discordNotifyParent {
+			return notificationLevelFromDiscord(override.MessageNotifications)
+		}
+	}
+	if settings.MessageNotifications != discordNotifyParent {
+		return notificationLevelFromDiscord(settings.MessageNotifications)
+	}
+	return notificationLevelFromDiscord(guildDefault)
+}
+
+func (settings *discordUserGuildSettings) setChannelOverride(newOverride *discordChannelNotificationOverride) {
+	for i, override := range settings.ChannelOverrides {
+		if override.ChannelID == newOverride.ChannelID {
+			settings.ChannelOverrides[i] = newOverride
+			return
+		}
+	}
+	settings.ChannelOverrides = append(settings.ChannelOverrides, newOverride)
+}
+
+func parseReadyUserGuildSettings(rawReady json.RawMessage) ([]*discordUserGuildSettings, error) {
+	var ready struct {
+		UserGuildSettings json.RawMessage `json:"user_guild_settings"`
+	}
+	err := json.Unmarshal(rawReady, &ready)
+	if err != nil || len(ready.UserGuildSettings) == 0 {
+		return nil, err
+	}
+	// Older gateway versions send a plain array instead of an object with entries
+	var entries []*discordUserGuildSettings
+	if bytes.HasPrefix(bytes.TrimSpace(ready.UserGuildSettings), []byte("[")) {
+		err = json.Unmarshal(ready.UserGuildSettings, &entries)
+	} else {
+		var list struct {
+			Entries []*discordUserGuildSettings `json:"entries"`
+		}
+		err = json.Unmarshal(ready.UserGuildSettings, &list)
+		entries = list.Entries
+	}
+	return entries, err
+}
+
+func (user *User) rawEventHandler(evt *discordgo.Event) {
+	if !user.bridge.Config.Bridge.NotificationSync.Enabled {
+		return
+	}
+	switch evt.Type {
+	case "READY":
+		entries, err := parseReadyUserGuildSettings(evt.RawData)
+		if err != nil {
+			user.log.Warn().Err(err).Msg("Failed to parse user guild settings in ready event")
+			return
+		}
+		user.notificationLock.Lock()
+		user.notificationSettings = make(map[string]*discordUserGuildSettings, len(entries))
+		for _, entry := range entries {
+			user.notificationSettings[entry.GuildID] = entry
+		}
+		user.notificationLock.Unlock()
+		user.log.Debug().Int("guild_count", len(entries)).Msg("Received user guild settings")
+		user.syncNotificationSettings(user.getNotificationSyncPortals(nil))
+	case "USER_GUILD_SETTINGS_UPDATE":
+		var settings discordUserGuildSettings
+		err := json.Unmarshal(evt.RawData, &settings)
+		if err != nil {
+			user.log.Warn().Err(err).Msg("Failed to parse user guild settings update")
+			return
+		}
+		user.notificationLock.Lock()
+		if user.notificationSettings == nil {
+			user.notificationLock.Unlock()
+			return
+		}
+		user.notificationSettings[settings.GuildID] = &settings
+		user.notificationLock.Unlock()
+		user.log.Debug().Str("guild_id", settings.GuildID).Msg("User guild settings updated")
+		user.syncNotificationSettings(user.getNotificationSyncPortals(&settings.GuildID))
+	}
+}
+
+// getNotificationSyncPortals returns the portals the user is in, optionally limited to a single guild (empty ID for DMs).
+func (user *User) getNotificationSyncPortals(onlyGuildID *string) (portals []*Portal) {
+	for _, userPortal := range user.GetPortals() {
+		switch userPortal.Type {
+		case database.UserPortalTypeGuild:
+			if onlyGuildID == nil || *onlyGuildID == userPortal.DiscordID {
+				portals = append(portals, user.bridge.GetAllPortalsInGuild(userPortal.DiscordID)...)
+			}
+		case database.UserPortalTypeDM:
+			if onlyGuildID == nil || *onlyGuildID == "" {
+				if portal := user.GetExistingPortalByID(userPortal.DiscordID); portal != nil {
+					portals = append(portals, portal)
+				}
+			}
+		}
+	}
+	return
+}
+
+// getDiscordNotificationLevel finds the notification level of the portal on Discord. The caller must hold notificationLock.
+func (user *User) getDiscordNotificationLevel(portal *Portal, ignoreChannelOverride bool) (level portalNotificationLevel, suppressEveryone, ok bool) {
+	if user.notificationSettings == nil {
+		return
+	}
+	settings, hasSettings := user.notificationSettings[portal.GuildID]
+	if !hasSettings {
+		settings = defaultUserGuildSettings(portal.GuildID)
+	}
+	guildDefault := discordNotifyAllMessages
+	if portal.GuildID != "" && user.Session != nil {
+		if guild, err := user.Session.State.Guild(portal.GuildID); err == nil {
+			guildDefault = int(guild.DefaultMessageNotifications)
+		}
+	}
+	channelID := portal.Key.ChannelID
+	if ignoreChannelOverride {
+		channelID = ""
+	}
+	return settings.notificationLevel(channelID, portal.ParentID, guildDefault), settings.SuppressEveryone, true
+}
+
+func findOverridePushRule(rules *pushrules.PushRuleset, ruleID string) *pushrules.PushRule {
+	for _, rule := range rules.Override {
+		if rule.RuleID == ruleID {
+			return rule
+		}
+	}
+	return nil
+}
+
+func isDontNotifyRule(rule *pushrules.PushRule) bool {
+	return rule != nil && rule.Enabled && !rule.Actions.Should().Notify
+}
+
+// getMatrixNotificationLevel finds the notification level of a room from push rules, using the same rules as Element.
+func getMatrixNotificationLevel(rules *pushrules.PushRuleset, roomID id.RoomID) portalNotificationLevel {
+	if isDontNotifyRule(findOverridePushRule(rules, string(roomID))) {
+		return portalNotifyMuted
+	} else if rules.Room.Map != nil && isDontNotifyRule(rules.Room.Map[string(roomID)]) {
+		return portalNotifyMentions
+	}
+	return portalNotifyAll
+}
+
+func (user *User) setPortalPushRules(intent *appservice.IntentAPI, rules *pushrules.PushRuleset, roomID id.RoomID, level portalNotificationLevel, suppressEveryone bool) error {
+	dontNotify := []pushrules.PushActionType{pushrules.ActionDontNotify}
+	hasOverrideRule := findOverridePushRule(rules, string(roomID)) != nil
+	hasRoomRule := rules.Room.Map != nil && rules.Room.Map[string(roomID)] != nil
+	var errs []error
+	deleteRule := func(kind pushrules.PushRuleType, ruleID string) {
+		err := intent.DeletePushRule("global", kind, ruleID)
+		if err != nil && !errors.Is(err, mautrix.MNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	if level == portalNotifyMuted {
+		errs = append(errs, intent.PutPushRule("global", pushrules.OverrideRule, string(roomID), &mautrix.ReqPutPushRule{
+			Actions: dontNotify,
+			Conditions: []pushrules.PushCondition{{
+				Kind:    pushrules.KindEventMatch,
+				Key:     "room_id",
+				Pattern: string(roomID),
+			}},
+		}))
+	} else if hasOverrideRule {
+		deleteRule(pushrules.OverrideRule, string(roomID))
+	}
+	if level == portalNotifyMentions {
+		errs = append(errs, intent.PutPushRule("global", pushrules.RoomRule, string(roomID), &mautrix.ReqPutPushRule{
+			Actions: dontNotify,
+		}))
+	} else if hasRoomRule {
+		deleteRule(pushrules.RoomRule, string(roomID))
+	}
+
+	suppressRuleID := suppressEveryonePushRulePrefix + string(roomID)
+	hasSuppressRule := findOverridePushRule(rules, suppressRuleID) != nil
+	if suppressEveryone && level != portalNotifyMuted && !hasSuppressRule {
+		// This also suppresses messages that mention both the user and everyone, but there's no better way to express it
+		errs = append(errs, intent.PutPushRule("global", pushrules.OverrideRule, suppressRuleID, &mautrix.ReqPutPushRule{
+			Actions: dontNotify,
+			Conditions: []pushrules.PushCondition{{
+				Kind:    pushrules.KindEventMatch,
+				Key:     "room_id",
+				Pattern: string(roomID),
+			}, {
+				Kind:  pushrules.KindEventPropertyIs,
+				Key:   `content.m\.mentions.room`,
+				Value: true,
+			}},
+		}))
+	} else if (!suppressEveryone || level == portalNotifyMuted) && hasSuppressRule {
+		deleteRule(pushrules.OverrideRule, suppressRuleID)
+	}
+	return errors.Join(errs...)
+}
+
+// pushNotificationLevelToDiscord updates the channel override on Discord after the user changed the room's push rules.
+// The caller must hold notificationLock.
+func (user *User) pushNotificationLevelToDiscord(portal *Portal, level portalNotificationLevel) error {
+	inherited, _, _ := user.getDiscordNotificationLevel(portal, true)
+	override := &discordChannelNotificationOverride{
+		Muted:                level == portalNotifyMuted,
+		MessageNotifications: discordNotifyParent,
+	}
+	if override.Muted {
+		override.MuteConfig = &discordMuteConfig{SelectedTimeWindow: -1}
+	} else if level != inherited {
+		switch level {
+		case portalNotifyAll:
+			override.MessageNotifications = discordNotifyAllMessages
+		case portalNotifyMentions:
+			override.MessageNotifications = discordNotifyOnlyMentions
+		}
+	}
+	guildID := portal.GuildID
+	if guildID == "" {
+		guildID = "@me"
+	}
+	body := map[string]any{
+		"channel_overrides": map[string]*discordChannelNotificationOverride{
+			portal.Key.ChannelID: override,
+		},
+	}
+	resp, err := user.Session.Request(http.MethodPatch, discordgo.EndpointUserGuild("@me", guildID)+"/settings", body)
+	if err != nil {
+		return err
+	}
+	var settings discordUserGuildSettings
+	if err = json.Unmarshal(resp, &settings); err == nil {
+		user.notificationSettings[settings.GuildID] = &settings
+	} else {
+		// The request succeeded, so just update the local copy manually
+		existing, ok := user.notificationSettings[portal.GuildID]
+		if !ok {
+			existing = defaultUserGuildSettings(portal.GuildID)
+			user.notificationSettings[portal.GuildID] = existing
+		}
+		override.ChannelID = portal.Key.ChannelID
+		existing.setChannelOverride(override)
+	}
+	return nil
+}
+
+// syncNotificationSettings syncs the notification settings of the given portals between Discord and the user's push rules.
+// Discord is the source of truth, except when the push rules of a room were changed since they were last synced,
+// in which case the change is sent to Discord (if syncing back is enabled).
+func (user *User) syncNotificationSettings(portals []*Portal) {
+	if len(portals) == 0 {
+		return
+	}
+	intent := user.bridge.GetPuppetByCustomMXID(user.MXID).CustomIntent()
+	if intent == nil {
+		return
+	}
+	user.notificationLock.Lock()
+	hasSettings := user.notificationSettings != nil
+	user.notificationLock.Unlock()
+	if !hasSettings {
+		return
+	}
+	// The push rules are fetched before locking to avoid blocking Discord event handlers on the request
+	rules, err := intent.GetPushRules()
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to get push rules to sync notification settings")
+		return
+	}
+	user.notificationLock.Lock()
+	defer user.notificationLock.Unlock()
+	if user.notificationSettings == nil {
+		return
+	}
+	syncBack := user.bridge.Config.Bridge.NotificationSync.PollIntervalSeconds > 0 && user.Session != nil
+	for _, portal := range portals {
+		if portal.MXID == "" {
+			continue
+		}
+		log := user.log.With().
+			Str("channel_id", portal.Key.ChannelID).
+			Str("room_id", portal.MXID.String()).
+			Logger()
+		matrixLevel := getMatrixNotificationLevel(rules, portal.MXID)
+		syncedLevel, wasSynced := user.notificationLevels[portal.MXID]
+		if syncBack && wasSynced && matrixLevel != syncedLevel {
+			log.Debug().
+				Stringer("old_level", syncedLevel).
+				Stringer("new_level", matrixLevel).
+				Msg("Push rules changed on Matrix, updating Discord notification settings")
+			err = user.pushNotificationLevelToDiscord(portal, matrixLevel)
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to update Discord notification settings")
+			}
+			user.notificationLevels[portal.MXID] = matrixLevel
+			continue
+		}
+		discordLevel, suppressEveryone, ok := user.getDiscordNotificationLevel(portal, false)
+		if !ok {
+			continue
+		}
+		hasSuppressRule := findOverridePushRule(rules, suppressEveryonePushRulePrefix+string(portal.MXID)) != nil
+		wantSuppressRule := suppressEveryone && discordLevel != portalNotifyMuted
+		if matrixLevel != discordLevel || hasSuppressRule != wantSuppressRule {
+			log.Debug().
+				Stringer("level", discordLevel).
+				Bool("suppress_everyone", suppressEveryone).
+				Msg("Updating push rules to match Discord notification settings")
+			err = user.setPortalPushRules(intent, rules, portal.MXID, discordLevel, suppressEveryone)
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to update push rules through double puppet")
+			}
+		}
+		user.notificationLevels[portal.MXID] = discordLevel
+	}
+}
+
+// notificationSyncBatchDelay is how long new portals are collected before syncing their notification settings.
+const notificationSyncBatchDelay = 5 * time.Second
+
+// queueNotificationSync schedules syncing the notification settings of a new portal. Portals created within
+// a short time are synced in a single batch, so that the push rules aren't fetched separately for each one.
+func (user *User) queueNotificationSync(portal *Portal) {
+	user.pendingNotificationSyncLock.Lock()
+	defer user.pendingNotificationSyncLock.Unlock()
+	if user.pendingNotificationSync == nil {
+		user.pendingNotificationSync = make(map[*Portal]struct{})
+		time.AfterFunc(notificationSyncBatchDelay, user.syncPendingNotificationSettings)
+	}
+	user.pendingNotificationSync[portal] = struct{}{}
+}
+
+func (user *User) syncPendingNotificationSettings() {
+	user.pendingNotificationSyncLock.Lock()
+	portals := slices.Collect(maps.Keys(user.pendingNotificationSync))
+	user.pendingNotificationSync = nil
+	user.pendingNotificationSyncLock.Unlock()
+	user.syncNotificationSettings(portals)
+}
+
+func (br *DiscordBridge) runNotificationSync() {
+	cfg := br.Config.Bridge.NotificationSync
+	if !cfg.Enabled || cfg.PollIntervalSeconds <= 0 {
+		return
+	}
+	interval := time.Duration(cfg.PollIntervalSeconds) * time.Second
+	for {
+		time.Sleep(interval)
+		for _, user := range br.getAllLoadedUsers() {
+			if user.Session != nil {
+				user.syncNotificationSettings(user.getNotificationSyncPortals(nil))
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserGuildSettingsNotificationLevel(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	settings := &discordUserGuildSettings{
+		MessageNotifications: discordNotifyParent,
+		ChannelOverrides: []*discordChannelNotificationOverride{
+			{ChannelID: "muted", Muted: true, MessageNotifications: discordNotifyParent},
+			{ChannelID: "expired", Muted: true, MuteConfig: &discordMuteConfig{EndTime: &past}, MessageNotifications: discordNotifyParent},
+			{ChannelID: "mentions", MessageNotifications: discordNotifyOnlyMentions},
+			{ChannelID: "nothing", MessageNotifications: discordNotifyNoMessages},
+			{ChannelID: "category", MessageNotifications: discordNotifyOnlyMentions},
+			{ChannelID: "all", MessageNotifications: discordNotifyAllMessages},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		channelID    string
+		categoryID   string
+		guildDefault int
+		expected     portalNotificationLevel
+	}{
+		{"Guild default all", "other", "", discordNotifyAllMessages, portalNotifyAll},
+		{"Guild default mentions", "other", "", discordNotifyOnlyMentions, portalNotifyMentions},
+		{"Muted channel", "muted", "", discordNotifyAllMessages, portalNotifyMuted},
+		{"Expired mute", "expired", "", discordNotifyAllMessages, portalNotifyAll},
+		{"Mentions only", "mentions", "", discordNotifyAllMessages, portalNotifyMentions},
+		{"No messages", "nothing", "", discordNotifyAllMessages, portalNotifyMuted},
+		{"Inherit from category", "other", "category", discordNotifyAllMessages, portalNotifyMentions},
+		{"Channel overrides category", "all", "category", discordNotifyAllMessages, portalNotifyAll},
+		{"Muted category", "all", "muted", discordNotifyAllMessages, portalNotifyMuted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, settings.notificationLevel(test.channelID, test.categoryID, test.guildDefault))
+		})
+	}
+
+	t.Run("Muted guild", func(t *testing.T) {
+		mutedGuild := &discordUserGuildSettings{Muted: true, MessageNotifications: discordNotifyAllMessages}
+		assert.Equal(t, portalNotifyMuted, mutedGuild.notificationLevel("all", "", discordNotifyAllMessages))
+	})
+}
+
+func TestParseReadyUserGuildSettings(t *testing.T) {
+	entries, err := parseReadyUserGuildSettings([]byte(`{"user_guild_settings": {"entries": [
+		{"guild_id": null, "muted": false, "message_notifications": 3, "channel_overrides": [{"channel_id": "1", "muted": true}]},
+		{"guild_id": "2", "muted": true, "suppress_everyone": true, "message_notifications": 1}
+	], "partial": false, "version": 5}}`))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "", entries[0].GuildID)
+	assert.Equal(t, portalNotifyMuted, entries[0].notificationLevel("1", "", discordNotifyAllMessages))
+	assert.Equal(t, "2", entries[1].GuildID)
+	assert.True(t, entries[1].SuppressEveryone)
+
+	entries, err = parseReadyUserGuildSettings([]byte(`{"user_guild_settings": [{"guild_id": "3", "message_notifications": 2}]}`))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, portalNotifyMuted, entries[0].notificationLevel("", "", discordNotifyAllMessages))
+}
@@ -69,17 +69,31 @@ type Portal struct {
 	matrixMessages  chan portalMatrixMessage
 
 	recentMessages *exsync.RingBuffer[string, *discordgo.Message]
+	// recentDiscordEvents contains the keys of recently handled Discord events, used to drop
+	// duplicates when multiple users receive the same event from their own gateway connections.
+	recentDiscordEvents *exsync.RingBuffer[string, string]
+
+	// botInteractions contains command interactions bridged to Matrix, keyed by the notice event ID
+	botInteractions *exsync.Map[id.EventID, *botInteraction]
 
 	commands     map[string]*discordgo.ApplicationCommand
 	commandsLock sync.RWMutex
 
 	forwardBackfillLock sync.Mutex
+	reconcileLock       sync.Mutex
+	exportLock          sync.Mutex
 
 	currentlyTyping     []id.UserID
 	currentlyTypingLock sync.Mutex
+
+	// mediaBatch is protected by forwardBackfillLock like all other Matrix event handling.
+	mediaBatch *matrixMediaBatch
+
+	configOverrides configOverrideCache
 }
 
 const recentMessageBufferSize = 32
+const recentDiscordEventBufferSize = 256
 
 var _ bridge.Portal = (*Portal)(nil)
 var _ bridge.ReadReceiptHandlingPortal = (*Portal)(nil)
@@ -100,7 +114,7 @@ func (portal *Portal) MarkEncrypted() {
 
 func (portal *Portal) ReceiveMatrixEvent(user bridge.User, evt *event.Event) {
 	if user.GetPermissionLevel() >= bridgeconfig.PermissionLevelUser || portal.RelayWebhookID != "" {
-		portal.matrixMessages <- portalMatrixMessage{user: user.(*User), evt: evt}
+		portal.matrixMessages <- portalMatrixMessage{user: user.(*User).accountForPortal(portal), evt: evt}
 	}
 }
 
@@ -266,7 +280,9 @@ func (br *DiscordBridge) NewPortal(dbPortal *database.Portal) *Portal {
 		discordMessages: make(chan portalDiscordMessage, br.Config.Bridge.PortalMessageBuffer),
 		matrixMessages:  make(chan portalMatrixMessage, br.Config.Bridge.PortalMessageBuffer),
 
-		recentMessages: exsync.NewRingBuffer[string, *discordgo.Message](recentMessageBufferSize),
+		recentMessages:      exsync.NewRingBuffer[string, *discordgo.Message](recentMessageBufferSize),
+		recentDiscordEvents: exsync.NewRingBuffer[string, string](recentDiscordEventBufferSize),
+		botInteractions:     exsync.NewMap[id.EventID, *botInteraction](),
 
 		commands: make(map[string]*discordgo.ApplicationCommand),
 	}
@@ -282,11 +298,70 @@ func (portal *Portal) messageLoop() {
 		case msg := <-portal.matrixMessages:
 			portal.handleMatrixMessages(msg)
 		case msg := <-portal.discordMessages:
+			if portal.isDuplicateDiscordEvent(msg) {
+				continue
+			}
 			portal.handleDiscordMessages(msg)
 		}
 	}
 }
 
+func (portal *Portal) queueDiscordMessage(msg portalDiscordMessage, typeName string) {
+	select {
+	case portal.discordMessages <- msg:
+	default:
+		portal.log.Warn().
+			Str("discord_event", typeName).
+			Str("user_id", msg.user.MXID.String()).
+			Msg("Portal message buffer is full")
+		portal.discordMessages <- msg
+	}
+}
+
+// discordEventKey returns the key that identifies a Discord event for deduplication, or an empty string if
+// the event shouldn't be deduplicated. Events with the same key are duplicates if they also have the same state,
+// which allows reactions to be added again after being removed.
+func discordEventKey(rawEvt any) (key, state string) {
+	switch evt := rawEvt.(type) {
+	case *discordgo.MessageCreate:
+		return "create|" + evt.ID, ""
+	case *discordgo.MessageUpdate:
+		// Updates without an edit timestamp only change embeds, which are usually added rather than replaced
+		edit := fmt.Sprintf("embeds-%d", len(evt.Embeds))
+		if evt.EditedTimestamp != nil {
+			edit = strconv.FormatInt(evt.EditedTimestamp.UnixMilli(), 10)
+		}
+		return "update|" + evt.ID + "|" + edit, ""
+	case *discordgo.MessageDelete:
+		return "delete|" + evt.ID, ""
+	case *discordgo.MessageDeleteBulk:
+		return "delete-bulk|" + strings.Join(evt.Messages, ","), ""
+	case *discordgo.MessageReactionAdd:
+		return fmt.Sprintf("reaction|%s|%s|%s:%s", evt.MessageID, evt.UserID, evt.Emoji.ID, evt.Emoji.Name), "add"
+	case *discordgo.MessageReactionRemove:
+		return fmt.Sprintf("reaction|%s|%s|%s:%s", evt.MessageID, evt.UserID, evt.Emoji.ID, evt.Emoji.Name), "remove"
+	default:
+		return "", ""
+	}
+}
+
+// isDuplicateDiscordEvent checks if the event was already handled and remembers it if not.
+// It must only be called from the portal's message loop.
+func (portal *Portal) isDuplicateDiscordEvent(msg portalDiscordMessage) bool {
+	key, state := discordEventKey(msg.msg)
+	if key == "" {
+		return false
+	} else if prevState, ok := portal.recentDiscordEvents.Get(key); ok && prevState == state {
+		portal.log.Debug().
+			Str("event_key", key).
+			Str("user_id", msg.user.MXID.String()).
+			Msg("Dropping duplicate Discord event")
+		return true
+	}
+	portal.recentDiscordEvents.Push(key, state)
+	return false
+}
+
 func (portal *Portal) IsPrivateChat() bool {
 	return portal.Type == discordgo.ChannelTypeDM
 }
@@ -563,6 +638,10 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 }
 
 func (portal *Portal) handleDiscordMessages(msg portalDiscordMessage) {
+	if update, ok := msg.msg.(*discordgo.ChannelUpdate); ok {
+		portal.handleDiscordChannelUpdate(msg.user, update.Channel)
+		return
+	}
 	if portal.MXID == "" {
 		msgCreate, ok := msg.msg.(*discordgo.MessageCreate)
 		if !ok {
@@ -594,21 +673,34 @@ func (portal *Portal) handleDiscordMessages(msg portalDiscordMessage) {
 		portal.handleDiscordReaction(msg.user, convertedMsg.MessageReaction, true, msg.thread, convertedMsg.Member)
 	case *discordgo.MessageReactionRemove:
 		portal.handleDiscordReaction(msg.user, convertedMsg.MessageReaction, false, msg.thread, nil)
+	case *discordgo.InteractionCreate:
+		portal.handleDiscordInteraction(msg.user, convertedMsg.Interaction, msg.thread)
 	default:
 		portal.log.Warn().Type("message_type", msg.msg).Msg("Unknown message type in handleDiscordMessages")
 	}
 }
 
+func (portal *Portal) handleDiscordChannelUpdate(user *User, meta *discordgo.Channel) {
+	if meta.GuildID == "" {
+		user.handlePrivateChannel(portal, meta, time.Now(), true, user.IsInSpace(portal.Key.String()))
+	} else {
+		portal.UpdateInfo(user, meta)
+	}
+}
+
 func (portal *Portal) ensureUserInvited(user *User, ignoreCache bool) bool {
 	return user.ensureInvited(portal.MainIntent(), portal.MXID, portal.IsPrivateChat(), ignoreCache)
 }
 
-func (portal *Portal) markMessageHandled(discordID string, authorID string, timestamp time.Time, threadID string, senderMXID id.UserID, parts []database.MessagePart) *database.Message {
+func (portal *Portal) markMessageHandled(discordID string, authorID string, timestamp time.Time, editTimestamp *time.Time, threadID string, senderMXID id.UserID, parts []database.MessagePart) *database.Message {
 	msg := portal.bridge.DB.Message.New()
 	msg.Channel = portal.Key
 	msg.DiscordID = discordID
 	msg.SenderID = authorID
 	msg.Timestamp = timestamp
+	if editTimestamp != nil {
+		msg.EditTimestamp = *editTimestamp
+	}
 	msg.ThreadID = threadID
 	msg.SenderMXID = senderMXID
 	msg.MassInsertParts(parts)
@@ -638,6 +730,9 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 	if existing != nil {
 		log.Debug().Msg("Dropping duplicate message")
 		return
+	} else if portal.isBridgedInteractionPlaceholder(msg) {
+		log.Debug().Msg("Dropping placeholder response of interaction that was bridged as a notice")
+		return
 	}
 
 	handlingStartTime := time.Now()
@@ -703,7 +798,7 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 		log.Warn().Msg("All parts of message failed to send to Matrix")
 	} else {
 		log.Debug().Dict("event_ids", eventIDs).Msg("Finished handling Discord message")
-		firstDBMessage := portal.markMessageHandled(msg.ID, msg.Author.ID, ts, discordThreadID, intent.UserID, dbParts)
+		firstDBMessage := portal.markMessageHandled(msg.ID, msg.Author.ID, ts, msg.EditedTimestamp, discordThreadID, intent.UserID, dbParts)
 		if msg.Flags == discordgo.MessageFlagsHasThread {
 			portal.bridge.threadFound(ctx, user, firstDBMessage, msg.ID, msg.Thread)
 		}
@@ -864,6 +959,9 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 			Str("author_id", msg.Author.ID).
 			Msg("Dropping edit from relay webhook")
 		return
+	} else if portal.isBridgedInteractionResponse(msg) {
+		log.Debug().Msg("Dropping edit of interaction response sent from Matrix")
+		return
 	}
 
 	puppet := portal.bridge.GetPuppetByID(msg.Author.ID)
@@ -923,7 +1021,7 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 			Msg("Dropping non-text edit")
 		return
 	}
-	puppet.addWebhookMeta(converted, msg)
+	puppet.addWebhookMeta(converted, msg, portal.BridgeConfig().PrefixWebhookMessages)
 	puppet.addMemberMeta(converted, msg)
 	converted.Content.Mentions = portal.convertDiscordMentions(msg, false)
 	converted.Content.SetEdit(existing[0].MXID)
@@ -950,6 +1048,7 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 
 	if msg.EditedTimestamp != nil {
 		existing[0].UpdateEditTimestamp(*msg.EditedTimestamp)
+		portal.storeEditRevision(msg, resp.EventID)
 	}
 	log.Debug().
 		Str("event_id", resp.EventID.String()).
@@ -957,6 +1056,19 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 		Msg("Finished handling Discord edit")
 }
 
+func (portal *Portal) storeEditRevision(msg *discordgo.Message, mxid id.EventID) {
+	edit := portal.bridge.DB.MessageEdit.New()
+	edit.Channel = portal.Key
+	edit.DiscordID = msg.ID
+	edit.EditTimestamp = *msg.EditedTimestamp
+	if msg.Author != nil {
+		edit.SenderID = msg.Author.ID
+	}
+	edit.Content = msg.Content
+	edit.MXID = mxid
+	edit.Insert()
+}
+
 func (portal *Portal) handleDiscordMessageDelete(user *User, msg *discordgo.Message) {
 	lastResp := portal.redactAllParts(portal.MainIntent(), msg.ID)
 	if lastResp != "" {
@@ -992,6 +1104,9 @@ func (portal *Portal) redactAllParts(intent *appservice.IntentAPI, msgID string)
 		}
 		dbMsg.Delete()
 	}
+	if len(existing) > 0 {
+		portal.bridge.DB.MessageEdit.DeleteAllForMessage(portal.Key, msgID)
+	}
 	return
 }
 
@@ -1100,6 +1215,9 @@ func (portal *Portal) sendMatrixMessage(intent *appservice.IntentAPI, eventType
 func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
 	portal.forwardBackfillLock.Lock()
 	defer portal.forwardBackfillLock.Unlock()
+	if portal.mediaBatch != nil && !portal.mediaBatch.canContinue(msg.user, msg.evt) {
+		portal.flushMediaBatch()
+	}
 	switch msg.evt.Type {
 	case event.EventMessage, event.EventSticker:
 		portal.handleMatrixMessage(msg.user, msg.evt)
@@ -1229,6 +1347,8 @@ var (
 	errRelationshipsNotReady       = errors.New("can't direct message before receiving relationships")
 	errDMingStranger               = errors.New("can't direct message a stranger")
 	errCantStartThread             = errors.New("can't create thread without being logged into Discord")
+	errFileTooLarge                = errors.New("file is too large to upload to Discord")
+	errInteractionResponseNotText  = errors.New("only text messages can be used to respond to commands")
 )
 
 func errorToStatusReason(err error) (reason event.MessageStatusReason, status event.MessageStatus, isCertain, sendNotice bool, humanMessage string, checkpointError error) {
@@ -1241,8 +1361,11 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		errors.Is(err, id.InvalidContentURI),
 		errors.Is(err, attachment.UnsupportedVersion),
 		errors.Is(err, attachment.UnsupportedAlgorithm),
-		errors.Is(err, errCantStartThread):
+		errors.Is(err, errCantStartThread),
+		errors.Is(err, errInteractionResponseNotText):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, "", nil
+	case errors.Is(err, errFileTooLarge):
+		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, "The file is too large to upload to Discord.", nil
 	case errors.Is(err, errDMingStranger):
 		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, "You can't message users who aren't on your friends list. Use the Discord app to chat or add them as a friend to continue.", nil
 	case errors.Is(err, errRelationshipsNotReady):
@@ -1449,6 +1572,23 @@ func (br *DiscordBridge) makeMediaProxyURL(mxc id.ContentURI) string {
 	return br.Config.Bridge.PublicAddress + path + base64.RawURLEncoding.EncodeToString(checksum)
 }
 
+// makeOversizedFileLink returns a link to a Matrix file that is too large to upload to Discord.
+// Encrypted files can't be linked, as the media proxy only serves files as-is.
+func (portal *Portal) makeOversizedFileLink(content *event.MessageEventContent, filename string, uploadLimit int64) (string, error) {
+	if content.File != nil || content.URL == "" {
+		return "", fmt.Errorf("%w (limit: %d MiB)", errFileTooLarge, uploadLimit/1024/1024)
+	}
+	mxc, err := content.URL.Parse()
+	if err != nil {
+		return "", err
+	}
+	url := portal.bridge.makeMediaProxyURL(mxc)
+	if url == "" {
+		return "", fmt.Errorf("%w (limit: %d MiB)", errFileTooLarge, uploadLimit/1024/1024)
+	}
+	return fmt.Sprintf("[%s](%s)", escapeDiscordMarkdown(filename), url), nil
+}
+
 func (portal *Portal) getRelayUserMeta(sender *User) (name, avatarURL string) {
 	member := portal.bridge.StateStore.GetMember(portal.MXID, sender.MXID)
 	name = member.Displayname
@@ -1548,26 +1688,15 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 			return
 		}
 
-		if portal.bridge.Config.Bridge.ForbidDMingStrangers && sess.IsUser {
-			recipient := portal.bridge.GetPuppetByID(portal.OtherUserID)
-
-			if !recipient.IsBot {
-				sender.relationshipLock.RLock()
-				if !sender.relationshipsReady {
-					go portal.sendMessageMetrics(evt, errRelationshipsNotReady, "")
-					sender.relationshipLock.RUnlock()
-					return
-				}
-				relationship, hasRelationship := sender.relationships[portal.OtherUserID]
-				sender.relationshipLock.RUnlock()
-
-				if !hasRelationship || relationship.Type != discordgo.RelationshipFriend {
-					go portal.sendMessageMetrics(evt, errDMingStranger, "")
-					return
-				}
-			}
+		if err := sender.checkCanDM(portal.OtherUserID); err != nil {
+			go portal.sendMessageMetrics(evt, err, "")
+			return
 		}
 	}
+	if interaction := portal.getBotInteraction(content.RelatesTo.GetNonFallbackReplyTo()); interaction != nil {
+		portal.handleMatrixInteractionResponse(sender, evt, content, interaction)
+		return
+	}
 	var threadID string
 
 	if editMXID := content.GetRelatesTo().GetReplaceID(); editMXID != "" && content.NewContent != nil {
@@ -1578,7 +1707,6 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 			var err error
 			var msg *discordgo.Message
 			if !isWebhookSend {
-				// TODO save edit in message table
 				msg, err = sess.ChannelMessageEdit(edits.DiscordProtoChannelID(), edits.DiscordID, discordContent)
 			} else {
 				msg, err = relayClient.WebhookMessageEdit(portal.RelayWebhookID, portal.RelayWebhookSecret, edits.DiscordID, &discordgo.WebhookEdit{
@@ -1589,6 +1717,7 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 			go portal.sendMessageMetrics(evt, err, "Failed to edit")
 			if msg != nil && msg.EditedTimestamp != nil {
 				edits.UpdateEditTimestamp(*msg.EditedTimestamp)
+				portal.storeEditRevision(msg, evt.ID)
 			}
 		} else {
 			go portal.sendMessageMetrics(evt, fmt.Errorf("%w %s", errUnknownEditTarget, editMXID), "Ignoring")
@@ -1619,6 +1748,14 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	}
 
 	var sendReq discordgo.MessageSend
+	// The downloaded media is closed after sending, unless it's handed over to a media batch.
+	var mediaFile *spooledFile
+	defer func() {
+		if mediaFile != nil {
+			_ = mediaFile.Close()
+		}
+	}()
+	var batchable bool
 
 	var description string
 	if evt.Type == event.EventSticker {
@@ -1653,38 +1790,134 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	}
 	switch content.MsgType {
 	case event.MsgText, event.MsgEmote, event.MsgNotice:
-		sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(content, parseAllowedLinkPreviews(evt.Content.Raw))
-		if content.MsgType == event.MsgEmote {
+		allowedLinkPreviews := parseAllowedLinkPreviews(evt.Content.Raw)
+		textContent := content
+		if canSendEmbeds(sess) {
+			var embeds []*discordgo.MessageEmbed
+			if portal.bridge.Config.Bridge.LinkPreviewEmbeds {
+				var convertedURLs []string
+				embeds, convertedURLs = portal.convertMatrixLinkPreviews(evt.Content.Raw)
+				// Discord would otherwise add its own preview for the same link
+				allowedLinkPreviews = withoutConvertedPreviews(allowedLinkPreviews, convertedURLs)
+			}
+			if portal.bridge.Config.Bridge.RichContentEmbeds {
+				var richEmbeds []*discordgo.MessageEmbed
+				textContent, richEmbeds = portal.extractMatrixHTMLEmbeds(content, allowedLinkPreviews)
+				embeds = append(richEmbeds, embeds...)
+			}
+			sendReq.Embeds = limitEmbeds(append(sendReq.Embeds, embeds...))
+		}
+		sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(textContent, allowedLinkPreviews)
+		if content.MsgType == event.MsgEmote && sendReq.Content != "" {
 			sendReq.Content = fmt.Sprintf("_%s_", sendReq.Content)
 		}
 	case event.MsgAudio, event.MsgFile, event.MsgImage, event.MsgVideo:
-		data, err := downloadMatrixAttachment(portal.MainIntent(), content)
-		if err != nil {
-			go portal.sendMessageMetrics(evt, err, "Error downloading media in")
-			return
+		attMeta := convertMatrixAttachmentMeta(content, evt.Content.Raw)
+		filename := attMeta.Filename
+		if attMeta.Description != "" {
+			description = attMeta.Description
 		}
-		filename := content.Body
-		if content.FileName != "" && content.FileName != content.Body {
-			filename = content.FileName
+		if attMeta.Caption {
 			sendReq.Content, sendReq.AllowedMentions = portal.parseMatrixHTML(content, parseAllowedLinkPreviews(evt.Content.Raw))
 		}
+		if attMeta.SpoilerReason != "" {
+			// Discord doesn't have spoiler reasons, so include it in the message text to show it before the file is revealed.
+			reason := fmt.Sprintf("Spoiler: %s", escapeDiscordMarkdown(attMeta.SpoilerReason))
+			if sendReq.Content != "" {
+				sendReq.Content = fmt.Sprintf("%s\n%s", reason, sendReq.Content)
+			} else {
+				sendReq.Content = reason
+			}
+		}
+		hasCaption := sendReq.Content != ""
 
-		if evt.Content.Raw["page.codeberg.everypizza.msc4193.spoiler"] == true {
-			filename = "SPOILER_" + filename
+		uploadLimit := portal.discordUploadLimit(sess)
+		var data *spooledFile
+		var err error
+		// Don't bother downloading files that are known to be too large to upload
+		if int64(content.GetInfo().Size) <= uploadLimit {
+			data, err = downloadMatrixAttachment(portal.MainIntent(), content, uploadLimit)
+			if errors.Is(err, errDownloadTooLarge) {
+				data = nil
+			} else if err != nil {
+				go portal.sendMessageMetrics(evt, err, "Error downloading media in")
+				return
+			}
+			mediaFile = data
+		}
+		if data == nil || data.Size() > uploadLimit {
+			link, err := portal.makeOversizedFileLink(content, filename, uploadLimit)
+			if err != nil {
+				go portal.sendMessageMetrics(evt, err, "Error bridging oversized media in")
+				return
+			}
+			if attMeta.Description != "" {
+				// There's no attachment to put the caption in, so send it as text
+				link = fmt.Sprintf("%s\n%s", escapeDiscordMarkdown(attMeta.Description), link)
+			}
+			if sendReq.Content != "" {
+				sendReq.Content = fmt.Sprintf("%s\n%s", sendReq.Content, link)
+			} else {
+				sendReq.Content = link
+			}
+			break
 		}
 
-		if portal.bridge.Config.Bridge.UseDiscordCDNUpload && !isWebhookSend && sess.IsUser {
+		if attMeta.Spoiler {
+			filename = discordSpoilerPrefix + filename
+		}
+
+		var upload io.Reader
+		uploadSize := data.Size()
+		mimeType := content.GetInfo().MimeType
+		var voice *matrixVoiceMessage
+		// Voice messages can't have captions and can only be sent by real users or bots (not webhooks) via the CDN upload path.
+		if _, isVoice := evt.Content.Raw["org.matrix.msc3245.voice"]; isVoice && content.MsgType == event.MsgAudio && !hasCaption && !isWebhookSend {
+			var rawVoiceData, voiceData []byte
+			voice, err = parseMatrixVoiceMessage(content, evt.Content.Raw)
+			if err == nil {
+				rawVoiceData, err = data.Bytes()
+			}
+			if err == nil {
+				voiceData, err = convertToOggOpus(context.Background(), rawVoiceData, mimeType)
+			}
+			if err != nil {
+				portal.log.Warn().Err(err).
+					Str("event_id", evt.ID.String()).
+					Msg("Failed to prepare voice message, sending as normal audio file")
+				voice = nil
+			} else {
+				filename = discordVoiceMessageFilename
+				mimeType = discordVoiceMessageMime
+				sendReq.Flags |= discordgo.MessageFlagsIsVoiceMessage
+				upload = bytes.NewReader(voiceData)
+				uploadSize = int64(len(voiceData))
+			}
+		}
+		if upload == nil {
+			upload, err = data.Reader()
+			if err != nil {
+				go portal.sendMessageMetrics(evt, err, "Error reading downloaded media in")
+				return
+			}
+		}
+
+		if !isWebhookSend && (voice != nil || (portal.bridge.Config.Bridge.UseDiscordCDNUpload && sess.IsUser)) {
 			att := &discordgo.MessageAttachment{
 				ID:                  "0",
 				Filename:            filename,
 				Description:         description,
-				OriginalContentType: content.Info.MimeType,
+				OriginalContentType: mimeType,
+			}
+			if voice != nil {
+				att.DurationSeconds = voice.DurationSeconds
+				att.Waveform = &voice.Waveform
 			}
 			sendReq.Attachments = []*discordgo.MessageAttachment{att}
 			isClip := false
 			prep, err := sender.Session.ChannelAttachmentCreate(channelID, &discordgo.ReqPrepareAttachments{
 				Files: []*discordgo.FilePrepare{{
-					Size: len(data),
+					Size: int(uploadSize),
 					Name: att.Filename,
 					ID:   sender.NextDiscordUploadID(),
 
@@ -1698,7 +1931,7 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 			}
 			prepared := prep.Attachments[0]
 			att.UploadedFilename = prepared.UploadFilename
-			err = uploadDiscordAttachment(sender.Session.Client, prepared.UploadURL, data)
+			err = uploadDiscordAttachment(sender.Session.Client, prepared.UploadURL, upload, uploadSize)
 			if err != nil {
 				go portal.sendMessageMetrics(evt, err, "Error reuploading media in")
 				return
@@ -1706,10 +1939,19 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		} else {
 			sendReq.Files = []*discordgo.File{{
 				Name:        filename,
-				ContentType: content.Info.MimeType,
-				Reader:      bytes.NewReader(data),
+				ContentType: mimeType,
+				Reader:      upload,
 			}}
+			if description != "" {
+				// The attachment ID refers to the index in the multipart files
+				sendReq.Attachments = []*discordgo.MessageAttachment{{
+					ID:          "0",
+					Filename:    filename,
+					Description: description,
+				}}
+			}
 		}
+		batchable = voice == nil && !hasCaption && evt.Type == event.EventMessage
 	default:
 		go portal.sendMessageMetrics(evt, fmt.Errorf("%w %q", errUnknownMsgType, content.MsgType), "Ignoring")
 		return
@@ -1740,11 +1982,37 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 			sendReq.AllowedMentions.Parse = append(sendReq.AllowedMentions.Parse, discordgo.AllowedMentionTypeEveryone)
 		}
 	}
+	if portal.mediaBatch != nil || (batchable && portal.bridge.Config.Bridge.MediaBatchWindowMS > 0) {
+		if batchable && portal.addToMediaBatch(sender, evt, threadID, &sendReq, mediaFile) {
+			mediaFile = nil
+			return
+		} else if content.MsgType == event.MsgText && portal.mediaBatch != nil && portal.mediaBatch.canContinue(sender, evt) {
+			portal.mediaBatch.setCaption(evt, &sendReq)
+			portal.flushMediaBatch()
+			return
+		}
+		portal.flushMediaBatch()
+	}
+	msg, err := portal.sendDiscordMessage(sender, threadID, &sendReq)
+	go portal.sendMessageMetrics(evt, err, "Error sending")
+	if msg != nil {
+		part := database.MessagePart{MXID: evt.ID}
+		if len(msg.Attachments) > 0 {
+			part.AttachmentID = msg.Attachments[0].ID
+		}
+		portal.markMatrixMessageSent(sender, msg, threadID, []database.MessagePart{part})
+	}
+}
+
+// sendDiscordMessage sends a message to Discord using the sender's session, or the relay webhook if they're not logged in.
+func (portal *Portal) sendDiscordMessage(sender *User, threadID string, sendReq *discordgo.MessageSend) (msg *discordgo.Message, err error) {
+	channelID := portal.Key.ChannelID
+	if threadID != "" {
+		channelID = threadID
+	}
 	sendReq.Nonce = generateNonce()
-	var msg *discordgo.Message
-	var err error
-	if !isWebhookSend {
-		msg, err = sess.ChannelMessageSendComplex(channelID, &sendReq, portal.RefererOptIfUser(sess, threadID)...)
+	if sess := sender.Session; sess != nil {
+		msg, err = sess.ChannelMessageSendComplex(channelID, sendReq, portal.RefererOptIfUser(sess, threadID)...)
 	} else {
 		username, avatarURL := portal.getRelayUserMeta(sender)
 		msg, err = relayClient.WebhookThreadExecute(portal.RelayWebhookID, portal.RelayWebhookSecret, true, threadID, &discordgo.WebhookParams{
@@ -1752,31 +2020,23 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 			Username:        username,
 			AvatarURL:       avatarURL,
 			Files:           sendReq.Files,
+			Attachments:     sendReq.Attachments,
 			Components:      sendReq.Components,
 			Embeds:          sendReq.Embeds,
 			AllowedMentions: sendReq.AllowedMentions,
 		})
 	}
 	sender.handlePossible40002(err)
-	go portal.sendMessageMetrics(evt, err, "Error sending")
-	if msg != nil {
-		dbMsg := portal.bridge.DB.Message.New()
-		dbMsg.Channel = portal.Key
-		dbMsg.DiscordID = msg.ID
-		if len(msg.Attachments) > 0 {
-			dbMsg.AttachmentID = msg.Attachments[0].ID
-		}
-		dbMsg.MXID = evt.ID
-		if sess != nil {
-			dbMsg.SenderID = sender.DiscordID
-		} else {
-			dbMsg.SenderID = portal.RelayWebhookID
-		}
-		dbMsg.SenderMXID = sender.MXID
-		dbMsg.Timestamp, _ = discordgo.SnowflakeTimestamp(msg.ID)
-		dbMsg.ThreadID = threadID
-		dbMsg.Insert()
+	return
+}
+
+func (portal *Portal) markMatrixMessageSent(sender *User, msg *discordgo.Message, threadID string, parts []database.MessagePart) {
+	senderID := portal.RelayWebhookID
+	if sender.Session != nil {
+		senderID = sender.DiscordID
 	}
+	ts, _ := discordgo.SnowflakeTimestamp(msg.ID)
+	portal.markMessageHandled(msg.ID, senderID, ts, nil, threadID, sender.MXID, parts)
 }
 
 func parseAllowedLinkPreviews(raw map[string]any) []string {
@@ -1813,7 +2073,7 @@ func (portal *Portal) sendDeliveryReceipt(eventID id.EventID) {
 }
 
 func (portal *Portal) HandleMatrixLeave(brSender bridge.User) {
-	sender := brSender.(*User)
+	sender := brSender.(*User).accountForPortal(portal)
 	if portal.IsPrivateChat() && sender.DiscordID == portal.Key.Receiver {
 		portal.log.Debug().Msg("User left private chat portal, cleaning up and deleting...")
 		portal.cleanup(false)
@@ -1823,8 +2083,7 @@ func (portal *Portal) HandleMatrixLeave(brSender bridge.User) {
 	}
 }
 
-func (portal *Portal) HandleMatrixKick(brSender bridge.User, brTarget bridge.Ghost)   {}
-func (portal *Portal) HandleMatrixInvite(brSender bridge.User, brTarget bridge.Ghost) {}
+func (portal *Portal) HandleMatrixKick(brSender bridge.User, brTarget bridge.Ghost) {}
 
 func (portal *Portal) Delete() {
 	portal.Portal.Delete()
@@ -2030,6 +2289,46 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
 	}
 }
 
+// convertDiscordReactionKey returns the emoji name used in the database and the Matrix reaction key for the given Discord emoji.
+// The Matrix key is empty if a custom emoji couldn't be reuploaded.
+func (portal *Portal) convertDiscordReactionKey(emoji *discordgo.Emoji) (discordID, matrixReaction string) {
+	if emoji.ID != "" {
+		reactionMXC := portal.getEmojiMXCByDiscordID(emoji.ID, emoji.Name, emoji.Animated)
+		if reactionMXC.IsEmpty() {
+			return
+		}
+		return fmt.Sprintf("%s:%s", emoji.Name, emoji.ID), reactionMXC.String()
+	}
+	return emoji.Name, variationselector.Add(emoji.Name)
+}
+
+func (portal *Portal) makeDiscordReactionContent(emoji *discordgo.Emoji, matrixReaction string, target id.EventID) *event.Content {
+	content := event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{
+			EventID: target,
+			Type:    event.RelAnnotation,
+			Key:     matrixReaction,
+		},
+	}
+	extraContent := map[string]any{}
+	if emoji.ID != "" {
+		extraContent["fi.mau.discord.reaction"] = map[string]any{
+			"id":   emoji.ID,
+			"name": emoji.Name,
+			"mxc":  matrixReaction,
+		}
+		wrappedShortcode := fmt.Sprintf(":%s:", emoji.Name)
+		extraContent["com.beeper.reaction.shortcode"] = wrappedShortcode
+		if !portal.BridgeConfig().CustomEmojiReactions {
+			content.RelatesTo.Key = wrappedShortcode
+		}
+	}
+	return &event.Content{
+		Parsed: &content,
+		Raw:    extraContent,
+	}
+}
+
 func (portal *Portal) handleDiscordReaction(user *User, reaction *discordgo.MessageReaction, add bool, thread *Thread, member *discordgo.Member) {
 	puppet := portal.bridge.GetPuppetByID(reaction.UserID)
 	if member != nil {
@@ -2044,19 +2343,9 @@ func (portal *Portal) handleDiscordReaction(user *User, reaction *discordgo.Mess
 		Str("action", "discord reaction").
 		Logger()
 
-	var discordID string
-	var matrixReaction string
-
-	if reaction.Emoji.ID != "" {
-		reactionMXC := portal.getEmojiMXCByDiscordID(reaction.Emoji.ID, reaction.Emoji.Name, reaction.Emoji.Animated)
-		if reactionMXC.IsEmpty() {
-			return
-		}
-		matrixReaction = reactionMXC.String()
-		discordID = fmt.Sprintf("%s:%s", reaction.Emoji.Name, reaction.Emoji.ID)
-	} else {
-		discordID = reaction.Emoji.Name
-		matrixReaction = variationselector.Add(reaction.Emoji.Name)
+	discordID, matrixReaction := portal.convertDiscordReactionKey(&reaction.Emoji)
+	if matrixReaction == "" {
+		return
 	}
 
 	// Find the message that we're working with.
@@ -2088,31 +2377,7 @@ func (portal *Portal) handleDiscordReaction(user *User, reaction *discordgo.Mess
 		return
 	}
 
-	content := event.ReactionEventContent{
-		RelatesTo: event.RelatesTo{
-			EventID: message[0].MXID,
-			Type:    event.RelAnnotation,
-			Key:     matrixReaction,
-		},
-	}
-	extraContent := map[string]any{}
-	if reaction.Emoji.ID != "" {
-		extraContent["fi.mau.discord.reaction"] = map[string]any{
-			"id":   reaction.Emoji.ID,
-			"name": reaction.Emoji.Name,
-			"mxc":  matrixReaction,
-		}
-		wrappedShortcode := fmt.Sprintf(":%s:", reaction.Emoji.Name)
-		extraContent["com.beeper.reaction.shortcode"] = wrappedShortcode
-		if !portal.bridge.Config.Bridge.CustomEmojiReactions {
-			content.RelatesTo.Key = wrappedShortcode
-		}
-	}
-
-	resp, err := intent.SendMessageEvent(portal.MXID, event.EventReaction, &event.Content{
-		Parsed: &content,
-		Raw:    extraContent,
-	})
+	resp, err := intent.SendMessageEvent(portal.MXID, event.EventReaction, portal.makeDiscordReactionContent(&reaction.Emoji, matrixReaction, message[0].MXID))
 	if err != nil {
 		log.Err(err).Msg("Failed to send reaction")
 		return
@@ -2155,8 +2420,9 @@ func (portal *Portal) handleMatrixRedaction(sender *User, evt *event.Event) {
 	message := portal.bridge.DB.Message.GetByMXID(portal.Key, evt.Redacts)
 	if message != nil {
 		var err error
-		// TODO add support for deleting individual attachments from messages
-		if sess != nil {
+		if remaining, ok := portal.remainingMessageParts(sender, message); ok {
+			err = portal.removeDiscordMessagePart(sender, message, remaining)
+		} else if sess != nil {
 			err = sess.ChannelMessageDelete(message.DiscordProtoChannelID(), message.DiscordID, portal.RefererOptIfUser(sess, message.ThreadID)...)
 		} else {
 			// TODO pre-validate that the message was sent by the webhook?
@@ -2184,8 +2450,59 @@ func (portal *Portal) handleMatrixRedaction(sender *User, evt *event.Event) {
 	go portal.sendMessageMetrics(evt, errTargetNotFound, "Ignoring")
 }
 
+// remainingMessageParts finds the attachments that would be left in a Discord message if the given part was removed.
+// It returns false if the whole message should be deleted instead, e.g. because it only has one part
+// or because it wasn't sent by the user (other people's messages can't be edited).
+func (portal *Portal) remainingMessageParts(sender *User, target *database.Message) ([]*discordgo.MessageAttachment, bool) {
+	if (sender.Session != nil && target.SenderID != sender.DiscordID) || (sender.Session == nil && target.SenderID != portal.RelayWebhookID) {
+		return nil, false
+	}
+	parts := portal.bridge.DB.Message.GetByDiscordID(portal.Key, target.DiscordID)
+	if len(parts) < 2 {
+		return nil, false
+	}
+	var remaining []*discordgo.MessageAttachment
+	var hasText bool
+	for _, part := range parts {
+		if part.AttachmentID == target.AttachmentID {
+			continue
+		} else if part.AttachmentID == "" {
+			hasText = true
+		} else if _, err := strconv.ParseUint(part.AttachmentID, 10, 64); err == nil {
+			// Parts like converted embeds have non-numeric IDs and aren't real attachments
+			remaining = append(remaining, &discordgo.MessageAttachment{ID: part.AttachmentID})
+		}
+	}
+	if len(remaining) == 0 && !hasText {
+		return nil, false
+	}
+	return remaining, true
+}
+
+// removeDiscordMessagePart edits a Discord message to remove a single attachment or the caption text.
+func (portal *Portal) removeDiscordMessagePart(sender *User, target *database.Message, remaining []*discordgo.MessageAttachment) error {
+	var content *string
+	if target.AttachmentID == "" {
+		empty := ""
+		content = &empty
+	}
+	var err error
+	if sess := sender.Session; sess != nil {
+		edit := discordgo.NewMessageEdit(target.DiscordProtoChannelID(), target.DiscordID)
+		edit.Content = content
+		edit.Attachments = &remaining
+		_, err = sess.ChannelMessageEditComplex(edit, portal.RefererOptIfUser(sess, target.ThreadID)...)
+	} else {
+		_, err = relayClient.WebhookMessageEdit(portal.RelayWebhookID, portal.RelayWebhookSecret, target.DiscordID, &discordgo.WebhookEdit{
+			Content:     content,
+			Attachments: &remaining,
+		})
+	}
+	return err
+}
+
 func (portal *Portal) HandleMatrixReadReceipt(brUser bridge.User, eventID id.EventID, receipt event.ReadReceipt) {
-	sender := brUser.(*User)
+	sender := brUser.(*User).accountForPortal(portal)
 	if sender.Session == nil {
 		return
 	}
@@ -2216,6 +2533,7 @@ func (portal *Portal) HandleMatrixReadReceipt(brUser bridge.User, eventID id.Eve
 		// Drop read receipts from bot users (after checking for the thread auto-join stuff)
 		return
 	}
+	sender.ViewingChannel(portal)
 	msg := portal.bridge.DB.Message.GetByMXID(portal.Key, eventID)
 	if msg == nil {
 		msg = portal.bridge.DB.Message.GetClosestBefore(portal.Key, discordThreadID, receipt.Timestamp)
@@ -2273,6 +2591,9 @@ func (portal *Portal) HandleMatrixTyping(newTyping []id.UserID) {
 	portal.currentlyTyping = newTyping
 	for _, userID := range startedTyping {
 		user := portal.bridge.GetUserByMXID(userID)
+		if user != nil {
+			user = user.accountForPortal(portal)
+		}
 		if user != nil && user.Session != nil {
 			user.ViewingChannel(portal)
 			err := user.Session.ChannelTyping(portal.Key.ChannelID, portal.RefererOptIfUser(user.Session, "")...)
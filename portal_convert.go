@@ -56,7 +56,9 @@ func (portal *Portal) createMediaFailedMessage(bridgeErr error) *event.MessageEv
 const DiscordStickerSize = 160
 
 func (portal *Portal) convertDiscordFile(ctx context.Context, typeName string, intent *appservice.IntentAPI, id, url string, content *event.MessageEventContent) *event.MessageEventContent {
-	meta := AttachmentMeta{AttachmentID: id, MimeType: content.Info.MimeType}
+	meta := portal.attachmentMeta()
+	meta.AttachmentID = id
+	meta.MimeType = content.Info.MimeType
 	if typeName == "sticker" && content.Info.MimeType == "application/json" {
 		meta.Converter = portal.bridge.convertLottie
 	}
@@ -144,6 +146,63 @@ func (portal *Portal) convertDiscordSticker(ctx context.Context, intent *appserv
 	}
 }
 
+const (
+	discordSpoilerPrefix = "SPOILER_"
+	// maxDiscordAttachmentDescription is the maximum length of attachment alt text on Discord.
+	maxDiscordAttachmentDescription = 1024
+
+	matrixSpoilerKey       = "page.codeberg.everypizza.msc4193.spoiler"
+	matrixSpoilerReasonKey = "page.codeberg.everypizza.msc4193.spoiler.reason"
+)
+
+// applyDiscordAttachmentMeta maps the filename, alt text and spoiler flag of a Discord attachment to Matrix.
+// The alt text becomes the caption and the SPOILER_ filename prefix becomes a MSC4193 spoiler flag.
+func applyDiscordAttachmentMeta(att *discordgo.MessageAttachment, content *event.MessageEventContent, extra map[string]any) {
+	filename, isSpoiler := strings.CutPrefix(att.Filename, discordSpoilerPrefix)
+	if isSpoiler {
+		extra[matrixSpoilerKey] = true
+	}
+	if filename == "" {
+		filename = att.Filename
+	}
+	content.Body = filename
+	if att.Description != "" {
+		content.Body = att.Description
+		content.FileName = filename
+	}
+}
+
+// matrixAttachmentMeta contains the Discord attachment metadata of a Matrix media message.
+type matrixAttachmentMeta struct {
+	Filename    string
+	Description string
+	// Caption is set if the message has a caption that couldn't be used as the attachment description.
+	// It should be sent as the text of the Discord message instead.
+	Caption       bool
+	Spoiler       bool
+	SpoilerReason string
+}
+
+// convertMatrixAttachmentMeta finds the Discord filename, alt text and spoiler flag for a Matrix media message.
+// Plain text image captions become attachment descriptions, other captions are sent as the message text.
+func convertMatrixAttachmentMeta(content *event.MessageEventContent, raw map[string]any) (meta matrixAttachmentMeta) {
+	meta.Filename = content.Body
+	if content.FileName != "" && content.FileName != content.Body {
+		meta.Filename = content.FileName
+		if content.MsgType == event.MsgImage && content.Format != event.FormatHTML && len(content.Body) <= maxDiscordAttachmentDescription {
+			meta.Description = content.Body
+		} else {
+			meta.Caption = true
+		}
+	}
+	meta.Spoiler, _ = raw[matrixSpoilerKey].(bool)
+	if meta.Spoiler {
+		meta.SpoilerReason, _ = raw[matrixSpoilerReasonKey].(string)
+		meta.SpoilerReason = strings.TrimSpace(meta.SpoilerReason)
+	}
+	return
+}
+
 func (portal *Portal) convertDiscordAttachment(ctx context.Context, intent *appservice.IntentAPI, messageID string, att *discordgo.MessageAttachment) *ConvertedMessage {
 	content := &event.MessageEventContent{
 		Body: att.Filename,
@@ -158,25 +217,25 @@ func (portal *Portal) convertDiscordAttachment(ctx context.Context, intent *apps
 	}
 
 	var extra = make(map[string]any)
-
-	if strings.HasPrefix(att.Filename, "SPOILER_") {
-		extra["page.codeberg.everypizza.msc4193.spoiler"] = true
-	}
-
-	if att.Description != "" {
-		content.Body = att.Description
-		content.FileName = att.Filename
-	}
+	applyDiscordAttachmentMeta(att, content, extra)
 
 	switch strings.ToLower(strings.Split(att.ContentType, "/")[0]) {
 	case "audio":
 		content.MsgType = event.MsgAudio
 		if att.Waveform != nil {
-			// TODO convert waveform
-			extra["org.matrix.msc1767.audio"] = map[string]any{
-				"duration": int(att.DurationSeconds * 1000),
+			durationMS := int(att.DurationSeconds * 1000)
+			audioInfo := map[string]any{
+				"duration": durationMS,
+			}
+			waveform, err := convertDiscordWaveform(*att.Waveform)
+			if err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Str("attachment_id", att.ID).Msg("Failed to decode voice message waveform")
+			} else {
+				audioInfo["waveform"] = waveform
 			}
+			extra["org.matrix.msc1767.audio"] = audioInfo
 			extra["org.matrix.msc3245.voice"] = map[string]any{}
+			content.Info.Duration = durationMS
 		}
 	case "image":
 		content.MsgType = event.MsgImage
@@ -217,7 +276,7 @@ func (portal *Portal) convertDiscordVideoEmbed(ctx context.Context, intent *apps
 			},
 		}
 	}
-	dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, proxyURL, portal.Encrypted, NoMeta)
+	dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, proxyURL, portal.Encrypted, portal.attachmentMeta())
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to copy video embed to Matrix")
 		return &ConvertedMessage{
@@ -331,8 +390,9 @@ func (portal *Portal) convertDiscordMessage(ctx context.Context, puppet *Puppet,
 			Body:    fmt.Sprintf("Created a thread: %s", msg.Thread.Name),
 		}})
 	}
+	prefixWebhookMessages := portal.BridgeConfig().PrefixWebhookMessages
 	for _, part := range parts {
-		puppet.addWebhookMeta(part, msg)
+		puppet.addWebhookMeta(part, msg, prefixWebhookMessages)
 		puppet.addMemberMeta(part, msg)
 	}
 	return parts
@@ -378,7 +438,7 @@ func (puppet *Puppet) addMemberMeta(part *ConvertedMessage, msg *discordgo.Messa
 	}
 }
 
-func (puppet *Puppet) addWebhookMeta(part *ConvertedMessage, msg *discordgo.Message) {
+func (puppet *Puppet) addWebhookMeta(part *ConvertedMessage, msg *discordgo.Message, prefixFallback bool) {
 	if msg.WebhookID == "" {
 		return
 	}
@@ -405,7 +465,7 @@ func (puppet *Puppet) addWebhookMeta(part *ConvertedMessage, msg *discordgo.Mess
 	profileID := sha256.Sum256(fmt.Appendf(nil, "%s:%s", msg.Author.Username, msg.Author.Avatar))
 	hasFallback := false
 	if msg.ApplicationID == "" &&
-		puppet.bridge.Config.Bridge.PrefixWebhookMessages &&
+		prefixFallback &&
 		(part.Content.MsgType == event.MsgText || part.Content.MsgType == event.MsgNotice || (part.Content.FileName != "" && part.Content.FileName != part.Content.Body)) {
 		part.Content.EnsureHasHTML()
 		part.Content.Body = fmt.Sprintf("%s: %s", msg.Author.Username, part.Content.Body)
@@ -441,7 +501,7 @@ const (
 	embedFooterDateSeparator = ` • `
 )
 
-func (portal *Portal) convertDiscordRichEmbed(ctx context.Context, intent *appservice.IntentAPI, embed *discordgo.MessageEmbed, msgID string, index int) string {
+func (portal *Portal) convertDiscordRichEmbed(ctx context.Context, embed *discordgo.MessageEmbed, media *discordEmbedMedia) string {
 	log := zerolog.Ctx(ctx)
 	var htmlParts []string
 	if embed.Author != nil {
@@ -451,13 +511,8 @@ func (portal *Portal) convertDiscordRichEmbed(ctx context.Context, intent *appse
 			authorNameHTML = fmt.Sprintf(embedHTMLAuthorLink, embed.Author.URL, authorNameHTML)
 		}
 		authorHTML = fmt.Sprintf(embedHTMLAuthorPlain, authorNameHTML)
-		if embed.Author.ProxyIconURL != "" {
-			dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, embed.Author.ProxyIconURL, false, NoMeta)
-			if err != nil {
-				log.Warn().Err(err).Msg("Failed to reupload author icon in embed")
-			} else {
-				authorHTML = fmt.Sprintf(embedHTMLAuthorWithImage, dbFile.MXC, authorNameHTML)
-			}
+		if media.AuthorIcon != "" {
+			authorHTML = fmt.Sprintf(embedHTMLAuthorWithImage, media.AuthorIcon, authorNameHTML)
 		}
 		htmlParts = append(htmlParts, authorHTML)
 	}
@@ -476,7 +531,7 @@ func (portal *Portal) convertDiscordRichEmbed(ctx context.Context, intent *appse
 	}
 	for i := 0; i < len(embed.Fields); i++ {
 		item := embed.Fields[i]
-		if portal.bridge.Config.Bridge.EmbedFieldsAsTables {
+		if portal.BridgeConfig().EmbedFieldsAsTables {
 			splitItems := []*discordgo.MessageEmbedField{item}
 			if item.Inline && len(embed.Fields) > i+1 && embed.Fields[i+1].Inline {
 				splitItems = append(splitItems, embed.Fields[i+1])
@@ -501,13 +556,8 @@ func (portal *Portal) convertDiscordRichEmbed(ctx context.Context, intent *appse
 			))
 		}
 	}
-	if embed.Image != nil {
-		dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, embed.Image.ProxyURL, false, NoMeta)
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to reupload image in embed")
-		} else {
-			htmlParts = append(htmlParts, fmt.Sprintf(embedHTMLImage, dbFile.MXC))
-		}
+	if media.Image != "" {
+		htmlParts = append(htmlParts, fmt.Sprintf(embedHTMLImage, media.Image))
 	}
 	var embedDateHTML string
 	if embed.Timestamp != "" {
@@ -527,13 +577,8 @@ func (portal *Portal) convertDiscordRichEmbed(ctx context.Context, intent *appse
 			datePart = embedFooterDateSeparator + embedDateHTML
 		}
 		footerHTML = fmt.Sprintf(embedHTMLFooterPlain, html.EscapeString(embed.Footer.Text), datePart)
-		if embed.Footer.ProxyIconURL != "" {
-			dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, embed.Footer.ProxyIconURL, false, NoMeta)
-			if err != nil {
-				log.Warn().Err(err).Msg("Failed to reupload footer icon in embed")
-			} else {
-				footerHTML = fmt.Sprintf(embedHTMLFooterWithImage, dbFile.MXC, html.EscapeString(embed.Footer.Text), datePart)
-			}
+		if media.FooterIcon != "" {
+			footerHTML = fmt.Sprintf(embedHTMLFooterWithImage, media.FooterIcon, html.EscapeString(embed.Footer.Text), datePart)
 		}
 		htmlParts = append(htmlParts, footerHTML)
 	} else if embed.Timestamp != "" {
@@ -560,7 +605,7 @@ type BeeperLinkPreview struct {
 }
 
 func (portal *Portal) convertDiscordLinkEmbedImage(ctx context.Context, intent *appservice.IntentAPI, url string, width, height int, preview *BeeperLinkPreview) {
-	dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, url, portal.Encrypted, NoMeta)
+	dbFile, err := portal.bridge.copyAttachmentToMatrix(intent, url, portal.Encrypted, portal.attachmentMeta())
 	if err != nil {
 		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to reupload image in URL preview")
 		return
@@ -735,6 +780,10 @@ func (portal *Portal) convertDiscordTextMessage(ctx context.Context, intent *app
 		htmlParts = append(htmlParts, fmt.Sprintf(forwardTemplateHTML, forwardedHTML, origLink))
 	}
 	previews := make([]*BeeperLinkPreview, 0)
+	bridgeConfig := portal.BridgeConfig()
+	var jsonEmbeds []*matrixEmbedJSON
+	// Plain text versions of HTML parts, used instead of the automatically generated plain text body to keep embeds readable
+	plainParts := make(map[int]string)
 	for i, embed := range msg.Embeds {
 		if i == 0 && msg.MessageReference == nil && isReplyEmbed(embed) {
 			continue
@@ -745,7 +794,19 @@ func (portal *Portal) convertDiscordTextMessage(ctx context.Context, intent *app
 		switch getEmbedType(msg, embed) {
 		case EmbedRich:
 			log := with.Str("computed_embed_type", "rich").Logger()
-			htmlParts = append(htmlParts, portal.convertDiscordRichEmbed(log.WithContext(ctx), intent, embed, msg.ID, i))
+			media := portal.reuploadDiscordEmbedMedia(log.WithContext(ctx), intent, embed)
+			var embedHTML string
+			if bridgeConfig.HasEmbedTemplate(portal.GuildID) {
+				embedHTML = portal.renderDiscordEmbedTemplate(log.WithContext(ctx), bridgeConfig, embed, media)
+			}
+			if embedHTML == "" {
+				embedHTML = portal.convertDiscordRichEmbed(log.WithContext(ctx), embed, media)
+			}
+			htmlParts = append(htmlParts, embedHTML)
+			plainParts[len(htmlParts)-1] = portal.convertDiscordRichEmbedPlain(embed)
+			if bridgeConfig.EmbedJSON {
+				jsonEmbeds = append(jsonEmbeds, &matrixEmbedJSON{MessageEmbed: embed, discordEmbedMedia: *media})
+			}
 		case EmbedLinkPreview:
 			log := with.Str("computed_embed_type", "link preview").Logger()
 			previews = append(previews, portal.convertDiscordLinkEmbedToBeeper(log.WithContext(ctx), intent, embed))
@@ -771,9 +832,25 @@ func (portal *Portal) convertDiscordTextMessage(ctx context.Context, intent *app
 	}
 
 	content := format.HTMLToContent(fullHTML)
+	if len(plainParts) > 0 {
+		plainBody := make([]string, len(htmlParts))
+		for i, part := range htmlParts {
+			var ok bool
+			if plainBody[i], ok = plainParts[i]; !ok {
+				plainBody[i] = format.HTMLToText(part)
+			}
+		}
+		content.Body = strings.Join(plainBody, "\n")
+		if !msg.MentionEveryone {
+			content.Body = strings.ReplaceAll(content.Body, "@room", "@\u2063ro\u2063om")
+		}
+	}
 	extraContent := map[string]any{
 		"com.beeper.linkpreviews": previews,
 	}
+	if len(jsonEmbeds) > 0 {
+		extraContent["fi.mau.discord.embeds"] = jsonEmbeds
+	}
 
 	return &ConvertedMessage{Type: event.EventMessage, Content: &content, Extra: extraContent}
 }
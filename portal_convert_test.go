@@ -0,0 +1,143 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestApplyDiscordAttachmentMeta(t *testing.T) {
+	type metaTest struct {
+		name             string
+		filename         string
+		description      string
+		expectedBody     string
+		expectedFileName string
+		expectedSpoiler  bool
+	}
+
+	tests := []metaTest{
+		{"Plain file", "cat.png", "", "cat.png", "", false},
+		{"Alt text", "cat.png", "A cat sitting on a keyboard", "A cat sitting on a keyboard", "cat.png", false},
+		{"Spoiler", "SPOILER_cat.png", "", "cat.png", "", true},
+		{"Spoiler with alt text", "SPOILER_cat.png", "A cat", "A cat", "cat.png", true},
+		{"Spoiler prefix only", "SPOILER_", "", "SPOILER_", "", true},
+		{"Lowercase prefix", "spoiler_cat.png", "", "spoiler_cat.png", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := &event.MessageEventContent{}
+			extra := make(map[string]any)
+			applyDiscordAttachmentMeta(&discordgo.MessageAttachment{
+				Filename:    test.filename,
+				Description: test.description,
+			}, content, extra)
+			assert.Equal(t, test.expectedBody, content.Body)
+			assert.Equal(t, test.expectedFileName, content.FileName)
+			if test.expectedSpoiler {
+				assert.Equal(t, true, extra[matrixSpoilerKey])
+			} else {
+				assert.NotContains(t, extra, matrixSpoilerKey)
+			}
+		})
+	}
+}
+
+func TestConvertMatrixAttachmentMeta(t *testing.T) {
+	type metaTest struct {
+		name     string
+		content  *event.MessageEventContent
+		raw      map[string]any
+		expected matrixAttachmentMeta
+	}
+
+	longCaption := strings.Repeat("a", maxDiscordAttachmentDescription+1)
+	tests := []metaTest{
+		{
+			"No caption",
+			&event.MessageEventContent{MsgType: event.MsgImage, Body: "cat.png"},
+			nil,
+			matrixAttachmentMeta{Filename: "cat.png"},
+		},
+		{
+			"Filename same as body",
+			&event.MessageEventContent{MsgType: event.MsgImage, Body: "cat.png", FileName: "cat.png"},
+			nil,
+			matrixAttachmentMeta{Filename: "cat.png"},
+		},
+		{
+			"Image caption",
+			&event.MessageEventContent{MsgType: event.MsgImage, Body: "A cat", FileName: "cat.png"},
+			nil,
+			matrixAttachmentMeta{Filename: "cat.png", Description: "A cat"},
+		},
+		{
+			"Formatted image caption",
+			&event.MessageEventContent{MsgType: event.MsgImage, Body: "A cat", Format: event.FormatHTML, FormattedBody: "A <b>cat</b>", FileName: "cat.png"},
+			nil,
+			matrixAttachmentMeta{Filename: "cat.png", Caption: true},
+		},
+		{
+			"Long image caption",
+			&event.MessageEventContent{MsgType: event.MsgImage, Body: longCaption, FileName: "cat.png"},
+			nil,
+			matrixAttachmentMeta{Filename: "cat.png", Caption: true},
+		},
+		{
+			"File caption",
+			&event.MessageEventContent{MsgType: event.MsgFile, Body: "Meeting notes", FileName: "notes.pdf"},
+			nil,
+			matrixAttachmentMeta{Filename: "notes.pdf", Caption: true},
+		},
+		{
+			"Spoiler",
+			&event.MessageEventContent{MsgType: event.MsgImage, Body: "cat.png"},
+			map[string]any{matrixSpoilerKey: true},
+			matrixAttachmentMeta{Filename: "cat.png", Spoiler: true},
+		},
+		{
+			"Spoiler with reason",
+			&event.MessageEventContent{MsgType: event.MsgImage, Body: "A cat", FileName: "cat.png"},
+			map[string]any{matrixSpoilerKey: true, matrixSpoilerReasonKey: " cute overload "},
+			matrixAttachmentMeta{Filename: "cat.png", Description: "A cat", Spoiler: true, SpoilerReason: "cute overload"},
+		},
+		{
+			"Reason without spoiler",
+			&event.MessageEventContent{MsgType: event.MsgImage, Body: "cat.png"},
+			map[string]any{matrixSpoilerReasonKey: "cute overload"},
+			matrixAttachmentMeta{Filename: "cat.png"},
+		},
+		{
+			"Invalid spoiler flag",
+			&event.MessageEventContent{MsgType: event.MsgImage, Body: "cat.png"},
+			map[string]any{matrixSpoilerKey: "yes"},
+			matrixAttachmentMeta{Filename: "cat.png"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, convertMatrixAttachmentMeta(test.content, test.raw))
+		})
+	}
+}
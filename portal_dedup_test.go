@@ -0,0 +1,57 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"go.mau.fi/util/exsync"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestIsDuplicateDiscordEvent(t *testing.T) {
+	portal := &Portal{
+		log:                 zerolog.Nop(),
+		recentDiscordEvents: exsync.NewRingBuffer[string, string](recentDiscordEventBufferSize),
+	}
+	user := &User{User: &database.User{MXID: "@user:example.com"}}
+	wrap := func(evt any) portalDiscordMessage {
+		return portalDiscordMessage{msg: evt, user: user}
+	}
+	message := &discordgo.Message{ID: "1", ChannelID: "2"}
+	assert.False(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.MessageCreate{Message: message})))
+	assert.True(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.MessageCreate{Message: message})))
+
+	firstEdit, secondEdit := time.UnixMilli(1000), time.UnixMilli(2000)
+	assert.False(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.MessageUpdate{Message: &discordgo.Message{ID: "1", EditedTimestamp: &firstEdit}})))
+	assert.True(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.MessageUpdate{Message: &discordgo.Message{ID: "1", EditedTimestamp: &firstEdit}})))
+	assert.False(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.MessageUpdate{Message: &discordgo.Message{ID: "1", EditedTimestamp: &secondEdit}})))
+
+	reaction := &discordgo.MessageReaction{MessageID: "1", UserID: "3", Emoji: discordgo.Emoji{Name: "👍"}}
+	assert.False(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.MessageReactionAdd{MessageReaction: reaction})))
+	assert.True(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.MessageReactionAdd{MessageReaction: reaction})))
+	assert.False(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.MessageReactionRemove{MessageReaction: reaction})))
+	assert.False(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.MessageReactionAdd{MessageReaction: reaction})))
+
+	assert.False(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.ChannelUpdate{Channel: &discordgo.Channel{ID: "2"}})))
+	assert.False(t, portal.isDuplicateDiscordEvent(wrap(&discordgo.ChannelUpdate{Channel: &discordgo.Channel{ID: "2"}})))
+}
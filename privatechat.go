@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// maxGroupDMRecipients is the maximum number of other users in a Discord group DM.
+const maxGroupDMRecipients = 9
+
+var (
+	errBotGroupDM            = errors.New("bot accounts can't create group DMs")
+	errTooManyGroupRecipient = fmt.Errorf("group DMs can have at most %d other users", maxGroupDMRecipients)
+)
+
+// createGroupDM creates a new Discord group DM with the given users.
+func (user *User) createGroupDM(recipientIDs []string) (channel *discordgo.Channel, err error) {
+	if !user.Session.IsUser {
+		return nil, errBotGroupDM
+	} else if len(recipientIDs) > maxGroupDMRecipients {
+		return nil, errTooManyGroupRecipient
+	}
+	data := struct {
+		Recipients []string `json:"recipients"`
+	}{recipientIDs}
+	body, err := user.Session.RequestWithBucketID(http.MethodPost, discordgo.EndpointUserChannels("@me"), data, discordgo.EndpointUserChannels(""))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &channel)
+	return
+}
+
+// addGroupDMRecipient adds a user to an existing Discord group DM.
+func (user *User) addGroupDMRecipient(channelID, recipientID string) error {
+	_, err := user.Session.RequestWithBucketID(
+		http.MethodPut,
+		discordgo.EndpointChannel(channelID)+"/recipients/"+recipientID,
+		nil,
+		discordgo.EndpointChannel(channelID)+"/recipients/",
+	)
+	return err
+}
+
+// getInvitedGhostIDs returns the Discord user IDs of all ghosts that are invited to or joined the given room.
+// The ghost whose invite is being handled is always first.
+func (br *DiscordBridge) getInvitedGhostIDs(intent *appservice.IntentAPI, roomID id.RoomID, inviter *User, ghost *Puppet) ([]string, error) {
+	members, err := intent.Members(roomID)
+	if err != nil {
+		return nil, err
+	}
+	ghostIDs := []string{ghost.ID}
+	for _, evt := range members.Chunk {
+		_ = evt.Content.ParseRaw(evt.Type)
+		membership := evt.Content.AsMember().Membership
+		if membership != event.MembershipInvite && membership != event.MembershipJoin {
+			continue
+		}
+		discordID, isGhost := br.ParsePuppetMXID(id.UserID(evt.GetStateKey()))
+		if isGhost && discordID != ghost.ID && discordID != inviter.DiscordID {
+			ghostIDs = append(ghostIDs, discordID)
+		}
+	}
+	return ghostIDs, nil
+}
+
+// createPrivatePortalFromInvite opens a Discord DM (or creates a group DM if multiple ghosts were invited)
+// for a room that a user created by inviting Discord ghosts, and uses the room as the portal.
+func (br *DiscordBridge) createPrivatePortalFromInvite(roomID id.RoomID, inviter *User, ghost *Puppet) {
+	log := br.ZLog.With().
+		Str("action", "create private portal from invite").
+		Str("room_id", roomID.String()).
+		Str("inviter_mxid", inviter.MXID.String()).
+		Str("ghost_id", ghost.ID).
+		Logger()
+	intent := ghost.DefaultIntent()
+	rejectWithNotice := func(message string) {
+		_, _ = intent.SendNotice(roomID, message)
+		_, err := intent.LeaveRoom(roomID)
+		if err != nil {
+			log.Err(err).Msg("Failed to leave room after rejecting private chat creation")
+		}
+	}
+	if inviter.Session == nil {
+		rejectWithNotice("You're not connected to Discord")
+		return
+	} else if ghost.ID == inviter.DiscordID {
+		rejectWithNotice("You can't start a chat with yourself")
+		return
+	}
+	recipientIDs, err := br.getInvitedGhostIDs(intent, roomID, inviter, ghost)
+	if err != nil {
+		log.Err(err).Msg("Failed to get room members")
+		rejectWithNotice("Failed to get room members")
+		return
+	}
+	for _, recipientID := range recipientIDs {
+		if err = inviter.checkCanDM(recipientID); err != nil {
+			log.Debug().Err(err).Str("recipient_id", recipientID).Msg("Not allowed to start private chat")
+			_, _, _, _, humanMessage, _ := errorToStatusReason(err)
+			rejectWithNotice(humanMessage)
+			return
+		}
+	}
+
+	var channel *discordgo.Channel
+	if len(recipientIDs) == 1 {
+		log.Debug().Msg("Opening Discord DM for room created by inviting ghost")
+		channel, err = inviter.Session.UserChannelCreate(recipientIDs[0])
+	} else {
+		log.Debug().Strs("recipient_ids", recipientIDs).Msg("Creating Discord group DM for room created by inviting ghosts")
+		channel, err = inviter.createGroupDM(recipientIDs)
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to create Discord private channel")
+		rejectWithNotice(fmt.Sprintf("Failed to create Discord chat: %v", err))
+		return
+	}
+
+	portal := inviter.GetPortalByMeta(channel)
+	if portal.MXID != "" {
+		if portal.ensureUserInvited(inviter, false) {
+			message := fmt.Sprintf("You already have a private chat portal with me at [%[1]s](https://matrix.to/#/%[1]s)", portal.MXID)
+			content := format.RenderMarkdown(message, true, false)
+			_, _ = intent.SendMessageEvent(roomID, event.EventMessage, &content)
+			log.Debug().
+				Str("existing_room_id", portal.MXID.String()).
+				Msg("Leaving room after accepting invite as the private chat portal already exists")
+			_, _ = intent.LeaveRoom(roomID)
+			return
+		}
+		log.Warn().
+			Str("existing_room_id", portal.MXID.String()).
+			Msg("Failed to invite user to existing private chat portal, redirecting portal to new room")
+		portal.cleanup(false)
+		portal.RemoveMXID()
+	}
+	err = portal.adoptPrivateChatRoom(inviter, channel, roomID, intent)
+	if err != nil {
+		log.Err(err).Msg("Failed to set up private chat portal")
+		rejectWithNotice(fmt.Sprintf("Failed to set up portal: %v", err))
+		return
+	}
+	inviter.MarkInPortal(database.UserPortal{
+		DiscordID: portal.Key.ChannelID,
+		Type:      database.UserPortalTypeDM,
+		Timestamp: time.Now(),
+		InSpace:   inviter.addPrivateChannelToSpace(portal),
+	})
+	log.Info().Str("channel_id", portal.Key.ChannelID).Msg("Created private chat portal from invite")
+}
+
+// adoptPrivateChatRoom uses an existing Matrix room created by the user as the portal room for a private channel.
+// This is the equivalent of CreateMatrixRoom for rooms created on the Matrix side.
+func (portal *Portal) adoptPrivateChatRoom(user *User, channel *discordgo.Channel, roomID id.RoomID, invitedIntent *appservice.IntentAPI) error {
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	if portal.MXID != "" {
+		return fmt.Errorf("portal already has a room")
+	}
+
+	// Update info before setting the room ID to find the other user and name, but not send anything yet
+	channel = portal.UpdateInfo(user, channel)
+	if channel == nil {
+		return fmt.Errorf("didn't find channel metadata")
+	}
+	var encryption event.EncryptionEventContent
+	err := invitedIntent.StateEvent(roomID, event.StateEncryption, "", &encryption)
+	if err == nil && encryption.Algorithm != "" {
+		portal.Encrypted = true
+	}
+	intent := portal.MainIntent()
+	if intent.UserID != invitedIntent.UserID {
+		// The main intent of group DMs is the bridge bot, which needs to be invited by the ghost
+		err = intent.EnsureJoined(roomID, appservice.EnsureJoinedParams{BotOverride: invitedIntent.Client})
+		if err != nil {
+			return fmt.Errorf("failed to add %s to room: %w", intent.UserID, err)
+		}
+	}
+	if portal.Encrypted && intent.UserID != portal.bridge.Bot.UserID {
+		err = portal.bridge.Bot.EnsureJoined(roomID, appservice.EnsureJoinedParams{BotOverride: intent.Client})
+		if err != nil {
+			portal.log.Err(err).Msg("Failed to ensure bridge bot is joined to encrypted private chat portal")
+		}
+	}
+	// The room was created by the user, so the bridge can only change the room metadata through double puppeting
+	if doublePuppet := portal.bridge.GetPuppetByCustomMXID(user.MXID).CustomIntent(); doublePuppet != nil {
+		levels, err := doublePuppet.PowerLevels(roomID)
+		if err != nil {
+			portal.log.Warn().Err(err).Msg("Failed to get power levels of adopted room")
+		} else if levels.EnsureUserLevel(intent.UserID, 100) {
+			_, err = doublePuppet.SetPowerLevels(roomID, levels)
+			if err != nil {
+				portal.log.Warn().Err(err).Msg("Failed to give main intent admin in adopted room")
+			}
+		}
+	}
+
+	var backfillStarted bool
+	portal.forwardBackfillLock.Lock()
+	defer func() {
+		if !backfillStarted {
+			portal.forwardBackfillLock.Unlock()
+		}
+	}()
+
+	portal.MXID = roomID
+	portal.log = portal.bridge.ZLog.With().
+		Str("channel_id", portal.Key.ChannelID).
+		Str("channel_receiver", portal.Key.Receiver).
+		Str("room_id", portal.MXID.String()).
+		Logger()
+	portal.bridge.portalsLock.Lock()
+	portal.bridge.portalsByMXID[portal.MXID] = portal
+	portal.bridge.portalsLock.Unlock()
+	portal.NameSet = false
+	portal.TopicSet = false
+	portal.AvatarSet = false
+	portal.updateRoomName()
+	if portal.Topic != "" {
+		portal.updateRoomTopic()
+	}
+	portal.updateRoomAvatar()
+	portal.Update()
+	portal.UpdateBridgeInfo()
+	portal.log.Info().Msg("Adopted Matrix room as private chat portal")
+
+	user.syncChatDoublePuppetDetails(portal, true)
+	portal.syncParticipants(user, channel.Recipients)
+	if portal.IsPrivateChat() {
+		user.updateDirectChats(map[id.UserID][]id.RoomID{
+			portal.bridge.GetPuppetByID(portal.OtherUserID).MXID: {portal.MXID},
+		})
+	}
+
+	firstEventResp, err := intent.SendMessageEvent(portal.MXID, portalCreationDummyEvent, struct{}{})
+	if err != nil {
+		portal.log.Err(err).Msg("Failed to send dummy event to mark portal creation")
+	} else {
+		portal.FirstEventID = firstEventResp.EventID
+		portal.Update()
+	}
+
+	go portal.forwardBackfillInitial(user, nil)
+	backfillStarted = true
+	return nil
+}
+
+func (portal *Portal) HandleMatrixInvite(brSender bridge.User, brTarget bridge.Ghost) {
+	sender := brSender.(*User).accountForPortal(portal)
+	ghost := brTarget.(*Puppet)
+	log := portal.log.With().
+		Str("action", "handle matrix invite").
+		Str("sender_mxid", sender.MXID.String()).
+		Str("ghost_id", ghost.ID).
+		Logger()
+	intent := ghost.DefaultIntent()
+	reject := func(reason string) {
+		log.Debug().Str("reason", reason).Msg("Rejecting invite")
+		_, err := intent.LeaveRoom(portal.MXID, &mautrix.ReqLeave{Reason: reason})
+		if err != nil {
+			log.Err(err).Msg("Failed to reject invite")
+		}
+	}
+	switch portal.Type {
+	case discordgo.ChannelTypeDM:
+		if ghost.ID == portal.OtherUserID {
+			err := intent.EnsureJoined(portal.MXID)
+			if err != nil {
+				log.Err(err).Msg("Failed to join DM portal")
+			}
+		} else {
+			reject("Discord DMs can't have more users. Create a new room to start a group DM.")
+		}
+	case discordgo.ChannelTypeGroupDM:
+		if sender.Session == nil {
+			reject("You're not connected to Discord")
+			return
+		}
+		channel, _ := sender.Session.State.Channel(portal.Key.ChannelID)
+		if channel == nil {
+			// The channel may not be in the state cache yet if the group DM was just created from Matrix
+			channel, _ = sender.Session.Channel(portal.Key.ChannelID)
+		}
+		if channel != nil {
+			for _, recipient := range channel.Recipients {
+				if recipient.ID == ghost.ID {
+					portal.syncParticipant(sender, recipient, false)
+					return
+				}
+			}
+		}
+		if err := sender.checkCanDM(ghost.ID); err != nil {
+			_, _, _, _, humanMessage, _ := errorToStatusReason(err)
+			reject(humanMessage)
+			return
+		}
+		err := sender.addGroupDMRecipient(portal.Key.ChannelID, ghost.ID)
+		if err != nil {
+			log.Err(err).Msg("Failed to add user to Discord group DM")
+			reject(fmt.Sprintf("Failed to add user to Discord group DM: %v", err))
+			return
+		}
+		// The ghost will join when the recipient add event comes from Discord
+		log.Debug().Msg("Added user to Discord group DM")
+	}
+}
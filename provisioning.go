@@ -5,12 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"strings"
 	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	log "maunium.net/go/maulogger/v2"
@@ -19,6 +22,7 @@ import (
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/id"
 
+	"go.mau.fi/mautrix-discord/config"
 	"go.mau.fi/mautrix-discord/database"
 	"go.mau.fi/mautrix-discord/remoteauth"
 )
@@ -40,6 +44,12 @@ const (
 	ErrCodeLoginConnectionFailed = "FI.MAU.DISCORD.LOGIN_CONN_FAILED"
 	ErrCodeLoginFailed           = "FI.MAU.DISCORD.LOGIN_FAILED"
 	ErrCodePostLoginConnFailed   = "FI.MAU.DISCORD.POST_LOGIN_CONNECTION_FAILED"
+	ErrCodeUnknownConfigKey      = "FI.MAU.DISCORD.UNKNOWN_CONFIG_KEY"
+	ErrCodeInvalidConfigValue    = "FI.MAU.DISCORD.INVALID_CONFIG_VALUE"
+	ErrCodeNoManagementRoom      = "FI.MAU.DISCORD.NO_MANAGEMENT_ROOM"
+	ErrCodeInvalidInvite         = "FI.MAU.DISCORD.INVALID_INVITE"
+	ErrCodeGuildJoinFailed       = "FI.MAU.DISCORD.GUILD_JOIN_FAILED"
+	ErrCodeUnknownAccount        = "FI.MAU.DISCORD.UNKNOWN_ACCOUNT"
 )
 
 type ProvisioningAPI struct {
@@ -67,16 +77,28 @@ func newProvisioningAPI(br *DiscordBridge) *ProvisioningAPI {
 	r.HandleFunc("/v1/login/token", p.tokenLogin).Methods(http.MethodPost)
 	r.HandleFunc("/v1/logout", p.logout).Methods(http.MethodPost)
 	r.HandleFunc("/v1/reconnect", p.reconnect).Methods(http.MethodPost)
+	r.HandleFunc("/v1/accounts", p.accountsList).Methods(http.MethodGet)
+	r.HandleFunc("/v1/accounts", p.accountsRemove).Methods(http.MethodDelete)
 
 	r.HandleFunc("/v1/guilds", p.guildsList).Methods(http.MethodGet)
 	r.HandleFunc("/v1/guilds/{guildID}", p.guildsBridge).Methods(http.MethodPost)
 	r.HandleFunc("/v1/guilds/{guildID}", p.guildsUnbridge).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/invites/{code}", p.inviteResolve).Methods(http.MethodGet)
+	r.HandleFunc("/v1/invites/{code}/join", p.inviteJoin).Methods(http.MethodPost)
+	r.HandleFunc("/v1/guilds/{guildID}/config", p.configGet).Methods(http.MethodGet)
+	r.HandleFunc("/v1/guilds/{guildID}/config/{key}", p.configSet).Methods(http.MethodPut)
+	r.HandleFunc("/v1/guilds/{guildID}/config/{key}", p.configUnset).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/portals/{roomID}/config", p.configGet).Methods(http.MethodGet)
+	r.HandleFunc("/v1/portals/{roomID}/config/{key}", p.configSet).Methods(http.MethodPut)
+	r.HandleFunc("/v1/portals/{roomID}/config/{key}", p.configUnset).Methods(http.MethodDelete)
+	r.HandleFunc("/v1/portals/{roomID}/export", p.exportHistory).Methods(http.MethodPost)
 
 	if p.bridge.Config.Bridge.Provisioning.DebugEndpoints {
 		p.log.Debugln("Enabling debug API at /debug")
 		r := p.bridge.AS.Router.PathPrefix("/debug").Subrouter()
 		r.Use(p.authMiddleware)
 		r.PathPrefix("/pprof").Handler(http.DefaultServeMux)
+		r.Path("/vars").Handler(http.DefaultServeMux)
 	}
 
 	return p
@@ -151,7 +173,24 @@ func (p *ProvisioningAPI) authMiddleware(h http.Handler) http.Handler {
 		}
 
 		userID := r.URL.Query().Get("user_id")
-		user := p.bridge.GetUserByMXID(id.UserID(userID))
+		account, err := normalizeAccountName(r.URL.Query().Get("account"))
+		if err != nil {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   err.Error(),
+				ErrCode: mautrix.MInvalidParam.ErrCode,
+			})
+			return
+		}
+		// Extra accounts are created when logging into them
+		isLogin := strings.Contains(r.URL.Path, "/login/")
+		user := p.bridge.GetUserAccount(id.UserID(userID), account, isLogin)
+		if user == nil {
+			jsonResponse(w, http.StatusNotFound, Error{
+				Error:   "Account not found",
+				ErrCode: ErrCodeUnknownAccount,
+			})
+			return
+		}
 
 		start := time.Now()
 		wWrap := &responseWrap{w, 200}
@@ -196,6 +235,54 @@ func (p *ProvisioningAPI) disconnect(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type accountEntry struct {
+	Name           string    `json:"name"`
+	ID             string    `json:"id,omitempty"`
+	Username       string    `json:"username,omitempty"`
+	LoggedIn       bool      `json:"logged_in"`
+	Connected      bool      `json:"connected"`
+	ManagementRoom id.RoomID `json:"management_room,omitempty"`
+	SpaceRoom      id.RoomID `json:"space_room,omitempty"`
+}
+
+type respAccountsList struct {
+	Accounts []accountEntry `json:"accounts"`
+}
+
+func (p *ProvisioningAPI) accountsList(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	var resp respAccountsList
+	resp.Accounts = []accountEntry{}
+	for _, account := range user.GetAccounts() {
+		entry := accountEntry{
+			Name:           account.AccountName(),
+			ID:             account.DiscordID,
+			LoggedIn:       account.IsLoggedIn(),
+			Connected:      account.Connected(),
+			ManagementRoom: account.GetManagementRoomID(),
+			SpaceRoom:      account.SpaceRoom,
+		}
+		if account.Session != nil && account.Session.State.User != nil {
+			entry.Username = account.Session.State.User.Username
+		}
+		resp.Accounts = append(resp.Accounts, entry)
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+func (p *ProvisioningAPI) accountsRemove(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if err := user.deleteAccount(); err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   err.Error(),
+			ErrCode: mautrix.MInvalidParam.ErrCode,
+		})
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
 type respPing struct {
 	Discord struct {
 		ID        string `json:"id,omitempty"`
@@ -207,6 +294,7 @@ type respPing struct {
 		} `json:"conn"`
 	}
 	MXID           id.UserID `json:"mxid"`
+	Account        string    `json:"account"`
 	ManagementRoom id.RoomID `json:"management_room"`
 }
 
@@ -215,7 +303,8 @@ func (p *ProvisioningAPI) ping(w http.ResponseWriter, r *http.Request) {
 
 	resp := respPing{
 		MXID:           user.MXID,
-		ManagementRoom: user.ManagementRoom,
+		Account:        user.AccountName(),
+		ManagementRoom: user.GetManagementRoomID(),
 	}
 	resp.Discord.LoggedIn = user.IsLoggedIn()
 	resp.Discord.Connected = user.Connected()
@@ -240,8 +329,7 @@ func (p *ProvisioningAPI) logout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *ProvisioningAPI) qrLogin(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
-	user := p.bridge.GetUserByMXID(id.UserID(userID))
+	user := r.Context().Value("user").(*User)
 
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -374,8 +462,7 @@ type reqTokenLogin struct {
 }
 
 func (p *ProvisioningAPI) tokenLogin(w http.ResponseWriter, r *http.Request) {
-	userID := r.URL.Query().Get("user_id")
-	user := p.bridge.GetUserByMXID(id.UserID(userID))
+	user := r.Context().Value("user").(*User)
 	log := p.log.Sub("TokenLogin").Sub(user.MXID.String())
 	if user.IsLoggedIn() {
 		jsonResponse(w, http.StatusConflict, Error{
@@ -550,3 +637,284 @@ func (p *ProvisioningAPI) guildsUnbridge(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
+
+type respInvite struct {
+	Code        string `json:"code"`
+	GuildID     string `json:"guild_id"`
+	GuildName   string `json:"guild_name"`
+	ChannelID   string `json:"channel_id,omitempty"`
+	ChannelName string `json:"channel_name,omitempty"`
+	MemberCount int    `json:"member_count"`
+	OnlineCount int    `json:"online_count"`
+	Joined      bool   `json:"joined"`
+}
+
+func makeRespInvite(user *User, invite *discordgo.Invite) respInvite {
+	resp := respInvite{
+		Code:        invite.Code,
+		GuildID:     invite.Guild.ID,
+		GuildName:   invite.Guild.Name,
+		MemberCount: invite.ApproximateMemberCount,
+		OnlineCount: invite.ApproximatePresenceCount,
+	}
+	if invite.Channel != nil {
+		resp.ChannelID = invite.Channel.ID
+		resp.ChannelName = invite.Channel.Name
+	}
+	_, err := user.Session.State.Guild(invite.Guild.ID)
+	resp.Joined = err == nil
+	return resp
+}
+
+func (p *ProvisioningAPI) resolveInvite(w http.ResponseWriter, r *http.Request) (*User, *discordgo.Invite) {
+	user := r.Context().Value("user").(*User)
+	if !user.Connected() {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "You're not connected to Discord",
+			ErrCode: ErrCodeNotConnected,
+		})
+		return nil, nil
+	}
+	invite, err := user.resolveInvite(mux.Vars(r)["code"])
+	if err != nil {
+		p.log.Debugfln("Failed to resolve invite for %s: %v", user.MXID, err)
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("Failed to resolve invite: %v", err),
+			ErrCode: ErrCodeInvalidInvite,
+		})
+		return nil, nil
+	}
+	return user, invite
+}
+
+func (p *ProvisioningAPI) inviteResolve(w http.ResponseWriter, r *http.Request) {
+	if user, invite := p.resolveInvite(w, r); invite != nil {
+		jsonResponse(w, http.StatusOK, makeRespInvite(user, invite))
+	}
+}
+
+type reqJoinInvite struct {
+	BridgingMode string `json:"bridging_mode"`
+}
+
+func (p *ProvisioningAPI) inviteJoin(w http.ResponseWriter, r *http.Request) {
+	var body reqJoinInvite
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Failed to parse request body",
+			ErrCode: mautrix.MBadJSON.ErrCode,
+		})
+		return
+	}
+	mode := database.GuildBridgeNothing
+	if body.BridgingMode != "" {
+		mode = database.ParseGuildBridgingMode(body.BridgingMode)
+		if mode == database.GuildBridgeInvalid {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Invalid bridging mode",
+				ErrCode: mautrix.MInvalidParam.ErrCode,
+			})
+			return
+		}
+	}
+	user, invite := p.resolveInvite(w, r)
+	if invite == nil {
+		return
+	}
+	alreadyJoined, err := user.joinGuildByInvite(invite, mode)
+	if err != nil {
+		p.log.Errorfln("Error joining %s with invite for %s: %v", invite.Guild.ID, user.MXID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to join guild: %v", err),
+			ErrCode: ErrCodeGuildJoinFailed,
+		})
+		return
+	}
+	resp := makeRespInvite(user, invite)
+	resp.Joined = true
+	if alreadyJoined {
+		jsonResponse(w, http.StatusOK, resp)
+	} else {
+		jsonResponse(w, http.StatusCreated, resp)
+	}
+}
+
+type respConfig struct {
+	Overrides map[string]string `json:"overrides"`
+	Effective map[string]string `json:"effective"`
+}
+
+type reqSetConfig struct {
+	Value string `json:"value"`
+}
+
+func (p *ProvisioningAPI) getConfigTarget(w http.ResponseWriter, r *http.Request) configOverrideTarget {
+	user := r.Context().Value("user").(*User)
+	vars := mux.Vars(r)
+	if guildID, ok := vars["guildID"]; ok {
+		guild := p.bridge.GetGuildByID(guildID, false)
+		if guild == nil {
+			jsonResponse(w, http.StatusNotFound, Error{
+				Error:   "Guild not found",
+				ErrCode: mautrix.MNotFound.ErrCode,
+			})
+			return nil
+		} else if !guild.CanManageConfig(user) {
+			jsonResponse(w, http.StatusForbidden, Error{
+				Error:   "You must have the Manage Server permission in the guild to manage its config",
+				ErrCode: mautrix.MForbidden.ErrCode,
+			})
+			return nil
+		}
+		return guild
+	}
+	portal := p.bridge.GetPortalByMXID(id.RoomID(vars["roomID"]))
+	if portal == nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Portal not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return nil
+	}
+	canManage, err := portal.CanManageConfig(user)
+	if err != nil {
+		p.log.Warnfln("Failed to check power levels of %s in %s: %v", user.MXID, portal.MXID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to check room power levels",
+			ErrCode: "M_UNKNOWN",
+		})
+		return nil
+	} else if !canManage {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You must be a moderator in the room to manage its config",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return nil
+	}
+	return portal
+}
+
+func configResponse(w http.ResponseWriter, target configOverrideTarget) {
+	resp := respConfig{
+		Overrides: target.GetConfigOverrides(),
+		Effective: make(map[string]string),
+	}
+	cfg := target.BridgeConfig()
+	for _, key := range config.OverridableKeys() {
+		resp.Effective[key], _ = cfg.GetOverridable(key)
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+func (p *ProvisioningAPI) configGet(w http.ResponseWriter, r *http.Request) {
+	if target := p.getConfigTarget(w, r); target != nil {
+		configResponse(w, target)
+	}
+}
+
+func (p *ProvisioningAPI) configSet(w http.ResponseWriter, r *http.Request) {
+	target := p.getConfigTarget(w, r)
+	if target == nil {
+		return
+	}
+	key := mux.Vars(r)["key"]
+	var body reqSetConfig
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Failed to parse request body",
+			ErrCode: mautrix.MBadJSON.ErrCode,
+		})
+	} else if _, err = target.SetConfigOverride(key, body.Value); errors.Is(err, config.ErrUnknownOverrideKey) {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("%s is not an overridable config option", key),
+			ErrCode: ErrCodeUnknownConfigKey,
+		})
+	} else if err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("Invalid value for %s: %v", key, err),
+			ErrCode: ErrCodeInvalidConfigValue,
+		})
+	} else {
+		configResponse(w, target)
+	}
+}
+
+func (p *ProvisioningAPI) configUnset(w http.ResponseWriter, r *http.Request) {
+	target := p.getConfigTarget(w, r)
+	if target == nil {
+		return
+	}
+	key := mux.Vars(r)["key"]
+	if !config.IsOverridable(key) {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("%s is not an overridable config option", key),
+			ErrCode: ErrCodeUnknownConfigKey,
+		})
+	} else {
+		target.UnsetConfigOverride(key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type reqExportHistory struct {
+	IncludeMedia *bool `json:"include_media"`
+}
+
+func (p *ProvisioningAPI) exportHistory(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	portal := p.bridge.GetPortalByMXID(id.RoomID(mux.Vars(r)["roomID"]))
+	if portal == nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Portal not found",
+			ErrCode: mautrix.MNotFound.ErrCode,
+		})
+		return
+	} else if !p.bridge.StateStore.IsInRoom(portal.MXID, user.MXID) {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You must be in the room to export its history",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return
+	}
+	if allowed, err := portal.CanExportHistory(user); err != nil {
+		p.log.Warnfln("Failed to check power levels of %s in %s: %v", user.MXID, portal.MXID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to check room power levels",
+			ErrCode: "M_UNKNOWN",
+		})
+		return
+	} else if !allowed {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You must be a moderator in the room to export its history",
+			ErrCode: mautrix.MForbidden.ErrCode,
+		})
+		return
+	} else if user.GetManagementRoomID() == "" {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "You don't have a management room to send the archive to",
+			ErrCode: ErrCodeNoManagementRoom,
+		})
+		return
+	}
+	var body reqExportHistory
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Failed to parse request body",
+				ErrCode: mautrix.MBadJSON.ErrCode,
+			})
+			return
+		}
+	}
+	includeMedia := body.IncludeMedia == nil || *body.IncludeMedia
+	go func() {
+		_, err := portal.ExportHistory(user, includeMedia)
+		if err != nil {
+			p.log.Warnfln("Failed to export history of %s for %s: %v", portal.MXID, user.MXID, err)
+		}
+	}()
+	jsonResponse(w, http.StatusAccepted, Response{
+		Success: true,
+		Status:  "export started, the archive will be sent to the management room",
+	})
+}
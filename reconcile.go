@@ -0,0 +1,298 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// requestLimiter spaces out requests so that at most one request is made per interval.
+type requestLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRequestLimiter(interval time.Duration) *requestLimiter {
+	return &requestLimiter{interval: interval}
+}
+
+// Wait blocks until the next request is allowed.
+func (rl *requestLimiter) Wait() {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if wait := time.Until(rl.next); wait > 0 {
+		time.Sleep(wait)
+	}
+	rl.next = time.Now().Add(rl.interval)
+}
+
+// reconcileMaxFetchFactor limits how many Discord messages are fetched relative to the reconcile limit
+// when looking for the oldest bridged message, in case there are lots of unbridged messages in between.
+const reconcileMaxFetchFactor = 4
+
+// maxReactionUserFetchSize is the maximum page size of the reaction users endpoint.
+const maxReactionUserFetchSize = 100
+
+type reconcileReactionKey struct {
+	MessageID string
+	Emoji     string
+}
+
+// reconcileRecent compares the last N bridged messages in the portal with Discord and bridges any reactions,
+// edits and deletions that were missed, e.g. while the bridge was offline.
+func (portal *Portal) reconcileRecent(source *User, thread *Thread) {
+	if portal.MXID == "" {
+		return
+	}
+	limits := portal.BridgeConfig().Backfill.Reconcile.Limits
+	limit := limits.Channel
+	if thread != nil {
+		limit = limits.Thread
+	} else if portal.GuildID == "" {
+		limit = limits.DM
+	}
+	if limit <= 0 {
+		return
+	}
+
+	protoChannelID := portal.Key.ChannelID
+	threadID := ""
+	with := portal.log.With().
+		Str("action", "reconcile recent messages").
+		Int("limit", limit)
+	if thread != nil {
+		protoChannelID = thread.ID
+		threadID = thread.ID
+		with = with.Str("thread_id", thread.ID)
+	}
+	log := with.Logger()
+
+	// Don't run multiple reconciliations of the same portal at once, e.g. when reconnecting quickly
+	// or when multiple logged-in users are in the same channel.
+	if !portal.reconcileLock.TryLock() {
+		log.Debug().Msg("Reconciliation already in progress, skipping")
+		return
+	}
+	defer portal.reconcileLock.Unlock()
+
+	dbMessages := portal.bridge.DB.Message.GetLastNInThread(portal.Key, threadID, limit)
+	if len(dbMessages) == 0 {
+		return
+	}
+	oldestID := dbMessages[0].DiscordID
+
+	discordMessages, reachedOldest, err := portal.fetchMessagesForReconcile(source, protoChannelID, oldestID, limit*reconcileMaxFetchFactor)
+	if err != nil {
+		log.Err(err).Msg("Failed to fetch messages for reconciliation")
+		return
+	} else if len(discordMessages) == 0 {
+		return
+	}
+	// Only messages that are within the range we fetched can be checked for deletion.
+	coveredFromID := oldestID
+	if !reachedOldest {
+		coveredFromID = discordMessages[len(discordMessages)-1].ID
+	}
+
+	discordMessagesByID := make(map[string]*discordgo.Message, len(discordMessages))
+	for _, msg := range discordMessages {
+		discordMessagesByID[msg.ID] = msg
+	}
+	var deleted []string
+	var edited []*discordgo.Message
+	var seen = make(map[string]struct{})
+	for _, dbMsg := range dbMessages {
+		if _, alreadySeen := seen[dbMsg.DiscordID]; alreadySeen {
+			continue
+		}
+		seen[dbMsg.DiscordID] = struct{}{}
+		msg, ok := discordMessagesByID[dbMsg.DiscordID]
+		if !ok {
+			if compareMessageIDs(dbMsg.DiscordID, coveredFromID) >= 0 {
+				deleted = append(deleted, dbMsg.DiscordID)
+			}
+			continue
+		}
+		if msg.EditedTimestamp != nil && msg.EditedTimestamp.After(dbMsg.EditTimestamp) {
+			edited = append(edited, msg)
+		}
+	}
+
+	reactionUsers := portal.fetchReactionUsersForReconcile(log, source, protoChannelID, discordMessages, seen)
+
+	portal.forwardBackfillLock.Lock()
+	defer portal.forwardBackfillLock.Unlock()
+	for _, msgID := range deleted {
+		log.Debug().Str("message_id", msgID).Msg("Found deletion that was missed")
+		portal.handleDiscordMessageDelete(source, &discordgo.Message{ID: msgID, ChannelID: protoChannelID})
+	}
+	if len(deleted) > 0 {
+		log.Info().Int("count", len(deleted)).Msg("Bridged missed deletions")
+	}
+	portal.bridgeMissedEdits(log, source, edited)
+	portal.bridgeMissedReactions(log, source, thread, protoChannelID, reactionUsers)
+}
+
+// fetchMessagesForReconcile fetches messages from the end of the channel, newest first,
+// until the given message ID or the maximum number of messages is reached.
+func (portal *Portal) fetchMessagesForReconcile(source *User, protoChannelID, oldestID string, maxMessages int) (messages []*discordgo.Message, reachedOldest bool, err error) {
+	var before string
+	for len(messages) < maxMessages {
+		portal.bridge.reconcileLimiter.Wait()
+		var chunk []*discordgo.Message
+		chunk, err = source.Session.ChannelMessages(protoChannelID, messageFetchChunkSize, before, "", "", portal.RefererOptIfUser(source.Session, protoChannelID)...)
+		if err != nil {
+			return
+		}
+		messages = append(messages, chunk...)
+		if len(chunk) < messageFetchChunkSize {
+			reachedOldest = true
+			return
+		}
+		before = chunk[len(chunk)-1].ID
+		if compareMessageIDs(before, oldestID) <= 0 {
+			reachedOldest = true
+			return
+		}
+	}
+	return
+}
+
+// reconcileReactionSignature is the number of reactors of an emoji and whether the source user is one of them.
+type reconcileReactionSignature struct {
+	Count int
+	Me    bool
+}
+
+// matchesOnlySelf checks if the reaction on Discord is known to have exactly the same reactors as the database
+// without fetching them. That's only the case when the source user is the sole reactor on both sides, as other
+// users could have swapped reactions without changing the count.
+func (sig *reconcileReactionSignature) matchesOnlySelf(reaction *discordgo.MessageReactions) bool {
+	return sig != nil && reaction.Me && sig.Me && reaction.Count == 1 && sig.Count == 1
+}
+
+// fetchReactionUsersForReconcile returns the full list of users for every reaction on the given bridged messages.
+// Reactions that only the source user has made on both Discord and in the database are omitted from the result.
+// Emojis that aren't on Discord anymore are included with an empty user list.
+func (portal *Portal) fetchReactionUsersForReconcile(log zerolog.Logger, source *User, protoChannelID string, messages []*discordgo.Message, bridged map[string]struct{}) map[reconcileReactionKey][]string {
+	result := make(map[reconcileReactionKey][]string)
+	for _, msg := range messages {
+		if _, ok := bridged[msg.ID]; !ok {
+			continue
+		}
+		dbReactions := make(map[string]*reconcileReactionSignature)
+		for _, reaction := range portal.bridge.DB.Reaction.GetAllForMessage(portal.Key, msg.ID) {
+			sig, ok := dbReactions[reaction.EmojiName]
+			if !ok {
+				sig = &reconcileReactionSignature{}
+				dbReactions[reaction.EmojiName] = sig
+			}
+			sig.Count++
+			if reaction.Sender == source.DiscordID {
+				sig.Me = true
+			}
+		}
+		for _, reaction := range msg.Reactions {
+			if reaction.Emoji == nil {
+				continue
+			}
+			emojiName := reaction.Emoji.APIName()
+			dbSig := dbReactions[emojiName]
+			delete(dbReactions, emojiName)
+			if dbSig.matchesOnlySelf(reaction) {
+				continue
+			}
+			users, err := portal.fetchAllReactionUsers(source, protoChannelID, msg.ID, emojiName, portal.bridge.reconcileLimiter)
+			if err != nil {
+				log.Warn().Err(err).
+					Str("message_id", msg.ID).
+					Str("emoji", emojiName).
+					Msg("Failed to fetch reaction users for reconciliation")
+				continue
+			}
+			userIDs := make([]string, len(users))
+			for i, user := range users {
+				userIDs[i] = user.ID
+			}
+			result[reconcileReactionKey{MessageID: msg.ID, Emoji: emojiName}] = userIDs
+		}
+		for emojiName := range dbReactions {
+			result[reconcileReactionKey{MessageID: msg.ID, Emoji: emojiName}] = nil
+		}
+	}
+	return result
+}
+
+// fetchAllReactionUsers fetches all users who reacted to the given message with the given emoji.
+// If limiter is set, it's waited before each request.
+func (portal *Portal) fetchAllReactionUsers(source *User, protoChannelID, messageID, emojiName string, limiter *requestLimiter) ([]*discordgo.User, error) {
+	var allUsers []*discordgo.User
+	var after string
+	for {
+		if limiter != nil {
+			limiter.Wait()
+		}
+		users, err := source.Session.MessageReactions(protoChannelID, messageID, emojiName, maxReactionUserFetchSize, "", after, portal.RefererOptIfUser(source.Session, protoChannelID)...)
+		if err != nil {
+			return nil, err
+		}
+		allUsers = append(allUsers, users...)
+		if len(users) < maxReactionUserFetchSize {
+			return allUsers, nil
+		}
+		after = users[len(users)-1].ID
+	}
+}
+
+func emojiFromAPIName(apiName string) discordgo.Emoji {
+	name, emojiID, isCustom := strings.Cut(apiName, ":")
+	if !isCustom {
+		return discordgo.Emoji{Name: apiName}
+	}
+	return discordgo.Emoji{Name: name, ID: emojiID}
+}
+
+// bridgeMissedReactions diffs the given reaction user lists against the database and bridges the differences.
+func (portal *Portal) bridgeMissedReactions(log zerolog.Logger, source *User, thread *Thread, protoChannelID string, reactionUsers map[reconcileReactionKey][]string) {
+	var added, removed int
+	for key, userIDs := range reactionUsers {
+		existing := make(map[string]*database.Reaction)
+		for _, reaction := range portal.bridge.DB.Reaction.GetAllForMessage(portal.Key, key.MessageID) {
+			if reaction.EmojiName == key.Emoji {
+				existing[reaction.Sender] = reaction
+			}
+		}
+		reaction := &discordgo.MessageReaction{
+			MessageID: key.MessageID,
+			ChannelID: protoChannelID,
+			GuildID:   portal.GuildID,
+			Emoji:     emojiFromAPIName(key.Emoji),
+		}
+		for _, userID := range userIDs {
+			if _, ok := existing[userID]; ok {
+				delete(existing, userID)
+				continue
+			}
+			reaction.UserID = userID
+			portal.handleDiscordReaction(source, reaction, true, thread, nil)
+			added++
+		}
+		for userID := range existing {
+			reaction.UserID = userID
+			portal.handleDiscordReaction(source, reaction, false, thread, nil)
+			removed++
+		}
+	}
+	if added > 0 || removed > 0 {
+		log.Info().
+			Int("added", added).
+			Int("removed", removed).
+			Msg("Bridged missed reactions")
+	}
+}
@@ -0,0 +1,35 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileReactionSignatureMatchesOnlySelf(t *testing.T) {
+	own := &discordgo.MessageReactions{Count: 1, Me: true}
+	assert.True(t, (&reconcileReactionSignature{Count: 1, Me: true}).matchesOnlySelf(own))
+	assert.False(t, (&reconcileReactionSignature{Count: 1}).matchesOnlySelf(own))
+	assert.False(t, (*reconcileReactionSignature)(nil).matchesOnlySelf(own))
+	// Another user could have removed their reaction while someone else added the same one
+	swapped := &discordgo.MessageReactions{Count: 1}
+	assert.False(t, (&reconcileReactionSignature{Count: 1}).matchesOnlySelf(swapped))
+	assert.False(t, (&reconcileReactionSignature{Count: 2, Me: true}).matchesOnlySelf(&discordgo.MessageReactions{Count: 2, Me: true}))
+}
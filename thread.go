@@ -101,7 +101,7 @@ func (br *DiscordBridge) threadFound(ctx context.Context, source *User, rootMess
 }
 
 func (thread *Thread) maybeInitialBackfill(source *User) {
-	if thread.initialBackfillAttempted || thread.Parent.bridge.Config.Bridge.Backfill.Limits.Initial.Thread == 0 {
+	if thread.initialBackfillAttempted || thread.Parent.BridgeConfig().Backfill.Limits.Initial.Thread == 0 {
 		return
 	}
 	thread.Parent.forwardBackfillLock.Lock()
@@ -124,7 +124,7 @@ func (thread *Thread) Join(user *User) {
 	log.Debug().Msg("Joining thread")
 
 	var doBackfill, backfillStarted bool
-	if !thread.initialBackfillAttempted && thread.Parent.bridge.Config.Bridge.Backfill.Limits.Initial.Thread > 0 {
+	if !thread.initialBackfillAttempted && thread.Parent.BridgeConfig().Backfill.Limits.Initial.Thread > 0 {
 		thread.Parent.forwardBackfillLock.Lock()
 		lastMessage := thread.Parent.bridge.DB.Message.GetLastInThread(thread.Parent.Key, thread.ID)
 		if lastMessage != nil {
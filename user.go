@@ -21,12 +21,14 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/exsync"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
 
@@ -59,8 +61,16 @@ type User struct {
 	wasDisconnected bool
 	wasLoggedOut    bool
 
+	connSupervisor *connectionSupervisor
+
+	// portalEvents contains gateway events that are forwarded to portals, queued per channel to keep them in order
+	portalEvents *channelEventQueue
+
 	markedOpened     map[string]time.Time
 	markedOpenedLock sync.Mutex
+	// viewedGuildChannels contains the guild channels that the session is subscribed to, mapped to the time
+	// when the user was last active in them. It's protected by markedOpenedLock.
+	viewedGuildChannels map[string]map[string]time.Time
 
 	pendingInteractions     map[string]*WrappedCommandEvent
 	pendingInteractionsLock sync.Mutex
@@ -74,6 +84,21 @@ type User struct {
 	// and "available" but not logically "ready" just yet.
 	relationshipsReady bool
 	relationshipLock   sync.RWMutex
+
+	// pendingGuildJoins contains the requested bridging modes of guilds that were joined with an invite
+	pendingGuildJoins *exsync.Map[string, database.GuildBridgingMode]
+
+	// friendRequestNotices maps friend request notices in the management room to the requester's Discord user ID
+	friendRequestNotices *exsync.Map[id.EventID, string]
+
+	// notificationSettings is nil until the user guild settings are received from Discord
+	notificationSettings map[string]*discordUserGuildSettings
+	// notificationLevels contains the last synced notification level of each room
+	notificationLevels map[id.RoomID]portalNotificationLevel
+	notificationLock   sync.Mutex
+	// pendingNotificationSync contains new portals whose notification settings will be synced in the next batch
+	pendingNotificationSync     map[*Portal]struct{}
+	pendingNotificationSyncLock sync.Mutex
 }
 
 func (user *User) GetRemoteID() string {
@@ -118,6 +143,12 @@ func (user *User) GetPermissionLevel() bridgeconfig.PermissionLevel {
 }
 
 func (user *User) GetManagementRoomID() id.RoomID {
+	if user.ManagementRoom == "" && user.Account != "" {
+		// Extra accounts without their own management room use the one of the default account
+		if defaultUser := user.bridge.GetCachedUserByMXID(user.MXID); defaultUser != nil {
+			return defaultUser.ManagementRoom
+		}
+	}
 	return user.ManagementRoom
 }
 
@@ -161,7 +192,16 @@ func (br *DiscordBridge) loadUser(dbUser *database.User, mxid *id.UserID) *User
 	}
 
 	user := br.NewUser(dbUser)
-	br.usersByMXID[user.MXID] = user
+	if user.Account == "" {
+		br.usersByMXID[user.MXID] = user
+	} else {
+		accounts, ok := br.extraAccountsByMXID[user.MXID]
+		if !ok {
+			accounts = make(map[string]*User)
+			br.extraAccountsByMXID[user.MXID] = accounts
+		}
+		accounts[user.Account] = user
+	}
 	if user.DiscordID != "" {
 		br.usersByID[user.DiscordID] = user
 	}
@@ -211,20 +251,31 @@ func (br *DiscordBridge) GetCachedUserByMXID(userID id.UserID) *User {
 }
 
 func (br *DiscordBridge) NewUser(dbUser *database.User) *User {
+	logWith := br.ZLog.With().Str("user_id", string(dbUser.MXID))
+	if dbUser.Account != "" {
+		logWith = logWith.Str("account", dbUser.Account)
+	}
 	user := &User{
 		User:   dbUser,
 		bridge: br,
-		log:    br.ZLog.With().Str("user_id", string(dbUser.MXID)).Logger(),
+		log:    logWith.Logger(),
 
-		markedOpened:    make(map[string]time.Time),
-		PermissionLevel: br.Config.Bridge.Permissions.Get(dbUser.MXID),
+		markedOpened:        make(map[string]time.Time),
+		viewedGuildChannels: make(map[string]map[string]time.Time),
+		PermissionLevel:     br.Config.Bridge.Permissions.Get(dbUser.MXID),
 
 		pendingInteractions: make(map[string]*WrappedCommandEvent),
 
-		relationships: make(map[string]*discordgo.Relationship),
+		relationships:        make(map[string]*discordgo.Relationship),
+		friendRequestNotices: exsync.NewMap[id.EventID, string](),
+		pendingGuildJoins:    exsync.NewMap[string, database.GuildBridgingMode](),
+
+		notificationLevels: make(map[id.RoomID]portalNotificationLevel),
 	}
 	user.nextDiscordUploadID.Store(rand.Int31n(100))
 	user.BridgeState = br.NewBridgeStateQueue(user)
+	user.connSupervisor = newConnectionSupervisor(user)
+	user.portalEvents = newChannelEventQueue(br.Config.Bridge.PortalMessageBuffer, user.eventHandler, user.recoverDroppedEvents)
 	return user
 }
 
@@ -236,8 +287,8 @@ func (br *DiscordBridge) getAllUsersWithToken() []*User {
 	users := make([]*User, len(dbUsers))
 
 	for idx, dbUser := range dbUsers {
-		user, ok := br.usersByMXID[dbUser.MXID]
-		if !ok {
+		user := br.getLoadedUserAccount(dbUser.MXID, dbUser.Account)
+		if user == nil {
 			user = br.loadUser(dbUser, nil)
 		}
 		users[idx] = user
@@ -250,7 +301,7 @@ func (br *DiscordBridge) startUsers() {
 
 	usersWithToken := br.getAllUsersWithToken()
 	for _, u := range usersWithToken {
-		go u.startupTryConnect(0)
+		go u.connSupervisor.connectWithRetry()
 	}
 	if len(usersWithToken) == 0 {
 		br.SendGlobalBridgeState(status.BridgeState{StateEvent: status.StateUnconfigured}.Fill(nil))
@@ -268,26 +319,6 @@ func (br *DiscordBridge) startUsers() {
 	}
 }
 
-func (user *User) startupTryConnect(retryCount int) {
-	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
-	err := user.Connect()
-	if err != nil {
-		user.log.Error().Err(err).Msg("Error connecting on startup")
-		closeErr := &websocket.CloseError{}
-		if errors.As(err, &closeErr) && closeErr.Code == 4004 {
-			user.invalidAuthHandler(nil)
-		} else if retryCount < 6 {
-			user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: "dc-unknown-websocket-error", Message: err.Error()})
-			retryInSeconds := 2 << retryCount
-			user.log.Debug().Int("retry_in_seconds", retryInSeconds).Msg("Sleeping and retrying connection")
-			time.Sleep(time.Duration(retryInSeconds) * time.Second)
-			user.startupTryConnect(retryCount + 1)
-		} else {
-			user.BridgeState.Send(status.BridgeState{StateEvent: status.StateUnknownError, Error: "dc-unknown-websocket-error", Message: err.Error()})
-		}
-	}
-}
-
 func (user *User) SetManagementRoom(roomID id.RoomID) {
 	user.bridge.managementRoomsLock.Lock()
 	defer user.bridge.managementRoomsLock.Unlock()
@@ -303,6 +334,28 @@ func (user *User) SetManagementRoom(roomID id.RoomID) {
 	user.Update()
 }
 
+// formatAccountNotice prefixes notices of extra accounts with the account name,
+// as they may be sent to the same management room as the notices of the default account.
+func (user *User) formatAccountNotice(message string) string {
+	if user.Account == "" {
+		return message
+	}
+	return fmt.Sprintf("**[%s]** %s", user.Account, message)
+}
+
+func (user *User) sendManagementNotice(message string, args ...any) {
+	managementRoom := user.GetManagementRoomID()
+	if managementRoom == "" {
+		return
+	}
+	content := format.RenderMarkdown(user.formatAccountNotice(fmt.Sprintf(message, args...)), true, false)
+	content.MsgType = event.MsgNotice
+	_, err := user.bridge.Bot.SendMessageEvent(managementRoom, event.EventMessage, &content)
+	if err != nil {
+		user.log.Warn().Err(err).Msg("Failed to send notice to management room")
+	}
+}
+
 func (user *User) getSpaceRoom(ptr *id.RoomID, name, topic string, parent id.RoomID) id.RoomID {
 	if len(*ptr) > 0 {
 		return *ptr
@@ -377,6 +430,9 @@ func (user *User) getSpaceRoom(ptr *id.RoomID, name, topic string, parent id.Roo
 }
 
 func (user *User) GetSpaceRoom() id.RoomID {
+	if user.Account != "" {
+		return user.getSpaceRoom(&user.SpaceRoom, fmt.Sprintf("Discord (%s)", user.Account), fmt.Sprintf("Your Discord bridged chats from the %s account", user.Account), "")
+	}
 	return user.getSpaceRoom(&user.SpaceRoom, "Discord", "Your Discord bridged chats", "")
 }
 
@@ -384,16 +440,21 @@ func (user *User) GetDMSpaceRoom() id.RoomID {
 	return user.getSpaceRoom(&user.DMSpaceRoom, "Direct Messages", "Your Discord direct messages", user.GetSpaceRoom())
 }
 
+// ViewingChannel is called when the user reads or types in a portal on Matrix. DMs are marked as being viewed,
+// while guild channels are subscribed to, so that Discord sends typing notifications for them.
+// It returns true if the channel wasn't already being viewed.
 func (user *User) ViewingChannel(portal *Portal) bool {
-	if portal.GuildID != "" || !user.Session.IsUser {
+	if !user.Session.IsUser {
 		return false
+	} else if portal.GuildID != "" {
+		return user.viewingGuildChannel(portal.GuildID, portal.Key.ChannelID)
 	}
 	user.markedOpenedLock.Lock()
 	defer user.markedOpenedLock.Unlock()
 	ts := user.markedOpened[portal.Key.ChannelID]
-	// TODO is there an expiry time?
-	if ts.IsZero() {
-		user.markedOpened[portal.Key.ChannelID] = time.Now()
+	user.markedOpened[portal.Key.ChannelID] = time.Now()
+	timeout := user.bridge.viewingTimeout()
+	if ts.IsZero() || (timeout > 0 && time.Since(ts) > timeout) {
 		err := user.Session.MarkViewing(portal.Key.ChannelID)
 		if err != nil {
 			user.log.Error().Err(err).
@@ -406,7 +467,7 @@ func (user *User) ViewingChannel(portal *Portal) bool {
 }
 
 func (user *User) mutePortal(intent *appservice.IntentAPI, portal *Portal, unmute bool) {
-	if len(portal.MXID) == 0 || !user.bridge.Config.Bridge.MuteChannelsOnCreate {
+	if len(portal.MXID) == 0 || !portal.BridgeConfig().MuteChannelsOnCreate {
 		return
 	}
 	var err error
@@ -432,8 +493,9 @@ func (user *User) syncChatDoublePuppetDetails(portal *Portal, justCreated bool)
 		return
 	}
 
-	// TODO sync mute status properly
-	if portal.GuildID != "" && user.bridge.Config.Bridge.MuteChannelsOnCreate && justCreated {
+	if user.bridge.Config.Bridge.NotificationSync.Enabled {
+		user.queueNotificationSync(portal)
+	} else if portal.GuildID != "" && portal.BridgeConfig().MuteChannelsOnCreate && justCreated {
 		user.mutePortal(doublePuppetIntent, portal, false)
 	}
 }
@@ -497,6 +559,8 @@ func (user *User) Logout(isOverwriting bool) {
 	}
 
 	if user.Session != nil {
+		user.connSupervisor.stop()
+		user.bridge.releaseGuildPrimary(user, "")
 		if err := user.Session.Close(); err != nil {
 			user.log.Warn().Err(err).Msg("Error closing session")
 		}
@@ -629,6 +693,8 @@ func (user *User) Connect() error {
 		session.Identify.Intents = BotIntents
 	}
 	session.EventHandler = user.eventHandlerSync
+	// Reconnections are handled by the connection supervisor
+	session.ShouldReconnectOnError = false
 
 	if session.IsUser {
 		err = session.LoadMainPage(context.TODO())
@@ -645,15 +711,54 @@ func (user *User) Connect() error {
 			user.log.Warn().Err(err).Msg("Retrying initial connection in 5 seconds")
 			time.Sleep(5 * time.Second)
 			continue
+		} else if err == nil {
+			user.connSupervisor.start(session)
 		}
 		return err
 	}
 }
 
 func (user *User) eventHandlerSync(rawEvt any) {
+	switch rawEvt.(type) {
+	case *discordgo.Connect, *discordgo.Disconnect:
+	default:
+		user.connSupervisor.markDispatch()
+	}
+	// Events that end up in portal queues must keep their order within the channel.
+	// This runs on the gateway goroutine, so it must never block: if the channel's queue is full, the event is
+	// dropped and recovered by backfilling the channel after the queue has been drained.
+	if channelID := portalEventChannelID(rawEvt); channelID != "" {
+		if !user.portalEvents.Push(channelID, rawEvt) {
+			user.log.Warn().
+				Type("event_type", rawEvt).
+				Str("channel_id", channelID).
+				Msg("Dropping event as channel event buffer is full")
+		}
+		return
+	}
 	go user.eventHandler(rawEvt)
 }
 
+// recoverDroppedEvents bridges events that were dropped because the channel's event queue was full.
+// Missed messages are backfilled, and edits, deletions and reactions are reconciled with the recent messages.
+func (user *User) recoverDroppedEvents(channelID string) {
+	log := user.log.With().
+		Str("action", "recover dropped events").
+		Str("channel_id", channelID).
+		Logger()
+	portal, thread := user.findPortal(channelID)
+	if portal == nil || portal.MXID == "" {
+		return
+	}
+	channel, err := user.Session.Channel(channelID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get channel info to recover dropped events")
+		return
+	}
+	log.Info().Msg("Backfilling channel to recover events that were dropped")
+	portal.ForwardBackfillMissed(user, channel.LastMessageID, thread)
+}
+
 func (user *User) eventHandler(rawEvt any) {
 	defer func() {
 		err := recover()
@@ -721,10 +826,12 @@ func (user *User) eventHandler(rawEvt any) {
 		user.typingStartHandler(evt)
 	case *discordgo.InteractionSuccess:
 		user.interactionSuccessHandler(evt)
+	case *discordgo.InteractionCreate:
+		user.interactionCreateHandler(evt)
 	case *discordgo.ThreadListSync:
 		user.threadListSyncHandler(evt)
 	case *discordgo.Event:
-		// Ignore
+		user.rawEventHandler(evt)
 	default:
 		user.log.Debug().Type("event_type", evt).Msg("Unhandled event")
 	}
@@ -739,6 +846,7 @@ func (user *User) Disconnect() error {
 
 	user.log.Info().Msg("Disconnecting session manually")
 	user.reconstructRelationships(nil)
+	user.connSupervisor.stop()
 	if err := user.Session.Close(); err != nil {
 		return err
 	}
@@ -798,6 +906,8 @@ func (user *User) readyHandler(r *discordgo.Ready) {
 	user.tryAutomaticDoublePuppeting()
 
 	user.reconstructRelationships(r.Relationships)
+	// Channel subscriptions and viewing states are tied to the gateway session
+	user.clearViewedChannels()
 
 	updateTS := time.Now()
 	portalsInSpace := make(map[string]bool)
@@ -828,6 +938,13 @@ func (user *User) readyHandler(r *discordgo.Ready) {
 	}
 
 	go user.subscribeGuilds(2 * time.Second)
+	if !user.Session.IsUser {
+		appID := r.User.ID
+		if r.Application != nil {
+			appID = r.Application.ID
+		}
+		go user.registerApplicationCommands(appID)
+	}
 
 	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
 }
@@ -837,24 +954,35 @@ func (user *User) subscribeGuilds(delay time.Duration) {
 		return
 	}
 	for _, guildMeta := range user.Session.State.Guilds {
-		guild := user.bridge.GetGuildByID(guildMeta.ID, false)
-		if guild != nil && guild.MXID != "" {
-			user.log.Debug().Str("guild_id", guild.ID).Msg("Subscribing to guild")
-			dat := discordgo.GuildSubscribeData{
-				GuildID:    guild.ID,
-				Typing:     true,
-				Activities: true,
-				Threads:    true,
-			}
-			err := user.Session.SubscribeGuild(dat)
-			if err != nil {
-				user.log.Warn().Err(err).Str("guild_id", guild.ID).Msg("Failed to subscribe to guild")
-			}
+		if user.isGuildPrimary(guildMeta.ID) && user.subscribeGuild(guildMeta.ID) {
 			time.Sleep(delay)
 		}
 	}
 }
 
+func (user *User) subscribeGuild(guildID string) bool {
+	session := user.Session
+	if session == nil || !session.IsUser {
+		return false
+	}
+	guild := user.bridge.GetGuildByID(guildID, false)
+	if guild == nil || guild.MXID == "" {
+		return false
+	}
+	user.log.Debug().Str("guild_id", guild.ID).Msg("Subscribing to guild")
+	dat := discordgo.GuildSubscribeData{
+		GuildID:    guild.ID,
+		Typing:     true,
+		Activities: true,
+		Threads:    true,
+	}
+	err := session.SubscribeGuild(dat)
+	if err != nil {
+		user.log.Warn().Err(err).Str("guild_id", guild.ID).Msg("Failed to subscribe to guild")
+	}
+	return true
+}
+
 func (user *User) resumeHandler(_ *discordgo.Resumed) {
 	user.log.Debug().Msg("Discord connection resumed")
 	user.subscribeGuilds(0 * time.Second)
@@ -878,12 +1006,34 @@ func (user *User) addPrivateChannelToSpace(portal *Portal) bool {
 	}
 }
 
+// checkCanDM checks whether forbid_dming_strangers allows the user to message the given Discord user.
+func (user *User) checkCanDM(otherUserID string) error {
+	if !user.bridge.Config.Bridge.ForbidDMingStrangers || user.Session == nil || !user.Session.IsUser {
+		return nil
+	} else if user.bridge.GetPuppetByID(otherUserID).IsBot {
+		return nil
+	}
+	user.relationshipLock.RLock()
+	defer user.relationshipLock.RUnlock()
+	if !user.relationshipsReady {
+		return errRelationshipsNotReady
+	}
+	relationship, hasRelationship := user.relationships[otherUserID]
+	if !hasRelationship || relationship.Type != discordgo.RelationshipFriend {
+		return errDMingStranger
+	}
+	return nil
+}
+
 func (user *User) relationshipAddHandler(r *discordgo.RelationshipAdd) {
 	user.log.Debug().Interface("relationship", r.Relationship).Msg("Relationship added")
 	user.relationshipLock.Lock()
 	defer user.relationshipLock.Unlock()
 	user.relationships[r.ID] = r.Relationship
 	user.handleRelationshipChange(r.ID, r.Nickname)
+	if r.Type == discordgo.RelationshipIncomingRequest {
+		go user.sendFriendRequestNotice(r.Relationship)
+	}
 }
 
 func (user *User) relationshipUpdateHandler(r *discordgo.RelationshipUpdate) {
@@ -1036,21 +1186,7 @@ func (user *User) handleGuild(meta *discordgo.Guild, timestamp time.Time, isInSp
 			if !user.channelIsBridgeable(ch) {
 				continue
 			}
-			portal := user.GetPortalByMeta(ch)
-			if guild.BridgingMode >= database.GuildBridgeEverything && portal.MXID == "" {
-				err := portal.CreateMatrixRoom(user, ch)
-				if err != nil {
-					user.log.Error().Err(err).
-						Str("guild_id", guild.ID).
-						Str("channel_id", ch.ID).
-						Msg("Failed to create portal for guild channel in guild handler")
-				}
-			} else {
-				portal.UpdateInfo(user, ch)
-				if user.bridge.Config.Bridge.Backfill.MaxGuildMembers < 0 || meta.MemberCount < user.bridge.Config.Bridge.Backfill.MaxGuildMembers {
-					portal.ForwardBackfillMissed(user, ch.LastMessageID, nil)
-				}
-			}
+			user.handleGuildChannel(guild, meta, user.GetPortalByMeta(ch), ch)
 		}
 	}
 	if len(meta.Roles) > 0 {
@@ -1059,6 +1195,31 @@ func (user *User) handleGuild(meta *discordgo.Guild, timestamp time.Time, isInSp
 	user.addGuildToSpace(guild, isInSpace, timestamp)
 }
 
+func (user *User) handleGuildChannel(guild *Guild, meta *discordgo.Guild, portal *Portal, ch *discordgo.Channel) {
+	if !user.shouldHandleGuildChannel(meta.ID, ch.ID) {
+		// Another user's session is the primary for this guild and syncs the portal,
+		// but this user still needs to be invited to it.
+		if portal.MXID != "" {
+			portal.ensureUserInvited(user, false)
+		}
+		return
+	}
+	if guild.BridgingMode >= database.GuildBridgeEverything && portal.MXID == "" {
+		err := portal.CreateMatrixRoom(user, ch)
+		if err != nil {
+			user.log.Error().Err(err).
+				Str("guild_id", guild.ID).
+				Str("channel_id", ch.ID).
+				Msg("Failed to create portal for guild channel in guild handler")
+		}
+	} else {
+		portal.UpdateInfo(user, ch)
+		if user.bridge.Config.Bridge.Backfill.MaxGuildMembers < 0 || meta.MemberCount < user.bridge.Config.Bridge.Backfill.MaxGuildMembers {
+			portal.ForwardBackfillMissed(user, ch.LastMessageID, nil)
+		}
+	}
+}
+
 func (user *User) connectedHandler(_ *discordgo.Connect) {
 	user.bridgeStateLock.Lock()
 	defer user.bridgeStateLock.Unlock()
@@ -1077,7 +1238,9 @@ func (user *User) disconnectedHandler(_ *discordgo.Disconnect) {
 	}
 	user.log.Debug().Msg("Disconnected from Discord")
 	user.wasDisconnected = true
+	user.bridge.releaseGuildPrimary(user, "")
 	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: "dc-transient-disconnect", Message: "Temporarily disconnected from Discord, trying to reconnect"})
+	go user.connSupervisor.handleDisconnect()
 }
 
 func (user *User) invalidAuthHandler(_ *discordgo.InvalidAuth) {
@@ -1085,6 +1248,7 @@ func (user *User) invalidAuthHandler(_ *discordgo.InvalidAuth) {
 	defer user.bridgeStateLock.Unlock()
 	user.log.Info().Msg("Got logged out from Discord due to invalid token")
 	user.wasLoggedOut = true
+	user.connSupervisor.stop()
 	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBadCredentials, Error: "dc-websocket-disconnect-4004", Message: "Discord access token is no longer valid, please log in again"})
 	go user.Logout(false)
 }
@@ -1105,6 +1269,7 @@ func (user *User) guildCreateHandler(g *discordgo.GuildCreate) {
 		Bool("unavailable", g.Unavailable).
 		Msg("Got guild create event")
 	user.handleGuild(g.Guild, time.Now(), false)
+	user.handlePendingGuildJoin(g.ID)
 }
 
 func (user *User) guildDeleteHandler(g *discordgo.GuildDelete) {
@@ -1113,6 +1278,7 @@ func (user *User) guildDeleteHandler(g *discordgo.GuildDelete) {
 		return
 	}
 	user.log.Info().Str("guild_id", g.ID).Msg("Got guild delete event")
+	user.bridge.releaseGuildPrimary(user, g.ID)
 	user.MarkNotInPortal(g.ID)
 	guild := user.bridge.GetGuildByID(g.ID, false)
 	if guild == nil || guild.MXID == "" {
@@ -1140,6 +1306,10 @@ func (user *User) threadListSyncHandler(t *discordgo.ThreadListSync) {
 			Str("parent_id", meta.ParentID).
 			Str("thread_id", meta.ID).
 			Logger()
+		if !user.shouldHandleGuildChannel(t.GuildID, meta.ID) {
+			log.Trace().Msg("Ignoring thread list sync entry as another user is the primary for the guild")
+			continue
+		}
 		ctx := log.WithContext(context.Background())
 		thread := user.bridge.GetThreadByID(meta.ID, nil)
 		if thread == nil {
@@ -1197,8 +1367,9 @@ func (user *User) channelDeleteHandler(c *discordgo.ChannelDelete) {
 	user.log.Info().
 		Str("guild_id", c.GuildID).Str("channel_id", c.ID).
 		Msg("Got channel delete event, cleaning up portal")
+	deletePortal := portal.BridgeConfig().DeletePortalOnChannelDelete
 	portal.Delete()
-	portal.cleanup(!user.bridge.Config.Bridge.DeletePortalOnChannelDelete)
+	portal.cleanup(!deletePortal)
 	if c.GuildID == "" {
 		user.MarkNotInPortal(portal.Key.ChannelID)
 	}
@@ -1208,12 +1379,12 @@ func (user *User) channelDeleteHandler(c *discordgo.ChannelDelete) {
 }
 
 func (user *User) channelUpdateHandler(c *discordgo.ChannelUpdate) {
-	portal := user.GetPortalByMeta(c.Channel)
-	if c.GuildID == "" {
-		user.handlePrivateChannel(portal, c.Channel, time.Now(), true, user.IsInSpace(portal.Key.String()))
-	} else if user.channelIsBridgeable(c.Channel) {
-		portal.UpdateInfo(user, c.Channel)
+	if c.GuildID != "" && (!user.shouldHandleGuildChannel(c.GuildID, c.ID) || !user.channelIsBridgeable(c.Channel)) {
+		return
 	}
+	// Metadata updates go through the portal queue so that they're applied in order with messages
+	portal := user.GetPortalByMeta(c.Channel)
+	portal.queueDiscordMessage(portalDiscordMessage{msg: c, user: user}, "channel update")
 }
 
 func (user *User) channelRecipientAdd(c *discordgo.ChannelRecipientAdd) {
@@ -1273,6 +1444,10 @@ func (user *User) pushPortalMessage(msg interface{}, typeName, channelID, guildI
 		// If guild bridging mode is nothing, don't even check if the portal exists
 		return
 	}
+	if !user.shouldHandleGuildChannel(guildID, channelID) {
+		// Another user's session is the primary for this guild and will handle the event
+		return
+	}
 
 	portal, thread := user.findPortal(channelID)
 	if portal == nil {
@@ -1287,21 +1462,11 @@ func (user *User) pushPortalMessage(msg interface{}, typeName, channelID, guildI
 		return
 	}
 
-	wrappedMsg := portalDiscordMessage{
+	portal.queueDiscordMessage(portalDiscordMessage{
 		msg:    msg,
 		user:   user,
 		thread: thread,
-	}
-	select {
-	case portal.discordMessages <- wrappedMsg:
-	default:
-		user.log.Warn().
-			Str("discord_event", typeName).
-			Str("guild_id", guildID).
-			Str("channel_id", channelID).
-			Msg("Portal message buffer is full")
-		portal.discordMessages <- wrappedMsg
-	}
+	}, typeName)
 }
 
 type CustomReadReceipt struct {
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const viewingExpiryInterval = 30 * time.Second
+
+// The member list range requested when subscribing to a channel. The members themselves aren't used,
+// but Discord only sends typing notifications for guild channels that have a member list subscription.
+var viewedChannelRanges = [][2]int{{0, 99}}
+
+func (br *DiscordBridge) viewingTimeout() time.Duration {
+	return time.Duration(br.Config.Bridge.ViewingTimeoutSeconds) * time.Second
+}
+
+// viewingGuildChannel refreshes the viewing timestamp of a guild channel and subscribes to it if necessary.
+func (user *User) viewingGuildChannel(guildID, channelID string) bool {
+	if user.bridge.viewingTimeout() <= 0 {
+		return false
+	}
+	user.markedOpenedLock.Lock()
+	channels, ok := user.viewedGuildChannels[guildID]
+	if !ok {
+		channels = make(map[string]time.Time)
+		user.viewedGuildChannels[guildID] = channels
+	}
+	_, alreadyViewing := channels[channelID]
+	channels[channelID] = time.Now()
+	var subscriptions map[string][][2]int
+	if !alreadyViewing {
+		subscriptions = make(map[string][][2]int, len(channels))
+		for viewedChannelID := range channels {
+			subscriptions[viewedChannelID] = viewedChannelRanges
+		}
+	}
+	user.markedOpenedLock.Unlock()
+	if alreadyViewing {
+		return false
+	}
+	user.log.Debug().Str("guild_id", guildID).Str("channel_id", channelID).Msg("Subscribing to viewed guild channel")
+	user.subscribeGuildChannels(guildID, subscriptions)
+	return true
+}
+
+// expireViewedChannels unsubscribes from guild channels that the user hasn't been active in recently.
+func (user *User) expireViewedChannels(timeout time.Duration) {
+	user.markedOpenedLock.Lock()
+	for channelID, ts := range user.markedOpened {
+		if time.Since(ts) > timeout {
+			delete(user.markedOpened, channelID)
+		}
+	}
+	changedGuilds := make(map[string]map[string][][2]int)
+	for guildID, channels := range user.viewedGuildChannels {
+		var subscriptions map[string][][2]int
+		for channelID, ts := range channels {
+			if time.Since(ts) > timeout {
+				delete(channels, channelID)
+				if subscriptions == nil {
+					subscriptions = make(map[string][][2]int)
+				}
+				// An empty range list removes the subscription
+				subscriptions[channelID] = [][2]int{}
+			}
+		}
+		if subscriptions == nil {
+			continue
+		}
+		for channelID := range channels {
+			subscriptions[channelID] = viewedChannelRanges
+		}
+		if len(channels) == 0 {
+			delete(user.viewedGuildChannels, guildID)
+		}
+		changedGuilds[guildID] = subscriptions
+	}
+	user.markedOpenedLock.Unlock()
+	for guildID, subscriptions := range changedGuilds {
+		user.log.Debug().Str("guild_id", guildID).Int("channel_count", len(subscriptions)).Msg("Unsubscribing from guild channels that are no longer viewed")
+		user.subscribeGuildChannels(guildID, subscriptions)
+	}
+}
+
+// clearViewedChannels forgets all viewed channels, as subscriptions don't persist across gateway sessions.
+func (user *User) clearViewedChannels() {
+	user.markedOpenedLock.Lock()
+	clear(user.markedOpened)
+	clear(user.viewedGuildChannels)
+	user.markedOpenedLock.Unlock()
+}
+
+func (user *User) subscribeGuildChannels(guildID string, channels map[string][][2]int) {
+	session := user.Session
+	if session == nil || !session.IsUser {
+		return
+	}
+	err := session.SubscribeGuild(discordgo.GuildSubscribeData{
+		GuildID:    guildID,
+		Typing:     true,
+		Activities: true,
+		Threads:    true,
+		Channels:   channels,
+	})
+	if err != nil {
+		user.log.Warn().Err(err).Str("guild_id", guildID).Msg("Failed to update guild channel subscriptions")
+	}
+}
+
+func (br *DiscordBridge) runViewingExpiry() {
+	timeout := br.viewingTimeout()
+	if timeout <= 0 {
+		return
+	}
+	for {
+		time.Sleep(viewingExpiryInterval)
+		for _, user := range br.getAllLoadedUsers() {
+			user.expireViewedChannels(timeout)
+		}
+	}
+}
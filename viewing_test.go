@@ -0,0 +1,51 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+func TestViewedGuildChannelExpiry(t *testing.T) {
+	br := &DiscordBridge{Config: &config.Config{}}
+	br.Config.Bridge.ViewingTimeoutSeconds = 60
+	user := &User{
+		bridge:              br,
+		log:                 zerolog.Nop(),
+		markedOpened:        make(map[string]time.Time),
+		viewedGuildChannels: make(map[string]map[string]time.Time),
+	}
+	assert.True(t, user.viewingGuildChannel("1", "10"))
+	assert.False(t, user.viewingGuildChannel("1", "10"))
+	assert.True(t, user.viewingGuildChannel("1", "11"))
+
+	user.viewedGuildChannels["1"]["10"] = time.Now().Add(-2 * time.Minute)
+	user.expireViewedChannels(br.viewingTimeout())
+	assert.NotContains(t, user.viewedGuildChannels["1"], "10")
+	assert.Contains(t, user.viewedGuildChannels["1"], "11")
+
+	user.viewedGuildChannels["1"]["11"] = time.Now().Add(-2 * time.Minute)
+	user.expireViewedChannels(br.viewingTimeout())
+	assert.NotContains(t, user.viewedGuildChannels, "1")
+	assert.True(t, user.viewingGuildChannel("1", "10"))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+
+	"go.mau.fi/util/ffmpeg"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	// discordWaveformMaxLength is the maximum number of samples in a Discord voice message waveform.
+	discordWaveformMaxLength = 256
+	// matrixWaveformMax is the maximum value of a sample in a MSC3246 waveform.
+	matrixWaveformMax = 1024
+
+	discordVoiceMessageFilename = "voice-message.ogg"
+	discordVoiceMessageMime     = "audio/ogg"
+)
+
+var errVoiceMessageNoDuration = errors.New("voice message doesn't have a duration")
+
+// convertDiscordWaveform converts a base64-encoded Discord waveform (one byte per sample)
+// into a MSC3246 waveform (integers between 0 and 1024).
+func convertDiscordWaveform(waveform string) ([]int, error) {
+	data, err := base64.StdEncoding.DecodeString(waveform)
+	if err != nil {
+		return nil, err
+	}
+	converted := make([]int, len(data))
+	for i, sample := range data {
+		converted[i] = int(sample) * matrixWaveformMax / math.MaxUint8
+	}
+	return converted, nil
+}
+
+// convertMatrixWaveform converts a MSC3246 waveform into a base64-encoded Discord waveform,
+// resampling it to at most discordWaveformMaxLength samples.
+func convertMatrixWaveform(waveform []int) string {
+	if len(waveform) > discordWaveformMaxLength {
+		waveform = resampleWaveform(waveform, discordWaveformMaxLength)
+	}
+	data := make([]byte, len(waveform))
+	for i, sample := range waveform {
+		data[i] = byte(min(max(sample, 0), matrixWaveformMax) * math.MaxUint8 / matrixWaveformMax)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// resampleWaveform shrinks a waveform to the given length by taking the peak of each bucket.
+func resampleWaveform(waveform []int, length int) []int {
+	resampled := make([]int, length)
+	for i := range resampled {
+		start := i * len(waveform) / length
+		end := max((i+1)*len(waveform)/length, start+1)
+		for _, sample := range waveform[start:end] {
+			resampled[i] = max(resampled[i], sample)
+		}
+	}
+	return resampled
+}
+
+// matrixVoiceMessage contains the voice message metadata extracted from a Matrix event.
+type matrixVoiceMessage struct {
+	DurationSeconds float64
+	Waveform        string
+}
+
+// parseMatrixVoiceMessage extracts the duration and waveform of a MSC3245 voice message.
+// If the event doesn't have a waveform, a flat one is generated, as Discord requires one.
+func parseMatrixVoiceMessage(content *event.MessageEventContent, raw map[string]any) (*matrixVoiceMessage, error) {
+	var durationMS int
+	var waveform []int
+	if audioInfo, ok := raw["org.matrix.msc1767.audio"].(map[string]any); ok {
+		if duration, ok := audioInfo["duration"].(float64); ok {
+			durationMS = int(duration)
+		}
+		rawWaveform, _ := audioInfo["waveform"].([]any)
+		for _, sample := range rawWaveform {
+			if sampleNum, ok := sample.(float64); ok {
+				waveform = append(waveform, int(sampleNum))
+			}
+		}
+	}
+	if durationMS == 0 && content.Info != nil {
+		durationMS = content.Info.Duration
+	}
+	if durationMS <= 0 {
+		return nil, errVoiceMessageNoDuration
+	}
+	if len(waveform) == 0 {
+		// Discord clients show one sample per 100ms up to the max length
+		waveform = make([]int, min(max(durationMS/100, 1), discordWaveformMaxLength))
+		for i := range waveform {
+			waveform[i] = matrixWaveformMax / 4
+		}
+	}
+	return &matrixVoiceMessage{
+		DurationSeconds: float64(durationMS) / 1000,
+		Waveform:        convertMatrixWaveform(waveform),
+	}, nil
+}
+
+// convertToOggOpus transcodes audio into Ogg/Opus, which is the only format Discord accepts for voice messages.
+func convertToOggOpus(ctx context.Context, data []byte, mimeType string) ([]byte, error) {
+	if mimeType == discordVoiceMessageMime || mimeType == "audio/ogg; codecs=opus" {
+		return data, nil
+	}
+	converted, err := ffmpeg.ConvertBytes(ctx, data, ".ogg", []string{}, []string{"-c:a", "libopus"}, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert audio to ogg/opus: %w", err)
+	}
+	return converted, nil
+}